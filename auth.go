@@ -1,38 +1,625 @@
 package auth
 
 import (
+	"database/sql"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/k0marov/golang-auth/internal/core/breached_passwords"
+	"github.com/k0marov/golang-auth/internal/core/client_errors"
 	"github.com/k0marov/golang-auth/internal/core/crypto/bcrypt_hasher"
+	"github.com/k0marov/golang-auth/internal/core/crypto/foreign_hashes"
+	"github.com/k0marov/golang-auth/internal/core/crypto/peppered_hasher"
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store"
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store/resp_client"
+	"github.com/k0marov/golang-auth/internal/data/sql_store"
 	"github.com/k0marov/golang-auth/internal/data/store"
 	"github.com/k0marov/golang-auth/internal/data/store/db_file_interactor_impl"
+	"github.com/k0marov/golang-auth/internal/data/token_cache"
 	"github.com/k0marov/golang-auth/internal/delivery/http/handlers"
 	"github.com/k0marov/golang-auth/internal/delivery/token_auth_middleware"
 	"github.com/k0marov/golang-auth/internal/domain/auth_service"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
 	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/id_migration"
+	"github.com/k0marov/golang-auth/internal/domain/mappers"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/user_export"
+	"github.com/k0marov/golang-auth/internal/domain/user_importer"
+	"github.com/k0marov/golang-auth/internal/values"
 )
 
 var UserContextKey = token_auth_middleware.UserContextKey{}
 
-func NewStoreImpl(dbFileName string) (*store.PersistentInMemoryFileStore, error) {
-	fileInteractor := db_file_interactor_impl.NewDBFileInteractor(dbFileName)
+// UserModel is a user as it is kept in a store
+type UserModel = models.UserModel
 
-	store, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+// Token is an auth token of a user
+type Token = entities.Token
+
+// UserStore keeps users and is all the handlers need, so applications can plug in their own backends.
+// Implementations should be safe for concurrent use, and:
+//   - FindUser and UpdatePassword return ErrUserNotFound for unknown usernames
+//   - CreateUser assigns a new unique id, and returns ErrUsernameTaken if the username exists (atomically with creating the user).
+//     It may also assign a public id (see IdStrategy), otherwise the user is exposed with its integer id.
+//   - CreateUser returns ErrTokenTaken if another user has the token
+//   - returned UserModels are copies, which can be modified by callers
+//
+// The storetest package checks all of this.
+type UserStore = auth_store_contract.AuthStore
+
+// TokenStore finds users by their tokens and is all the token middleware needs.
+// FindUserFromToken returns ErrTokenNotFound for unknown tokens.
+type TokenStore = token_store_contract.TokenStore
+
+// Store is implemented by both the file store (see NewStoreImpl) and the SQL store (see NewSQLStore)
+type Store interface {
+	UserStore
+	TokenStore
+}
+
+// NewStoreImpl opens the DB file and loads it into memory.
+// Only one process can write to a DB file: it is locked until Close() is called,
+// and opening it again fails with ErrStoreLocked. Tools, which need to run alongside the writer, should use WithReadOnly.
+func NewStoreImpl(dbFileName string, opts ...StoreOption) (*store.PersistentInMemoryFileStore, error) {
+	options := storeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	fileInteractor := db_file_interactor_impl.NewDBFileInteractor(dbFileName, options.fileOptions...)
+	if err := fileInteractor.Lock(); err != nil {
+		return nil, fmt.Errorf("problem creating a store: %w", err)
+	}
+
+	store, err := store.NewPersistentInMemoryFileStore(fileInteractor, options.storeOptions...)
+	if err != nil {
+		fileInteractor.Close()
+		return nil, fmt.Errorf("problem creating a store: %w", err)
+	}
+	return store, nil
+}
+
+var ErrStoreLocked = db_file_interactor_impl.ErrLocked
+
+// ErrFileLockingNotSupported is returned by NewStoreImpl on platforms without flock (e.g. Windows), unless WithoutFileLocking is used
+var ErrFileLockingNotSupported = db_file_interactor_impl.ErrLockingNotSupported
+var ErrStoreReadOnly = store.ErrReadOnly
+
+// ErrUsernameTaken is returned by Store.CreateUser if the username already exists
+var ErrUsernameTaken = auth_store_contract.UsernameTakenErr
+var ErrUserNotFound = auth_store_contract.UserNotFoundErr
+
+// ErrTokenTaken is returned by Store.CreateUser if another user already has the token
+var ErrTokenTaken = auth_store_contract.TokenTakenErr
+var ErrTokenNotFound = token_store_contract.TokenNotFoundErr
+
+// ErrInvalidBackup is returned by Restore() of the file store, if the backup is corrupt, truncated or inconsistent
+var ErrInvalidBackup = store.ErrInvalidBackup
+
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	storeOptions []store.Option
+	fileOptions  []db_file_interactor_impl.Option
+}
+
+type CompactionPolicy = store.CompactionPolicy
+
+// WithCompactionPolicy makes the file store compact its log into a snapshot when it gets too long.
+// Compaction can also be triggered manually with Compact() or periodically with StartPeriodicCompaction().
+func WithCompactionPolicy(policy CompactionPolicy) StoreOption {
+	return func(o *storeOptions) {
+		o.storeOptions = append(o.storeOptions, store.WithCompactionPolicy(policy))
+	}
+}
+
+// WithEncryption encrypts every record of the DB file with AES-256-GCM, the keys are never written to the file.
+// Records in the clear are then rejected, so an existing plaintext file has to be encrypted once with WithEncryptionMigration
+// (or the encrypt_db command). To rotate the key, add a key with a bigger version to the provider and restart:
+// records encrypted with older keys are then re-encrypted in the background, after which older keys can be removed.
+// The decrypt_db command can be used to inspect an encrypted file.
+func WithEncryption(keys KeyProvider) StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithEncryption(keys))
+	}
+}
+
+// WithEncryptionMigration makes the store accept a DB file with records in the clear once while it is opened,
+// and encrypt it with the keys of WithEncryption before returning. Files with older format versions are migrated without keeping a backup.
+// It is meant for the first start after enabling encryption, and should be removed afterwards,
+// so that records slipped into the file in the clear are rejected.
+func WithEncryptionMigration() StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithEncryptionMigration())
+	}
+}
+
+// WithReadOnly opens the DB file without locking it and without ever modifying it, all mutations fail with ErrStoreReadOnly.
+// Changes made by the writer after opening are not visible, unless WithFollowing is used instead.
+func WithReadOnly() StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithReadOnly())
+		o.storeOptions = append(o.storeOptions, store.WithReadOnly())
+	}
+}
+
+// WithoutFileLocking opens the DB file for writing without locking it, which is needed on platforms without flock (see ErrFileLockingNotSupported).
+// The application then has to make sure that only one process writes to the file, since concurrent writers corrupt it.
+func WithoutFileLocking() StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithoutLocking())
+	}
+}
+
+// WithFollowing opens the DB file in read-only mode (see WithReadOnly) and keeps the store up to date with the writer:
+// records appended to the file are applied as soon as it changes (inotify is used on Linux),
+// and at least every pollInterval. It is meant for read-mostly replicas sharing the file with a single writer,
+// e.g. API instances which only need TokenAuthMiddleware.
+// The store's ReplicationLag() shows how far behind the writer it is, see also PublishReplicationLag.
+func WithFollowing(pollInterval time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithReadOnly())
+		o.storeOptions = append(o.storeOptions, store.WithFollowing(pollInterval))
+	}
+}
+
+// PublishReplicationLag exports the replication lag of a following store (see WithFollowing) in seconds as an expvar metric,
+// which is served at /debug/vars by the expvar package. Like expvar.Publish, it panics if the name is already used.
+func PublishReplicationLag(name string, s *store.PersistentInMemoryFileStore) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.ReplicationLag().Seconds()
+	}))
+}
+
+type Durability = db_file_interactor_impl.Durability
+
+const (
+	NoSync         = db_file_interactor_impl.NoSync
+	SyncEveryWrite = db_file_interactor_impl.SyncEveryWrite
+	GroupCommit    = db_file_interactor_impl.GroupCommit
+)
+
+// WithDurability sets when writes to the DB file are fsynced, NoSync is the default.
+// SyncEveryWrite and GroupCommit guarantee that an acknowledged write (e.g. a registration) survives a machine crash.
+// With SyncEveryWrite writes are serialized for the whole fsync, while GroupCommit lets concurrent writes share one,
+// so it is faster when there are many of them.
+func WithDurability(durability Durability) StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithDurability(durability))
+	}
+}
+
+type VerifyPolicy = db_file_interactor_impl.VerifyPolicy
+
+const (
+	FailOnCorruption = db_file_interactor_impl.FailOnCorruption
+	SkipCorrupted    = db_file_interactor_impl.SkipCorrupted
+)
+
+// WithVerifyPolicy sets what happens when a record of the DB file fails its checksum while loading, FailOnCorruption is the default.
+// The verify_db command can be used to find all corrupt records and duplicates in a DB file.
+func WithVerifyPolicy(policy VerifyPolicy) StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithVerifyPolicy(policy))
+	}
+}
+
+// WithBinarySnapshots makes compaction write the users in a compact binary form, which loads about ten times faster than JSON records.
+// Operations after the last compaction are still appended as JSON records. A file with a binary snapshot can't be opened
+// by versions of the library before this option was added; compacting it without the option (or the decrypt_db command)
+// converts it back.
+func WithBinarySnapshots() StoreOption {
+	return func(o *storeOptions) {
+		o.fileOptions = append(o.fileOptions, db_file_interactor_impl.WithBinarySnapshots())
+	}
+}
+
+// IdStrategy generates the public ids, with which users are exposed to clients (as User.Id),
+// so that they leak neither the number of users nor the ids of other users. Without a strategy, users are exposed with their sequential integer ids.
+type IdStrategy = user_ids.Strategy
+
+var (
+	// UUIDv7 ids are roughly ordered by creation time, which keeps database indexes compact
+	UUIDv7 IdStrategy = user_ids.UUIDv7
+	// ULID ids are ordered by creation time and shorter than UUIDs (26 characters)
+	ULID IdStrategy = user_ids.ULID
+	// Random128 ids are 128 random bits in hex, which don't reveal even the creation time
+	Random128 IdStrategy = user_ids.Random128
+)
+
+// IdStrategyByName returns the strategy named "uuidv7", "ulid" or "random128", e.g. for command line flags
+var IdStrategyByName = user_ids.Named
+
+// WithIdStrategy makes new users of the file store get public ids generated by the strategy.
+// Existing users keep being exposed with their integer ids until AssignPublicIds is run.
+// Versions of the library before public ids were added can read the file (unless it has a binary snapshot, see WithBinarySnapshots),
+// but lose the public ids when compacting it.
+func WithIdStrategy(strategy IdStrategy) StoreOption {
+	return func(o *storeOptions) {
+		o.storeOptions = append(o.storeOptions, store.WithIdStrategy(strategy))
+	}
+}
+
+// UserByIdFinder is implemented by both the file store and the SQL store.
+// FindUserById resolves the ids exposed as User.Id, including the integer ids of users, which got public ids later.
+type UserByIdFinder = auth_store_contract.UserByIdFinder
+
+// PublicIdSetter is implemented by both the file store and the SQL store
+type PublicIdSetter = auth_store_contract.PublicIdSetter
+
+// HashReplacer is implemented by both the file store and the SQL store.
+// Outdated password hashes (e.g. after raising the hash cost or rotating peppers) are upgraded on login only in stores implementing it,
+// since replacing the hash unconditionally could revert a password change made during the login.
+type HashReplacer = auth_store_contract.HashReplacer
+
+// ExposedId returns the id, with which the user is exposed to clients as User.Id:
+// its public id, or the integer id, with which it was exposed before getting one
+var ExposedId = mappers.ExposedId
+
+// ErrPublicIdTaken is returned by SetPublicId if another user already has the public or the legacy id
+var ErrPublicIdTaken = auth_store_contract.PublicIdTakenErr
+
+type PublicIdStore interface {
+	UserLister
+	PublicIdSetter
+}
+
+// AssignPublicIds is the migration path to public ids: it gives every user without a public id one generated by the strategy,
+// while the integer id, with which it was exposed so far, stays resolvable by FindUserById. It returns how many users got public ids.
+// It can be run again after an interruption, and alongside the service with the SQL store (the file store is locked while the service runs).
+// The store should also be opened with the strategy (WithIdStrategy or WithSQLIdStrategy), so that new users get public ids too.
+// onProgress (if not nil) is called with the number of users processed so far. See also the assign_public_ids command.
+func AssignPublicIds(store PublicIdStore, strategy IdStrategy, onProgress func(processed int)) (int, error) {
+	return id_migration.AssignPublicIds(store, strategy, onProgress)
+}
+
+type EncryptionKey = record_encryption.Key
+type KeyProvider = record_encryption.KeyProvider
+
+var NewKeyRing = record_encryption.NewKeyRing
+var LoadEncryptionKeysFromEnv = record_encryption.LoadKeysFromEnv
+var LoadEncryptionKeysFromFile = record_encryption.LoadKeysFromFile
+
+type SQLDialect = sql_store.Dialect
+
+var (
+	SQLite     = sql_store.SQLite
+	PostgreSQL = sql_store.PostgreSQL
+	MySQL      = sql_store.MySQL
+)
+
+// NewSQLStore creates a store backed by a database/sql database, which can be shared between multiple instances of the application.
+// The schema is created and migrated automatically. The driver should be registered and db opened by the caller, e.g.:
+//
+//	import _ "github.com/mattn/go-sqlite3"
+//	db, err := sql.Open("sqlite3", "auth.db")
+//	store, err := auth.NewSQLStore(db, auth.SQLite)
+func NewSQLStore(db *sql.DB, dialect SQLDialect, opts ...SQLStoreOption) (*sql_store.SQLStore, error) {
+	store, err := sql_store.NewSQLStore(db, dialect, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("problem creating a store: %v", err)
 	}
 	return store, nil
 }
 
-func NewHandlersImpl(store *store.PersistentInMemoryFileStore, hashCost int, onNewRegister func(User)) (login http.Handler, register http.Handler) {
-	hasher := bcrypt_hasher.NewBcryptHasher(hashCost)
-	service := auth_service.NewAuthServiceImpl(store, hasher, onNewRegister)
+type SQLStoreOption = sql_store.Option
+
+// WithSQLIdStrategy makes new users of the SQL store get public ids generated by the strategy, see WithIdStrategy
+func WithSQLIdStrategy(strategy IdStrategy) SQLStoreOption {
+	return sql_store.WithIdStrategy(strategy)
+}
+
+// Panics if hashCost or some of the provided options are invalid (e.g. two peppers with the same version are provided),
+// so that misconfiguration is found at startup and not at the first registration.
+// Logs a warning if hashCost is too low for production usage.
+func NewHandlersImpl(store UserStore, hashCost int, onNewRegister func(User), opts ...HandlersOption) (login http.Handler, register http.Handler) {
+	service := newAuthService(store, hashCost, onNewRegister, opts)
 	return handlers.NewLoginHandler(service.Login), handlers.NewRegisterHandler(service.Register)
 }
 
-func NewTokenAuthMiddleware(store *store.PersistentInMemoryFileStore) *token_auth_middleware.TokenAuthMiddleware {
+// NewChangePasswordHandler returns a handler, which accepts {"username", "password", "new_password"} and returns the user's token.
+// The same options as for NewHandlersImpl should be provided, so that the new password is hashed and checked the same way.
+func NewChangePasswordHandler(store UserStore, hashCost int, opts ...HandlersOption) http.Handler {
+	service := newAuthService(store, hashCost, func(User) {}, opts)
+	return handlers.NewChangePasswordHandler(service.ChangePassword)
+}
+
+// BackupStore is implemented by the file store (see NewStoreImpl)
+type BackupStore interface {
+	// Snapshot writes a point-in-time copy of all users to w
+	Snapshot(w io.Writer) error
+	// Restore replaces all users with a snapshot, it returns ErrInvalidBackup and changes nothing if the snapshot is invalid
+	Restore(r io.Reader) error
+}
+
+// NewBackupHandler returns an admin handler for online backups of the file store:
+// GET streams a point-in-time snapshot while writes continue, POST validates the snapshot in the request body
+// and atomically replaces all users with it. Requests need an "Authorization: Token {adminToken}" header.
+// Backups contain password hashes and live tokens, so it should only be served over TLS. The backup_db command is a client for it.
+// Backups bigger than DefaultMaxBackupSize (see WithMaxBackupSize) are rejected with 413 and a "backup-too-large" error.
+// Panics if adminToken is empty.
+func NewBackupHandler(s BackupStore, adminToken string, opts ...BackupHandlerOption) http.Handler {
+	if adminToken == "" {
+		panic("the admin token of the backup handler can't be empty")
+	}
+	options := backupHandlerOptions{maxBackupSize: DefaultMaxBackupSize}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	restore := func(r io.Reader) error {
+		err := s.Restore(r)
+		if errors.Is(err, store.ErrInvalidBackup) {
+			clientErr := client_errors.BackupInvalidError
+			clientErr.ReadableDetail += " " + err.Error()
+			return clientErr
+		}
+		return err
+	}
+	return handlers.NewBackupHandler(s.Snapshot, restore, adminToken, options.maxBackupSize)
+}
+
+// DefaultMaxBackupSize is the biggest backup NewBackupHandler restores by default, the whole backup is held in memory while restoring it
+const DefaultMaxBackupSize = 1 << 30
+
+type BackupHandlerOption func(*backupHandlerOptions)
+
+type backupHandlerOptions struct {
+	maxBackupSize int64
+}
+
+// WithMaxBackupSize sets the biggest backup in bytes, which NewBackupHandler restores
+func WithMaxBackupSize(bytes int64) BackupHandlerOption {
+	return func(o *backupHandlerOptions) {
+		o.maxBackupSize = bytes
+	}
+}
+
+// NewPasswordResetter returns a function, which sets a new password for a user without checking the current one.
+// It is meant to be used after the application has verified the user in some other way (e.g. via email).
+// If the new password is not acceptable, the returned error can be sent to the client as JSON.
+func NewPasswordResetter(store UserStore, hashCost int, opts ...HandlersOption) func(username, newPassword string) error {
+	service := newAuthService(store, hashCost, func(User) {}, opts)
+	return service.ResetPassword
+}
+
+func newAuthService(store UserStore, hashCost int, onNewRegister func(User), opts []HandlersOption) *auth_service.AuthServiceImpl {
+	options := handlersOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := bcrypt_hasher.ValidateCost(hashCost); err != nil {
+		panic(fmt.Sprintf("invalid hash cost: %v", err))
+	}
+	if hashCost < bcrypt_hasher.MinSafeCost {
+		log.Printf("WARNING: hash cost %d is below the safe minimum of %d, it should only be used in tests (see CalibrateHashCost)", hashCost, bcrypt_hasher.MinSafeCost)
+	}
+
+	// hashes imported from other systems are upgraded to bcrypt on the first login
+	var hasher auth_service.Hasher = foreign_hashes.NewUpgradingHasher(bcrypt_hasher.NewBcryptHasher(hashCost))
+	if len(options.peppers) != 0 {
+		pepperedHasher, err := peppered_hasher.NewPepperedHasher(hasher, options.peppers)
+		if err != nil {
+			panic(fmt.Sprintf("invalid peppers: %v", err))
+		}
+		hasher = pepperedHasher
+	}
+
+	return auth_service.NewAuthServiceImpl(store, hasher, onNewRegister, options.serviceOptions...)
+}
+
+type HandlersOption func(*handlersOptions)
+
+type handlersOptions struct {
+	peppers        []Pepper
+	serviceOptions []auth_service.Option
+}
+
+// WithPeppers enables peppering of passwords before hashing them.
+// The pepper with the biggest version is used for new hashes, others are used only for checking older hashes.
+// Hashes created with older peppers (or without a pepper) are rehashed on the next successful login.
+func WithPeppers(peppers []Pepper) HandlersOption {
+	return func(o *handlersOptions) {
+		o.peppers = peppers
+	}
+}
+
+// WithBreachedPasswordCheck makes registration and password changes reject passwords found by the checker with a "password-breached" error.
+// See NewHIBPRangeDataset and LoadBreachFilter for the available offline checkers.
+func WithBreachedPasswordCheck(checker BreachChecker) HandlersOption {
+	return func(o *handlersOptions) {
+		o.serviceOptions = append(o.serviceOptions, auth_service.WithPasswordChecks(breached_passwords.NewPasswordCheck(checker)))
+	}
+}
+
+// WithPasswordHistory makes password changes and resets reject any of the last historySize passwords of the user
+// with a "password-reused" error. The hashes of previous passwords are persisted in the store.
+func WithPasswordHistory(historySize int) HandlersOption {
+	return func(o *handlersOptions) {
+		o.serviceOptions = append(o.serviceOptions, auth_service.WithPasswordHistory(historySize))
+	}
+}
+
+// TokenIssuer issues tokens returned by the handlers (e.g. the store returned by NewRedisTokenStore)
+type TokenIssuer = auth_service.TokenIssuer
+
+// WithTokenIssuer makes registration, login and password changes return a new token from the issuer,
+// instead of the token kept with the user in the store. The middleware should then use the token store of the issuer.
+func WithTokenIssuer(issuer TokenIssuer) HandlersOption {
+	return func(o *handlersOptions) {
+		o.serviceOptions = append(o.serviceOptions, auth_service.WithTokenIssuer(issuer))
+	}
+}
+
+// DefaultHashLatency is a reasonable target latency for CalibrateHashCost
+const DefaultHashLatency = 250 * time.Millisecond
+
+// CalibrateHashCost benchmarks this machine and returns the highest hash cost,
+// for which hashing a single password takes less than targetLatency.
+// It is meant to be called once at startup, with the result passed to NewHandlersImpl.
+func CalibrateHashCost(targetLatency time.Duration) int {
+	return bcrypt_hasher.CalibrateCost(targetLatency)
+}
+
+type Pepper = peppered_hasher.Pepper
+
+var LoadPeppersFromEnv = peppered_hasher.LoadPeppersFromEnv
+var LoadPeppersFromFile = peppered_hasher.LoadPeppersFromFile
+
+func NewTokenAuthMiddleware(store TokenStore) *token_auth_middleware.TokenAuthMiddleware {
 	return token_auth_middleware.NewTokenAuthMiddleware(store)
 }
 
+type TokenCacheOption = token_cache.Option
+
+const DefaultTokenCacheCapacity = token_cache.DefaultCapacity
+
+var (
+	WithTokenCacheCapacity    = token_cache.WithCapacity
+	WithTokenCacheTTL         = token_cache.WithTTL
+	WithTokenCacheNegativeTTL = token_cache.WithNegativeTTL
+)
+
+// TokenInvalidator is implemented by the token cache (see NewCachingTokenStore)
+type TokenInvalidator = store.TokenInvalidator
+
+// NewCachingTokenStore returns a read-through cache in front of a slow token store (e.g. the SQL store),
+// which can be passed to NewTokenAuthMiddleware. It keeps the most recently used tokens (DefaultTokenCacheCapacity by default)
+// for a TTL (a minute by default) and unknown tokens for a shorter negative TTL, and concurrent lookups of the same token share a single query.
+//
+// If the store has a SetTokenInvalidator(TokenInvalidator) method (like the file store), the cache is hooked to it,
+// so that revoked and changed tokens are dropped immediately. Otherwise the application should call Invalidate of the cache
+// on logout and revocation; changes made by other instances are seen when the entries expire.
+func NewCachingTokenStore(s TokenStore, opts ...TokenCacheOption) *token_cache.CachingTokenStore {
+	cache := token_cache.NewCachingTokenStore(s, opts...)
+	if notifier, ok := s.(interface{ SetTokenInvalidator(TokenInvalidator) }); ok {
+		notifier.SetTokenInvalidator(cache)
+	}
+	return cache
+}
+
+type RedisOption func(*redisOptions)
+
+type redisOptions struct {
+	clientOptions []resp_client.Option
+	storeOptions  []redis_token_store.Option
+}
+
+// WithRedisPassword authenticates to the server with the password
+func WithRedisPassword(password string) RedisOption {
+	return func(o *redisOptions) {
+		o.clientOptions = append(o.clientOptions, resp_client.WithPassword(password))
+	}
+}
+
+// WithRedisDB selects a logical database of the server
+func WithRedisDB(db int) RedisOption {
+	return func(o *redisOptions) {
+		o.clientOptions = append(o.clientOptions, resp_client.WithDB(db))
+	}
+}
+
+// WithRedisTimeout sets the timeout for connecting and for every command (5 seconds by default)
+func WithRedisTimeout(timeout time.Duration) RedisOption {
+	return func(o *redisOptions) {
+		o.clientOptions = append(o.clientOptions, resp_client.WithTimeout(timeout))
+	}
+}
+
+// WithRedisKeyPrefix sets the prefix of the token keys ("auth:token:" by default)
+func WithRedisKeyPrefix(prefix string) RedisOption {
+	return func(o *redisOptions) {
+		o.storeOptions = append(o.storeOptions, redis_token_store.WithKeyPrefix(prefix))
+	}
+}
+
+// WithRedisTokenTTL sets after how long tokens expire (30 days by default), zero means they never do
+func WithRedisTokenTTL(ttl time.Duration) RedisOption {
+	return func(o *redisOptions) {
+		o.storeOptions = append(o.storeOptions, redis_token_store.WithTokenTTL(ttl))
+	}
+}
+
+// NewRedisTokenStore returns a token store backed by a server speaking the Redis protocol at addr (host:port),
+// so that several instances of the application share the tokens, while the users stay in the given store.
+// Tokens expire using the native key TTL. Pass the returned store to WithTokenIssuer, so that the handlers issue tokens in it,
+// and to NewTokenAuthMiddleware. Tokens can be revoked (e.g. on logout) with DeleteToken.
+func NewRedisTokenStore(addr string, users UserStore, opts ...RedisOption) *redis_token_store.RedisTokenStore {
+	options := redisOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	client := resp_client.NewClient(addr, options.clientOptions...)
+	return redis_token_store.NewRedisTokenStore(client, users, options.storeOptions...)
+}
+
 type User = entities.User
+
+type BreachChecker = breached_passwords.Checker
+
+var NewHIBPRangeDataset = breached_passwords.NewHIBPRangeDataset
+
+// LoadBreachFilter loads a filter file built with the build_breach_filter command
+var LoadBreachFilter = breached_passwords.LoadBloomFilter
+
+type ImportedUser = values.ImportedUser
+type ImportReport = user_importer.Report
+
+// ImportUsers creates users with password hashes from other systems (pbkdf2_sha256, scrypt, md5-crypt or bcrypt).
+// Their hashes are upgraded on the first successful login.
+// With dryRun nothing is written, but the report still shows invalid usernames, duplicates, etc.
+func ImportUsers(store UserStore, users []ImportedUser, dryRun bool) (ImportReport, error) {
+	return user_importer.Import(store, users, dryRun)
+}
+
+var ParseImportJSON = user_importer.ParseJSON
+var ParseImportCSV = user_importer.ParseCSV
+
+// UserLister is implemented by both the file store and the SQL store
+type UserLister = auth_store_contract.UserLister
+type ExportImportReport = user_export.ImportReport
+type ExportVerifyReport = user_export.VerifyReport
+
+var ErrInvalidExport = user_export.ErrInvalidExport
+
+// ExportOption configures ExportUsers, ImportExportedUsers and VerifyExportedUsers
+type ExportOption = user_export.Option
+
+// ExportTokenStore is a token store keeping tokens apart from the users, whose tokens can be exported, e.g. the store returned by NewRedisTokenStore
+type ExportTokenStore = user_export.TokenStore
+
+// WithExportTokenStore moves the tokens of a separate token store too: ExportUsers writes them, ImportExportedUsers adds them to the given store
+// (with its full TTL) and VerifyExportedUsers checks them in it. Without it, only the tokens kept in the users are moved.
+func WithExportTokenStore(tokens ExportTokenStore) ExportOption {
+	return user_export.WithTokenStore(tokens)
+}
+
+// ExportUsers writes all users of the store with their hashes, tokens and password histories to w in a portable JSON format,
+// which can be imported into a store of any kind with ImportExportedUsers.
+// Unlike ImportUsers, which is for users from other systems, the export/import pair moves users between stores of this package.
+// onProgress (if not nil) is called with the number of users exported so far.
+func ExportUsers(w io.Writer, store UserLister, onProgress func(exported int), opts ...ExportOption) (int, error) {
+	return user_export.Export(w, store, onProgress, opts...)
+}
+
+// ImportExportedUsers creates the users of an export written by ExportUsers in the store.
+// Users, which already exist in the store with the same hash, are completed and counted, so an interrupted import can be run again,
+// while users with another hash are left untouched and reported.
+// If the store implements PublicIdSetter, the users keep the ids exposed to clients (see IdStrategy).
+// onProgress (if not nil) is called with the number of users processed so far.
+func ImportExportedUsers(r io.Reader, store UserStore, onProgress func(processed int), opts ...ExportOption) (ExportImportReport, error) {
+	return user_export.Import(r, store, onProgress, opts...)
+}
+
+// VerifyExportedUsers checks that all users of an export are present in the store unchanged, e.g. after ImportExportedUsers
+func VerifyExportedUsers(r io.Reader, store Store, opts ...ExportOption) (ExportVerifyReport, error) {
+	return user_export.Verify(r, store, opts...)
+}
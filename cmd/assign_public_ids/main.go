@@ -0,0 +1,98 @@
+// Command assign_public_ids gives public ids (see auth.IdStrategy) to all users of a store, which were created without them.
+// The integer ids, with which they were exposed so far, stay resolvable (see auth.AssignPublicIds).
+//
+// Usage:
+//
+//	assign_public_ids -store file:users.db -strategy ulid [-keys-file keys.txt | -keys-env AUTH_DB_KEY_V]
+//	assign_public_ids -store sqlite:auth.sqlite -strategy uuidv7
+//
+// Strategies are uuidv7, ulid and random128. A DB file is locked by the running service, so it has to be stopped first;
+// an SQL database can be migrated while the service is running. Running the command again after an interruption resumes it.
+// Afterwards, the service should be started with the same strategy, so that new users get public ids too.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	auth "github.com/k0marov/golang-auth"
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+)
+
+func main() {
+	storeSpec := flag.String("store", "", "the store: file:PATH or sqlite:PATH")
+	strategyName := flag.String("strategy", "", "the id strategy: uuidv7, ulid or random128")
+	keys := key_flags.Register("for DB files")
+	flag.Parse()
+	if *storeSpec == "" || *strategyName == "" || !keys.Valid(false) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(*storeSpec, *strategyName, *keys); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(storeSpec, strategyName string, keys key_flags.Flags) error {
+	strategy, err := auth.IdStrategyByName(strategyName)
+	if err != nil {
+		return err
+	}
+	store, closeStore, err := open(storeSpec, keys)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	lastPrinted := time.Now()
+	assigned, err := auth.AssignPublicIds(store, strategy, func(processed int) {
+		if time.Since(lastPrinted) >= time.Second {
+			lastPrinted = time.Now()
+			fmt.Fprintf(os.Stderr, "processed %d users...\n", processed)
+		}
+	})
+	fmt.Printf("assigned public ids: %d\n", assigned)
+	return err
+}
+
+func open(spec string, keys key_flags.Flags) (auth.PublicIdStore, func(), error) {
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok || path == "" {
+		return nil, nil, fmt.Errorf("invalid store %q, use file:PATH or sqlite:PATH", spec)
+	}
+	switch kind {
+	case "file":
+		opts, err := keys.StoreOptions()
+		if err != nil {
+			return nil, nil, err
+		}
+		fileStore, err := auth.NewStoreImpl(path, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileStore, func() { fileStore.Close() }, nil
+	case "sqlite":
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil, fmt.Errorf("error opening the database: %w", err)
+		}
+		db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening %s: %w", path, err)
+		}
+		sqlStore, err := auth.NewSQLStore(db, auth.SQLite)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return sqlStore, func() { sqlStore.Close(); db.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown kind of store %q, use file or sqlite", kind)
+	}
+}
@@ -0,0 +1,186 @@
+// Command backup_db takes and restores backups of a DB file, either online through the backup handler
+// of a running service (see auth.NewBackupHandler), or directly on the file.
+//
+// Usage:
+//
+//	backup_db -url https://example.com/admin/backup (-out backup.db | -restore backup.db)
+//	backup_db -db users.db [-keys-file keys.txt | -keys-env AUTH_DB_KEY_V] (-out backup.db | -restore backup.db)
+//
+// The admin token for -url is read from the env variable set by -token-env (AUTH_ADMIN_TOKEN by default).
+// A backup of a file can be taken while the service is running, but restoring into a file needs the service to be stopped,
+// since the file is locked by it. The backup is written to stdout if -out is not set.
+// Backups contain password hashes and live tokens, so handle them with care.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	auth "github.com/k0marov/golang-auth"
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+	"github.com/k0marov/golang-auth/internal/core/client_errors"
+	"github.com/k0marov/golang-auth/internal/data/store"
+)
+
+func main() {
+	url := flag.String("url", "", "URL of the backup handler of a running service")
+	tokenEnv := flag.String("token-env", "AUTH_ADMIN_TOKEN", "env variable with the admin token for -url")
+	db := flag.String("db", "", "path to the DB file")
+	keys := key_flags.Register("for -db")
+	out := flag.String("out", "", "path to the file the backup is written to (stdout by default)")
+	restore := flag.String("restore", "", "path to the backup which should be restored")
+	flag.Parse()
+	if (*url == "") == (*db == "") || (*out != "" && *restore != "") || !keys.Valid(false) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var backuper backuper
+	if *url != "" {
+		token := os.Getenv(*tokenEnv)
+		if token == "" {
+			log.Fatalf("the admin token should be set in the %s env variable", *tokenEnv)
+		}
+		backuper = remoteBackuper{url: *url, token: token}
+	} else {
+		backuper = fileBackuper{db: *db, keys: *keys}
+	}
+
+	var err error
+	if *restore != "" {
+		err = runRestore(backuper, *restore)
+	} else {
+		err = runSnapshot(backuper, *out)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type backuper interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+func runSnapshot(backuper backuper, out string) error {
+	if out == "" {
+		return backuper.Snapshot(os.Stdout)
+	}
+	// the backup appears at out only when it is complete
+	tmpFile, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".partial-*")
+	if err != nil {
+		return fmt.Errorf("error creating the output file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	if err := backuper.Snapshot(tmpFile); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the output file: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), out); err != nil {
+		return fmt.Errorf("error renaming the output file: %w", err)
+	}
+	log.Printf("the backup is written to %s", out)
+	return nil
+}
+
+func runRestore(backuper backuper, backup string) error {
+	backupFile, err := os.Open(backup)
+	if err != nil {
+		return fmt.Errorf("error opening the backup: %w", err)
+	}
+	defer backupFile.Close()
+	if err := backuper.Restore(backupFile); err != nil {
+		return err
+	}
+	log.Printf("%s is restored", backup)
+	return nil
+}
+
+type fileBackuper struct {
+	db   string
+	keys key_flags.Flags
+}
+
+func (f fileBackuper) Snapshot(w io.Writer) error {
+	fileStore, err := f.open(auth.WithReadOnly())
+	if err != nil {
+		return err
+	}
+	defer fileStore.Close()
+	return fileStore.Snapshot(w)
+}
+
+func (f fileBackuper) Restore(r io.Reader) error {
+	fileStore, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer fileStore.Close()
+	return fileStore.Restore(r)
+}
+
+func (f fileBackuper) open(opts ...auth.StoreOption) (*store.PersistentInMemoryFileStore, error) {
+	keyOpts, err := f.keys.StoreOptions()
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewStoreImpl(f.db, append(opts, keyOpts...)...)
+}
+
+type remoteBackuper struct {
+	url, token string
+}
+
+func (r remoteBackuper) Snapshot(w io.Writer) error {
+	response, err := r.do(http.MethodGet, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// a broken connection shows up here, the handler breaks it if the snapshot fails midway
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("error downloading the backup: %w", err)
+	}
+	return nil
+}
+
+func (r remoteBackuper) Restore(backup io.Reader) error {
+	response, err := r.do(http.MethodPost, backup)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+func (r remoteBackuper) do(method string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, r.url, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating a request: %w", err)
+	}
+	request.Header.Set("Authorization", "Token "+r.token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending a request to the backup handler: %w", err)
+	}
+	if response.StatusCode/100 != 2 {
+		defer response.Body.Close()
+		responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		var clientErr client_errors.ClientError
+		if json.Unmarshal(bytes.TrimSpace(responseBody), &clientErr) == nil && clientErr.DetailCode != "" {
+			return nil, fmt.Errorf("the backup handler returned %s: %s", response.Status, clientErr.ReadableDetail)
+		}
+		return nil, fmt.Errorf("the backup handler returned %s", response.Status)
+	}
+	return response, nil
+}
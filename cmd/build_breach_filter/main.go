@@ -0,0 +1,126 @@
+// Command build_breach_filter builds a compact filter of breached passwords
+// from a local copy of the Have I Been Pwned SHA-1 dataset, which can then be loaded with auth.LoadBreachFilter.
+//
+// Usage:
+//
+//	build_breach_filter -in pwnedpasswords.txt -out breached.filter [-fp-rate 0.001] [-min-count 1]
+//
+// The input can be either a single file with lines of the form {SHA-1}:{count},
+// or a directory with range files named {first 5 chars of SHA-1}.txt.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/k0marov/golang-auth/internal/core/breached_passwords"
+)
+
+func main() {
+	in := flag.String("in", "", "path to the HIBP dataset (a single file or a directory of range files)")
+	out := flag.String("out", "", "path to the output filter file")
+	fpRate := flag.Float64("fp-rate", 0.001, "wanted false positive rate of the filter")
+	minCount := flag.Int("min-count", 1, "only include hashes which appeared in at least this many breaches")
+	flag.Parse()
+	if *in == "" || *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// checked before reading the dataset, which takes a while; written this way to also reject NaN
+	if !(*fpRate > 0 && *fpRate < 1) {
+		fmt.Fprintf(os.Stderr, "-fp-rate must be between 0 and 1, got %v\n", *fpRate)
+		os.Exit(2)
+	}
+
+	if err := run(*in, *out, *fpRate, *minCount); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(in, out string, fpRate float64, minCount int) error {
+	// the dataset is read twice: first for counting the hashes, so that the filter can be sized properly
+	count := 0
+	err := forEachHash(in, func(string, int) bool {
+		count++
+		return true
+	}, minCount)
+	if err != nil {
+		return err
+	}
+	log.Printf("building a filter for %d hashes with false positive rate %v", count, fpRate)
+
+	filter, err := breached_passwords.NewBloomFilter(count, fpRate)
+	if err != nil {
+		return err
+	}
+	var addErr error
+	err = forEachHash(in, func(hash string, _ int) bool {
+		addErr = filter.AddHash(hash)
+		return addErr == nil
+	}, minCount)
+	if err != nil {
+		return err
+	}
+	if addErr != nil {
+		return addErr
+	}
+
+	outFile, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("error creating the output file: %w", err)
+	}
+	defer outFile.Close()
+	size, err := filter.WriteTo(outFile)
+	if err != nil {
+		return fmt.Errorf("error writing the filter: %w", err)
+	}
+	if err := outFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the output file: %w", err)
+	}
+	log.Printf("written %d bytes to %s", size, out)
+	return nil
+}
+
+func forEachHash(in string, onHash func(hash string, count int) bool, minCount int) error {
+	filtered := func(hash string, count int) bool {
+		if count < minCount {
+			return true
+		}
+		return onHash(hash, count)
+	}
+	info, err := os.Stat(in)
+	if err != nil {
+		return fmt.Errorf("error opening the dataset: %w", err)
+	}
+	if !info.IsDir() {
+		return readFile(in, "", filtered)
+	}
+
+	rangeFiles, err := filepath.Glob(filepath.Join(in, "*.txt"))
+	if err != nil {
+		return fmt.Errorf("error listing range files: %w", err)
+	}
+	for _, rangeFile := range rangeFiles {
+		prefix := strings.ToUpper(strings.TrimSuffix(filepath.Base(rangeFile), ".txt"))
+		if err := readFile(rangeFile, prefix, filtered); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(fileName, hashPrefix string, onHash func(hash string, count int) bool) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", fileName, err)
+	}
+	defer file.Close()
+	if err := breached_passwords.ReadHashes(file, hashPrefix, onHash); err != nil {
+		return fmt.Errorf("error reading %s: %w", fileName, err)
+	}
+	return nil
+}
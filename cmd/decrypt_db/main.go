@@ -0,0 +1,59 @@
+// Command decrypt_db writes a plaintext copy of an encrypted DB file for inspection.
+//
+// Usage:
+//
+//	decrypt_db -db users.db (-keys-file keys.txt | -keys-env AUTH_DB_KEY_V) [-out users.plain.db]
+//
+// The key file has the same format as for auth.LoadEncryptionKeysFromFile: {version}:{base64 key} on every line.
+// The output is written to stdout by default. It contains live tokens and hashes, so handle it with care.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+	"github.com/k0marov/golang-auth/internal/data/store/db_file_interactor_impl"
+)
+
+func main() {
+	db := flag.String("db", "", "path to the encrypted DB file")
+	keys := key_flags.Register("")
+	out := flag.String("out", "", "path to the output file (stdout by default)")
+	flag.Parse()
+	if *db == "" || !keys.Valid(true) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*db, *keys, *out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(db string, keyFlags key_flags.Flags, out string) error {
+	keys, err := keyFlags.Load()
+	if err != nil {
+		return err
+	}
+
+	dbFile, err := os.Open(db)
+	if err != nil {
+		return fmt.Errorf("error opening the DB file: %w", err)
+	}
+	defer dbFile.Close()
+
+	var dst io.Writer = os.Stdout
+	if out != "" {
+		outFile, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating the output file: %w", err)
+		}
+		defer outFile.Close()
+		dst = outFile
+	}
+	return db_file_interactor_impl.Decrypt(dst, dbFile, keys)
+}
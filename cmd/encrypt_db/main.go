@@ -0,0 +1,48 @@
+// Command encrypt_db encrypts the records of a DB file, which were written in the clear, with the current key.
+// Once encryption is enabled (see auth.WithEncryption), records in the clear are rejected, so an existing file has to be encrypted once.
+//
+// Usage:
+//
+//	encrypt_db -db users.db (-keys-file keys.txt | -keys-env AUTH_DB_KEY_V)
+//
+// The DB file is locked by the running service, so it has to be stopped first.
+// Files with older format versions are migrated too, without keeping a backup in the clear.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	auth "github.com/k0marov/golang-auth"
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+)
+
+func main() {
+	db := flag.String("db", "", "path to the DB file")
+	keys := key_flags.Register("")
+	flag.Parse()
+	if *db == "" || !keys.Valid(true) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*db, *keys); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(db string, keyFlags key_flags.Flags) error {
+	opts, err := keyFlags.StoreOptions()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(db); err != nil {
+		return err
+	}
+	store, err := auth.NewStoreImpl(db, append(opts, auth.WithEncryptionMigration())...)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
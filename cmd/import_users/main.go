@@ -0,0 +1,91 @@
+// Command import_users imports users with password hashes from other systems into a DB file.
+//
+// Usage:
+//
+//	import_users -db users.db -in users.json [-format json|csv] [-dry-run]
+//
+// JSON input is an array of {"username": ..., "password_hash": ...} objects,
+// CSV input should have a header with the username and password_hash columns.
+// Supported hash formats are pbkdf2_sha256 and scrypt (Django), md5-crypt and bcrypt.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	auth "github.com/k0marov/golang-auth"
+)
+
+func main() {
+	db := flag.String("db", "", "path to the DB file")
+	in := flag.String("in", "", "path to the file with users to import")
+	format := flag.String("format", "", "format of the input file: json or csv (by default it is inferred from the extension)")
+	dryRun := flag.Bool("dry-run", false, "only validate the input and print the report, without writing anything")
+	flag.Parse()
+	if *db == "" || *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*in), ".")
+	}
+
+	report, err := run(*db, *in, *format, *dryRun)
+	printReport(report, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(db, in, format string, dryRun bool) (auth.ImportReport, error) {
+	inFile, err := os.Open(in)
+	if err != nil {
+		return auth.ImportReport{}, fmt.Errorf("error opening the input file: %w", err)
+	}
+	defer inFile.Close()
+
+	var users []auth.ImportedUser
+	switch format {
+	case "json":
+		users, err = auth.ParseImportJSON(inFile)
+	case "csv":
+		users, err = auth.ParseImportCSV(inFile)
+	default:
+		return auth.ImportReport{}, fmt.Errorf("unknown input format %q, use json or csv", format)
+	}
+	if err != nil {
+		return auth.ImportReport{}, err
+	}
+
+	store, err := auth.NewStoreImpl(db)
+	if err != nil {
+		return auth.ImportReport{}, err
+	}
+	defer store.Close()
+	return auth.ImportUsers(store, users, dryRun)
+}
+
+func printReport(report auth.ImportReport, dryRun bool) {
+	if dryRun {
+		fmt.Println("DRY RUN, nothing was written")
+	}
+	fmt.Printf("total: %d, imported: %d, skipped: %d\n", report.Total, report.Imported, report.Skipped())
+	printList("invalid usernames", report.InvalidUsernames)
+	printList("duplicate usernames", report.Duplicates)
+	printList("already existing usernames", report.AlreadyExisting)
+	printList("usernames with unsupported hashes", report.UnsupportedHashes)
+}
+
+func printList(title string, usernames []string) {
+	if len(usernames) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(usernames))
+	for _, username := range usernames {
+		fmt.Printf("  %s\n", username)
+	}
+}
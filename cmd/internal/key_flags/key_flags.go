@@ -0,0 +1,66 @@
+// Package key_flags defines the -keys-file and -keys-env flags of the commands, which open encrypted DB files.
+// The key file and the env variables have the formats of auth.LoadEncryptionKeysFromFile and auth.LoadEncryptionKeysFromEnv.
+package key_flags
+
+import (
+	"flag"
+
+	auth "github.com/k0marov/golang-auth"
+)
+
+type Flags struct {
+	// path to the key file
+	File string
+	// prefix of the env variables with the keys
+	Env string
+}
+
+// Register defines the flags on the command line, target is appended to their usage (e.g. "for DB files")
+func Register(target string) *Flags {
+	if target != "" {
+		target = " " + target
+	}
+	f := &Flags{}
+	flag.StringVar(&f.File, "keys-file", "", "path to the file with encryption keys"+target)
+	flag.StringVar(&f.Env, "keys-env", "", "prefix of the env variables with encryption keys"+target)
+	return f
+}
+
+// Given reports whether one of the flags is given
+func (f Flags) Given() bool {
+	return f.File != "" || f.Env != ""
+}
+
+// Valid reports whether the flags aren't given together, and whether one of them is given if the keys are required
+func (f Flags) Valid(required bool) bool {
+	if f.File != "" && f.Env != "" {
+		return false
+	}
+	return f.Given() || !required
+}
+
+// Load loads the keys given with the flags, or returns nil if none are given
+func (f Flags) Load() (auth.KeyProvider, error) {
+	if !f.Given() {
+		return nil, nil
+	}
+	load := auth.LoadEncryptionKeysFromEnv
+	source := f.Env
+	if f.File != "" {
+		load, source = auth.LoadEncryptionKeysFromFile, f.File
+	}
+	keys, err := load(source)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// StoreOptions returns the options for opening a DB file with the keys given with the flags, if any
+func (f Flags) StoreOptions() ([]auth.StoreOption, error) {
+	keys, err := f.Load()
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	return []auth.StoreOption{auth.WithEncryption(keys)}, nil
+}
@@ -0,0 +1,249 @@
+// Command migrate_users moves users with their hashes, tokens and password histories from one store to another,
+// e.g. from a DB file to an SQL database, through the portable export format (see auth.ExportUsers).
+//
+// Usage:
+//
+//	migrate_users -from file:users.db -to sqlite:auth.sqlite
+//	migrate_users -from file:users.db -out users.json
+//	migrate_users -in users.json -to sqlite:auth.sqlite
+//
+// Stores are given as file:PATH for DB files (see auth.NewStoreImpl, -keys-file and -keys-env apply to them)
+// or sqlite:PATH for SQLite databases (see auth.NewSQLStore).
+// A source DB file is opened read-only, so it can be exported while the service is running.
+// Tokens kept in a Redis server apart from the users (see auth.NewRedisTokenStore) are moved too if -from-redis and -to-redis
+// give the addresses (host:port) of the servers of the source and the destination; the keys have the default prefix.
+// After importing, every user is verified in the destination store and the counts are printed;
+// the command fails if some of them are missing or differ. Users, which already exist in the destination with the same hash,
+// are completed instead of created, so an interrupted migration can be run again.
+// Exports contain password hashes and live tokens, so handle them with care.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	auth "github.com/k0marov/golang-auth"
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+)
+
+type store interface {
+	auth.Store
+	auth.UserLister
+}
+
+func main() {
+	from := flag.String("from", "", "the source store: file:PATH or sqlite:PATH")
+	to := flag.String("to", "", "the destination store: file:PATH or sqlite:PATH")
+	out := flag.String("out", "", "only export the source store to this file")
+	in := flag.String("in", "", "import this export file instead of a source store")
+	keys := key_flags.Register("for DB files")
+	fromRedis := flag.String("from-redis", "", "export the tokens of the source store kept in the Redis server at this address")
+	toRedis := flag.String("to-redis", "", "import the tokens into the Redis server of the destination at this address")
+	flag.Parse()
+	if (*from == "") == (*in == "") || (*to == "") == (*out == "") || (*in != "" && *out != "") || !keys.Valid(false) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opener := opener{keys: *keys, fromRedis: *fromRedis, toRedis: *toRedis}
+
+	var err error
+	switch {
+	case *out != "":
+		err = runExport(opener, *from, *out)
+	case *in != "":
+		err = runImport(opener, *in, *to)
+	default:
+		err = runMigration(opener, *from, *to)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runExport(opener opener, from, out string) error {
+	outFile, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("error creating the output file: %w", err)
+	}
+	defer outFile.Close()
+	exported, err := export(opener, from, outFile)
+	if err != nil {
+		return err
+	}
+	if err := outFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the output file: %w", err)
+	}
+	fmt.Printf("exported: %d\n", exported)
+	return nil
+}
+
+func runMigration(opener opener, from, to string) error {
+	// the export is kept in a temporary file, since it is read twice: for importing and for verifying
+	tmpFile, err := os.CreateTemp("", "migrate_users-*.json")
+	if err != nil {
+		return fmt.Errorf("error creating a temporary file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	exported, err := export(opener, from, tmpFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported: %d\n", exported)
+	return runImport(opener, tmpFile.Name(), to)
+}
+
+func export(opener opener, from string, w io.Writer) (int, error) {
+	source, closeSource, err := opener.open(from, true)
+	if err != nil {
+		return 0, err
+	}
+	defer closeSource()
+	var opts []auth.ExportOption
+	if opener.fromRedis != "" {
+		tokens := auth.NewRedisTokenStore(opener.fromRedis, source)
+		defer tokens.Close()
+		opts = append(opts, auth.WithExportTokenStore(tokens))
+	}
+	progress := newProgress("exported")
+	exported, err := auth.ExportUsers(w, source, progress.report, opts...)
+	progress.done(exported)
+	return exported, err
+}
+
+func runImport(opener opener, in, to string) error {
+	destination, closeDestination, err := opener.open(to, false)
+	if err != nil {
+		return err
+	}
+	defer closeDestination()
+	var opts []auth.ExportOption
+	if opener.toRedis != "" {
+		tokens := auth.NewRedisTokenStore(opener.toRedis, destination)
+		defer tokens.Close()
+		opts = append(opts, auth.WithExportTokenStore(tokens))
+	}
+
+	inFile, err := os.Open(in)
+	if err != nil {
+		return fmt.Errorf("error opening the export: %w", err)
+	}
+	defer inFile.Close()
+	progress := newProgress("imported")
+	report, err := auth.ImportExportedUsers(inFile, destination, progress.report, opts...)
+	progress.done(report.Total)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("total: %d, imported: %d, already imported: %d, already existing: %d\n",
+		report.Total, report.Imported, report.AlreadyImported, len(report.AlreadyExisting))
+	printList("already existing usernames (left untouched)", report.AlreadyExisting)
+	printList("usernames exposed with new ids (their public or legacy ids are taken in the destination)", report.IdConflicts)
+	if report.Tokens > 0 {
+		fmt.Printf("tokens: %d, imported: %d, skipped: %d\n", report.Tokens, report.ImportedTokens, report.SkippedTokens)
+	}
+
+	if _, err := inFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error rewinding the export: %w", err)
+	}
+	verifyReport, err := auth.VerifyExportedUsers(inFile, destination, opts...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("verified: %d, missing: %d, mismatched: %d\n", verifyReport.Checked, len(verifyReport.Missing), len(verifyReport.Mismatched))
+	printList("missing usernames", verifyReport.Missing)
+	printList("mismatched usernames", verifyReport.Mismatched)
+	if verifyReport.CheckedTokens > 0 {
+		fmt.Printf("verified tokens: %d, missing: %d\n", verifyReport.CheckedTokens, len(verifyReport.MissingTokens))
+		printList("usernames with missing tokens", verifyReport.MissingTokens)
+	}
+	if !verifyReport.OK() {
+		return errors.New("verification failed")
+	}
+	return nil
+}
+
+type opener struct {
+	keys               key_flags.Flags
+	fromRedis, toRedis string
+}
+
+func (o opener) open(spec string, readOnly bool) (store, func(), error) {
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok || path == "" {
+		return nil, nil, fmt.Errorf("invalid store %q, use file:PATH or sqlite:PATH", spec)
+	}
+	switch kind {
+	case "file":
+		opts, err := o.keys.StoreOptions()
+		if err != nil {
+			return nil, nil, err
+		}
+		if readOnly {
+			opts = append(opts, auth.WithReadOnly())
+		}
+		fileStore, err := auth.NewStoreImpl(path, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileStore, func() { fileStore.Close() }, nil
+	case "sqlite":
+		if readOnly {
+			if _, err := os.Stat(path); err != nil {
+				return nil, nil, fmt.Errorf("error opening the source database: %w", err)
+			}
+		}
+		db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening %s: %w", path, err)
+		}
+		sqlStore, err := auth.NewSQLStore(db, auth.SQLite)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return sqlStore, func() { sqlStore.Close(); db.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown kind of store %q, use file or sqlite", kind)
+	}
+}
+
+// progress prints the number of processed users to stderr at most once a second
+type progress struct {
+	action      string
+	lastPrinted time.Time
+}
+
+func newProgress(action string) *progress {
+	return &progress{action: action, lastPrinted: time.Now()}
+}
+
+func (p *progress) report(processed int) {
+	if time.Since(p.lastPrinted) >= time.Second {
+		p.lastPrinted = time.Now()
+		fmt.Fprintf(os.Stderr, "%s %d users...\n", p.action, processed)
+	}
+}
+
+func (p *progress) done(processed int) {
+	fmt.Fprintf(os.Stderr, "%s %d users\n", p.action, processed)
+}
+
+func printList(title string, usernames []string) {
+	if len(usernames) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n", title)
+	for _, username := range usernames {
+		fmt.Printf("  %s\n", username)
+	}
+}
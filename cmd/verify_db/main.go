@@ -0,0 +1,88 @@
+// Command verify_db scans a DB file and reports corrupt records, records referring to non existing users,
+// and ids, usernames, tokens or public ids shared by several users. It never modifies the file, so it can run alongside the service.
+//
+// Usage:
+//
+//	verify_db -db users.db [-keys-file keys.txt | -keys-env AUTH_DB_KEY_V]
+//
+// Keys are needed only for encrypted files. The exit code is 1 if any problems are found.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/k0marov/golang-auth/cmd/internal/key_flags"
+	"github.com/k0marov/golang-auth/internal/data/store/db_file_interactor_impl"
+)
+
+func main() {
+	db := flag.String("db", "", "path to the DB file")
+	keys := key_flags.Register("")
+	flag.Parse()
+	if *db == "" || !keys.Valid(false) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	report, err := run(*db, *keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printReport(report)
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func run(db string, keyFlags key_flags.Flags) (db_file_interactor_impl.VerifyReport, error) {
+	keys, err := keyFlags.Load()
+	if err != nil {
+		return db_file_interactor_impl.VerifyReport{}, err
+	}
+
+	dbFile, err := os.Open(db)
+	if err != nil {
+		return db_file_interactor_impl.VerifyReport{}, fmt.Errorf("error opening the DB file: %w", err)
+	}
+	defer dbFile.Close()
+	return db_file_interactor_impl.Verify(dbFile, keys)
+}
+
+func printReport(report db_file_interactor_impl.VerifyReport) {
+	fmt.Printf("format version: %d, records: %d\n", report.FormatVersion, report.Records)
+	if report.UncheckedRecords != 0 {
+		fmt.Printf("records without a checksum (appended by an older version): %d\n", report.UncheckedRecords)
+	}
+	printRecords("corrupt records", report.CorruptRecords)
+	printRecords("records referring to non existing users", report.DanglingRecords)
+	printDuplicates("duplicate ids", report.DuplicateIds)
+	printDuplicates("duplicate usernames", report.DuplicateUsernames)
+	printDuplicates("duplicate tokens", report.DuplicateTokens)
+	printDuplicates("duplicate public ids", report.DuplicatePublicIds)
+	if report.OK() {
+		fmt.Println("OK")
+	}
+}
+
+func printRecords(title string, records []db_file_interactor_impl.CorruptRecord) {
+	if len(records) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(records))
+	for _, record := range records {
+		fmt.Printf("  line %d: %v\n", record.Line, record.Err)
+	}
+}
+
+func printDuplicates(title string, duplicates []db_file_interactor_impl.Duplicate) {
+	if len(duplicates) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(duplicates))
+	for _, duplicate := range duplicates {
+		fmt.Printf("  %s: lines %v\n", duplicate.Value, duplicate.Lines)
+	}
+}
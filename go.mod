@@ -3,6 +3,6 @@ module github.com/k0marov/golang-auth
 go 1.18
 
 require (
-	github.com/google/uuid v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 )
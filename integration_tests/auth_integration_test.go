@@ -2,35 +2,66 @@ package auth_integration_test
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/k0marov/golang-auth/internal/core/client_errors"
+	"github.com/k0marov/golang-auth/internal/data/store"
 	"github.com/k0marov/golang-auth/internal/domain/entities"
 	. "github.com/k0marov/golang-auth/internal/test_helpers"
 	"github.com/k0marov/golang-auth/internal/values"
+	"github.com/k0marov/golang-auth/storetest"
 
 	auth "github.com/k0marov/golang-auth"
+	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuthIntegration(t *testing.T) {
-	tempDB, closeDB := CreateTempFile(t, "")
-	defer closeDB()
-	store, err := auth.NewStoreImpl(tempDB)
-	if err != nil {
-		t.Fatalf("error while opening a store: %v", err)
-	}
+	t.Run("file store", func(t *testing.T) {
+		tempDB, closeDB := CreateTempFile(t, "")
+		defer closeDB()
+		store, err := auth.NewStoreImpl(tempDB)
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		testAuthFlow(t, store)
+	})
+	t.Run("sql store", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+		if err != nil {
+			t.Fatalf("error while opening a db: %v", err)
+		}
+		defer db.Close()
+		store, err := auth.NewSQLStore(db, auth.SQLite)
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		defer store.Close()
+		testAuthFlow(t, store)
+	})
+	t.Run("custom store", func(t *testing.T) {
+		testAuthFlow(t, newMapStore())
+	})
+}
+
+func testAuthFlow(t *testing.T, store auth.Store) {
 	bcryptCost := 4
 	successRegistrationCount := 0
 	loginHandler, registerHandler := auth.NewHandlersImpl(store, bcryptCost, func(auth.User) {
 		successRegistrationCount++
 	})
-	if err != nil {
-		t.Fatalf("error while creating login/register handlers: %v", err)
-	}
 
 	handleRequest := func(userData values.AuthData, handler http.Handler) *httptest.ResponseRecorder {
 		body := bytes.NewBuffer(nil)
@@ -88,6 +119,572 @@ func TestAuthIntegration(t *testing.T) {
 	// check middleware with valid token
 	response = requestMiddleware(loginToken.Token)
 	assertSuccessAndValidUser(t, response, username)
+
+	changePasswordHandler := auth.NewChangePasswordHandler(store, bcryptCost, auth.WithPasswordHistory(2))
+	requestChangePassword := func(data values.ChangePasswordData) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(data)
+		response := httptest.NewRecorder()
+		changePasswordHandler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		return response
+	}
+	newPassword := "another_strong_password"
+
+	// change password and login with the new one
+	response = requestChangePassword(values.ChangePasswordData{Username: username, Password: string(passwordHashed), NewPassword: newPassword})
+	Assert(t, assertSuccessAndGetToken(t, response), loginToken, "the token returned from password change")
+	response = requestLogin(values.AuthData{Username: username, Password: newPassword})
+	assertSuccessAndGetToken(t, response)
+	response = requestLogin(values.AuthData{Username: username, Password: string(passwordHashed)})
+	assertClientError(t, response, client_errors.InvalidCredentialsError, http.StatusBadRequest)
+
+	// try to change password back to the previous one
+	response = requestChangePassword(values.ChangePasswordData{Username: username, Password: newPassword, NewPassword: string(passwordHashed)})
+	assertClientError(t, response, client_errors.PasswordReusedError, http.StatusBadRequest)
+}
+
+func TestStoreConformance(t *testing.T) {
+	t.Run("file store", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			dbFile := filepath.Join(t.TempDir(), "users.db")
+			return func() (auth.Store, error) {
+				return auth.NewStoreImpl(dbFile)
+			}
+		})
+	})
+	t.Run("file store with binary snapshots", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			dbFile := filepath.Join(t.TempDir(), "users.db")
+			return func() (auth.Store, error) {
+				// frequent compaction, so that the users are mostly read from binary snapshots
+				return auth.NewStoreImpl(dbFile, auth.WithBinarySnapshots(), auth.WithCompactionPolicy(auth.CompactionPolicy{MaxOperations: 5}))
+			}
+		})
+	})
+	t.Run("file store with public ids", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			dbFile := filepath.Join(t.TempDir(), "users.db")
+			return func() (auth.Store, error) {
+				return auth.NewStoreImpl(dbFile, auth.WithIdStrategy(auth.ULID), auth.WithBinarySnapshots(), auth.WithCompactionPolicy(auth.CompactionPolicy{MaxOperations: 5}))
+			}
+		})
+	})
+	t.Run("sql store", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db")+"?_busy_timeout=5000")
+			if err != nil {
+				t.Fatalf("error while opening a db: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return func() (auth.Store, error) {
+				return auth.NewSQLStore(db, auth.SQLite)
+			}
+		})
+	})
+	t.Run("sql store with public ids", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db")+"?_busy_timeout=5000")
+			if err != nil {
+				t.Fatalf("error while opening a db: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return func() (auth.Store, error) {
+				return auth.NewSQLStore(db, auth.SQLite, auth.WithSQLIdStrategy(auth.UUIDv7))
+			}
+		})
+	})
+	t.Run("custom store", func(t *testing.T) {
+		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+			store := newMapStore()
+			return func() (auth.Store, error) {
+				return store, nil
+			}
+		})
+	})
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	t.Run("file store", func(t *testing.T) {
+		tempDB, closeDB := CreateTempFile(t, "")
+		defer closeDB()
+		store, err := auth.NewStoreImpl(tempDB)
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		defer store.Close()
+		testConcurrentRegistration(t, store)
+	})
+	t.Run("sql store", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db")+"?_busy_timeout=5000")
+		if err != nil {
+			t.Fatalf("error while opening a db: %v", err)
+		}
+		defer db.Close()
+		store, err := auth.NewSQLStore(db, auth.SQLite)
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		defer store.Close()
+		testConcurrentRegistration(t, store)
+	})
+}
+
+// testConcurrentRegistration registers the same username from many goroutines, exactly one of them should succeed
+func testConcurrentRegistration(t *testing.T, store auth.Store) {
+	const goroutines = 20
+	var registered int32
+	_, registerHandler := auth.NewHandlersImpl(store, 4, func(auth.User) {
+		atomic.AddInt32(&registered, 1)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	responses := make([]*httptest.ResponseRecorder, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			body := bytes.NewBuffer(nil)
+			json.NewEncoder(body).Encode(values.AuthData{Username: "same_user", Password: "some_password"})
+			responses[i] = httptest.NewRecorder()
+			registerHandler.ServeHTTP(responses[i], httptest.NewRequest(http.MethodPost, "/", body))
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, response := range responses {
+		if response.Code == http.StatusOK {
+			succeeded++
+		} else {
+			assertClientError(t, response, client_errors.UsernameAlreadyTakenError, http.StatusBadRequest)
+		}
+	}
+	Assert(t, succeeded, 1, "number of successful registrations")
+	Assert(t, atomic.LoadInt32(&registered), int32(1), "number of calls to the register handler")
+}
+
+func TestImportedUsers(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	// django's pbkdf2_sha256 hash of "secret"
+	djangoHash := "pbkdf2_sha256$1000$somesalt$vqJqygf2tor+2oXl6lWino6yb6bhsvOKyvQv/Gi94uE="
+	report, err := auth.ImportUsers(store, []auth.ImportedUser{{Username: "django_user", PasswordHash: djangoHash}}, false)
+	AssertNoError(t, err)
+	Assert(t, report.Imported, 1, "number of imported users")
+
+	loginHandler, _ := auth.NewHandlersImpl(store, 4, func(auth.User) {})
+	login := func(password string) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(values.AuthData{Username: "django_user", Password: password})
+		response := httptest.NewRecorder()
+		loginHandler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		return response
+	}
+
+	assertClientError(t, login("wrong"), client_errors.InvalidCredentialsError, http.StatusBadRequest)
+	assertSuccessAndGetToken(t, login("secret"))
+
+	// after the first login the hash should be upgraded
+	AssertNoError(t, store.Close())
+	store, err = auth.NewStoreImpl(tempDB)
+	AssertNoError(t, err)
+	user, err := store.FindUser("django_user")
+	AssertNoError(t, err)
+	if user.StoredPass == djangoHash {
+		t.Error("the imported hash should have been upgraded after login")
+	}
+	loginHandler, _ = auth.NewHandlersImpl(store, 4, func(auth.User) {})
+	assertSuccessAndGetToken(t, login("secret"))
+}
+
+func TestStoreLocking(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	writer, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	_, register := auth.NewHandlersImpl(writer, 4, func(auth.User) {})
+	body := bytes.NewBuffer(nil)
+	json.NewEncoder(body).Encode(values.AuthData{Username: "some_user", Password: "some_password"})
+	register.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", body))
+
+	_, err = auth.NewStoreImpl(tempDB)
+	Assert(t, errors.Is(err, auth.ErrStoreLocked), true, "opening a locked store returns ErrStoreLocked")
+
+	readOnly, err := auth.NewStoreImpl(tempDB, auth.WithReadOnly())
+	AssertNoError(t, err)
+	Assert(t, readOnly.UserExists("some_user"), true, "user is visible in the read-only store")
+	_, err = readOnly.CreateUser("other_user", "pass", entities.Token{Token: "token"})
+	AssertError(t, err, auth.ErrStoreReadOnly)
+
+	AssertNoError(t, writer.Close())
+	writer, err = auth.NewStoreImpl(tempDB)
+	AssertNoError(t, err)
+	AssertNoError(t, writer.Close())
+}
+
+func TestFollowingStore(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	writer, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer writer.Close()
+	follower, err := auth.NewStoreImpl(tempDB, auth.WithFollowing(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while opening a following store: %v", err)
+	}
+	defer follower.Close()
+	lagMetric := fmt.Sprintf("test_replication_lag_seconds_%p", follower) // expvar names can't be reused
+	auth.PublishReplicationLag(lagMetric, follower)
+
+	_, register := auth.NewHandlersImpl(writer, 4, func(auth.User) {})
+	registerAndWait := func(username string) {
+		t.Helper()
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(values.AuthData{Username: username, Password: "some_password"})
+		response := httptest.NewRecorder()
+		register.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		token := assertSuccessAndGetToken(t, response)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			user, err := follower.FindUserFromToken(token.Token)
+			if err == nil {
+				Assert(t, user.Username, username, "username of the user found by the follower")
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the follower didn't see the registration of %s", username)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	registerAndWait("first_user")
+	AssertNoError(t, writer.Compact())
+	registerAndWait("second_user")
+	Assert(t, follower.UserExists("first_user"), true, "the first user is still visible after compaction")
+	Assert(t, expvar.Get(lagMetric).String(), "0", "published replication lag")
+}
+
+func TestBackupHandler(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer store.Close()
+	const adminToken = "some_admin_token"
+	backupHandler := auth.NewBackupHandler(store, adminToken)
+	_, register := auth.NewHandlersImpl(store, 4, func(auth.User) {})
+	registerUser := func(username string) {
+		t.Helper()
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(values.AuthData{Username: username, Password: "some_password"})
+		response := httptest.NewRecorder()
+		register.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		assertSuccessAndGetToken(t, response)
+	}
+	requestBackup := func(method string, body []byte) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/", bytes.NewReader(body))
+		request.Header.Set("Authorization", "Token "+adminToken)
+		response := httptest.NewRecorder()
+		backupHandler.ServeHTTP(response, request)
+		return response
+	}
+
+	registerUser("backed_up_user")
+	response := requestBackup(http.MethodGet, nil)
+	Assert(t, response.Code, http.StatusOK, "status code of taking a backup")
+	backup := response.Body.Bytes()
+	registerUser("later_user")
+
+	response = requestBackup(http.MethodPost, backup[:len(backup)/2])
+	Assert(t, response.Code, http.StatusBadRequest, "status code of restoring a truncated backup")
+	Assert(t, store.UserExists("later_user"), true, "the store is intact after an invalid backup")
+
+	response = requestBackup(http.MethodPost, backup)
+	Assert(t, response.Code, http.StatusNoContent, "status code of restoring a backup")
+	Assert(t, store.UserExists("backed_up_user"), true, "the backed up user exists")
+	Assert(t, store.UserExists("later_user"), false, "the user registered after the backup exists")
+
+	// the restored state should survive a restart
+	AssertNoError(t, store.Close())
+	store, err = auth.NewStoreImpl(tempDB)
+	AssertNoError(t, err)
+	Assert(t, store.UserExists("backed_up_user"), true, "the backed up user exists after a restart")
+	Assert(t, store.UserExists("later_user"), false, "the user registered after the backup exists after a restart")
+}
+
+func TestExportImport(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	fileStore, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer fileStore.Close()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("error while opening a db: %v", err)
+	}
+	defer db.Close()
+	sqlStore, err := auth.NewSQLStore(db, auth.SQLite)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer sqlStore.Close()
+
+	login := func(store auth.Store) *httptest.ResponseRecorder {
+		loginHandler, _ := auth.NewHandlersImpl(store, 4, func(auth.User) {})
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(values.AuthData{Username: "migrated_user", Password: "some_password"})
+		response := httptest.NewRecorder()
+		loginHandler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		return response
+	}
+	_, register := auth.NewHandlersImpl(fileStore, 4, func(auth.User) {})
+	body := bytes.NewBuffer(nil)
+	json.NewEncoder(body).Encode(values.AuthData{Username: "migrated_user", Password: "some_password"})
+	response := httptest.NewRecorder()
+	register.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+	token := assertSuccessAndGetToken(t, response)
+
+	export := bytes.NewBuffer(nil)
+	exported, err := auth.ExportUsers(export, fileStore, nil)
+	AssertNoError(t, err)
+	Assert(t, exported, 1, "number of exported users")
+	report, err := auth.ImportExportedUsers(bytes.NewReader(export.Bytes()), sqlStore, nil)
+	AssertNoError(t, err)
+	Assert(t, report.Imported, 1, "number of imported users")
+	verifyReport, err := auth.VerifyExportedUsers(bytes.NewReader(export.Bytes()), sqlStore)
+	AssertNoError(t, err)
+	Assert(t, verifyReport.OK(), true, "verification result")
+
+	// the session and the password survive the migration
+	user, err := sqlStore.FindUserFromToken(token.Token)
+	AssertNoError(t, err)
+	Assert(t, user.Username, "migrated_user", "owner of the migrated token")
+	assertSuccessAndGetToken(t, login(sqlStore))
+}
+
+func TestPublicIds(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	openFileStore := func(opts ...auth.StoreOption) *store.PersistentInMemoryFileStore {
+		fileStore, err := auth.NewStoreImpl(tempDB, opts...)
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		return fileStore
+	}
+	exposedUser := func(s auth.TokenStore, token string) (user auth.User) {
+		middleware := auth.NewTokenAuthMiddleware(s).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user = r.Context().Value(auth.UserContextKey).(auth.User)
+		}))
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Add("Authorization", "Token "+token)
+		middleware.ServeHTTP(httptest.NewRecorder(), request)
+		return user
+	}
+
+	// users created before public ids were enabled
+	fileStore := openFileStore()
+	existing := GenerateRandomUsers(2)
+	for _, user := range existing {
+		_, err := fileStore.CreateUser(user.Username, user.Password, user.Token)
+		AssertNoError(t, err)
+	}
+	Assert(t, exposedUser(fileStore, existing[0].Token.Token).Id, "1", "exposed id of an existing user")
+	fileStore.Close()
+
+	fileStore = openFileStore(auth.WithIdStrategy(auth.UUIDv7))
+	defer fileStore.Close()
+	newUser := GenerateRandomUser()
+	_, err := fileStore.CreateUser(newUser.Username, newUser.Password, newUser.Token)
+	AssertNoError(t, err)
+	newId := exposedUser(fileStore, newUser.Token.Token).Id
+	Assert(t, len(newId), 36, "length of the exposed UUID of a new user")
+	Assert(t, exposedUser(fileStore, existing[0].Token.Token).Id, "1", "exposed id of an existing user before the migration")
+
+	assigned, err := auth.AssignPublicIds(fileStore, auth.UUIDv7, nil)
+	AssertNoError(t, err)
+	Assert(t, assigned, 2, "number of users given public ids")
+	migratedId := exposedUser(fileStore, existing[0].Token.Token).Id
+	Assert(t, len(migratedId), 36, "length of the exposed UUID of a migrated user")
+	for _, id := range []string{migratedId, "1"} {
+		found, err := fileStore.FindUserById(id)
+		AssertNoError(t, err)
+		Assert(t, found.Username, existing[0].Username, "user found by id "+id)
+	}
+	_, err = fileStore.FindUserById("3")
+	AssertError(t, err, auth.ErrUserNotFound)
+
+	t.Run("the exposed ids should survive a migration to another store", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+		if err != nil {
+			t.Fatalf("error while opening a db: %v", err)
+		}
+		defer db.Close()
+		sqlStore, err := auth.NewSQLStore(db, auth.SQLite, auth.WithSQLIdStrategy(auth.UUIDv7))
+		if err != nil {
+			t.Fatalf("error while opening a store: %v", err)
+		}
+		defer sqlStore.Close()
+
+		export := bytes.NewBuffer(nil)
+		_, err = auth.ExportUsers(export, fileStore, nil)
+		AssertNoError(t, err)
+		report, err := auth.ImportExportedUsers(bytes.NewReader(export.Bytes()), sqlStore, nil)
+		AssertNoError(t, err)
+		Assert(t, len(report.IdConflicts), 0, "number of id conflicts")
+		verifyReport, err := auth.VerifyExportedUsers(bytes.NewReader(export.Bytes()), sqlStore)
+		AssertNoError(t, err)
+		Assert(t, verifyReport.OK(), true, "verification result")
+
+		Assert(t, exposedUser(sqlStore, existing[0].Token.Token).Id, migratedId, "exposed id of a migrated user")
+		Assert(t, exposedUser(sqlStore, newUser.Token.Token).Id, newId, "exposed id of a new user")
+		found, err := sqlStore.FindUserById("1")
+		AssertNoError(t, err)
+		Assert(t, found.Username, existing[0].Username, "user found by the legacy id")
+	})
+}
+
+func TestLoginAfterLogout(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer store.Close()
+	loginHandler, registerHandler := auth.NewHandlersImpl(store, 4, func(auth.User) {})
+	handleRequest := func(userData values.AuthData, handler http.Handler) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(userData)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		return response
+	}
+	middleware := auth.NewTokenAuthMiddleware(store).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	requestMiddleware := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Add("Authorization", "Token "+token)
+		response := httptest.NewRecorder()
+		middleware.ServeHTTP(response, request)
+		return response
+	}
+
+	authData := values.AuthData{Username: "sam_komarov", Password: "very_strong_password"}
+	registerToken := assertSuccessAndGetToken(t, handleRequest(authData, registerHandler))
+	// logout
+	AssertNoError(t, store.RemoveToken(registerToken.Token))
+	assertClientError(t, requestMiddleware(registerToken.Token), client_errors.AuthTokenInvalidError, http.StatusUnauthorized)
+
+	loginToken := assertSuccessAndGetToken(t, handleRequest(authData, loginHandler))
+	Assert(t, loginToken.Token != "" && loginToken != registerToken, true, "login issued a new token")
+	Assert(t, requestMiddleware(loginToken.Token).Code, http.StatusOK, "status code with the new token")
+	assertClientError(t, requestMiddleware(registerToken.Token), client_errors.AuthTokenInvalidError, http.StatusUnauthorized)
+	Assert(t, assertSuccessAndGetToken(t, handleRequest(authData, loginHandler)), loginToken, "the token returned from the next login")
+}
+
+func TestCachingTokenStore(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer store.Close()
+	cache := auth.NewCachingTokenStore(store, auth.WithTokenCacheTTL(time.Hour))
+	middleware := auth.NewTokenAuthMiddleware(cache).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	requestMiddleware := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Add("Authorization", "Token "+token)
+		response := httptest.NewRecorder()
+		middleware.ServeHTTP(response, request)
+		return response
+	}
+
+	user := GenerateRandomUser()
+	_, err = store.CreateUser(user.Username, user.Password, user.Token)
+	AssertNoError(t, err)
+	Assert(t, requestMiddleware(user.Token.Token).Code, http.StatusOK, "status code with a valid token")
+	Assert(t, cache.Len(), 1, "number of cached tokens")
+
+	// revocation is visible immediately, since the cache is hooked to the file store
+	AssertNoError(t, store.RemoveToken(user.Token.Token))
+	assertClientError(t, requestMiddleware(user.Token.Token), client_errors.AuthTokenInvalidError, http.StatusUnauthorized)
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer store.Close()
+	server := NewFakeRESPServer(t)
+	server.SetPassword("redis_password")
+	tokens := auth.NewRedisTokenStore(server.Addr, store, auth.WithRedisPassword("redis_password"), auth.WithRedisKeyPrefix("app:token:"))
+	defer tokens.Close()
+
+	loginHandler, registerHandler := auth.NewHandlersImpl(store, 4, func(auth.User) {}, auth.WithTokenIssuer(tokens))
+	handleRequest := func(userData values.AuthData, handler http.Handler) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(userData)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		return response
+	}
+	middleware := auth.NewTokenAuthMiddleware(tokens).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	requestMiddleware := func(token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Add("Authorization", "Token "+token)
+		response := httptest.NewRecorder()
+		middleware.ServeHTTP(response, request)
+		return response
+	}
+
+	authData := values.AuthData{Username: "sam_komarov", Password: "very_strong_password"}
+	registerToken := assertSuccessAndGetToken(t, handleRequest(authData, registerHandler))
+	loginToken := assertSuccessAndGetToken(t, handleRequest(authData, loginHandler))
+	Assert(t, registerToken != loginToken, true, "every login issues a new token")
+	for _, token := range []auth.Token{registerToken, loginToken} {
+		owner, exists := server.Get("app:token:" + token.Token)
+		Assert(t, exists, true, "token is stored in the server")
+		Assert(t, strings.HasSuffix(owner, ":"+authData.Username), true, "the owner of the token is the user")
+		Assert(t, requestMiddleware(token.Token).Code, http.StatusOK, "status code with a valid token")
+	}
+
+	// logging out with one token doesn't affect the others
+	AssertNoError(t, tokens.DeleteToken(loginToken.Token))
+	assertClientError(t, requestMiddleware(loginToken.Token), client_errors.AuthTokenInvalidError, http.StatusUnauthorized)
+	Assert(t, requestMiddleware(registerToken.Token).Code, http.StatusOK, "status code with another token")
+}
+
+func TestNewHandlersImpl_InvalidHashCost(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	store, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected NewHandlersImpl to panic on an invalid hash cost")
+		}
+	}()
+	auth.NewHandlersImpl(store, 10000, func(auth.User) {})
 }
 
 func assertSuccessAndValidUser(t testing.TB, response *httptest.ResponseRecorder, username string) {
@@ -113,3 +710,124 @@ func assertClientError(t testing.TB, response *httptest.ResponseRecorder, error
 	json.NewDecoder(response.Result().Body).Decode(&gotError)
 	Assert(t, gotError, error, "response client error")
 }
+
+// mapStore is a store, which an application could write using only the public types of the package
+type mapStore struct {
+	mu     sync.Mutex
+	users  map[string]auth.UserModel
+	tokens map[string]string
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{users: map[string]auth.UserModel{}, tokens: map[string]string{}}
+}
+
+func (m *mapStore) UserExists(username string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.users[username]
+	return exists
+}
+
+func (m *mapStore) CreateUser(username, storedPassword string, token auth.Token) (auth.UserModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[username]; exists {
+		return auth.UserModel{}, auth.ErrUsernameTaken
+	}
+	if _, exists := m.tokens[token.Token]; exists {
+		return auth.UserModel{}, auth.ErrTokenTaken
+	}
+	user := auth.UserModel{Id: len(m.users) + 1, Username: username, StoredPass: storedPassword, AuthToken: token}
+	m.users[username] = user
+	m.tokens[token.Token] = username
+	return user, nil
+}
+
+func (m *mapStore) FindUser(username string) (auth.UserModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return auth.UserModel{}, auth.ErrUserNotFound
+	}
+	user.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return user, nil
+}
+
+func (m *mapStore) UpdatePassword(username, storedPassword string, passwordHistory []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return auth.ErrUserNotFound
+	}
+	user.StoredPass = storedPassword
+	user.PasswordHistory = append([]string(nil), passwordHistory...)
+	m.users[username] = user
+	return nil
+}
+
+func (m *mapStore) FindUserFromToken(token string) (auth.UserModel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	username, exists := m.tokens[token]
+	if !exists {
+		return auth.UserModel{}, auth.ErrTokenNotFound
+	}
+	user := m.users[username]
+	user.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return user, nil
+}
+
+func TestExportImportRedisTokens(t *testing.T) {
+	tempDB, closeDB := CreateTempFile(t, "")
+	defer closeDB()
+	fileStore, err := auth.NewStoreImpl(tempDB)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer fileStore.Close()
+	sourceTokens := auth.NewRedisTokenStore(NewFakeRESPServer(t).Addr, fileStore)
+	defer sourceTokens.Close()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("error while opening a db: %v", err)
+	}
+	defer db.Close()
+	sqlStore, err := auth.NewSQLStore(db, auth.SQLite)
+	if err != nil {
+		t.Fatalf("error while opening a store: %v", err)
+	}
+	defer sqlStore.Close()
+	destinationTokens := auth.NewRedisTokenStore(NewFakeRESPServer(t).Addr, sqlStore)
+	defer destinationTokens.Close()
+
+	loginHandler, registerHandler := auth.NewHandlersImpl(fileStore, 4, func(auth.User) {}, auth.WithTokenIssuer(sourceTokens))
+	var sessions []auth.Token
+	for _, handler := range []http.Handler{registerHandler, loginHandler} {
+		body := bytes.NewBuffer(nil)
+		json.NewEncoder(body).Encode(values.AuthData{Username: "migrated_user", Password: "some_password"})
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/", body))
+		sessions = append(sessions, assertSuccessAndGetToken(t, response))
+	}
+
+	export := bytes.NewBuffer(nil)
+	_, err = auth.ExportUsers(export, fileStore, nil, auth.WithExportTokenStore(sourceTokens))
+	AssertNoError(t, err)
+	report, err := auth.ImportExportedUsers(bytes.NewReader(export.Bytes()), sqlStore, nil, auth.WithExportTokenStore(destinationTokens))
+	AssertNoError(t, err)
+	Assert(t, report.ImportedTokens, 2, "number of imported tokens")
+	verifyReport, err := auth.VerifyExportedUsers(bytes.NewReader(export.Bytes()), sqlStore, auth.WithExportTokenStore(destinationTokens))
+	AssertNoError(t, err)
+	Assert(t, verifyReport.CheckedTokens, 2, "number of checked tokens")
+	Assert(t, verifyReport.OK(), true, "verification result")
+
+	// every session survives the migration
+	for _, session := range sessions {
+		user, err := destinationTokens.FindUserFromToken(session.Token)
+		AssertNoError(t, err)
+		Assert(t, user.Username, "migrated_user", "owner of the migrated token")
+	}
+}
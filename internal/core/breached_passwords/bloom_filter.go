@@ -0,0 +1,161 @@
+package breached_passwords
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// BloomFilter is a compact probabilistic set of breached password hashes.
+// It never gives false negatives, and gives false positives with the rate it was built for.
+// A filter for the whole HIBP dataset (~850M hashes) with 0.1% false positive rate takes about 1.5 GB,
+// so it is recommended to build it only from hashes with some minimum breach count.
+type BloomFilter struct {
+	bits      []uint64
+	numBits   uint64
+	numHashes uint32
+}
+
+var ErrInvalidFalsePositiveRate = errors.New("the false positive rate must be between 0 and 1")
+
+// NewBloomFilter creates an empty filter sized for expectedCount elements with the given false positive rate
+func NewBloomFilter(expectedCount int, falsePositiveRate float64) (*BloomFilter, error) {
+	// written this way to also reject NaN
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return nil, fmt.Errorf("%w: got %v", ErrInvalidFalsePositiveRate, falsePositiveRate)
+	}
+	if expectedCount < 1 {
+		expectedCount = 1
+	}
+	numBits := uint64(math.Ceil(-float64(expectedCount) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	numHashes := uint32(math.Round(float64(numBits) / float64(expectedCount) * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	return newBloomFilter(numBits, numHashes), nil
+}
+
+func newBloomFilter(numBits uint64, numHashes uint32) *BloomFilter {
+	return &BloomFilter{
+		bits:      make([]uint64, (numBits+63)/64),
+		numBits:   numBits,
+		numHashes: numHashes,
+	}
+}
+
+// AddHash adds a hex encoded SHA-1 hash (see PasswordHash) to the filter
+func (b *BloomFilter) AddHash(hash string) error {
+	h1, h2, err := splitHash(hash)
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < b.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.numBits
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	return nil
+}
+
+func (b *BloomFilter) IsBreached(password string) (bool, error) {
+	h1, h2, err := splitHash(PasswordHash(password))
+	if err != nil {
+		return false, err
+	}
+	for i := uint32(0); i < b.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.numBits
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// the hashed passwords are already uniformly distributed,
+// so parts of the SHA-1 itself are used for double hashing
+func splitHash(hash string) (h1, h2 uint64, err error) {
+	sum, err := hex.DecodeString(hash)
+	if err != nil || len(sum) != sha1HexLength/2 {
+		return 0, 0, fmt.Errorf("invalid SHA-1 hash: %s", hash)
+	}
+	h1 = binary.BigEndian.Uint64(sum[0:8])
+	h2 = binary.BigEndian.Uint64(sum[8:16]) | 1 // odd, so that the probes don't collapse
+	return h1, h2, nil
+}
+
+// The filter file consists of a header (magic, numBits, numHashes), followed by the bit set, all in big endian
+var filterMagic = [4]byte{'B', 'P', 'B', 'F'}
+
+const filterHeaderSize = len(filterMagic) + 8 + 4
+
+var ErrInvalidFilterFile = errors.New("not a breached passwords filter file")
+
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bufWriter := bufio.NewWriter(w)
+	counter := &countingWriter{w: bufWriter}
+	header := []any{filterMagic, b.numBits, b.numHashes}
+	for _, field := range header {
+		if err := binary.Write(counter, binary.BigEndian, field); err != nil {
+			return counter.count, fmt.Errorf("error writing filter header: %w", err)
+		}
+	}
+	if err := binary.Write(counter, binary.BigEndian, b.bits); err != nil {
+		return counter.count, fmt.Errorf("error writing filter bits: %w", err)
+	}
+	return counter.count, bufWriter.Flush()
+}
+
+// ReadBloomFilter reads a filter written by WriteTo, size is the length of the input (e.g. of the file).
+// The size of the bit set in the header is checked against it before allocating, so that a corrupt header can't make it allocate too much.
+func ReadBloomFilter(r io.Reader, size int64) (*BloomFilter, error) {
+	bufReader := bufio.NewReader(r)
+	var magic [4]byte
+	var numBits uint64
+	var numHashes uint32
+	for _, field := range []any{&magic, &numBits, &numHashes} {
+		if err := binary.Read(bufReader, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("error reading filter header: %w", err)
+		}
+	}
+	if magic != filterMagic || numBits == 0 || numHashes == 0 {
+		return nil, ErrInvalidFilterFile
+	}
+	// checking numBits against the size first also keeps rounding it up from overflowing
+	bitsSize := size - int64(filterHeaderSize)
+	if bitsSize <= 0 || numBits > uint64(bitsSize)*8 || (numBits+63)/64*8 != uint64(bitsSize) {
+		return nil, fmt.Errorf("%w: the size of the bit set doesn't match the size of the file", ErrInvalidFilterFile)
+	}
+	filter := newBloomFilter(numBits, numHashes)
+	if err := binary.Read(bufReader, binary.BigEndian, filter.bits); err != nil {
+		return nil, fmt.Errorf("error reading filter bits: %w", err)
+	}
+	return filter, nil
+}
+
+func LoadBloomFilter(fileName string) (*BloomFilter, error) {
+	filterFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening filter file: %w", err)
+	}
+	defer filterFile.Close()
+	info, err := filterFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the size of the filter file: %w", err)
+	}
+	return ReadBloomFilter(filterFile, info.Size())
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
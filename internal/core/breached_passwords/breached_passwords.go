@@ -0,0 +1,38 @@
+package breached_passwords
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/k0marov/golang-auth/internal/core/client_errors"
+)
+
+// PasswordHash returns the uppercase hex encoded SHA-1 of the password,
+// which is the format used by the Have I Been Pwned datasets
+func PasswordHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// rangePrefixLength is the length of hash prefixes used for naming range files in HIBP datasets
+const rangePrefixLength = 5
+
+type Checker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// NewPasswordCheck adapts a Checker for usage as a password check in the auth service
+func NewPasswordCheck(checker Checker) func(password string) error {
+	return func(password string) error {
+		breached, err := checker.IsBreached(password)
+		if err != nil {
+			return fmt.Errorf("error while checking if password is breached: %w", err)
+		}
+		if breached {
+			return client_errors.PasswordBreachedError
+		}
+		return nil
+	}
+}
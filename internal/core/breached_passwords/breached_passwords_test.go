@@ -0,0 +1,165 @@
+package breached_passwords_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/core/breached_passwords"
+	"github.com/k0marov/golang-auth/internal/core/client_errors"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestPasswordHash(t *testing.T) {
+	// well known SHA-1 of "password"
+	Assert(t, breached_passwords.PasswordHash("password"), "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8", "SHA-1 of password")
+}
+
+func TestHIBPRangeDataset(t *testing.T) {
+	dir := t.TempDir()
+	breached := []string{"password", "123456", "qwerty"}
+	writeRangeFiles(t, dir, breached)
+
+	dataset, err := breached_passwords.NewHIBPRangeDataset(dir)
+	AssertNoError(t, err)
+	for _, pass := range breached {
+		isBreached, err := dataset.IsBreached(pass)
+		AssertNoError(t, err)
+		Assert(t, isBreached, true, "IsBreached("+pass+")")
+	}
+	for i := 0; i < 100; i++ {
+		isBreached, err := dataset.IsBreached(RandomString() + RandomString())
+		AssertNoError(t, err)
+		Assert(t, isBreached, false, "IsBreached() of a random password")
+	}
+
+	t.Run("error cases", func(t *testing.T) {
+		_, err := breached_passwords.NewHIBPRangeDataset(filepath.Join(dir, "not-existing"))
+		AssertSomeError(t, err)
+
+		corruptedDir := t.TempDir()
+		hash := breached_passwords.PasswordHash("password")
+		os.WriteFile(filepath.Join(corruptedDir, hash[:5]+".txt"), []byte("not a hash\n"), 0644)
+		dataset, err := breached_passwords.NewHIBPRangeDataset(corruptedDir)
+		AssertNoError(t, err)
+		_, err = dataset.IsBreached("password")
+		AssertSomeError(t, err)
+	})
+}
+
+func TestBloomFilter(t *testing.T) {
+	breached := []string{}
+	for i := 0; i < 1000; i++ {
+		breached = append(breached, fmt.Sprintf("breached-%d", i))
+	}
+	filter, err := breached_passwords.NewBloomFilter(len(breached), 0.01)
+	AssertNoError(t, err)
+	for _, pass := range breached {
+		AssertNoError(t, filter.AddHash(breached_passwords.PasswordHash(pass)))
+	}
+	assertNoFalseNegatives := func(t testing.TB, filter *breached_passwords.BloomFilter) {
+		t.Helper()
+		for _, pass := range breached {
+			isBreached, err := filter.IsBreached(pass)
+			AssertNoError(t, err)
+			AssertFatal(t, isBreached, true, "IsBreached("+pass+")")
+		}
+	}
+
+	t.Run("should never give false negatives", func(t *testing.T) {
+		assertNoFalseNegatives(t, filter)
+	})
+	t.Run("should give false positives at roughly the configured rate", func(t *testing.T) {
+		const checks = 10000
+		falsePositives := 0
+		for i := 0; i < checks; i++ {
+			isBreached, _ := filter.IsBreached(fmt.Sprintf("not-breached-%d", i))
+			if isBreached {
+				falsePositives++
+			}
+		}
+		if falsePositives > checks*3/100 {
+			t.Errorf("too many false positives: %d out of %d", falsePositives, checks)
+		}
+	})
+	t.Run("should survive writing and reading", func(t *testing.T) {
+		buf := bytes.NewBuffer(nil)
+		_, err := filter.WriteTo(buf)
+		AssertNoError(t, err)
+		readFilter, err := breached_passwords.ReadBloomFilter(buf, int64(buf.Len()))
+		AssertNoError(t, err)
+		Assert(t, readFilter, filter, "read filter")
+		assertNoFalseNegatives(t, readFilter)
+	})
+	t.Run("should reject invalid files", func(t *testing.T) {
+		notFilter := "abracadabra, this is not a filter"
+		_, err := breached_passwords.ReadBloomFilter(strings.NewReader(notFilter), int64(len(notFilter)))
+		AssertError(t, err, breached_passwords.ErrInvalidFilterFile)
+		_, err = breached_passwords.ReadBloomFilter(strings.NewReader(""), 0)
+		AssertSomeError(t, err)
+
+		buf := bytes.NewBuffer(nil)
+		_, err = filter.WriteTo(buf)
+		AssertNoError(t, err)
+		written := buf.Bytes()
+		truncated := written[:len(written)-8]
+		_, err = breached_passwords.ReadBloomFilter(bytes.NewReader(truncated), int64(len(truncated)))
+		Assert(t, errors.Is(err, breached_passwords.ErrInvalidFilterFile), true, "error of a truncated file is ErrInvalidFilterFile")
+		// a header claiming a huge bit set mustn't make it allocate the bit set
+		huge := append([]byte{}, written...)
+		binary.BigEndian.PutUint64(huge[4:12], 1<<62)
+		_, err = breached_passwords.ReadBloomFilter(bytes.NewReader(huge), int64(len(huge)))
+		Assert(t, errors.Is(err, breached_passwords.ErrInvalidFilterFile), true, "error of a file with a huge bit set is ErrInvalidFilterFile")
+	})
+	t.Run("should reject invalid false positive rates", func(t *testing.T) {
+		for _, rate := range []float64{0, 1, -0.5, 2, math.NaN()} {
+			_, err := breached_passwords.NewBloomFilter(10, rate)
+			Assert(t, errors.Is(err, breached_passwords.ErrInvalidFalsePositiveRate), true, fmt.Sprintf("error for rate %v is ErrInvalidFalsePositiveRate", rate))
+		}
+	})
+	t.Run("should reject invalid hashes", func(t *testing.T) {
+		AssertSomeError(t, filter.AddHash("abracadabra"))
+	})
+}
+
+func TestNewPasswordCheck(t *testing.T) {
+	check := breached_passwords.NewPasswordCheck(stubChecker(func(pass string) (bool, error) {
+		return pass == "breached", nil
+	}))
+	AssertError(t, check("breached"), client_errors.PasswordBreachedError)
+	AssertNoError(t, check(RandomString()))
+
+	errorCheck := breached_passwords.NewPasswordCheck(stubChecker(func(string) (bool, error) {
+		return false, errors.New(RandomString())
+	}))
+	err := errorCheck(RandomString())
+	AssertSomeError(t, err)
+	if _, isClientErr := err.(client_errors.ClientError); isClientErr {
+		t.Error("checker errors shouldn't be converted to client errors")
+	}
+}
+
+type stubChecker func(string) (bool, error)
+
+func (s stubChecker) IsBreached(pass string) (bool, error) {
+	return s(pass)
+}
+
+func writeRangeFiles(t testing.TB, dir string, passwords []string) {
+	t.Helper()
+	ranges := map[string][]string{}
+	for _, pass := range passwords {
+		hash := breached_passwords.PasswordHash(pass)
+		ranges[hash[:5]] = append(ranges[hash[:5]], hash[5:]+":42")
+	}
+	for prefix, lines := range ranges {
+		err := os.WriteFile(filepath.Join(dir, prefix+".txt"), []byte(strings.Join(lines, "\r\n")), 0644)
+		AssertNoError(t, err)
+	}
+}
@@ -0,0 +1,90 @@
+package breached_passwords
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// HIBPRangeDataset checks passwords against a local copy of the Have I Been Pwned range dataset,
+// i.e. a directory with files named {first 5 chars of SHA-1}.txt, each containing lines of the form {rest of SHA-1}:{count}.
+// Such a directory can be downloaded with the official PwnedPasswordsDownloader.
+// Only one range file is read per check, so the dataset is never fully loaded into memory.
+type HIBPRangeDataset struct {
+	dir string
+}
+
+func NewHIBPRangeDataset(dir string) (*HIBPRangeDataset, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening HIBP dataset directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("HIBP dataset path %s is not a directory", dir)
+	}
+	return &HIBPRangeDataset{dir: dir}, nil
+}
+
+func (h *HIBPRangeDataset) IsBreached(password string) (bool, error) {
+	hash := PasswordHash(password)
+	prefix, suffix := hash[:rangePrefixLength], hash[rangePrefixLength:]
+
+	rangeFile, err := os.Open(filepath.Join(h.dir, prefix+".txt"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error opening HIBP range file: %w", err)
+	}
+	defer rangeFile.Close()
+
+	found := false
+	err = ReadHashes(rangeFile, prefix, func(hash string, _ int) bool {
+		if hash[rangePrefixLength:] == suffix {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found, err
+}
+
+// ReadHashes reads lines of the form {hash}:{count} from r, prepending hashPrefix to each hash.
+// For full HIBP dumps the prefix should be empty, for range files it is the name of the file.
+// Reading stops early if onHash returns false.
+func ReadHashes(r io.Reader, hashPrefix string, onHash func(hash string, count int) bool) error {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		hash, countStr, found := strings.Cut(line, ":")
+		count := 1
+		if found {
+			var err error
+			count, err = strconv.Atoi(countStr)
+			if err != nil {
+				return fmt.Errorf("invalid count on line %d of HIBP data: %w", lineNum, err)
+			}
+		}
+		hash = hashPrefix + strings.ToUpper(hash)
+		if len(hash) != sha1HexLength {
+			return fmt.Errorf("invalid SHA-1 hash on line %d of HIBP data: %s", lineNum, hash)
+		}
+		if !onHash(hash, count) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading HIBP data: %w", err)
+	}
+	return nil
+}
+
+const sha1HexLength = 40
@@ -38,3 +38,33 @@ var AuthTokenInvalidError = ClientError{
 	DetailCode:     "token-invalid",
 	ReadableDetail: "The Auth token you provided is invalid (maybe it has expired).",
 }
+
+var PasswordBreachedError = ClientError{
+	DetailCode:     "password-breached",
+	ReadableDetail: "This password has appeared in a known data breach, please choose a different one.",
+}
+
+var PasswordReusedError = ClientError{
+	DetailCode:     "password-reused",
+	ReadableDetail: "The new password can't be the same as one of your recent passwords.",
+}
+
+var PasswordTooLongError = ClientError{
+	DetailCode:     "password-too-long",
+	ReadableDetail: "Password is too long. Passwords can be at most 1024 bytes long.",
+}
+
+var AdminTokenInvalidError = ClientError{
+	DetailCode:     "admin-token-invalid",
+	ReadableDetail: "The token you provided doesn't grant access to this admin resource.",
+}
+
+var BackupInvalidError = ClientError{
+	DetailCode:     "backup-invalid",
+	ReadableDetail: "The provided backup is invalid, nothing was restored.",
+}
+
+var BackupTooLargeError = ClientError{
+	DetailCode:     "backup-too-large",
+	ReadableDetail: "The provided backup is bigger than this server accepts, nothing was restored.",
+}
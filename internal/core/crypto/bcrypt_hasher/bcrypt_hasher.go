@@ -1,8 +1,13 @@
 package bcrypt_hasher
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -15,15 +20,81 @@ func NewBcryptHasher(hashCost int) *BcryptHasher {
 	return &BcryptHasher{hashCost: hashCost}
 }
 
+// MinSafeCost is the lowest cost which is considered safe for production usage
+const MinSafeCost = 10
+
+var ErrInvalidCost = fmt.Errorf("bcrypt cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+func ValidateCost(hashCost int) error {
+	if hashCost < bcrypt.MinCost || hashCost > bcrypt.MaxCost {
+		return fmt.Errorf("got cost %d: %w", hashCost, ErrInvalidCost)
+	}
+	return nil
+}
+
+// CalibrateCost benchmarks hashing on this machine and returns the highest cost,
+// for which hashing a password takes less than targetLatency (but not less than bcrypt.MinCost).
+// Since every next cost is twice as slow, calibration itself takes up to 2*targetLatency.
+func CalibrateCost(targetLatency time.Duration) int {
+	cost := bcrypt.MinCost
+	for cost < bcrypt.MaxCost {
+		start := time.Now()
+		bcrypt.GenerateFromPassword([]byte(prehash("calibration password")), cost+1)
+		if time.Since(start) > targetLatency {
+			break
+		}
+		cost++
+	}
+	return cost
+}
+
+// bcrypt only uses the first 72 bytes of the password (newer versions of x/crypto even reject longer ones),
+// so passwords are pre-hashed with HMAC-SHA256 and base64 encoded (44 bytes) before passing them to bcrypt.
+// Such hashes are prefixed with prehashPrefix, hashes without it are plain bcrypt hashes created before pre-hashing was introduced.
+const prehashPrefix = "$bcrypt-sha256$"
+
+// prehashKey is not a secret, it only separates this usage of HMAC from any other (for secrets see peppered_hasher)
+var prehashKey = []byte("golang-auth bcrypt prehash")
+
 func (b BcryptHasher) Hash(pass string) (string, error) {
-	hashedPassBytes, err := bcrypt.GenerateFromPassword([]byte(pass), b.hashCost)
+	hashedPassBytes, err := bcrypt.GenerateFromPassword([]byte(prehash(pass)), b.hashCost)
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("hashing failed: %v", err))
 	}
-	return string(hashedPassBytes), nil
+	return prehashPrefix + string(hashedPassBytes), nil
 }
 
 func (b BcryptHasher) Compare(pass, hashedPass string) bool {
+	if bcryptHash, prehashed := cutPrehashPrefix(hashedPass); prehashed {
+		return bcrypt.CompareHashAndPassword([]byte(bcryptHash), []byte(prehash(pass))) == nil
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPass), []byte(pass))
 	return err == nil
 }
+
+// NeedsRehash returns true if the hash was created with a different cost than the one this hasher uses,
+// or if it was created without pre-hashing
+func (b BcryptHasher) NeedsRehash(hashedPass string) bool {
+	bcryptHash, prehashed := cutPrehashPrefix(hashedPass)
+	if !prehashed {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(bcryptHash))
+	if err != nil {
+		return true
+	}
+	return cost != b.hashCost
+}
+
+func prehash(pass string) string {
+	mac := hmac.New(sha256.New, prehashKey)
+	mac.Write([]byte(pass))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutPrehashPrefix(hashedPass string) (bcryptHash string, prehashed bool) {
+	if !strings.HasPrefix(hashedPass, prehashPrefix) {
+		return hashedPass, false
+	}
+	return strings.TrimPrefix(hashedPass, prehashPrefix), true
+}
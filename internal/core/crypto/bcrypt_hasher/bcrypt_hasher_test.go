@@ -1,11 +1,14 @@
 package bcrypt_hasher_test
 
 import (
+	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/k0marov/golang-auth/internal/core/crypto/bcrypt_hasher"
 	. "github.com/k0marov/golang-auth/internal/test_helpers"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestBcryptHasher(t *testing.T) {
@@ -38,4 +41,48 @@ func TestBcryptHasher(t *testing.T) {
 		_, err := hasher.Hash(RandomString())
 		AssertSomeError(t, err)
 	})
+	t.Run("should not truncate long passphrases", func(t *testing.T) {
+		hasher := bcrypt_hasher.NewBcryptHasher(4)
+		commonPrefix := strings.Repeat("a", 100)
+		hashed, err := hasher.Hash(commonPrefix + "first")
+		AssertNoError(t, err)
+		Assert(t, hasher.Compare(commonPrefix+"first", hashed), true, "comparing with the same long passphrase")
+		Assert(t, hasher.Compare(commonPrefix+"second", hashed), false, "comparing with a passphrase with the same prefix")
+	})
+	t.Run("should accept hashes created without pre-hashing, but ask to rehash them", func(t *testing.T) {
+		hasher := bcrypt_hasher.NewBcryptHasher(4)
+		pass := RandomString()
+		legacyHash, err := bcrypt.GenerateFromPassword([]byte(pass), 4)
+		AssertNoError(t, err)
+		Assert(t, hasher.Compare(pass, string(legacyHash)), true, "comparing with a legacy hash")
+		Assert(t, hasher.Compare(RandomString()+"x", string(legacyHash)), false, "comparing a wrong password with a legacy hash")
+		Assert(t, hasher.NeedsRehash(string(legacyHash)), true, "NeedsRehash() of a legacy hash")
+	})
+	t.Run("NeedsRehash() should compare cost of the hash with the configured one", func(t *testing.T) {
+		hashed, err := bcrypt_hasher.NewBcryptHasher(4).Hash(RandomString())
+		AssertNoError(t, err)
+		Assert(t, bcrypt_hasher.NewBcryptHasher(4).NeedsRehash(hashed), false, "NeedsRehash() with the same cost")
+		Assert(t, bcrypt_hasher.NewBcryptHasher(5).NeedsRehash(hashed), true, "NeedsRehash() with a different cost")
+		Assert(t, bcrypt_hasher.NewBcryptHasher(4).NeedsRehash(RandomString()), true, "NeedsRehash() of a non bcrypt hash")
+	})
+	t.Run("ValidateCost()", func(t *testing.T) {
+		AssertNoError(t, bcrypt_hasher.ValidateCost(bcrypt.MinCost))
+		AssertNoError(t, bcrypt_hasher.ValidateCost(bcrypt.MaxCost))
+		AssertSomeError(t, bcrypt_hasher.ValidateCost(bcrypt.MinCost-1))
+		AssertSomeError(t, bcrypt_hasher.ValidateCost(10000))
+	})
+	t.Run("CalibrateCost()", func(t *testing.T) {
+		Assert(t, bcrypt_hasher.CalibrateCost(0), bcrypt.MinCost, "cost calibrated for zero latency")
+
+		const target = 30 * time.Millisecond
+		cost := bcrypt_hasher.CalibrateCost(target)
+		AssertNoError(t, bcrypt_hasher.ValidateCost(cost))
+		start := time.Now()
+		_, err := bcrypt_hasher.NewBcryptHasher(cost).Hash(RandomString())
+		AssertNoError(t, err)
+		// generous bound, so that the test is not flaky on a loaded machine
+		if elapsed := time.Since(start); cost > bcrypt.MinCost && elapsed > 10*target {
+			t.Errorf("hashing with calibrated cost %d took %v, target was %v", cost, elapsed, target)
+		}
+	})
 }
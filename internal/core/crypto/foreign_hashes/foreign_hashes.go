@@ -0,0 +1,185 @@
+package foreign_hashes
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+type Hasher interface {
+	Hash(password string) (string, error)
+	Compare(pass, hashedPass string) bool
+	NeedsRehash(hashedPass string) bool
+}
+
+// UpgradingHasher accepts password hashes imported from other systems and asks to rehash them with the current hasher,
+// so that they are upgraded on the first successful login. The supported foreign formats are:
+//   - pbkdf2_sha256${iterations}${salt}${base64 hash} (Django)
+//   - scrypt${N}${salt}${r}${p}${base64 hash} (Django)
+//   - $1${salt}${hash} (md5-crypt, used by many legacy PHP apps)
+//   - $2a$, $2b$, $2y$ (plain bcrypt, e.g. from PHP's password_hash)
+//
+// All other hashes are passed to the current hasher.
+// The work factors of pbkdf2 and scrypt hashes are capped (see maxPBKDF2Iterations and maxScryptMemory),
+// so that a crafted hash can't make a single login take minutes or exhaust the memory.
+type UpgradingHasher struct {
+	current Hasher
+}
+
+func NewUpgradingHasher(current Hasher) *UpgradingHasher {
+	return &UpgradingHasher{current: current}
+}
+
+func (u *UpgradingHasher) Hash(pass string) (string, error) {
+	return u.current.Hash(pass)
+}
+
+func (u *UpgradingHasher) Compare(pass, hashedPass string) bool {
+	if verify := findVerifier(hashedPass); verify != nil {
+		return verify(pass, hashedPass)
+	}
+	return u.current.Compare(pass, hashedPass)
+}
+
+func (u *UpgradingHasher) NeedsRehash(hashedPass string) bool {
+	if findVerifier(hashedPass) != nil {
+		return true
+	}
+	return u.current.NeedsRehash(hashedPass)
+}
+
+// IsSupported returns true if the hash is in one of the supported foreign formats and is well formed.
+// It is used for validating hashes before importing them.
+func IsSupported(hashedPass string) bool {
+	switch {
+	case strings.HasPrefix(hashedPass, pbkdf2Prefix):
+		_, _, _, ok := parsePBKDF2(hashedPass)
+		return ok
+	case strings.HasPrefix(hashedPass, scryptPrefix):
+		_, _, ok := parseScrypt(hashedPass)
+		return ok
+	case strings.HasPrefix(hashedPass, md5CryptPrefix):
+		_, ok := parseMD5Crypt(hashedPass)
+		return ok
+	case isBcrypt(hashedPass):
+		_, err := bcrypt.Cost([]byte(hashedPass))
+		return err == nil
+	}
+	return false
+}
+
+type verifier func(pass, hashedPass string) bool
+
+func findVerifier(hashedPass string) verifier {
+	switch {
+	case strings.HasPrefix(hashedPass, pbkdf2Prefix):
+		return verifyPBKDF2
+	case strings.HasPrefix(hashedPass, scryptPrefix):
+		return verifyScrypt
+	case strings.HasPrefix(hashedPass, md5CryptPrefix):
+		return verifyMD5Crypt
+	case isBcrypt(hashedPass):
+		return verifyBcrypt
+	}
+	return nil
+}
+
+const pbkdf2Prefix = "pbkdf2_sha256$"
+
+// maxPBKDF2Iterations is several times the default of recent Django versions (1,000,000 in 5.2)
+const maxPBKDF2Iterations = 5_000_000
+
+func parsePBKDF2(hashedPass string) (iterations int, salt string, hash []byte, ok bool) {
+	parts := strings.Split(hashedPass, "$")
+	if len(parts) != 4 {
+		return 0, "", nil, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 || iterations > maxPBKDF2Iterations {
+		return 0, "", nil, false
+	}
+	hash, err = base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 {
+		return 0, "", nil, false
+	}
+	return iterations, parts[2], hash, true
+}
+
+func verifyPBKDF2(pass, hashedPass string) bool {
+	iterations, salt, hash, ok := parsePBKDF2(hashedPass)
+	if !ok {
+		return false
+	}
+	computed := pbkdf2.Key([]byte(pass), []byte(salt), iterations, len(hash), sha256.New)
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+const scryptPrefix = "scrypt$"
+
+// scrypt needs about 128*N*r bytes of memory and p times as much work, Django uses N=2^14, r=8, p=1 (16 MiB)
+const (
+	maxScryptMemory      = 256 << 20
+	maxScryptParallelism = 16
+)
+
+type scryptParams struct {
+	salt    string
+	n, r, p int
+}
+
+func parseScrypt(hashedPass string) (params scryptParams, hash []byte, ok bool) {
+	parts := strings.Split(hashedPass, "$")
+	if len(parts) != 6 {
+		return scryptParams{}, nil, false
+	}
+	params.salt = parts[2]
+	for _, field := range []struct {
+		part int
+		dst  *int
+	}{{1, &params.n}, {3, &params.r}, {4, &params.p}} {
+		val, err := strconv.Atoi(parts[field.part])
+		if err != nil || val < 1 {
+			return scryptParams{}, nil, false
+		}
+		*field.dst = val
+	}
+	if params.n > maxScryptMemory/128/params.r || params.p > maxScryptParallelism {
+		return scryptParams{}, nil, false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return scryptParams{}, nil, false
+	}
+	return params, hash, true
+}
+
+func verifyScrypt(pass, hashedPass string) bool {
+	params, hash, ok := parseScrypt(hashedPass)
+	if !ok {
+		return false
+	}
+	computed, err := scrypt.Key([]byte(pass), []byte(params.salt), params.n, params.r, params.p, len(hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, hash) == 1
+}
+
+func isBcrypt(hashedPass string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hashedPass, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyBcrypt(pass, hashedPass string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hashedPass), []byte(pass)) == nil
+}
@@ -0,0 +1,76 @@
+package foreign_hashes_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/bcrypt_hasher"
+	"github.com/k0marov/golang-auth/internal/core/crypto/foreign_hashes"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the pbkdf2 and scrypt vectors are from the test suite of Django (tests/auth_tests/test_hashers.py), md5-crypt ones from openssl passwd -1
+var foreignHashes = []struct {
+	format string
+	pass   string
+	hash   string
+}{
+	{"pbkdf2_sha256", "lètmein", "pbkdf2_sha256$260000$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo="},
+	{"scrypt", "lètmein", "scrypt$16384$seasalt$8$1$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw=="},
+	{"md5-crypt", "password", "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/"},
+	{"md5-crypt with a long password", "very long password with spaces 1234567890", "$1$ab$CwwEbOlBYsGYZzuLcIc/J."},
+}
+
+func TestUpgradingHasher(t *testing.T) {
+	current := bcrypt_hasher.NewBcryptHasher(4)
+	hasher := foreign_hashes.NewUpgradingHasher(current)
+
+	phpBcrypt, err := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	AssertNoError(t, err)
+	cases := append(foreignHashes, struct {
+		format string
+		pass   string
+		hash   string
+	}{"bcrypt from php", "secret", strings.Replace(string(phpBcrypt), "$2a$", "$2y$", 1)})
+
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			Assert(t, foreign_hashes.IsSupported(c.hash), true, "IsSupported()")
+			Assert(t, hasher.Compare(c.pass, c.hash), true, "comparing with the right password")
+			Assert(t, hasher.Compare(c.pass+"x", c.hash), false, "comparing with a wrong password")
+			Assert(t, hasher.NeedsRehash(c.hash), true, "NeedsRehash()")
+		})
+	}
+	t.Run("should delegate other hashes to the current hasher", func(t *testing.T) {
+		pass := RandomString()
+		hashed, err := hasher.Hash(pass)
+		AssertNoError(t, err)
+		Assert(t, current.Compare(pass, hashed), true, "hash is created by the current hasher")
+		Assert(t, hasher.Compare(pass, hashed), true, "comparing with the right password")
+		Assert(t, hasher.NeedsRehash(hashed), false, "NeedsRehash() of a current hash")
+		Assert(t, foreign_hashes.IsSupported(hashed), false, "IsSupported() of a current hash")
+	})
+	t.Run("should reject malformed hashes", func(t *testing.T) {
+		malformed := []string{
+			"pbkdf2_sha256$abc$salt$hash",
+			"pbkdf2_sha256$1000$salt$not base64!",
+			"scrypt$16384$salt$8$hash",
+			// the order of fields before Django's one was fixed
+			"scrypt$seasalt$16384$8$1$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw==",
+			// too expensive work factors
+			"pbkdf2_sha256$999999999$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo=",
+			"scrypt$1073741824$seasalt$8$1$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw==",
+			"scrypt$16384$seasalt$1048576$1$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw==",
+			"scrypt$16384$seasalt$8$1000$Qj3+9PPyRjSJIebHnG81TMjsqtaIGxNQG/aEB/NYafTJ7tibgfYz71m0ldQESkXFRkdVCBhhY8mx7rQwite/Pw==",
+			"$1$saltsalt$tooshort",
+			"$1$waytoolongsalt$qjXMvbEw8oaL.CzflDtaK/",
+			"$2y$04$notreallyabcrypthash",
+			RandomString(),
+		}
+		for _, hash := range malformed {
+			Assert(t, foreign_hashes.IsSupported(hash), false, "IsSupported("+hash+")")
+			Assert(t, hasher.Compare("secret", hash), false, "Compare() with "+hash)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package foreign_hashes
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"strings"
+)
+
+// md5-crypt is the FreeBSD MD5 based crypt(3), hashes look like $1${salt}${22 chars of hash}.
+// It is very weak by today's standards and is supported only for upgrading imported hashes.
+const md5CryptPrefix = "$1$"
+
+const md5CryptMaxSaltLength = 8
+const md5CryptHashLength = 22
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func parseMD5Crypt(hashedPass string) (salt string, ok bool) {
+	salt, hash, found := strings.Cut(strings.TrimPrefix(hashedPass, md5CryptPrefix), "$")
+	if !found || len(salt) > md5CryptMaxSaltLength || len(hash) != md5CryptHashLength {
+		return "", false
+	}
+	for _, char := range hash {
+		if !strings.ContainsRune(cryptAlphabet, char) {
+			return "", false
+		}
+	}
+	return salt, true
+}
+
+func verifyMD5Crypt(pass, hashedPass string) bool {
+	salt, ok := parseMD5Crypt(hashedPass)
+	if !ok {
+		return false
+	}
+	computed := md5Crypt([]byte(pass), []byte(salt))
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashedPass)) == 1
+}
+
+func md5Crypt(pass, salt []byte) string {
+	alternate := md5.New()
+	alternate.Write(pass)
+	alternate.Write(salt)
+	alternate.Write(pass)
+	alternateSum := alternate.Sum(nil)
+
+	digest := md5.New()
+	digest.Write(pass)
+	digest.Write([]byte(md5CryptPrefix))
+	digest.Write(salt)
+	for i := len(pass); i > 0; i -= md5.Size {
+		if i > md5.Size {
+			digest.Write(alternateSum)
+		} else {
+			digest.Write(alternateSum[:i])
+		}
+	}
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write(pass[:1])
+		}
+	}
+	sum := digest.Sum(nil)
+
+	// the 1000 rounds are meant to slow down brute forcing (it was 1994)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pass)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write(salt)
+		}
+		if i%7 != 0 {
+			round.Write(pass)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pass)
+		}
+		sum = round.Sum(nil)
+	}
+
+	result := strings.Builder{}
+	result.WriteString(md5CryptPrefix)
+	result.Write(salt)
+	result.WriteString("$")
+	groups := [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+	for _, group := range groups {
+		encodeCrypt64(&result, uint(sum[group[0]])<<16|uint(sum[group[1]])<<8|uint(sum[group[2]]), 4)
+	}
+	encodeCrypt64(&result, uint(sum[11]), 2)
+	return result.String()
+}
+
+func encodeCrypt64(result *strings.Builder, value uint, chars int) {
+	for i := 0; i < chars; i++ {
+		result.WriteByte(cryptAlphabet[value&0x3f])
+		value >>= 6
+	}
+}
@@ -0,0 +1,13 @@
+package peppered_hasher
+
+// LoadPeppersFromEnv reads all environment variables of the form {prefix}{version}={secret},
+// e.g. with prefix "AUTH_PEPPER_V" it will read AUTH_PEPPER_V1, AUTH_PEPPER_V2 and so on.
+func LoadPeppersFromEnv(prefix string) ([]Pepper, error) {
+	return pepperKind.LoadFromEnv(prefix)
+}
+
+// LoadPeppersFromFile reads a key file, in which every non-empty line has the form {version}:{secret}.
+// Lines starting with # are ignored.
+func LoadPeppersFromFile(keyFileName string) ([]Pepper, error) {
+	return pepperKind.LoadFromFile(keyFileName)
+}
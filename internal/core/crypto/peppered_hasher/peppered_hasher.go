@@ -0,0 +1,106 @@
+package peppered_hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/versioned_secrets"
+)
+
+type Hasher interface {
+	Hash(password string) (string, error)
+	Compare(pass, hashedPass string) bool
+	NeedsRehash(hashedPass string) bool
+}
+
+// Pepper is a server-side secret, which is mixed into every password before hashing.
+// It should never be stored in the DB file, see LoadPeppersFromEnv and LoadPeppersFromFile.
+type Pepper = versioned_secrets.Secret
+
+// Hashes produced by PepperedHasher look like "$pepper$<version>$<inner hash>",
+// so that the version of the pepper used for a particular hash is always known.
+// Hashes without this prefix are treated as unpeppered (e.g. created before the pepper was configured).
+const hashPrefix = "$pepper$"
+
+var ErrNoPeppers = errors.New("at least one pepper should be provided")
+
+var pepperKind = versioned_secrets.Kind{Name: "pepper", ErrNone: ErrNoPeppers}
+
+var errEmptyPepper = errors.New("the secret is empty")
+
+// PepperedHasher wraps some other Hasher, applying HMAC-SHA256 with the pepper to the password before hashing it.
+// The newest (biggest version) pepper is used for hashing new passwords,
+// and the older ones are kept only for comparing, so that the pepper can be rotated.
+type PepperedHasher struct {
+	inner   Hasher
+	peppers *versioned_secrets.Set
+}
+
+func NewPepperedHasher(inner Hasher, peppers []Pepper) (*PepperedHasher, error) {
+	set, err := pepperKind.NewSet(peppers, func(pepper Pepper) error {
+		if len(pepper.Secret) == 0 {
+			return errEmptyPepper
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PepperedHasher{inner: inner, peppers: set}, nil
+}
+
+func (p *PepperedHasher) Hash(pass string) (string, error) {
+	current := p.peppers.Current()
+	innerHash, err := p.inner.Hash(applyPepper(current, pass))
+	if err != nil {
+		return "", err
+	}
+	return hashPrefix + strconv.Itoa(current.Version) + "$" + innerHash, nil
+}
+
+func (p *PepperedHasher) Compare(pass, hashedPass string) bool {
+	version, innerHash, peppered := parseHash(hashedPass)
+	if !peppered {
+		return p.inner.Compare(pass, hashedPass)
+	}
+	pepper, ok := p.peppers.Get(version)
+	if !ok {
+		return false
+	}
+	return p.inner.Compare(applyPepper(pepper, pass), innerHash)
+}
+
+// NeedsRehash returns true if the hash was created without a pepper or with some older pepper,
+// or if the inner hasher wants it to be rehashed
+func (p *PepperedHasher) NeedsRehash(hashedPass string) bool {
+	version, innerHash, peppered := parseHash(hashedPass)
+	if !peppered || version != p.peppers.Current().Version {
+		return true
+	}
+	return p.inner.NeedsRehash(innerHash)
+}
+
+func applyPepper(pepper Pepper, pass string) string {
+	mac := hmac.New(sha256.New, pepper.Secret)
+	mac.Write([]byte(pass))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseHash(hashedPass string) (version int, innerHash string, peppered bool) {
+	if !strings.HasPrefix(hashedPass, hashPrefix) {
+		return 0, "", false
+	}
+	versionStr, innerHash, found := strings.Cut(strings.TrimPrefix(hashedPass, hashPrefix), "$")
+	if !found {
+		return 0, "", false
+	}
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return 0, "", false
+	}
+	return version, innerHash, true
+}
@@ -0,0 +1,116 @@
+package peppered_hasher_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/bcrypt_hasher"
+	"github.com/k0marov/golang-auth/internal/core/crypto/peppered_hasher"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+var pepperV1 = peppered_hasher.Pepper{Version: 1, Secret: []byte("first secret")}
+var pepperV2 = peppered_hasher.Pepper{Version: 2, Secret: []byte("second secret")}
+
+func TestPepperedHasher(t *testing.T) {
+	inner := bcrypt_hasher.NewBcryptHasher(4)
+	newHasher := func(t testing.TB, peppers ...peppered_hasher.Pepper) *peppered_hasher.PepperedHasher {
+		t.Helper()
+		hasher, err := peppered_hasher.NewPepperedHasher(inner, peppers)
+		AssertNoError(t, err)
+		return hasher
+	}
+
+	t.Run("should hash and compare passwords", func(t *testing.T) {
+		hasher := newHasher(t, pepperV1)
+		pass := RandomString()
+		hashed, err := hasher.Hash(pass)
+		AssertNoError(t, err)
+
+		Assert(t, strings.HasPrefix(hashed, "$pepper$1$"), true, "hash is prefixed with pepper version")
+		Assert(t, hasher.Compare(pass, hashed), true, "comparing with the right password")
+		Assert(t, hasher.Compare(pass+"x", hashed), false, "comparing with a wrong password")
+		Assert(t, hasher.NeedsRehash(hashed), false, "NeedsRehash() of a fresh hash")
+	})
+	t.Run("should not be comparable without the pepper", func(t *testing.T) {
+		pass := RandomString()
+		hashed, err := newHasher(t, pepperV1).Hash(pass)
+		AssertNoError(t, err)
+
+		innerHash := strings.TrimPrefix(hashed, "$pepper$1$")
+		Assert(t, inner.Compare(pass, innerHash), false, "comparing inner hash with unpeppered password")
+
+		otherPepper := peppered_hasher.Pepper{Version: 1, Secret: []byte("other secret")}
+		Assert(t, newHasher(t, otherPepper).Compare(pass, hashed), false, "comparing with another secret")
+	})
+	t.Run("should use the newest pepper and still accept older ones", func(t *testing.T) {
+		pass := RandomString()
+		oldHash, err := newHasher(t, pepperV1).Hash(pass)
+		AssertNoError(t, err)
+
+		rotated := newHasher(t, pepperV2, pepperV1)
+		Assert(t, rotated.Compare(pass, oldHash), true, "comparing a hash with an older pepper")
+		Assert(t, rotated.NeedsRehash(oldHash), true, "NeedsRehash() of a hash with an older pepper")
+
+		newHash, err := rotated.Hash(pass)
+		AssertNoError(t, err)
+		Assert(t, strings.HasPrefix(newHash, "$pepper$2$"), true, "new hash uses the newest pepper")
+		Assert(t, rotated.NeedsRehash(newHash), false, "NeedsRehash() of a hash with the newest pepper")
+	})
+	t.Run("should accept unpeppered hashes, but ask to rehash them", func(t *testing.T) {
+		pass := RandomString()
+		unpeppered, err := inner.Hash(pass)
+		AssertNoError(t, err)
+
+		hasher := newHasher(t, pepperV1)
+		Assert(t, hasher.Compare(pass, unpeppered), true, "comparing an unpeppered hash")
+		Assert(t, hasher.NeedsRehash(unpeppered), true, "NeedsRehash() of an unpeppered hash")
+	})
+	t.Run("should reject hashes with unknown pepper versions", func(t *testing.T) {
+		pass := RandomString()
+		hashed, err := newHasher(t, pepperV2).Hash(pass)
+		AssertNoError(t, err)
+		Assert(t, newHasher(t, pepperV1).Compare(pass, hashed), false, "comparing a hash with an unknown pepper")
+	})
+	t.Run("constructor error cases", func(t *testing.T) {
+		_, err := peppered_hasher.NewPepperedHasher(inner, nil)
+		AssertError(t, err, peppered_hasher.ErrNoPeppers)
+		_, err = peppered_hasher.NewPepperedHasher(inner, []peppered_hasher.Pepper{pepperV1, pepperV1})
+		AssertSomeError(t, err)
+		_, err = peppered_hasher.NewPepperedHasher(inner, []peppered_hasher.Pepper{{Version: 1}})
+		AssertSomeError(t, err)
+	})
+}
+
+func TestLoadPeppers(t *testing.T) {
+	t.Run("from env", func(t *testing.T) {
+		t.Setenv("TEST_PEPPER_V1", "first secret")
+		t.Setenv("TEST_PEPPER_V2", "second secret")
+		peppers, err := peppered_hasher.LoadPeppersFromEnv("TEST_PEPPER_V")
+		AssertNoError(t, err)
+		Assert(t, len(peppers), 2, "number of loaded peppers")
+		for _, pepper := range peppers {
+			want := map[int]string{1: "first secret", 2: "second secret"}[pepper.Version]
+			Assert(t, string(pepper.Secret), want, "pepper secret")
+		}
+
+		_, err = peppered_hasher.LoadPeppersFromEnv("TEST_UNSET_PEPPER_V")
+		AssertSomeError(t, err)
+	})
+	t.Run("from file", func(t *testing.T) {
+		keyFile, deleteFile := CreateTempFile(t, "# comment\n1:first secret\n\n2:second secret\n")
+		defer deleteFile()
+		peppers, err := peppered_hasher.LoadPeppersFromFile(keyFile)
+		AssertNoError(t, err)
+		Assert(t, peppers, []peppered_hasher.Pepper{pepperV1, pepperV2}, "loaded peppers")
+
+		invalidFile, deleteInvalid := CreateTempFile(t, "no version here\n")
+		defer deleteInvalid()
+		_, err = peppered_hasher.LoadPeppersFromFile(invalidFile)
+		AssertSomeError(t, err)
+
+		_, err = peppered_hasher.LoadPeppersFromFile(os.DevNull)
+		AssertSomeError(t, err)
+	})
+}
@@ -0,0 +1,23 @@
+package record_encryption
+
+// Keys are stored base64-encoded, a new one can be generated with e.g. `openssl rand -base64 32`.
+
+// LoadKeysFromEnv reads all environment variables of the form {prefix}{version}={base64 key},
+// e.g. with prefix "AUTH_DB_KEY_V" it will read AUTH_DB_KEY_V1, AUTH_DB_KEY_V2 and so on.
+func LoadKeysFromEnv(prefix string) (*KeyRing, error) {
+	keys, err := keyKind.LoadFromEnv(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRing(keys)
+}
+
+// LoadKeysFromFile reads a key file, in which every non-empty line has the form {version}:{base64 key}.
+// Lines starting with # are ignored.
+func LoadKeysFromFile(keyFileName string) (*KeyRing, error) {
+	keys, err := keyKind.LoadFromFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRing(keys)
+}
@@ -0,0 +1,127 @@
+package record_encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/versioned_secrets"
+)
+
+// KeySize is the size of AES-256 keys
+const KeySize = 32
+
+// Key is a secret used for encrypting records, it should never be stored next to the encrypted data.
+// See LoadKeysFromEnv and LoadKeysFromFile.
+type Key = versioned_secrets.Secret
+
+// KeyProvider supplies the keys for encrypting and decrypting records.
+// The current key is used for all new records, older keys are needed only for decrypting records,
+// which haven't been re-encrypted with the current one yet.
+type KeyProvider interface {
+	CurrentKey() (Key, error)
+	Key(version int) (Key, error)
+}
+
+var ErrNoKeys = errors.New("at least one encryption key should be provided")
+var ErrUnknownKeyVersion = errors.New("no encryption key with this version")
+var ErrInvalidKeySize = fmt.Errorf("encryption keys should be exactly %d bytes long", KeySize)
+
+var keyKind = versioned_secrets.Kind{Name: "encryption key", Decode: base64.StdEncoding.DecodeString, ErrNone: ErrNoKeys}
+
+// KeyRing is a KeyProvider with a fixed set of keys, the one with the biggest version is the current one.
+// To rotate the key, add a new version and keep the old one until everything is re-encrypted.
+type KeyRing struct {
+	keys *versioned_secrets.Set
+}
+
+func NewKeyRing(keys []Key) (*KeyRing, error) {
+	set, err := keyKind.NewSet(keys, func(key Key) error {
+		if len(key.Secret) != KeySize {
+			return ErrInvalidKeySize
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRing{keys: set}, nil
+}
+
+func (r *KeyRing) CurrentKey() (Key, error) {
+	return r.keys.Current(), nil
+}
+
+func (r *KeyRing) Key(version int) (Key, error) {
+	key, ok := r.keys.Get(version)
+	if !ok {
+		return Key{}, fmt.Errorf("%w: %d", ErrUnknownKeyVersion, version)
+	}
+	return key, nil
+}
+
+// Envelope is a single record encrypted with AES-256-GCM.
+// It carries the version of the key, so that records encrypted with different keys can be mixed during rotation.
+type Envelope struct {
+	KeyVersion int    `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"data"`
+}
+
+// Seal encrypts the plaintext with the current key.
+// The envelope is bound to additionalData (e.g. the position of the record), which is not encrypted,
+// but has to be passed to Open unchanged, so that an envelope can't be moved somewhere else.
+func Seal(keys KeyProvider, plaintext, additionalData []byte) (Envelope, error) {
+	key, err := keys.CurrentKey()
+	if err != nil {
+		return Envelope{}, fmt.Errorf("error getting the current encryption key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return Envelope{}, fmt.Errorf("error generating a nonce: %w", err)
+	}
+	return Envelope{
+		KeyVersion: key.Version,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, additionalData),
+	}, nil
+}
+
+// Open decrypts the envelope with the key it was encrypted with.
+// It returns an error if the envelope was tampered with or was sealed with other additionalData.
+func Open(keys KeyProvider, envelope Envelope, additionalData []byte) ([]byte, error) {
+	key, err := keys.Key(envelope.KeyVersion)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(envelope.Nonce))
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting a record with key version %d: %w", envelope.KeyVersion, err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key Key) (cipher.AEAD, error) {
+	if len(key.Secret) != KeySize {
+		return nil, ErrInvalidKeySize
+	}
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("error creating a cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
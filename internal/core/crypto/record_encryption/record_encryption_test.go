@@ -0,0 +1,126 @@
+package record_encryption_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+var keyV1 = record_encryption.Key{Version: 1, Secret: bytes.Repeat([]byte{1}, record_encryption.KeySize)}
+var keyV2 = record_encryption.Key{Version: 2, Secret: bytes.Repeat([]byte{2}, record_encryption.KeySize)}
+
+func newKeyRing(t testing.TB, keys ...record_encryption.Key) *record_encryption.KeyRing {
+	t.Helper()
+	ring, err := record_encryption.NewKeyRing(keys)
+	if err != nil {
+		t.Fatalf("error creating a key ring: %v", err)
+	}
+	return ring
+}
+
+func TestEnvelope(t *testing.T) {
+	t.Run("should encrypt and decrypt", func(t *testing.T) {
+		keys := newKeyRing(t, keyV1)
+		plaintext := []byte(RandomString())
+		envelope, err := record_encryption.Seal(keys, plaintext, nil)
+		AssertNoError(t, err)
+		Assert(t, envelope.KeyVersion, 1, "key version of the envelope")
+		Assert(t, bytes.Contains(envelope.Ciphertext, plaintext), false, "ciphertext contains the plaintext")
+
+		decrypted, err := record_encryption.Open(keys, envelope, nil)
+		AssertNoError(t, err)
+		Assert(t, decrypted, plaintext, "decrypted plaintext")
+	})
+	t.Run("should use random nonces", func(t *testing.T) {
+		keys := newKeyRing(t, keyV1)
+		first, err := record_encryption.Seal(keys, []byte("same"), nil)
+		AssertNoError(t, err)
+		second, err := record_encryption.Seal(keys, []byte("same"), nil)
+		AssertNoError(t, err)
+		Assert(t, bytes.Equal(first.Ciphertext, second.Ciphertext), false, "ciphertexts of the same plaintext are equal")
+	})
+	t.Run("should use the newest key and still decrypt with older ones", func(t *testing.T) {
+		oldEnvelope, err := record_encryption.Seal(newKeyRing(t, keyV1), []byte("old"), nil)
+		AssertNoError(t, err)
+
+		rotated := newKeyRing(t, keyV2, keyV1)
+		newEnvelope, err := record_encryption.Seal(rotated, []byte("new"), nil)
+		AssertNoError(t, err)
+		Assert(t, newEnvelope.KeyVersion, 2, "key version after rotation")
+		decrypted, err := record_encryption.Open(rotated, oldEnvelope, nil)
+		AssertNoError(t, err)
+		Assert(t, string(decrypted), "old", "record encrypted with the old key")
+
+		_, err = record_encryption.Open(newKeyRing(t, keyV2), oldEnvelope, nil)
+		Assert(t, errors.Is(err, record_encryption.ErrUnknownKeyVersion), true, "error is ErrUnknownKeyVersion")
+	})
+	t.Run("should detect tampering", func(t *testing.T) {
+		keys := newKeyRing(t, keyV1)
+		envelope, err := record_encryption.Seal(keys, []byte(RandomString()), nil)
+		AssertNoError(t, err)
+		envelope.Ciphertext[0] ^= 1
+		_, err = record_encryption.Open(keys, envelope, nil)
+		AssertSomeError(t, err)
+	})
+	t.Run("should bind the envelope to the additional data", func(t *testing.T) {
+		keys := newKeyRing(t, keyV1)
+		envelope, err := record_encryption.Seal(keys, []byte(RandomString()), []byte("line 2"))
+		AssertNoError(t, err)
+		_, err = record_encryption.Open(keys, envelope, []byte("line 2"))
+		AssertNoError(t, err)
+		_, err = record_encryption.Open(keys, envelope, []byte("line 3"))
+		AssertSomeError(t, err)
+		_, err = record_encryption.Open(keys, envelope, nil)
+		AssertSomeError(t, err)
+	})
+	t.Run("key ring error cases", func(t *testing.T) {
+		_, err := record_encryption.NewKeyRing(nil)
+		AssertError(t, err, record_encryption.ErrNoKeys)
+		_, err = record_encryption.NewKeyRing([]record_encryption.Key{{Version: 1, Secret: []byte("short")}})
+		Assert(t, errors.Is(err, record_encryption.ErrInvalidKeySize), true, "error is ErrInvalidKeySize")
+		_, err = record_encryption.NewKeyRing([]record_encryption.Key{keyV1, keyV1})
+		AssertSomeError(t, err)
+	})
+}
+
+func TestLoadKeys(t *testing.T) {
+	encode := base64.StdEncoding.EncodeToString
+	t.Run("from env", func(t *testing.T) {
+		t.Setenv("TEST_DB_KEY_V1", encode(keyV1.Secret))
+		t.Setenv("TEST_DB_KEY_V2", encode(keyV2.Secret))
+		keys, err := record_encryption.LoadKeysFromEnv("TEST_DB_KEY_V")
+		AssertNoError(t, err)
+		current, _ := keys.CurrentKey()
+		Assert(t, current, keyV2, "current key")
+		old, err := keys.Key(1)
+		AssertNoError(t, err)
+		Assert(t, old, keyV1, "old key")
+
+		_, err = record_encryption.LoadKeysFromEnv("TEST_UNSET_DB_KEY_V")
+		AssertSomeError(t, err)
+		t.Setenv("TEST_INVALID_DB_KEY_V1", "not base64!")
+		_, err = record_encryption.LoadKeysFromEnv("TEST_INVALID_DB_KEY_V")
+		AssertSomeError(t, err)
+	})
+	t.Run("from file", func(t *testing.T) {
+		keyFile, deleteFile := CreateTempFile(t, "# comment\n1:"+encode(keyV1.Secret)+"\n\n2:"+encode(keyV2.Secret)+"\n")
+		defer deleteFile()
+		keys, err := record_encryption.LoadKeysFromFile(keyFile)
+		AssertNoError(t, err)
+		current, _ := keys.CurrentKey()
+		Assert(t, current, keyV2, "current key")
+
+		invalidFile, deleteInvalid := CreateTempFile(t, "1:"+encode([]byte("too short"))+"\n")
+		defer deleteInvalid()
+		_, err = record_encryption.LoadKeysFromFile(invalidFile)
+		AssertSomeError(t, err)
+
+		_, err = record_encryption.LoadKeysFromFile(os.DevNull)
+		AssertSomeError(t, err)
+	})
+}
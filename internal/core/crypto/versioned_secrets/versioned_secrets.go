@@ -0,0 +1,141 @@
+// Package versioned_secrets loads and indexes secrets, which are rotated by adding a new version (peppers and encryption keys):
+// the one with the biggest version is used for new data, and the older ones are kept for the data created with them.
+//
+// Secrets are loaded either from environment variables of the form {prefix}{version}={secret}
+// or from a key file, in which every non-empty line has the form {version}:{secret} and lines starting with # are ignored.
+package versioned_secrets
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Secret struct {
+	Version int
+	Secret  []byte
+}
+
+// Kind describes a kind of secrets for loading them and for error messages
+type Kind struct {
+	// Name is used in error messages, e.g. "pepper"
+	Name string
+	// Decode turns the text of a secret into its bytes (e.g. base64.StdEncoding.DecodeString), nil means the text is the secret itself
+	Decode func(text string) ([]byte, error)
+	// ErrNone is returned (or wrapped) if there are no secrets
+	ErrNone error
+}
+
+// LoadFromEnv reads all environment variables of the form {prefix}{version}={secret},
+// e.g. with prefix "AUTH_PEPPER_V" it will read AUTH_PEPPER_V1, AUTH_PEPPER_V2 and so on.
+func (k Kind) LoadFromEnv(prefix string) ([]Secret, error) {
+	secrets := []Secret{}
+	for _, env := range os.Environ() {
+		name, text, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s version in env variable %s: %w", k.Name, name, err)
+		}
+		secret, err := k.decode(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in env variable %s: %w", k.Name, name, err)
+		}
+		secrets = append(secrets, Secret{Version: version, Secret: secret})
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no env variables with prefix %s: %w", prefix, k.ErrNone)
+	}
+	return secrets, nil
+}
+
+// LoadFromFile reads a key file, in which every non-empty line has the form {version}:{secret}.
+// Lines starting with # are ignored.
+func (k Kind) LoadFromFile(keyFileName string) ([]Secret, error) {
+	keyFile, err := os.Open(keyFileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s file: %w", k.Name, err)
+	}
+	defer keyFile.Close()
+
+	secrets := []Secret{}
+	scanner := bufio.NewScanner(keyFile)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		versionStr, text, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d of %s file is not in the {version}:{secret} format", lineNum, k.Name)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s version on line %d of %s file: %w", k.Name, lineNum, k.Name, err)
+		}
+		secret, err := k.decode(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s on line %d of %s file: %w", k.Name, lineNum, k.Name, err)
+		}
+		secrets = append(secrets, Secret{Version: version, Secret: secret})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s file: %w", k.Name, err)
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("%s file is empty: %w", k.Name, k.ErrNone)
+	}
+	return secrets, nil
+}
+
+func (k Kind) decode(text string) ([]byte, error) {
+	if k.Decode == nil {
+		return []byte(text), nil
+	}
+	return k.Decode(text)
+}
+
+// Set is a fixed set of secrets indexed by their versions
+type Set struct {
+	current Secret
+	secrets map[int]Secret
+}
+
+// NewSet checks that there is at least one secret, that every version is unique
+// and that validate (if not nil) accepts every secret.
+func (k Kind) NewSet(secrets []Secret, validate func(Secret) error) (*Set, error) {
+	if len(secrets) == 0 {
+		return nil, k.ErrNone
+	}
+	set := &Set{current: secrets[0], secrets: make(map[int]Secret)}
+	for _, secret := range secrets {
+		if validate != nil {
+			if err := validate(secret); err != nil {
+				return nil, fmt.Errorf("%s with version %d: %w", k.Name, secret.Version, err)
+			}
+		}
+		if _, exists := set.secrets[secret.Version]; exists {
+			return nil, fmt.Errorf("%s version %d is provided more than once", k.Name, secret.Version)
+		}
+		set.secrets[secret.Version] = secret
+		if secret.Version > set.current.Version {
+			set.current = secret
+		}
+	}
+	return set, nil
+}
+
+// Current returns the secret with the biggest version
+func (s *Set) Current() Secret {
+	return s.current
+}
+
+// Get returns the secret with the version, if there is one
+func (s *Set) Get(version int) (Secret, bool) {
+	secret, ok := s.secrets[version]
+	return secret, ok
+}
@@ -0,0 +1,86 @@
+package versioned_secrets_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/versioned_secrets"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+var errNone = errors.New("no test secrets")
+
+var rawKind = versioned_secrets.Kind{Name: "test secret", ErrNone: errNone}
+var hexKind = versioned_secrets.Kind{Name: "test key", Decode: hex.DecodeString, ErrNone: errNone}
+
+func TestLoad(t *testing.T) {
+	t.Run("from env", func(t *testing.T) {
+		t.Setenv("TEST_SECRET_V1", "6869")
+		t.Setenv("TEST_SECRET_V2", "6869")
+		secrets, err := hexKind.LoadFromEnv("TEST_SECRET_V")
+		AssertNoError(t, err)
+		Assert(t, len(secrets), 2, "number of loaded secrets")
+		for _, secret := range secrets {
+			Assert(t, string(secret.Secret), "hi", "decoded secret")
+		}
+
+		_, err = rawKind.LoadFromEnv("TEST_UNSET_SECRET_V")
+		Assert(t, errors.Is(err, errNone), true, "error is ErrNone")
+		t.Setenv("TEST_INVALID_SECRET_VX", "secret")
+		_, err = rawKind.LoadFromEnv("TEST_INVALID_SECRET_V")
+		AssertSomeError(t, err)
+		t.Setenv("TEST_NOT_HEX_SECRET_V1", "secret")
+		_, err = hexKind.LoadFromEnv("TEST_NOT_HEX_SECRET_V")
+		AssertSomeError(t, err)
+	})
+	t.Run("from file", func(t *testing.T) {
+		keyFile, deleteFile := CreateTempFile(t, "# comment\n1:first: with a colon\n\n  2:second  \n")
+		defer deleteFile()
+		secrets, err := rawKind.LoadFromFile(keyFile)
+		AssertNoError(t, err)
+		Assert(t, secrets, []versioned_secrets.Secret{{Version: 1, Secret: []byte("first: with a colon")}, {Version: 2, Secret: []byte("second")}}, "loaded secrets")
+
+		for name, contents := range map[string]string{"no version": "secret\n", "invalid version": "v1:secret\n", "not hex": "1:secret\n"} {
+			t.Run(name, func(t *testing.T) {
+				invalidFile, deleteInvalid := CreateTempFile(t, contents)
+				defer deleteInvalid()
+				_, err = hexKind.LoadFromFile(invalidFile)
+				AssertSomeError(t, err)
+			})
+		}
+
+		_, err = rawKind.LoadFromFile(os.DevNull)
+		Assert(t, errors.Is(err, errNone), true, "error is ErrNone")
+		_, err = rawKind.LoadFromFile(RandomString())
+		AssertSomeError(t, err)
+	})
+}
+
+func TestSet(t *testing.T) {
+	v1, v3, v2 := versioned_secrets.Secret{Version: 1, Secret: []byte("a")}, versioned_secrets.Secret{Version: 3, Secret: []byte("c")}, versioned_secrets.Secret{Version: 2, Secret: []byte("b")}
+	set, err := rawKind.NewSet([]versioned_secrets.Secret{v1, v3, v2}, nil)
+	AssertNoError(t, err)
+	Assert(t, set.Current(), v3, "current secret")
+	got, ok := set.Get(2)
+	Assert(t, ok, true, "secret exists")
+	Assert(t, got, v2, "secret with version 2")
+	_, ok = set.Get(4)
+	Assert(t, ok, false, "unknown version exists")
+
+	t.Run("error cases", func(t *testing.T) {
+		_, err := rawKind.NewSet(nil, nil)
+		AssertError(t, err, errNone)
+		_, err = rawKind.NewSet([]versioned_secrets.Secret{v1, v1}, nil)
+		AssertSomeError(t, err)
+		invalid := errors.New(RandomString())
+		_, err = rawKind.NewSet([]versioned_secrets.Secret{v1, v2}, func(secret versioned_secrets.Secret) error {
+			if secret.Version == 2 {
+				return invalid
+			}
+			return nil
+		})
+		Assert(t, errors.Is(err, invalid), true, "error is the validation error")
+	})
+}
@@ -0,0 +1,109 @@
+// Package user_ids generates the opaque ids, which are exposed to clients instead of the sequential integer ids of users,
+// so that they leak neither the number of users nor the ids of other users.
+//
+// Users created before public ids were enabled are exposed with their decimal integer ids (see FormatLegacyId),
+// which stay resolvable after they get a public id (see models.UserModel.LegacyId).
+package user_ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Strategy generates a new public id, ids must be unique with overwhelming probability
+type Strategy func() (string, error)
+
+// UUIDv7 generates UUIDs of version 7 (RFC 9562): a millisecond timestamp followed by 74 random bits,
+// so that ids are roughly ordered by creation time, which keeps database indexes compact.
+func UUIDv7() (string, error) {
+	var uuid [16]byte
+	if err := readRandom(uuid[6:]); err != nil {
+		return "", err
+	}
+	putTimestamp(uuid[:6], time.Now())
+	uuid[6] = 0x70 | uuid[6]&0x0f // version 7
+	uuid[8] = 0x80 | uuid[8]&0x3f // variant 10
+	encoded := hex.EncodeToString(uuid[:])
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:], nil
+}
+
+// ULID generates ULIDs (https://github.com/ulid/spec): a millisecond timestamp followed by 80 random bits,
+// encoded as 26 characters of Crockford's base32, so that they sort lexicographically by creation time.
+func ULID() (string, error) {
+	var ulid [16]byte
+	if err := readRandom(ulid[6:]); err != nil {
+		return "", err
+	}
+	putTimestamp(ulid[:6], time.Now())
+	return encodeCrockford(ulid), nil
+}
+
+// Random128 generates 128 random bits encoded as 32 hex characters, which reveal nothing, not even the creation time
+func Random128() (string, error) {
+	var id [16]byte
+	if err := readRandom(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// Named returns the strategy by its name ("uuidv7", "ulid" or "random128"), e.g. for command line flags
+func Named(name string) (Strategy, error) {
+	switch name {
+	case "uuidv7":
+		return UUIDv7, nil
+	case "ulid":
+		return ULID, nil
+	case "random128":
+		return Random128, nil
+	}
+	return nil, fmt.Errorf("unknown id strategy %q, expected uuidv7, ulid or random128", name)
+}
+
+// FormatLegacyId returns the id, with which users without a public id are exposed
+func FormatLegacyId(id int) string {
+	return strconv.Itoa(id)
+}
+
+// ParseLegacyId is the inverse of FormatLegacyId, it accepts only the canonical form (e.g. not "+1" or "01"),
+// so that every user has exactly one legacy id
+func ParseLegacyId(id string) (int, bool) {
+	parsed, err := strconv.Atoi(id)
+	if err != nil || parsed <= 0 || FormatLegacyId(parsed) != id {
+		return 0, false
+	}
+	return parsed, true
+}
+
+func readRandom(b []byte) error {
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("error generating a random id: %w", err)
+	}
+	return nil
+}
+
+// putTimestamp writes the unix time in milliseconds as a 48-bit big endian number
+func putTimestamp(b []byte, now time.Time) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(now.UnixMilli()))
+	copy(b, buf[2:])
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeCrockford encodes 128 bits as 26 characters, 5 bits per character starting from the most significant ones
+// (the first character holds only the top 3 bits)
+func encodeCrockford(id [16]byte) string {
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var encoded [26]byte
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded[:])
+}
@@ -0,0 +1,80 @@
+package user_ids_test
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestStrategies(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+	}{
+		{"uuidv7", `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"ulid", `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`},
+		{"random128", `^[0-9a-f]{32}$`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			strategy, err := user_ids.Named(c.name)
+			AssertNoError(t, err)
+			ids := []string{}
+			for i := 0; i < 1000; i++ {
+				id, err := strategy()
+				AssertNoError(t, err)
+				if !regexp.MustCompile(c.pattern).MatchString(id) {
+					t.Fatalf("id %q doesn't match %s", id, c.pattern)
+				}
+				_, isLegacy := user_ids.ParseLegacyId(id)
+				Assert(t, isLegacy, false, "the id looks like a legacy id")
+				ids = append(ids, id)
+			}
+			AssertUniqueCount(t, ids, len(ids))
+		})
+	}
+	t.Run("unknown strategy", func(t *testing.T) {
+		_, err := user_ids.Named(RandomString())
+		AssertSomeError(t, err)
+	})
+}
+
+func TestTimeOrderedStrategies(t *testing.T) {
+	for name, strategy := range map[string]user_ids.Strategy{"uuidv7": user_ids.UUIDv7, "ulid": user_ids.ULID} {
+		t.Run(name, func(t *testing.T) {
+			ids := []string{}
+			for i := 0; i < 3; i++ {
+				id, err := strategy()
+				AssertNoError(t, err)
+				ids = append(ids, id)
+				time.Sleep(2 * time.Millisecond)
+			}
+			Assert(t, sort.StringsAreSorted(ids), true, "ids are sorted by creation time")
+		})
+	}
+	t.Run("uuidv7 should start with the unix time in milliseconds", func(t *testing.T) {
+		before := time.Now().UnixMilli()
+		id, err := user_ids.UUIDv7()
+		AssertNoError(t, err)
+		timestamp, err := strconv.ParseInt(id[:8]+id[9:13], 16, 64)
+		AssertNoError(t, err)
+		Assert(t, timestamp >= before && timestamp <= time.Now().UnixMilli(), true, "timestamp is the creation time")
+	})
+}
+
+func TestLegacyIds(t *testing.T) {
+	for _, id := range []int{1, 42, 1234567} {
+		parsed, ok := user_ids.ParseLegacyId(user_ids.FormatLegacyId(id))
+		Assert(t, ok, true, "legacy id is parsed")
+		Assert(t, parsed, id, "parsed legacy id")
+	}
+	for _, id := range []string{"", "0", "-1", "+1", "01", "1.0", "abc", "99999999999999999999"} {
+		_, ok := user_ids.ParseLegacyId(id)
+		Assert(t, ok, false, "ParseLegacyId("+id+")")
+	}
+}
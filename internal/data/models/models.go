@@ -7,4 +7,36 @@ type UserModel struct {
 	Username   string
 	StoredPass string
 	AuthToken  entities.Token
+	// hashes of the previous passwords, the most recent first
+	PasswordHistory []string
+	// PublicId is the opaque id exposed to clients instead of Id (see the user_ids package).
+	// It is empty for users created without an id strategy, which are exposed with their decimal Id.
+	PublicId string
+	// LegacyId is the integer id, with which the user was exposed before getting a PublicId, so that it stays resolvable.
+	// It is zero for users created with a public id. It differs from Id only for users imported from another store.
+	LegacyId int
+}
+
+type OperationType string
+
+const (
+	CreateUserOp  OperationType = "create_user"
+	UpdateUserOp  OperationType = "update_user"
+	DeleteUserOp  OperationType = "delete_user"
+	AddTokenOp    OperationType = "add_token"
+	RemoveTokenOp OperationType = "remove_token"
+	// IdCounterOp is written at the start of snapshots, so that ids of deleted users are not reused after compaction
+	IdCounterOp OperationType = "id_counter"
+)
+
+// Operation is a single mutation of the store, the DB file is an append-only log of them.
+// Which fields are used depends on the Type:
+//   - CreateUserOp, UpdateUserOp: User holds the full new state of the user
+//   - DeleteUserOp, IdCounterOp: UserId
+//   - AddTokenOp, RemoveTokenOp: UserId and Token
+type Operation struct {
+	Type   OperationType
+	User   UserModel
+	UserId int
+	Token  entities.Token
 }
@@ -0,0 +1,272 @@
+package redis_token_store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/data/store"
+	"github.com/k0marov/golang-auth/internal/domain/auth_service"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+)
+
+const (
+	DefaultKeyPrefix = "auth:token:"
+	DefaultTokenTTL  = 30 * 24 * time.Hour
+)
+
+// Client sends a command to the server and returns its reply (see resp_client.Client.Do)
+type Client interface {
+	Do(args ...string) (any, error)
+}
+
+type Option func(*RedisTokenStore)
+
+// WithKeyPrefix sets the prefix of the keys, so that several applications can share a server
+func WithKeyPrefix(prefix string) Option {
+	return func(r *RedisTokenStore) {
+		r.keyPrefix = prefix
+	}
+}
+
+// WithTokenTTL sets after how long tokens expire, zero means they never do.
+// The expiry is left to the server (the keys are set with PX), so expired tokens disappear without any cleanup.
+func WithTokenTTL(ttl time.Duration) Option {
+	return func(r *RedisTokenStore) {
+		r.tokenTTL = ttl
+	}
+}
+
+// RedisTokenStore keeps tokens in a server speaking the Redis protocol, so that they are shared between instances of the application,
+// while users stay in their own store. Each token is a key holding "<id>:<username>" of its user.
+// The id is checked when the token is used, so that a user registered with the username of a deleted one doesn't inherit its tokens.
+// A user can have any number of tokens (e.g. one per login), which expire independently.
+type RedisTokenStore struct {
+	client    Client
+	users     auth_store_contract.AuthStore
+	keyPrefix string
+	tokenTTL  time.Duration
+
+	invalidatorMu sync.RWMutex
+	invalidator   store.TokenInvalidator
+}
+
+var errUnexpectedReply = errors.New("unexpected reply from the redis server")
+
+func NewRedisTokenStore(client Client, users auth_store_contract.AuthStore, opts ...Option) *RedisTokenStore {
+	r := &RedisTokenStore{client: client, users: users, keyPrefix: DefaultKeyPrefix, tokenTTL: DefaultTokenTTL}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// FindUserFromToken returns the user of the token with AuthToken set to it.
+// If the user doesn't exist anymore (even if another user has its username now), the token is deleted and TokenNotFoundErr is returned.
+func (r *RedisTokenStore) FindUserFromToken(token string) (models.UserModel, error) {
+	reply, err := r.client.Do("GET", r.key(token))
+	if err != nil {
+		return models.UserModel{}, fmt.Errorf("error getting a token: %w", err)
+	}
+	if reply == nil {
+		return models.UserModel{}, token_store_contract.TokenNotFoundErr
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return models.UserModel{}, errUnexpectedReply
+	}
+	id, username, ok := parseOwner(value)
+	if !ok {
+		return models.UserModel{}, fmt.Errorf("%w: invalid owner of a token %q", errUnexpectedReply, value)
+	}
+	user, err := r.users.FindUser(username)
+	if errors.Is(err, auth_store_contract.UserNotFoundErr) || (err == nil && user.Id != id) {
+		r.DeleteToken(token)
+		return models.UserModel{}, token_store_contract.TokenNotFoundErr
+	}
+	if err != nil {
+		return models.UserModel{}, err
+	}
+	user.AuthToken = entities.Token{Token: token}
+	return user, nil
+}
+
+// CreateToken issues a new token for the user, which expires after the token TTL
+func (r *RedisTokenStore) CreateToken(username string) (entities.Token, error) {
+	token, err := auth_service.GenerateToken()
+	if err != nil {
+		return entities.Token{}, err
+	}
+	if err := r.AddToken(username, token); err != nil {
+		return entities.Token{}, err
+	}
+	return token, nil
+}
+
+// IssueToken issues a new token for the user, it makes the store usable as a token issuer of the handlers
+func (r *RedisTokenStore) IssueToken(user models.UserModel) (entities.Token, error) {
+	token, err := auth_service.GenerateToken()
+	if err != nil {
+		return entities.Token{}, err
+	}
+	if err := r.addToken(user, token); err != nil {
+		return entities.Token{}, err
+	}
+	return token, nil
+}
+
+// AddToken stores a token generated elsewhere (e.g. when migrating existing tokens), it fails with TokenTakenErr if the token exists
+// and with UserNotFoundErr if the user doesn't
+func (r *RedisTokenStore) AddToken(username string, token entities.Token) error {
+	user, err := r.users.FindUser(username)
+	if err != nil {
+		return err
+	}
+	return r.addToken(user, token)
+}
+
+func (r *RedisTokenStore) addToken(user models.UserModel, token entities.Token) error {
+	args := []string{"SET", r.key(token.Token), formatOwner(user)}
+	if r.tokenTTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(r.tokenTTL.Milliseconds(), 10))
+	}
+	// NX keeps an existing token from being handed over to another user
+	reply, err := r.client.Do(append(args, "NX")...)
+	if err != nil {
+		return fmt.Errorf("error setting a token: %w", err)
+	}
+	if reply == nil {
+		return auth_store_contract.TokenTakenErr
+	}
+	r.invalidate(token.Token)
+	return nil
+}
+
+// DeleteToken revokes the token (e.g. on logout), it returns TokenNotFoundErr if the token doesn't exist or has expired
+func (r *RedisTokenStore) DeleteToken(token string) error {
+	reply, err := r.client.Do("DEL", r.key(token))
+	if err != nil {
+		return fmt.Errorf("error deleting a token: %w", err)
+	}
+	r.invalidate(token)
+	if deleted, ok := reply.(int64); !ok || deleted == 0 {
+		return token_store_contract.TokenNotFoundErr
+	}
+	return nil
+}
+
+// scanBatchSize is how many keys are asked for with every SCAN
+const scanBatchSize = "1000"
+
+// ForEachToken calls fn for every live token with the username of its owner, e.g. for exporting the tokens (see user_export).
+// The keys are walked with SCAN, so the server isn't blocked, but tokens created or expiring meanwhile may be missed.
+// Tokens of deleted users (or of their usernames' new users) are skipped like in FindUserFromToken.
+func (r *RedisTokenStore) ForEachToken(fn func(username string, token entities.Token) error) error {
+	pattern := escapeGlob(r.keyPrefix) + "*"
+	for cursor := "0"; ; {
+		reply, err := r.client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanBatchSize)
+		if err != nil {
+			return fmt.Errorf("error scanning the tokens: %w", err)
+		}
+		next, keys, ok := parseScanReply(reply)
+		if !ok {
+			return errUnexpectedReply
+		}
+		for _, key := range keys {
+			user, err := r.FindUserFromToken(strings.TrimPrefix(key, r.keyPrefix))
+			if errors.Is(err, token_store_contract.TokenNotFoundErr) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(user.Username, user.AuthToken); err != nil {
+				return err
+			}
+		}
+		if next == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func parseScanReply(reply any) (cursor string, keys []string, ok bool) {
+	elements, ok := reply.([]any)
+	if !ok || len(elements) != 2 {
+		return "", nil, false
+	}
+	cursor, ok = elements[0].(string)
+	keyElements, isArray := elements[1].([]any)
+	if !ok || !isArray {
+		return "", nil, false
+	}
+	for _, element := range keyElements {
+		key, ok := element.(string)
+		if !ok {
+			return "", nil, false
+		}
+		keys = append(keys, key)
+	}
+	return cursor, keys, true
+}
+
+// escapeGlob escapes the characters special in the patterns of SCAN MATCH
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// SetTokenInvalidator makes the store notify the invalidator (e.g. a token cache) about created and deleted tokens.
+// Tokens, which expire on their own, aren't reported, so a cache in front of the store should have a shorter TTL than the tokens.
+func (r *RedisTokenStore) SetTokenInvalidator(invalidator store.TokenInvalidator) {
+	r.invalidatorMu.Lock()
+	defer r.invalidatorMu.Unlock()
+	r.invalidator = invalidator
+}
+
+func (r *RedisTokenStore) invalidate(token string) {
+	r.invalidatorMu.RLock()
+	defer r.invalidatorMu.RUnlock()
+	if r.invalidator != nil {
+		r.invalidator.Invalidate(token)
+	}
+}
+
+// Close closes the connections of the client
+func (r *RedisTokenStore) Close() error {
+	if closer, ok := r.client.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (r *RedisTokenStore) key(token string) string {
+	return r.keyPrefix + token
+}
+
+// formatOwner returns the value of the keys of the user's tokens
+func formatOwner(user models.UserModel) string {
+	return strconv.Itoa(user.Id) + ":" + user.Username
+}
+
+func parseOwner(value string) (id int, username string, ok bool) {
+	idStr, username, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(idStr)
+	return id, username, err == nil
+}
@@ -0,0 +1,261 @@
+package redis_token_store_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store"
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store/resp_client"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestRedisTokenStore(t *testing.T) {
+	user := GenerateRandomUserModel()
+	newStore := func(t *testing.T, opts ...redis_token_store.Option) (*redis_token_store.RedisTokenStore, *FakeRESPServer, *stubUserStore) {
+		server := NewFakeRESPServer(t)
+		users := &stubUserStore{users: map[string]models.UserModel{user.Username: user}}
+		store := redis_token_store.NewRedisTokenStore(resp_client.NewClient(server.Addr), users, opts...)
+		t.Cleanup(func() { store.Close() })
+		return store, server, users
+	}
+
+	t.Run("should find the user of a created token", func(t *testing.T) {
+		store, _, _ := newStore(t)
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		Assert(t, token.Token != user.AuthToken.Token, true, "the token is newly generated")
+
+		found, err := store.FindUserFromToken(token.Token)
+		AssertNoError(t, err)
+		want := user
+		want.AuthToken = token
+		Assert(t, found, want, "found user")
+	})
+	t.Run("should return TokenNotFoundErr for unknown tokens", func(t *testing.T) {
+		store, _, _ := newStore(t)
+		_, err := store.FindUserFromToken(RandomString())
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+	})
+	t.Run("should store tokens under the key prefix", func(t *testing.T) {
+		prefix := RandomString() + ":"
+		store, server, _ := newStore(t, redis_token_store.WithKeyPrefix(prefix))
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		owner, exists := server.Get(prefix + token.Token)
+		Assert(t, exists, true, "key exists")
+		Assert(t, owner, fmt.Sprintf("%d:%s", user.Id, user.Username), "value of the key")
+	})
+	t.Run("tokens should expire after the TTL", func(t *testing.T) {
+		store, _, _ := newStore(t, redis_token_store.WithTokenTTL(20*time.Millisecond))
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		_, err = store.FindUserFromToken(token.Token)
+		AssertNoError(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+		_, err = store.FindUserFromToken(token.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+	})
+	t.Run("tokens should not expire with a zero TTL", func(t *testing.T) {
+		store, server, _ := newStore(t, redis_token_store.WithTokenTTL(0))
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		ttl, err := resp_client.NewClient(server.Addr).Do("PTTL", redis_token_store.DefaultKeyPrefix+token.Token)
+		AssertNoError(t, err)
+		Assert(t, ttl, any(int64(-1)), "PTTL of the key")
+	})
+	t.Run("DeleteToken()", func(t *testing.T) {
+		t.Run("should revoke the token", func(t *testing.T) {
+			store, _, _ := newStore(t)
+			token, err := store.CreateToken(user.Username)
+			AssertNoError(t, err)
+			AssertNoError(t, store.DeleteToken(token.Token))
+			_, err = store.FindUserFromToken(token.Token)
+			AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		})
+		t.Run("should return TokenNotFoundErr for unknown tokens", func(t *testing.T) {
+			store, _, _ := newStore(t)
+			AssertError(t, store.DeleteToken(RandomString()), token_store_contract.TokenNotFoundErr)
+		})
+	})
+	t.Run("AddToken()", func(t *testing.T) {
+		t.Run("should reject a taken token", func(t *testing.T) {
+			store, _, users := newStore(t)
+			other := GenerateRandomUserModel()
+			users.add(other)
+			token := entities.Token{Token: RandomString()}
+			AssertNoError(t, store.AddToken(user.Username, token))
+			AssertError(t, store.AddToken(other.Username, token), auth_store_contract.TokenTakenErr)
+			found, err := store.FindUserFromToken(token.Token)
+			AssertNoError(t, err)
+			Assert(t, found.Username, user.Username, "owner of the token")
+		})
+		t.Run("should reject unknown users", func(t *testing.T) {
+			store, _, _ := newStore(t)
+			AssertError(t, store.AddToken(RandomString(), entities.Token{Token: RandomString()}), auth_store_contract.UserNotFoundErr)
+		})
+	})
+	t.Run("ForEachToken()", func(t *testing.T) {
+		t.Run("should list the tokens of all users across several SCAN pages", func(t *testing.T) {
+			// the prefix has characters, which are special in SCAN patterns
+			store, server, users := newStore(t, redis_token_store.WithKeyPrefix("auth:[tokens]*:"))
+			other := GenerateRandomUserModel()
+			users.add(other)
+			want := map[string]string{}
+			for i := 0; i < 1500; i++ {
+				owner := []string{user.Username, other.Username}[i%2]
+				token, err := store.CreateToken(owner)
+				AssertNoError(t, err)
+				want[token.Token] = owner
+			}
+			// keys, which aren't tokens of the store
+			_, err := resp_client.NewClient(server.Addr).Do("SET", "auth:other:"+RandomString(), "1:john")
+			AssertNoError(t, err)
+
+			got := map[string]string{}
+			err = store.ForEachToken(func(username string, token entities.Token) error {
+				got[token.Token] = username
+				return nil
+			})
+			AssertNoError(t, err)
+			Assert(t, got, want, "listed tokens")
+		})
+		t.Run("should skip tokens of deleted users", func(t *testing.T) {
+			store, _, users := newStore(t)
+			_, err := store.CreateToken(user.Username)
+			AssertNoError(t, err)
+			users.remove(user.Username)
+			err = store.ForEachToken(func(string, entities.Token) error {
+				t.Error("a token of a deleted user was listed")
+				return nil
+			})
+			AssertNoError(t, err)
+		})
+		t.Run("should stop at the first error of fn", func(t *testing.T) {
+			store, _, _ := newStore(t)
+			for i := 0; i < 2; i++ {
+				_, err := store.CreateToken(user.Username)
+				AssertNoError(t, err)
+			}
+			fnErr, calls := errors.New(RandomString()), 0
+			err := store.ForEachToken(func(string, entities.Token) error {
+				calls++
+				return fnErr
+			})
+			AssertError(t, err, fnErr)
+			Assert(t, calls, 1, "number of calls")
+		})
+	})
+	t.Run("a user registered with the username of a deleted one should not inherit its tokens", func(t *testing.T) {
+		store, server, users := newStore(t)
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		users.remove(user.Username)
+		reregistered := GenerateRandomUserModel()
+		reregistered.Id, reregistered.Username = user.Id+1, user.Username
+		users.add(reregistered)
+
+		_, err = store.FindUserFromToken(token.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		_, exists := server.Get(redis_token_store.DefaultKeyPrefix + token.Token)
+		Assert(t, exists, false, "key exists")
+	})
+	t.Run("should delete tokens of deleted users", func(t *testing.T) {
+		store, server, users := newStore(t)
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		users.remove(user.Username)
+
+		_, err = store.FindUserFromToken(token.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		_, exists := server.Get(redis_token_store.DefaultKeyPrefix + token.Token)
+		Assert(t, exists, false, "key exists")
+	})
+	t.Run("should forward errors of the user store", func(t *testing.T) {
+		store, _, users := newStore(t)
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		users.err = errors.New(RandomString())
+		_, err = store.FindUserFromToken(token.Token)
+		AssertError(t, err, users.err)
+	})
+	t.Run("should return an error if the server is down", func(t *testing.T) {
+		store, server, _ := newStore(t)
+		server.Close()
+		_, err := store.CreateToken(user.Username)
+		AssertSomeError(t, err)
+		_, err = store.FindUserFromToken(RandomString())
+		AssertSomeError(t, err)
+		Assert(t, errors.Is(err, token_store_contract.TokenNotFoundErr), false, "error is TokenNotFoundErr")
+	})
+	t.Run("should notify the token invalidator", func(t *testing.T) {
+		store, _, _ := newStore(t)
+		invalidator := &stubTokenInvalidator{}
+		store.SetTokenInvalidator(invalidator)
+		token, err := store.CreateToken(user.Username)
+		AssertNoError(t, err)
+		AssertNoError(t, store.DeleteToken(token.Token))
+		Assert(t, invalidator.invalidated, []string{token.Token, token.Token}, "invalidated tokens")
+	})
+}
+
+type stubUserStore struct {
+	mu    sync.Mutex
+	users map[string]models.UserModel
+	err   error
+}
+
+func (s *stubUserStore) UserExists(username string) bool {
+	_, err := s.FindUser(username)
+	return err == nil
+}
+
+func (s *stubUserStore) CreateUser(string, string, entities.Token) (models.UserModel, error) {
+	panic("unimplemented")
+}
+
+func (s *stubUserStore) FindUser(username string) (models.UserModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return models.UserModel{}, s.err
+	}
+	user, ok := s.users[username]
+	if !ok {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	return user, nil
+}
+
+func (s *stubUserStore) UpdatePassword(string, string, []string) error {
+	panic("unimplemented")
+}
+
+func (s *stubUserStore) add(user models.UserModel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Username] = user
+}
+
+func (s *stubUserStore) remove(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+}
+
+type stubTokenInvalidator struct {
+	invalidated []string
+}
+
+func (s *stubTokenInvalidator) Invalidate(token string) {
+	s.invalidated = append(s.invalidated, token)
+}
+
+func (s *stubTokenInvalidator) InvalidateAll() {}
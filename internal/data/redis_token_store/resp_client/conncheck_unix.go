@@ -0,0 +1,42 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package resp_client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// checkConn returns an error if an idle connection was closed by the server (or it sent something unexpected),
+// by peeking at the socket without blocking, so that nothing has to be sent to find it out
+func checkConn(conn net.Conn) error {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var checkErr error
+	err = rawConn.Control(func(fd uintptr) {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		switch {
+		case n == 0 && err == nil:
+			checkErr = io.EOF
+		case n > 0:
+			checkErr = errUnexpectedReply
+		case errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK):
+			// nothing to read, the connection is open
+		default:
+			checkErr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return checkErr
+}
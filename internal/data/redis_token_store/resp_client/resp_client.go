@@ -0,0 +1,265 @@
+// Package resp_client is a minimal client for servers speaking the Redis protocol (RESP2), e.g. Redis, Valkey or KeyDB.
+// It only sends commands and parses replies, so it supports just what the token store needs.
+package resp_client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultMaxIdle = 16
+)
+
+// ErrorReply is an error returned by the server (e.g. "WRONGTYPE ..."), the connection stays usable after it
+type ErrorReply string
+
+func (e ErrorReply) Error() string {
+	return "redis: " + string(e)
+}
+
+var errUnexpectedReply = errors.New("unexpected reply from the redis server")
+
+type Option func(*Client)
+
+// WithPassword sends AUTH with the password on every new connection
+func WithPassword(password string) Option {
+	return func(c *Client) {
+		c.password = password
+	}
+}
+
+// WithDB selects the logical database on every new connection
+func WithDB(db int) Option {
+	return func(c *Client) {
+		c.db = db
+	}
+}
+
+// WithTimeout sets the timeout for connecting and for every command
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithMaxIdle sets how many idle connections are kept for reuse
+func WithMaxIdle(maxIdle int) Option {
+	return func(c *Client) {
+		c.idle = make(chan *conn, maxIdle)
+	}
+}
+
+// Client sends commands over a pool of connections, it is safe for concurrent use
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *conn
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+}
+
+func NewClient(addr string, opts ...Option) *Client {
+	c := &Client{addr: addr, timeout: DefaultTimeout, idle: make(chan *conn, DefaultMaxIdle)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Do sends the command and returns its reply: a string for simple and bulk strings, nil for a null bulk string,
+// an int64 for integers or a []any for arrays. Errors returned by the server are ErrorReply.
+//
+// A command is sent at most once, since the server might have applied it even if its reply didn't arrive (e.g. after a timeout),
+// and commands like SET NX or DEL can't be repeated safely. Idle connections closed by the server are noticed before sending
+// (see checkConn), and a command, which couldn't be written to a reused connection at all, is sent on a new one.
+func (c *Client) Do(args ...string) (any, error) {
+	cn, reused, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, sent, err := cn.do(c.timeout, args)
+	if err != nil && reused && !sent {
+		cn.netConn.Close()
+		cn, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+		reply, _, err = cn.do(c.timeout, args)
+	}
+	if err != nil && !isErrorReply(err) {
+		cn.netConn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// Close closes the idle connections, connections in use are closed when they are returned
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.netConn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection, which is still open, or a new one
+func (c *Client) get() (cn *conn, reused bool, err error) {
+	for {
+		select {
+		case cn := <-c.idle:
+			if cn.reader.Buffered() == 0 && checkConn(cn.netConn) == nil {
+				return cn, true, nil
+			}
+			cn.netConn.Close()
+		default:
+			cn, err := c.dial()
+			return cn, false, err
+		}
+	}
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.netConn.Close()
+	}
+}
+
+func (c *Client) dial() (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the redis server: %w", err)
+	}
+	cn := &conn{netConn: netConn, reader: bufio.NewReader(netConn), writer: bufio.NewWriter(netConn)}
+	if c.password != "" {
+		if _, _, err := cn.do(c.timeout, []string{"AUTH", c.password}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("error authenticating to the redis server: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, _, err := cn.do(c.timeout, []string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("error selecting the redis database: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+// do also reports whether the command might have reached the server
+func (cn *conn) do(timeout time.Duration, args []string) (reply any, sent bool, err error) {
+	if err := cn.netConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, false, err
+	}
+	if err := WriteCommand(cn.writer, args); err != nil {
+		// a part of the command might have been written, but the server doesn't execute incomplete commands
+		return nil, false, fmt.Errorf("error sending a command to the redis server: %w", err)
+	}
+	reply, err = ReadReply(cn.reader)
+	if err != nil && !isErrorReply(err) {
+		return nil, true, fmt.Errorf("error reading a reply from the redis server: %w", err)
+	}
+	return reply, true, err
+}
+
+func isErrorReply(err error) bool {
+	var reply ErrorReply
+	return errors.As(err, &reply)
+}
+
+// WriteCommand writes the command as an array of bulk strings and flushes w
+func WriteCommand(w *bufio.Writer, args []string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return w.Flush()
+}
+
+// ReadReply reads a single reply, see Client.Do for how it is represented
+func ReadReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errUnexpectedReply
+	}
+	payload := line[1:]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, ErrorReply(payload)
+	case ':':
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, errUnexpectedReply
+		}
+		return n, nil
+	case '$':
+		length, err := strconv.Atoi(payload)
+		if err != nil || length < -1 {
+			return nil, errUnexpectedReply
+		}
+		if length == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil || count < -1 {
+			return nil, errUnexpectedReply
+		}
+		if count == -1 {
+			return nil, nil
+		}
+		elements := make([]any, 0, count)
+		for i := 0; i < count; i++ {
+			element, err := ReadReply(r)
+			if err != nil && !isErrorReply(err) {
+				return nil, err
+			}
+			if err != nil {
+				element = err
+			}
+			elements = append(elements, element)
+		}
+		return elements, nil
+	default:
+		return nil, errUnexpectedReply
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errUnexpectedReply
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,123 @@
+package resp_client_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store/resp_client"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestClient(t *testing.T) {
+	t.Run("should send commands and parse replies", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		client := resp_client.NewClient(server.Addr)
+		defer client.Close()
+		key, value := RandomString(), RandomString()
+
+		reply, err := client.Do("GET", key)
+		AssertNoError(t, err)
+		Assert(t, reply, nil, "reply to GET of a missing key")
+
+		reply, err = client.Do("SET", key, value)
+		AssertNoError(t, err)
+		Assert(t, reply, any("OK"), "reply to SET")
+
+		reply, err = client.Do("GET", key)
+		AssertNoError(t, err)
+		Assert(t, reply, any(value), "reply to GET")
+
+		reply, err = client.Do("EXISTS", key, RandomString())
+		AssertNoError(t, err)
+		Assert(t, reply, any(int64(1)), "reply to EXISTS")
+	})
+	t.Run("should return error replies and keep the connection usable", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		client := resp_client.NewClient(server.Addr)
+		defer client.Close()
+
+		_, err := client.Do("UNKNOWN")
+		var errReply resp_client.ErrorReply
+		Assert(t, errors.As(err, &errReply), true, "error is an error reply")
+
+		reply, err := client.Do("PING")
+		AssertNoError(t, err)
+		Assert(t, reply, any("PONG"), "reply to PING")
+		Assert(t, server.Accepted(), 1, "number of connections")
+	})
+	t.Run("should authenticate and select the database on new connections", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		password, key := RandomString(), RandomString()
+		server.SetPassword(password)
+
+		_, err := resp_client.NewClient(server.Addr, resp_client.WithPassword(RandomString())).Do("PING")
+		AssertSomeError(t, err)
+
+		client := resp_client.NewClient(server.Addr, resp_client.WithPassword(password), resp_client.WithDB(1))
+		defer client.Close()
+		_, err = client.Do("SET", key, RandomString())
+		AssertNoError(t, err)
+		_, exists := server.Get(key)
+		Assert(t, exists, false, "key exists in the database 0")
+	})
+	t.Run("should reconnect if the server closes an idle connection", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		client := resp_client.NewClient(server.Addr)
+		defer client.Close()
+		_, err := client.Do("PING")
+		AssertNoError(t, err)
+
+		server.CloseConnections()
+		reply, err := client.Do("PING")
+		AssertNoError(t, err)
+		Assert(t, reply, any("PONG"), "reply to PING")
+		Assert(t, server.Accepted(), 2, "number of connections")
+	})
+	t.Run("should not resend a command whose reply timed out", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		client := resp_client.NewClient(server.Addr, resp_client.WithTimeout(50*time.Millisecond))
+		defer client.Close()
+		_, err := client.Do("PING")
+		AssertNoError(t, err)
+
+		server.SetReplyDelay(200 * time.Millisecond)
+		key := RandomString()
+		_, err = client.Do("SET", key, RandomString(), "NX")
+		AssertSomeError(t, err)
+		_, exists := server.Get(key)
+		Assert(t, exists, true, "the command was applied")
+		Assert(t, server.Commands(), 2, "number of executed commands")
+	})
+	t.Run("should fail if the server is unreachable", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		addr := server.Addr
+		server.Close()
+		_, err := resp_client.NewClient(addr).Do("PING")
+		AssertSomeError(t, err)
+	})
+	t.Run("should be safe for concurrent use", func(t *testing.T) {
+		server := NewFakeRESPServer(t)
+		client := resp_client.NewClient(server.Addr, resp_client.WithMaxIdle(4))
+		defer client.Close()
+
+		const goroutines = 50
+		var wg sync.WaitGroup
+		wg.Add(goroutines)
+		for i := 0; i < goroutines; i++ {
+			go func(i int) {
+				defer wg.Done()
+				// random strings alone can collide between goroutines
+				key, value := fmt.Sprintf("%s%d", RandomString(), i), RandomString()
+				_, err := client.Do("SET", key, value)
+				AssertNoError(t, err)
+				reply, err := client.Do("GET", key)
+				AssertNoError(t, err)
+				Assert(t, reply, any(value), "reply to GET")
+			}(i)
+		}
+		wg.Wait()
+	})
+}
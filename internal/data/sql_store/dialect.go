@@ -0,0 +1,79 @@
+package sql_store
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect holds everything, which differs between the supported databases
+type Dialect struct {
+	Name string
+	// idColumn is the definition of an auto incremented primary key
+	idColumn string
+	// indexedText is the type for columns with a unique index (MySQL can't index TEXT columns)
+	indexedText string
+	// caseSensitiveIndexedText replaces indexedText, if its comparisons (and so the unique indexes) ignore case by default, see migrations
+	caseSensitiveIndexedText string
+	// numberedPlaceholders is true for databases using $1, $2... instead of ?
+	numberedPlaceholders bool
+	// supportsReturning is true for databases, which can return the generated id from INSERT ... RETURNING
+	supportsReturning bool
+	// migrationLock keeps processes starting at the same time from applying the same migrations, see migrate
+	migrationLock migrationLock
+}
+
+// SQLite works with e.g. github.com/mattn/go-sqlite3 or modernc.org/sqlite (version 3.35+ is required)
+var SQLite = Dialect{
+	Name:              "sqlite",
+	idColumn:          "INTEGER PRIMARY KEY AUTOINCREMENT",
+	indexedText:       "TEXT",
+	supportsReturning: true,
+	// a write transaction locks the whole database, so the migrations are applied in it
+	migrationLock: migrationLock{lock: "BEGIN IMMEDIATE", unlock: "COMMIT", transactional: true},
+}
+
+// PostgreSQL works with e.g. github.com/lib/pq or github.com/jackc/pgx/v5/stdlib
+var PostgreSQL = Dialect{
+	Name:                 "postgres",
+	idColumn:             "SERIAL PRIMARY KEY",
+	indexedText:          "TEXT",
+	numberedPlaceholders: true,
+	supportsReturning:    true,
+	migrationLock: migrationLock{
+		lock:   "SELECT pg_advisory_lock(" + migrationLockId + ")",
+		unlock: "SELECT pg_advisory_unlock(" + migrationLockId + ")",
+	},
+}
+
+// MySQL works with e.g. github.com/go-sql-driver/mysql
+var MySQL = Dialect{
+	Name:        "mysql",
+	idColumn:    "INT AUTO_INCREMENT PRIMARY KEY",
+	indexedText: "VARCHAR(255)",
+	// the default collations of MySQL ignore case (and trailing spaces), while usernames and tokens are compared byte by byte
+	caseSensitiveIndexedText: "VARCHAR(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin",
+	// a negative timeout waits for the lock indefinitely, GET_LOCK returns 1 once it is taken
+	migrationLock: migrationLock{
+		lock:          "SELECT GET_LOCK('" + migrationLockName + "', -1)",
+		unlock:        "SELECT RELEASE_LOCK('" + migrationLockName + "')",
+		returnsResult: true,
+	},
+}
+
+// rebind converts a query written with ? placeholders to the placeholders of this dialect
+func (d Dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	rebound := strings.Builder{}
+	argNum := 0
+	for _, char := range query {
+		if char == '?' {
+			argNum++
+			rebound.WriteString("$" + strconv.Itoa(argNum))
+		} else {
+			rebound.WriteRune(char)
+		}
+	}
+	return rebound.String()
+}
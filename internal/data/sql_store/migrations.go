@@ -0,0 +1,163 @@
+package sql_store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// migrations are applied in order, each one exactly once.
+// Never change an existing migration, add a new one instead.
+var migrations = []func(d Dialect) []string{
+	func(d Dialect) []string {
+		return []string{
+			`CREATE TABLE users (
+				id ` + d.idColumn + `,
+				username ` + d.indexedText + ` NOT NULL,
+				stored_pass TEXT NOT NULL,
+				auth_token ` + d.indexedText + ` NOT NULL,
+				password_history TEXT NOT NULL,
+				CONSTRAINT users_username_unique UNIQUE (username),
+				CONSTRAINT users_auth_token_unique UNIQUE (auth_token)
+			)`,
+		}
+	},
+	// public ids, see the user_ids package. Both columns are NULL for users without them, which unique indexes allow for many rows.
+	func(d Dialect) []string {
+		return []string{
+			`ALTER TABLE users ADD COLUMN public_id ` + d.indexedText,
+			`ALTER TABLE users ADD COLUMN legacy_id INTEGER`,
+			`CREATE UNIQUE INDEX users_public_id_unique ON users (public_id)`,
+			`CREATE UNIQUE INDEX users_legacy_id_unique ON users (legacy_id)`,
+		}
+	},
+	// case-sensitive usernames, tokens and public ids, which only MySQL compared case-insensitively,
+	// so that e.g. "alice" couldn't register after "Alice". Existing rows can't clash, since the old indexes were stricter.
+	func(d Dialect) []string {
+		if d.caseSensitiveIndexedText == "" {
+			return nil
+		}
+		return []string{
+			`ALTER TABLE users
+				MODIFY username ` + d.caseSensitiveIndexedText + ` NOT NULL,
+				MODIFY auth_token ` + d.caseSensitiveIndexedText + ` NOT NULL,
+				MODIFY public_id ` + d.caseSensitiveIndexedText,
+		}
+	},
+}
+
+// the names of the locks taken by migrate, they only need to differ from the locks of other applications using the database
+const (
+	migrationLockId   = "7262653470139241"
+	migrationLockName = "golang_auth_schema_migrations"
+)
+
+// migrationLock is a lock held by a connection, see Dialect.migrationLock
+type migrationLock struct {
+	lock, unlock string
+	// the lock statement returns 1 if the lock was taken
+	returnsResult bool
+	// the lock is a transaction, which is committed by unlock, so the migrations are applied in it instead of their own ones
+	transactional bool
+}
+
+func (l migrationLock) acquire(ctx context.Context, conn *sql.Conn) error {
+	if !l.returnsResult {
+		_, err := conn.ExecContext(ctx, l.lock)
+		return err
+	}
+	var taken sql.NullInt64
+	if err := conn.QueryRowContext(ctx, l.lock).Scan(&taken); err != nil {
+		return err
+	}
+	if taken.Int64 != 1 {
+		return errors.New("the lock wasn't taken")
+	}
+	return nil
+}
+
+// release releases the lock, a transactional lock is committed only if applied is set
+func (l migrationLock) release(ctx context.Context, conn *sql.Conn, applied bool) error {
+	if l.transactional && !applied {
+		_, err := conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	_, err := conn.ExecContext(ctx, l.unlock)
+	return err
+}
+
+// migrate applies the pending migrations holding the migration lock of the dialect,
+// so that when several processes start at the same time, one of them applies the migrations and the others wait for it.
+// The current version is read under the lock, so the waiting ones then find nothing to apply.
+func migrate(db *sql.DB, dialect Dialect) error {
+	ctx := context.Background()
+	// the locks belong to a connection (a session), so everything is done on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting a connection for migrations: %w", err)
+	}
+	defer conn.Close()
+	if err := dialect.migrationLock.acquire(ctx, conn); err != nil {
+		return fmt.Errorf("error taking the migration lock: %w", err)
+	}
+	err = migrateLocked(ctx, conn, dialect)
+	if releaseErr := dialect.migrationLock.release(ctx, conn, err == nil); releaseErr != nil && err == nil {
+		err = fmt.Errorf("error releasing the migration lock: %w", releaseErr)
+	}
+	return err
+}
+
+// migrateLocked should be called with the migration lock taken on conn
+func migrateLocked(ctx context.Context, conn *sql.Conn, dialect Dialect) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %w", err)
+	}
+	var currentVersion int
+	err = conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&currentVersion)
+	if err != nil {
+		return fmt.Errorf("error getting current schema version: %w", err)
+	}
+	if currentVersion > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", currentVersion, len(migrations))
+	}
+
+	for version := currentVersion + 1; version <= len(migrations); version++ {
+		if err := applyMigration(ctx, conn, dialect, version); err != nil {
+			return fmt.Errorf("error applying migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// execer is implemented by both *sql.Conn and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, dialect Dialect, version int) error {
+	if dialect.migrationLock.transactional {
+		// already in the transaction of the lock
+		return execMigration(ctx, conn, dialect, version)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := execMigration(ctx, tx, dialect, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func execMigration(ctx context.Context, db execer, dialect Dialect, version int) error {
+	for _, statement := range migrations[version-1](dialect) {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	_, err := db.ExecContext(ctx, dialect.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+	return err
+}
@@ -0,0 +1,120 @@
+package sql_store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+)
+
+// WithIdStrategy makes new users get public ids generated by the strategy.
+// Existing users keep being exposed with their integer ids until they are given public ids with SetPublicId.
+func WithIdStrategy(strategy user_ids.Strategy) Option {
+	return func(s *SQLStore) {
+		s.idStrategy = strategy
+	}
+}
+
+// maxPublicIdAttempts bounds the retries after generating a taken public id, which only a broken strategy does repeatedly
+const maxPublicIdAttempts = 10
+
+var errPublicIdsExhausted = errors.New("the id strategy keeps generating taken public ids")
+
+// newPublicId returns a public id for a new user, or an empty one if no id strategy is set.
+// The id is checked to be free beforehand, the unique index catches the (practically impossible) concurrent generation of the same id.
+func (s *SQLStore) newPublicId() (string, error) {
+	if s.idStrategy == nil {
+		return "", nil
+	}
+	for i := 0; i < maxPublicIdAttempts; i++ {
+		id, err := s.idStrategy()
+		if err != nil {
+			return "", err
+		}
+		_, err = s.FindUserById(id)
+		if errors.Is(err, auth_store_contract.UserNotFoundErr) {
+			return id, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", errPublicIdsExhausted
+}
+
+// FindUserById finds the user by its public id, by its legacy id,
+// or by its integer id if it has neither (see mappers.ExposedId)
+func (s *SQLStore) FindUserById(id string) (models.UserModel, error) {
+	user, err := scanUser(s.findUserByPublicId.QueryRow(id))
+	if !errors.Is(err, sql.ErrNoRows) {
+		return user, err
+	}
+	legacyId, ok := user_ids.ParseLegacyId(id)
+	if !ok {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	user, err = scanUser(s.findUserByLegacyId.QueryRow(legacyId))
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = scanUser(s.findLegacyUser.QueryRow(legacyId))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	return user, err
+}
+
+// SetPublicId replaces the public and the legacy id of the user, e.g. for giving a public id to a user created without an id strategy.
+// It returns auth_store_contract.PublicIdTakenErr if another user is resolvable by one of the new ids.
+func (s *SQLStore) SetPublicId(username, publicId string, legacyId int) error {
+	if err := s.checkIdsFree(username, publicId, legacyId); err != nil {
+		return err
+	}
+	result, err := s.setPublicId.Exec(nullString(publicId), sql.NullInt64{Int64: int64(legacyId), Valid: legacyId != 0}, username)
+	if err != nil {
+		// the unique indexes reject ids taken concurrently
+		if checkErr := s.checkIdsFree(username, publicId, legacyId); checkErr != nil {
+			return checkErr
+		}
+		return fmt.Errorf("error setting public id: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting number of updated rows: %w", err)
+	}
+	if updated == 0 {
+		return auth_store_contract.UserNotFoundErr
+	}
+	return nil
+}
+
+// checkIdsFree returns PublicIdTakenErr if a user other than username is resolvable by one of the ids
+func (s *SQLStore) checkIdsFree(username, publicId string, legacyId int) error {
+	ids := []string{}
+	if publicId != "" {
+		ids = append(ids, publicId)
+	}
+	if legacyId != 0 {
+		ids = append(ids, user_ids.FormatLegacyId(legacyId))
+	}
+	for _, id := range ids {
+		owner, err := s.FindUserById(id)
+		if errors.Is(err, auth_store_contract.UserNotFoundErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if owner.Username != username {
+			return auth_store_contract.PublicIdTakenErr
+		}
+	}
+	return nil
+}
+
+// nullString stores empty strings as NULL, so that they don't violate unique indexes
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
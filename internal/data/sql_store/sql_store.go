@@ -0,0 +1,269 @@
+package sql_store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+)
+
+// SQLStore keeps users in a database accessed via database/sql,
+// so (unlike PersistentInMemoryFileStore) it can be shared between multiple instances of the application.
+// Uniqueness of usernames and tokens is enforced by the database.
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+	// generates public ids of new users, if set
+	idStrategy user_ids.Strategy
+
+	insertUser        *sql.Stmt
+	findUser          *sql.Stmt
+	findUserFromToken *sql.Stmt
+	userExists        *sql.Stmt
+	updatePassword    *sql.Stmt
+	replaceHash       *sql.Stmt
+	listUsers         *sql.Stmt
+	// see public_ids.go
+	findUserByPublicId *sql.Stmt
+	findUserByLegacyId *sql.Stmt
+	findLegacyUser     *sql.Stmt
+	setPublicId        *sql.Stmt
+}
+
+type Option func(*SQLStore)
+
+// NewSQLStore applies all pending schema migrations and prepares the statements.
+// The caller is responsible for registering the driver and opening db.
+func NewSQLStore(db *sql.DB, dialect Dialect, opts ...Option) (*SQLStore, error) {
+	if err := migrate(db, dialect); err != nil {
+		return nil, fmt.Errorf("error migrating the database: %w", err)
+	}
+
+	s := &SQLStore{db: db, dialect: dialect}
+	for _, opt := range opts {
+		opt(s)
+	}
+	insertUser := `INSERT INTO users (username, stored_pass, auth_token, password_history, public_id) VALUES (?, ?, ?, ?, ?)`
+	if dialect.supportsReturning {
+		insertUser += ` RETURNING id`
+	}
+	const selectUser = `SELECT id, username, stored_pass, auth_token, password_history, public_id, legacy_id FROM users`
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.insertUser, insertUser},
+		{&s.findUser, selectUser + ` WHERE username = ?`},
+		{&s.findUserFromToken, selectUser + ` WHERE auth_token = ?`},
+		{&s.userExists, `SELECT COUNT(*) FROM users WHERE username = ?`},
+		{&s.updatePassword, `UPDATE users SET stored_pass = ?, password_history = ? WHERE username = ?`},
+		{&s.replaceHash, `UPDATE users SET stored_pass = ? WHERE username = ? AND stored_pass = ?`},
+		{&s.listUsers, selectUser + ` ORDER BY id`},
+		{&s.findUserByPublicId, selectUser + ` WHERE public_id = ?`},
+		{&s.findUserByLegacyId, selectUser + ` WHERE legacy_id = ?`},
+		{&s.findLegacyUser, selectUser + ` WHERE id = ? AND public_id IS NULL AND legacy_id IS NULL`},
+		{&s.setPublicId, `UPDATE users SET public_id = ?, legacy_id = ? WHERE username = ?`},
+	}
+	for _, statement := range statements {
+		stmt, err := db.Prepare(dialect.rebind(statement.query))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("error preparing statement %q: %w", statement.query, err)
+		}
+		*statement.stmt = stmt
+	}
+	return s, nil
+}
+
+// Close closes the prepared statements, but not the db itself
+func (s *SQLStore) Close() error {
+	statements := []*sql.Stmt{
+		s.insertUser, s.findUser, s.findUserFromToken, s.userExists, s.updatePassword, s.replaceHash, s.listUsers,
+		s.findUserByPublicId, s.findUserByLegacyId, s.findLegacyUser, s.setPublicId,
+	}
+	for _, stmt := range statements {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) CreateUser(username, storedPass string, token entities.Token) (models.UserModel, error) {
+	publicId, err := s.newPublicId()
+	if err != nil {
+		return models.UserModel{}, err
+	}
+	var id int64
+	if s.dialect.supportsReturning {
+		err := s.insertUser.QueryRow(username, storedPass, token.Token, "", nullString(publicId)).Scan(&id)
+		if err != nil {
+			return models.UserModel{}, s.insertError(username, token.Token, err)
+		}
+	} else {
+		result, err := s.insertUser.Exec(username, storedPass, token.Token, "", nullString(publicId))
+		if err != nil {
+			return models.UserModel{}, s.insertError(username, token.Token, err)
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return models.UserModel{}, fmt.Errorf("error getting id of the inserted user: %w", err)
+		}
+	}
+	return models.UserModel{
+		Id:         int(id),
+		Username:   username,
+		StoredPass: storedPass,
+		AuthToken:  token,
+		PublicId:   publicId,
+	}, nil
+}
+
+// insertError maps violations of the unique constraints on usernames and tokens to UsernameTakenErr and TokenTakenErr.
+// The error codes differ between drivers, so instead of parsing them the username and the token are looked up after a failed insert:
+// if one of them exists now, the insert has lost the race to another one (possibly from a different instance).
+func (s *SQLStore) insertError(username, token string, err error) error {
+	if s.UserExists(username) {
+		return auth_store_contract.UsernameTakenErr
+	}
+	if _, findErr := s.FindUserFromToken(token); findErr == nil {
+		return auth_store_contract.TokenTakenErr
+	}
+	return fmt.Errorf("error inserting a user: %w", err)
+}
+
+func (s *SQLStore) FindUser(username string) (models.UserModel, error) {
+	user, err := scanUser(s.findUser.QueryRow(username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	return user, err
+}
+
+func (s *SQLStore) FindUserFromToken(token string) (models.UserModel, error) {
+	user, err := scanUser(s.findUserFromToken.QueryRow(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserModel{}, token_store_contract.TokenNotFoundErr
+	}
+	return user, err
+}
+
+// UserExists returns false if the query fails, since the interface doesn't allow returning an error.
+// In this case the following CreateUser will fail because of the unique constraint anyway.
+func (s *SQLStore) UserExists(username string) bool {
+	var count int
+	if err := s.userExists.QueryRow(username).Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func (s *SQLStore) UpdatePassword(username, storedPass string, passwordHistory []string) error {
+	history, err := encodeHistory(passwordHistory)
+	if err != nil {
+		return err
+	}
+	result, err := s.updatePassword.Exec(storedPass, history, username)
+	if err != nil {
+		return fmt.Errorf("error updating password: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting number of updated rows: %w", err)
+	}
+	if updated == 0 {
+		return auth_store_contract.UserNotFoundErr
+	}
+	return nil
+}
+
+// ReplaceHash sets newHash only if the stored hash of the user still equals oldHash, which the database checks atomically with the update
+func (s *SQLStore) ReplaceHash(username, oldHash, newHash string) (bool, error) {
+	result, err := s.replaceHash.Exec(newHash, username, oldHash)
+	if err != nil {
+		return false, fmt.Errorf("error replacing the password hash: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error getting number of updated rows: %w", err)
+	}
+	if updated == 0 {
+		if !s.UserExists(username) {
+			return false, auth_store_contract.UserNotFoundErr
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// ForEachUser calls fn for every user in the order of ids, stopping at the first error returned by fn.
+// The users are read with a single query, so with most databases they are a consistent snapshot.
+func (s *SQLStore) ForEachUser(fn func(models.UserModel) error) error {
+	rows, err := s.listUsers.Query()
+	if err != nil {
+		return fmt.Errorf("error listing users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error listing users: %w", err)
+	}
+	return nil
+}
+
+// scanUser scans a row of *sql.Row or *sql.Rows
+func scanUser(row interface{ Scan(dest ...any) error }) (models.UserModel, error) {
+	var user models.UserModel
+	var history string
+	var publicId sql.NullString
+	var legacyId sql.NullInt64
+	err := row.Scan(&user.Id, &user.Username, &user.StoredPass, &user.AuthToken.Token, &history, &publicId, &legacyId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.UserModel{}, err
+		}
+		return models.UserModel{}, fmt.Errorf("error scanning a user: %w", err)
+	}
+	user.PasswordHistory, err = decodeHistory(history)
+	if err != nil {
+		return models.UserModel{}, err
+	}
+	user.PublicId, user.LegacyId = publicId.String, int(legacyId.Int64)
+	return user, nil
+}
+
+func encodeHistory(history []string) (string, error) {
+	if len(history) == 0 {
+		return "", nil
+	}
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return "", fmt.Errorf("error encoding password history: %w", err)
+	}
+	return string(historyJSON), nil
+}
+
+func decodeHistory(history string) ([]string, error) {
+	if history == "" {
+		return nil, nil
+	}
+	var decoded []string
+	if err := json.Unmarshal([]byte(history), &decoded); err != nil {
+		return nil, fmt.Errorf("error decoding password history: %w", err)
+	}
+	return decoded, nil
+}
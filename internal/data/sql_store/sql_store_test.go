@@ -0,0 +1,190 @@
+package sql_store_test
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/data/sql_store"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openSQLite(t testing.TB, path string, opts ...sql_store.Option) (*sql_store.SQLStore, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("error opening sqlite db: %v", err)
+	}
+	store, err := sql_store.NewSQLStore(db, sql_store.SQLite, opts...)
+	if err != nil {
+		t.Fatalf("error creating sql store: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		db.Close()
+	})
+	return store, db
+}
+
+func TestSQLStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "auth.db")
+	sutStore, _ := openSQLite(t, dbPath)
+
+	users := GenerateRandomUsers(5)
+	for i, user := range users {
+		created, err := sutStore.CreateUser(user.Username, user.Password, user.Token)
+		AssertNoError(t, err)
+		Assert(t, created.Id, i+1, "generated id")
+	}
+	assertUsersInStore := func(t testing.TB, sutStore *sql_store.SQLStore) {
+		t.Helper()
+		for i, user := range users {
+			Assert(t, sutStore.UserExists(user.Username), true, "UserExists()")
+			found, err := sutStore.FindUser(user.Username)
+			AssertNoError(t, err)
+			Assert(t, found.Id, i+1, "id")
+			Assert(t, found.StoredPass, user.Password, "stored password")
+			Assert(t, found.AuthToken, user.Token, "token")
+			found, err = sutStore.FindUserFromToken(user.Token.Token)
+			AssertNoError(t, err)
+			Assert(t, found.Username, user.Username, "username")
+		}
+	}
+	assertUsersInStore(t, sutStore)
+
+	t.Run("not found errors", func(t *testing.T) {
+		notStored := GenerateRandomUser()
+		Assert(t, sutStore.UserExists(notStored.Username), false, "UserExists()")
+		_, err := sutStore.FindUser(notStored.Username)
+		AssertError(t, err, auth_store_contract.UserNotFoundErr)
+		_, err = sutStore.FindUserFromToken(notStored.Token.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		err = sutStore.UpdatePassword(notStored.Username, RandomString(), nil)
+		AssertError(t, err, auth_store_contract.UserNotFoundErr)
+	})
+	t.Run("unique constraints", func(t *testing.T) {
+		_, err := sutStore.CreateUser(users[0].Username, RandomString(), entities.Token{Token: RandomString() + "unique"})
+		AssertError(t, err, auth_store_contract.UsernameTakenErr)
+		_, err = sutStore.CreateUser(RandomString()+"unique", RandomString(), users[0].Token)
+		AssertError(t, err, auth_store_contract.TokenTakenErr)
+	})
+	t.Run("UpdatePassword()", func(t *testing.T) {
+		history := []string{users[2].Password, RandomString()}
+		users[2].Password = RandomString()
+		AssertNoError(t, sutStore.UpdatePassword(users[2].Username, users[2].Password, history))
+		found, err := sutStore.FindUser(users[2].Username)
+		AssertNoError(t, err)
+		Assert(t, found.StoredPass, users[2].Password, "updated password")
+		Assert(t, found.PasswordHistory, history, "updated history")
+	})
+	t.Run("ForEachUser()", func(t *testing.T) {
+		var listed []string
+		AssertNoError(t, sutStore.ForEachUser(func(user models.UserModel) error {
+			listed = append(listed, user.Username)
+			return nil
+		}))
+		AssertFatal(t, len(listed), len(users), "number of listed users")
+		for i, user := range users {
+			Assert(t, listed[i], user.Username, "listed username in the order of ids")
+		}
+
+		stopErr := errors.New(RandomString())
+		calls := 0
+		err := sutStore.ForEachUser(func(models.UserModel) error {
+			calls++
+			return stopErr
+		})
+		AssertError(t, err, stopErr)
+		Assert(t, calls, 1, "number of calls after an error")
+	})
+	t.Run("persistence and idempotent migrations", func(t *testing.T) {
+		reopened, db := openSQLite(t, dbPath)
+		assertUsersInStore(t, reopened)
+		var migrationsCount int
+		AssertNoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&migrationsCount))
+		Assert(t, migrationsCount, 3, "number of applied migrations")
+	})
+	t.Run("should apply migrations once when several processes start at the same time", func(t *testing.T) {
+		freshPath := filepath.Join(t.TempDir(), "auth.db")
+		const processes = 8
+		var wg sync.WaitGroup
+		wg.Add(processes)
+		for i := 0; i < processes; i++ {
+			// openSQLite can't be used here, since it stops the test from another goroutine on errors
+			db, err := sql.Open("sqlite3", freshPath+"?_busy_timeout=5000")
+			AssertNoError(t, err)
+			defer db.Close()
+			go func() {
+				defer wg.Done()
+				_, err := sql_store.NewSQLStore(db, sql_store.SQLite)
+				AssertNoError(t, err)
+			}()
+		}
+		wg.Wait()
+		_, db := openSQLite(t, freshPath)
+		var migrationsCount int
+		AssertNoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&migrationsCount))
+		Assert(t, migrationsCount, 3, "number of applied migrations")
+	})
+	t.Run("public ids", func(t *testing.T) {
+		withIds, _ := openSQLite(t, dbPath, sql_store.WithIdStrategy(func() (string, error) {
+			return RandomString() + RandomString() + RandomString(), nil
+		}))
+		user := GenerateRandomUser()
+		created, err := withIds.CreateUser(user.Username, user.Password, user.Token)
+		AssertNoError(t, err)
+		Assert(t, created.PublicId != "", true, "the new user has a public id")
+		assertFoundById := func(t testing.TB, id string, want models.UserModel) {
+			t.Helper()
+			found, err := withIds.FindUserById(id)
+			AssertNoError(t, err)
+			Assert(t, found, want, "user found by id "+id)
+		}
+		assertFoundById(t, created.PublicId, created)
+		_, err = withIds.FindUserById(strconv.Itoa(created.Id))
+		AssertError(t, err, auth_store_contract.UserNotFoundErr)
+
+		legacy, err := withIds.FindUser(users[0].Username)
+		AssertNoError(t, err)
+		Assert(t, legacy.PublicId, "", "public id of a user created without a strategy")
+		assertFoundById(t, "1", legacy)
+
+		migrated := legacy
+		migrated.PublicId, migrated.LegacyId = RandomString()+RandomString(), legacy.Id
+		AssertNoError(t, withIds.SetPublicId(migrated.Username, migrated.PublicId, migrated.LegacyId))
+		assertFoundById(t, migrated.PublicId, migrated)
+		assertFoundById(t, "1", migrated)
+
+		AssertError(t, withIds.SetPublicId(users[1].Username, created.PublicId, 0), auth_store_contract.PublicIdTakenErr)
+		AssertError(t, withIds.SetPublicId(users[1].Username, "", 1), auth_store_contract.PublicIdTakenErr)
+		AssertError(t, withIds.SetPublicId(RandomString()+"unique", RandomString(), 0), auth_store_contract.UserNotFoundErr)
+		// users without public ids don't violate the unique indexes
+		AssertNoError(t, withIds.SetPublicId(users[1].Username, "", 0))
+		AssertNoError(t, withIds.SetPublicId(users[3].Username, "", 0))
+	})
+	t.Run("concurrent usage", func(t *testing.T) {
+		const wantedCount = 50
+		var wg sync.WaitGroup
+		wg.Add(wantedCount)
+		ids := make([]int, wantedCount)
+		for i := 0; i < wantedCount; i++ {
+			go func(i int) {
+				defer wg.Done()
+				user, err := sutStore.CreateUser(RandomString()+string(rune('a'+i%26))+RandomString(), RandomString(), entities.Token{Token: RandomString() + RandomString() + RandomString()})
+				AssertNoError(t, err)
+				ids[i] = user.Id
+			}(i)
+		}
+		wg.Wait()
+		AssertUniqueCount(t, ids, wantedCount)
+	})
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// BackupDBFileInteractor is implemented by DB file interactors, which can write and read backups of the store
+type BackupDBFileInteractor interface {
+	DBFileInteractor
+	// WriteSnapshot writes the operations to w in the format of the DB file
+	WriteSnapshot(w io.Writer, operations []models.Operation) error
+	// ReadSnapshot reads and validates the operations written by WriteSnapshot
+	ReadSnapshot(r io.Reader) ([]models.Operation, error)
+}
+
+var ErrBackupNotSupported = errors.New("the db file interactor doesn't support backups")
+
+// ErrInvalidBackup is returned by Restore if the backup can't be read or its operations don't make sense
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// Snapshot writes a point-in-time copy of the store to w, which can be restored with Restore.
+// Writers are blocked only while the state is copied in memory, not while it is being written to w.
+func (p *PersistentInMemoryFileStore) Snapshot(w io.Writer) error {
+	backuper, ok := p.fileInteractor.(BackupDBFileInteractor)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	p.mu.Lock()
+	snapshot := p.snapshot()
+	p.mu.Unlock()
+	if err := backuper.WriteSnapshot(w, snapshot); err != nil {
+		return fmt.Errorf("got an error while writing a snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore replaces the whole contents of the store with a backup written by Snapshot.
+// The backup is fully read and validated before anything is changed, so an invalid backup (ErrInvalidBackup) leaves the store intact.
+// Then the DB file is atomically replaced and the new state is swapped in, so readers see either the old or the restored users.
+func (p *PersistentInMemoryFileStore) Restore(r io.Reader) error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	backuper, ok := p.fileInteractor.(BackupDBFileInteractor)
+	if !ok {
+		return ErrBackupNotSupported
+	}
+	operations, err := backuper.ReadSnapshot(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	fresh, err := replayed(operations)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	if err := fresh.checkUniqueness(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := fresh.snapshot()
+	if err := p.fileInteractor.ReplaceOperations(snapshot); err != nil {
+		return fmt.Errorf("got an error while replacing operations in a file interactor: %w", err)
+	}
+	fresh.operationsCount = len(snapshot)
+	p.swapState(fresh)
+	return nil
+}
+
+// checkUniqueness checks that no users share a username, a token or a public id, which replaying doesn't catch
+func (p *PersistentInMemoryFileStore) checkUniqueness() error {
+	if len(p.usernameToUser) != len(p.users) {
+		return errors.New("several users have the same username")
+	}
+	withTokens, withPublicIds, withLegacyIds := 0, 0, 0
+	for _, user := range p.users {
+		if user.AuthToken.Token != "" {
+			withTokens++
+		}
+		if user.PublicId != "" {
+			withPublicIds++
+		}
+		if user.LegacyId != 0 {
+			withLegacyIds++
+		}
+	}
+	if len(p.tokenToUser) != withTokens {
+		return errors.New("several users have the same token")
+	}
+	if len(p.publicIdToUser) != withPublicIds || len(p.legacyIdToUser) != withLegacyIds {
+		return errors.New("several users have the same public id")
+	}
+	return nil
+}
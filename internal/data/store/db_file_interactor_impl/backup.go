@@ -0,0 +1,55 @@
+package db_file_interactor_impl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// Backups (see store.Snapshot) have the same format as the DB file, so a backup can also be opened as a DB file.
+// They are encrypted with the same keys as the DB file, if encryption is enabled.
+
+var ErrEmptyBackup = errors.New("the backup is empty")
+
+// WriteSnapshot writes the operations to w in the format of the DB file, record by record
+func (d *DBFileInteractorImpl) WriteSnapshot(w io.Writer, operations []models.Operation) error {
+	buffered := bufio.NewWriter(w)
+	if _, err := buffered.Write(encodeHeader()); err != nil {
+		return fmt.Errorf("error writing the snapshot: %w", err)
+	}
+	for i, op := range operations {
+		// the records start after the header
+		line, err := d.codec.encode(op, i+2)
+		if err != nil {
+			return err
+		}
+		if _, err := buffered.Write(line); err != nil {
+			return fmt.Errorf("error writing the snapshot: %w", err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("error writing the snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot reads the operations of a backup written by WriteSnapshot (or of a DB file).
+// Unlike ReadOperations, it fails on any corrupt or truncated record regardless of the verify policy,
+// since restoring a partial backup would silently lose users.
+func (d *DBFileInteractorImpl) ReadSnapshot(r io.Reader) ([]models.Operation, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the snapshot: %w", err)
+	}
+	if len(contents) == 0 {
+		return nil, ErrEmptyBackup
+	}
+	parsed, err := upgradeFile(contents, codec{keys: d.codec.keys, verifyPolicy: FailOnCorruption})
+	if err != nil {
+		return nil, err
+	}
+	return parsed.operations, nil
+}
@@ -0,0 +1,54 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// Every record ends with a CRC32C checksum of the record without it, e.g.
+//
+//	{"op":"delete_user","user_id":1,"crc32c":"8a9136aa"}
+//
+// It is always the last field, so that it can be verified without re-encoding the record (which would lose unknown fields).
+// Older readers ignore it as an unknown field.
+//
+// Files with checksums have "checksums":true in the header, and every record written to such a file has one.
+// Records without it are still accepted: older versions of the library append them to any file (e.g. after a rollback),
+// and they keep the header, so a record without a checksum doesn't mean that the record is corrupt.
+// Such records are counted, and a file with any of them (or one written before checksums) is rewritten with checksums when opened for writing.
+// A record with a checksum is always verified.
+const checksumPrefix = `,"crc32c":"`
+
+// the length of `,"crc32c":"xxxxxxxx"}`
+const checksumSuffixLen = len(checksumPrefix) + 8 + 2
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksumMismatch = errors.New("record checksum mismatch")
+
+// addChecksum appends the checksum field to a JSON object without a trailing newline
+func addChecksum(record []byte) []byte {
+	sum := crc32.Checksum(record, castagnoli)
+	withoutBrace := record[:len(record)-1]
+	return append(withoutBrace, fmt.Sprintf(`%s%08x"}`, checksumPrefix, sum)...)
+}
+
+// verifyChecksum verifies the checksum of the record, reporting whether it has one (a record without it is accepted)
+func verifyChecksum(record []byte) (checked bool, err error) {
+	suffixStart := len(record) - checksumSuffixLen
+	if suffixStart < 0 || !bytes.HasSuffix(record, []byte(`"}`)) || !bytes.HasPrefix(record[suffixStart:], []byte(checksumPrefix)) {
+		return false, nil
+	}
+	want, err := strconv.ParseUint(string(record[suffixStart+len(checksumPrefix):len(record)-2]), 16, 32)
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid checksum", ErrChecksumMismatch)
+	}
+	original := append(record[:suffixStart:suffixStart], '}')
+	if got := crc32.Checksum(original, castagnoli); got != uint32(want) {
+		return false, fmt.Errorf("%w: stored %08x, computed %08x", ErrChecksumMismatch, want, got)
+	}
+	return true, nil
+}
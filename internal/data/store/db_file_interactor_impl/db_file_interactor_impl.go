@@ -1,87 +1,427 @@
 package db_file_interactor_impl
 
 import (
-	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sync"
 
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
 	"github.com/k0marov/golang-auth/internal/data/models"
-	"github.com/k0marov/golang-auth/internal/domain/entities"
 )
 
+// DBFileInteractorImpl stores operations in a versioned JSON Lines file, see format.go
 type DBFileInteractorImpl struct {
 	dbFileName string
+	codec      codec
+	readOnly   bool
+	durability Durability
+	// see WithBinarySnapshots
+	binarySnapshots bool
+	// the file holding the lock acquired by Lock, it is kept open until Close
+	lockFile *os.File
+	// see WithoutLocking
+	withoutLocking bool
+	// set by Close, after which nothing is written to the file anymore, guarded by mu
+	closed bool
+	// the background re-encryption started by ReadOperations, Close waits for it
+	background sync.WaitGroup
+	// mu serializes writes, so that the header is written only once and replacing doesn't race with appending
+	mu sync.Mutex
+	// the number of appended operations, guarded by mu
+	written uint64
+	// the number of lines in the file, which the next appended record follows, zero if it should be counted, guarded by mu
+	lines int
+	// see WithEncryptionMigration, guarded by tailMu
+	encryptionMigration bool
+	// the number of appended operations known to be on disk, guarded by syncMu (see groupSync)
+	synced uint64
+	syncMu sync.Mutex
+	// how far the file has been read, see follow.go
+	tail   tailState
+	tailMu sync.Mutex
 }
 
-func NewDBFileInteractor(dbFileName string) *DBFileInteractorImpl {
-	return &DBFileInteractorImpl{
+type Option func(*DBFileInteractorImpl)
+
+// WithEncryption encrypts every record with AES-256-GCM using the current key of the provider (see encryption.go).
+// Records encrypted with an older key are re-encrypted in the background after reading the file, so rotating the key only requires a restart.
+// Records in the clear are rejected, an existing plaintext file has to be encrypted with WithEncryptionMigration.
+func WithEncryption(keys record_encryption.KeyProvider) Option {
+	return func(d *DBFileInteractorImpl) {
+		d.codec.keys = keys
+	}
+}
+
+// WithEncryptionMigration makes the next ReadOperations accept records in the clear (and records encrypted
+// before they were bound to their lines), and synchronously rewrite the file encrypted with the current key.
+// Without it such records are rejected once encryption is enabled, so that records can't be slipped into an encrypted file.
+// The migration is one-shot: afterwards (e.g. when the file is reloaded) such records are rejected again.
+func WithEncryptionMigration() Option {
+	return func(d *DBFileInteractorImpl) {
+		d.encryptionMigration = true
+	}
+}
+
+// WithReadOnly makes the interactor never modify the file, so that it can be used by tools running alongside the writer.
+// Lock does nothing, writing methods return ErrReadOnly, and files with an older format are migrated only in memory.
+func WithReadOnly() Option {
+	return func(d *DBFileInteractorImpl) {
+		d.readOnly = true
+	}
+}
+
+func NewDBFileInteractor(dbFileName string, opts ...Option) *DBFileInteractorImpl {
+	interactor := &DBFileInteractorImpl{
 		dbFileName: dbFileName,
 	}
+	for _, opt := range opts {
+		opt(interactor)
+	}
+	return interactor
+}
+
+// ReadOperations reads all operations from the file.
+// If the file has an older format version, it is migrated and atomically rewritten in the current format,
+// while the original contents are kept next to it in a "<dbFileName>.v<version>.bak" file.
+// A truncated record at the end of the file, left by a crash while appending it, is moved aside (see recovery.go).
+// It should be called before WriteOperation, so that appended operations don't end up in a file with an older format.
+func (d *DBFileInteractorImpl) ReadOperations() ([]models.Operation, error) {
+	d.tailMu.Lock()
+	defer d.tailMu.Unlock()
+	return d.readOperations()
 }
 
-func (d *DBFileInteractorImpl) ReadUsers() ([]models.UserModel, error) {
-	dbFile, err := os.OpenFile(d.dbFileName, os.O_RDONLY|os.O_CREATE, 0666)
+// readOperations should be called with tailMu locked
+func (d *DBFileInteractorImpl) readOperations() ([]models.Operation, error) {
+	flag := os.O_RDONLY | os.O_CREATE
+	if d.readOnly {
+		flag = os.O_RDONLY
+	}
+	dbFile, err := os.OpenFile(d.dbFileName, flag, 0666)
 	if err != nil {
-		return []models.UserModel{}, fmt.Errorf("error opening file while reading users: %w", err)
+		return []models.Operation{}, fmt.Errorf("error opening file while reading operations: %w", err)
 	}
 	defer dbFile.Close()
-	csvReader := csv.NewReader(dbFile)
-	records, err := csvReader.ReadAll()
+
+	c := d.codec
+	c.acceptUnencrypted = d.encryptionMigration
+	// contents are only set for files of older versions, which are migrated below
+	parsed, end, contents, err := d.loadFile(dbFile, c)
 	if err != nil {
-		return []models.UserModel{}, fmt.Errorf("got an error while reading users: %w", err)
+		return []models.Operation{}, fmt.Errorf("got an error while parsing operations: %w", err)
+	}
+	parsed = skipDependents(parsed)
+	d.logCorruptRecords(parsed.corruptRecords)
+	if info, err := dbFile.Stat(); err == nil {
+		d.startTail(info, end, parsed)
+	}
+	operations := parsed.operations
+	if d.readOnly {
+		return operations, nil
 	}
+	// recovery might have changed the number of lines
+	d.mu.Lock()
+	d.lines = 0
+	d.mu.Unlock()
+	migrating := d.encryptionMigration
+	d.encryptionMigration = false
+	switch {
+	case !isAppendableVersion(parsed.version):
+		if err := d.migrate(contents, parsed.version, operations); err != nil {
+			return []models.Operation{}, err
+		}
+	case migrating && parsed.staleRecords != 0:
+		if err := d.ReplaceOperations(operations); err != nil {
+			return []models.Operation{}, fmt.Errorf("error encrypting the db file: %w", err)
+		}
+		log.Printf("encrypted %d records of db file %s", parsed.staleRecords, d.dbFileName)
+	case !parsed.checksums || parsed.uncheckedRecords != 0:
+		// files written before the header recorded checksums are rewritten once,
+		// and so are files, to which an older version of the library appended records without them (e.g. during a rollback)
+		if err := d.ReplaceOperations(operations); err != nil {
+			return []models.Operation{}, fmt.Errorf("error adding checksums to the db file: %w", err)
+		}
+		log.Printf("added checksums to every record of db file %s", d.dbFileName)
+	case parsed.staleRecords != 0:
+		d.background.Add(1)
+		go func() {
+			defer d.background.Done()
+			if err := d.Reencrypt(); err != nil && !errors.Is(err, ErrClosed) {
+				log.Printf("error while re-encrypting db file %s: %v", d.dbFileName, err)
+			}
+		}()
+	}
+	return operations, nil
+}
 
-	users := []models.UserModel{}
-	for _, record := range records {
-		user, err := sliceToUserModel(record)
+// readWholeFile reads the file into a buffer of its size, while io.ReadAll would grow the buffer (and copy it) many times for big files.
+// It is used only for files, which can't be streamed (see streaming.go).
+func readWholeFile(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// one more byte, so that growing while reading is noticed without another read
+	contents := make([]byte, 0, info.Size()+1)
+	for {
+		n, err := file.Read(contents[len(contents):cap(contents)])
+		contents = contents[:len(contents)+n]
+		if errors.Is(err, io.EOF) {
+			return contents, nil
+		}
 		if err != nil {
-			return []models.UserModel{}, fmt.Errorf("error converting csv row to user model: %w", err)
+			return nil, err
+		}
+		if len(contents) == cap(contents) {
+			contents = append(contents, 0)[:len(contents)]
 		}
-		users = append(users, user)
 	}
-	return users, nil
 }
 
-func (d *DBFileInteractorImpl) WriteUser(newUser models.UserModel) error {
+func (d *DBFileInteractorImpl) logCorruptRecords(corruptRecords []CorruptRecord) {
+	for _, corrupt := range corruptRecords {
+		log.Printf("skipping corrupt record on line %d of db file %s: %v", corrupt.Line, d.dbFileName, corrupt.Err)
+	}
+}
+
+// Reencrypt rewrites the file if some of its records are encrypted with an older key.
+// Writes are blocked while it runs. It returns ErrClosed after Close.
+func (d *DBFileInteractorImpl) Reencrypt() error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return ErrClosed
+	}
+	contents, err := os.ReadFile(d.dbFileName)
+	if err != nil {
+		return fmt.Errorf("error reading the db file: %w", err)
+	}
+	parsed, err := upgradeFile(contents, d.codec)
+	if err != nil {
+		return fmt.Errorf("error parsing the db file: %w", err)
+	}
+	if parsed.staleRecords == 0 {
+		return nil
+	}
+	if err := d.replace(parsed.operations); err != nil {
+		return err
+	}
+	log.Printf("re-encrypted %d records of db file %s", parsed.staleRecords, d.dbFileName)
+	return nil
+}
+
+// migrate rewrites a file with an older format version in the current one, keeping the original contents in a backup.
+// With encryption enabled no backup is kept, since older versions stored the records in the clear.
+func (d *DBFileInteractorImpl) migrate(oldContents []byte, oldVersion int, operations []models.Operation) error {
+	if d.codec.keys != nil {
+		if err := d.ReplaceOperations(operations); err != nil {
+			return fmt.Errorf("error rewriting the db file in the new format: %w", err)
+		}
+		log.Printf("migrated db file %s from format version %d to %d and encrypted it", d.dbFileName, oldVersion, currentFormatVersion)
+		return nil
+	}
+	backupFileName := fmt.Sprintf("%s.v%d.bak", d.dbFileName, oldVersion)
+	if err := os.WriteFile(backupFileName, oldContents, 0600); err != nil {
+		return fmt.Errorf("error backing up the db file before migrating it: %w", err)
+	}
+	if err := d.ReplaceOperations(operations); err != nil {
+		return fmt.Errorf("error rewriting the db file in the new format: %w", err)
+	}
+	log.Printf("migrated db file %s from format version %d to %d, the old file is kept in %s", d.dbFileName, oldVersion, currentFormatVersion, backupFileName)
+	return nil
+}
+
+func (d *DBFileInteractorImpl) WriteOperation(op models.Operation) error {
+	waitForSync, err := d.AppendOperation(op)
+	if err != nil {
+		return err
+	}
+	return waitForSync()
+}
+
+// AppendOperation appends the operation, leaving the fsync of GroupCommit to the returned function,
+// so that the caller can wait for it without blocking its other writers (see store.AppendingDBFileInteractor)
+func (d *DBFileInteractorImpl) AppendOperation(op models.Operation) (waitForSync func() error, err error) {
+	if d.readOnly {
+		return nil, ErrReadOnly
+	}
+	written, err := d.append(op)
+	if err != nil {
+		return nil, err
+	}
+	if d.durability != GroupCommit {
+		return func() error { return nil }, nil
+	}
+	return func() error { return d.groupSync(written) }, nil
+}
+
+// append writes the operation to the end of the file and returns the number of operations appended so far.
+// It is encoded under mu, since encrypted records are bound to their lines.
+func (d *DBFileInteractorImpl) append(op models.Operation) (written uint64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, ErrClosed
+	}
 	dbFile, err := os.OpenFile(d.dbFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
-		return fmt.Errorf("error opening file writing appending user: %w", err)
+		return 0, fmt.Errorf("error opening file while appending operation: %w", err)
 	}
 	defer dbFile.Close()
-	csvWriter := csv.NewWriter(dbFile)
+	info, err := dbFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error getting size of the db file: %w", err)
+	}
+	var header []byte
+	if info.Size() == 0 {
+		header, d.lines = encodeHeader(), 1
+	} else if d.lines == 0 {
+		contents, err := os.ReadFile(d.dbFileName)
+		if err != nil {
+			return 0, fmt.Errorf("error counting the lines of the db file: %w", err)
+		}
+		d.lines = countLines(contents)
+	}
+	line, err := d.codec.encode(op, d.lines+1)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dbFile.Write(append(header, line...)); err != nil {
+		// a part of the record might have been written
+		d.lines = 0
+		return 0, fmt.Errorf("error appending operation: %w", err)
+	}
+	d.lines++
+	if d.durability == SyncEveryWrite {
+		if err := dbFile.Sync(); err != nil {
+			return 0, fmt.Errorf("error syncing the db file: %w", err)
+		}
+	}
+	d.written++
+	return d.written, nil
+}
+
+// Size returns the current size of the DB file in bytes
+func (d *DBFileInteractorImpl) Size() (int64, error) {
+	info, err := os.Stat(d.dbFileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error getting size of the db file: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// ReplaceOperations atomically replaces the whole DB file with the given operations (e.g. a snapshot of the store).
+// They are written to a temp file in the same directory, which is fsynced and then renamed over the DB file,
+// so a crash at any moment leaves either the old or the new file.
+func (d *DBFileInteractorImpl) ReplaceOperations(operations []models.Operation) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.replace(operations)
+}
 
-	record := []string{
-		strconv.Itoa(newUser.Id),
-		newUser.Username,
-		newUser.StoredPass,
-		newUser.AuthToken.Token,
+// replace should be called with mu locked
+func (d *DBFileInteractorImpl) replace(operations []models.Operation) error {
+	if d.closed {
+		return ErrClosed
 	}
-	err = csvWriter.Write(record)
+	dir := filepath.Dir(d.dbFileName)
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(d.dbFileName)+".compact-*")
 	if err != nil {
-		return fmt.Errorf("error writing record to csv: %w", err)
+		return fmt.Errorf("error creating a temp file for compaction: %w", err)
 	}
-	csvWriter.Flush()
-	if err = csvWriter.Error(); err != nil {
-		return fmt.Errorf("error flushing a record to csv: %w", err)
+	renamed := false
+	defer func() {
+		if !renamed {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+	if d.lockFile != nil {
+		if err := tryLock(tmpFile); err != nil {
+			return fmt.Errorf("error locking the temp file: %w", err)
+		}
 	}
-	return nil
+
+	header, body, err := d.encodeFile(operations)
+	if err != nil {
+		return err
+	}
+	// the file is counted again before appending to it, since the binary snapshot counts as a single line
+	d.lines = 0
+	for _, part := range [][]byte{header, body} {
+		if _, err := tmpFile.Write(part); err != nil {
+			return fmt.Errorf("error writing the temp file: %w", err)
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the temp file: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), d.dbFileName); err != nil {
+		return fmt.Errorf("error renaming the temp file over the db file: %w", err)
+	}
+	renamed = true
+	// the lock moves to the new file, which is now at dbFileName
+	if d.lockFile != nil {
+		d.lockFile.Close()
+		d.lockFile = tmpFile
+	} else if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("error closing the new db file: %w", err)
+	}
+	return syncDir(dir)
 }
 
-const numberOfModelFields = 4
+// encodeFile returns the contents of a file holding the operations, the header is returned separately to avoid copying the body
+func (d *DBFileInteractorImpl) encodeFile(operations []models.Operation) (header, body []byte, err error) {
+	if d.binarySnapshots {
+		return encodeBinarySnapshot(operations, d.codec.keys)
+	}
+	body, err = encodeOperations(operations, 2, d.codec)
+	return encodeHeader(), body, err
+}
+
+// syncDir makes the rename durable
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening the db directory: %w", err)
+	}
+	defer dirFile.Close()
+	if err := dirFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the db directory: %w", err)
+	}
+	return nil
+}
 
-func sliceToUserModel(slice []string) (models.UserModel, error) {
-	if len(slice) != numberOfModelFields {
-		return models.UserModel{}, fmt.Errorf("incorrect amount of columns in a csv row: %v", slice)
+// Decrypt writes a plaintext copy of an encrypted db file for inspection.
+// keys may be nil if the file is not encrypted, in which case the file is just converted to the current format.
+func Decrypt(dst io.Writer, src io.Reader, keys record_encryption.KeyProvider) error {
+	contents, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("error reading the db file: %w", err)
+	}
+	parsed, err := upgradeFile(contents, codec{keys: keys, acceptUnencrypted: true})
+	if err != nil {
+		return fmt.Errorf("error parsing the db file: %w", err)
 	}
-	id, err := strconv.Atoi(slice[0])
+	body, err := encodeOperations(parsed.operations, 2, codec{})
 	if err != nil {
-		return models.UserModel{}, fmt.Errorf("error converting id to int: %w", err)
+		return err
+	}
+	if _, err := dst.Write(append(encodeHeader(), body...)); err != nil {
+		return fmt.Errorf("error writing the decrypted file: %w", err)
 	}
-	return models.UserModel{
-		Id:         id,
-		Username:   slice[1],
-		StoredPass: slice[2],
-		AuthToken:  entities.Token{Token: slice[3]},
-	}, nil
+	return nil
 }
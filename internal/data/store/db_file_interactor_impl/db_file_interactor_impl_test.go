@@ -1,12 +1,22 @@
 package db_file_interactor_impl_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	"github.com/k0marov/golang-auth/internal/data/models"
 	"github.com/k0marov/golang-auth/internal/data/store/db_file_interactor_impl"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
 	. "github.com/k0marov/golang-auth/internal/test_helpers"
 )
 
@@ -16,21 +26,21 @@ func TestFileInteractor(t *testing.T) {
 		defer deleteFile()
 
 		interactor := db_file_interactor_impl.NewDBFileInteractor(testFileName)
-		users, err := interactor.ReadUsers()
+		operations, err := interactor.ReadOperations()
 		AssertNoError(t, err)
-		Assert(t, len(users), 0, "length of parsed users")
+		Assert(t, len(operations), 0, "length of parsed operations")
 
-		t.Run("populate file with 5 users, close it and then read", func(t *testing.T) {
-			generatedUsers := GenerateRandomUserModels(5)
-			for _, user := range generatedUsers {
-				err := interactor.WriteUser(user)
+		t.Run("populate file with operations of all types, close it and then read", func(t *testing.T) {
+			generatedOps := GenerateRandomOperations(5)
+			for _, op := range generatedOps {
+				err := interactor.WriteOperation(op)
 				AssertNoError(t, err)
 			}
 			// emulate restarting the program
 			interactor = db_file_interactor_impl.NewDBFileInteractor(testFileName)
-			storedUsers, err := interactor.ReadUsers()
+			storedOps, err := interactor.ReadOperations()
 			AssertNoError(t, err)
-			if !Assert(t, storedUsers, generatedUsers, "stored users") {
+			if !Assert(t, storedOps, generatedOps, "stored operations") {
 				testFile, _ := os.Open(testFileName)
 				testFile.Seek(0, 0)
 				fileContents, _ := io.ReadAll(testFile)
@@ -50,18 +60,1035 @@ func TestFileInteractor(t *testing.T) {
 
 		for i := 0; i < wantedCount; i++ {
 			go func() {
-				err := interactor.WriteUser(GenerateRandomUserModel())
+				err := interactor.WriteOperation(models.Operation{Type: models.CreateUserOp, User: GenerateRandomUserModel()})
 				AssertNoError(t, err)
 				wg.Done()
 			}()
 		}
 		wg.Wait()
 
-		users, err := interactor.ReadUsers()
+		operations, err := interactor.ReadOperations()
 		AssertNoError(t, err)
-		Assert(t, len(users), wantedCount, "number of created users")
+		Assert(t, len(operations), wantedCount, "number of written operations")
+	})
+	t.Run("should migrate csv files written by older versions", func(t *testing.T) {
+		legacyContents := "1,John,hashed_pass,some_token\n2,Jack,pass,token,\"[\"\"old\"\"]\"\ndelete_user,2\n"
+		testFile, deleteFile := CreateTempFile(t, legacyContents)
+		defer deleteFile()
+		defer os.Remove(testFile + ".v1.bak")
+		interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+		wantOps := []models.Operation{
+			{Type: models.CreateUserOp, User: models.UserModel{Id: 1, Username: "John", StoredPass: "hashed_pass", AuthToken: entities.Token{Token: "some_token"}}},
+			{Type: models.CreateUserOp, User: models.UserModel{Id: 2, Username: "Jack", StoredPass: "pass", AuthToken: entities.Token{Token: "token"}, PasswordHistory: []string{"old"}}},
+			{Type: models.DeleteUserOp, UserId: 2},
+		}
+
+		operations, err := interactor.ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, wantOps, "read operations")
+
+		contents, err := os.ReadFile(testFile)
+		AssertNoError(t, err)
+		Assert(t, strings.HasPrefix(string(contents), `{"format":"golang-auth-db","version":2,"checksums":true}`+"\n"), true, "file starts with the current header")
+		backup, err := os.ReadFile(testFile + ".v1.bak")
+		AssertNoError(t, err)
+		Assert(t, string(backup), legacyContents, "contents of the backup")
+		backupInfo, err := os.Stat(testFile + ".v1.bak")
+		AssertNoError(t, err)
+		Assert(t, backupInfo.Mode().Perm(), os.FileMode(0600), "permissions of the backup")
+
+		// appending to the migrated file
+		newOp := models.Operation{Type: models.DeleteUserOp, UserId: 1}
+		AssertNoError(t, interactor.WriteOperation(newOp))
+		operations, err = interactor.ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, append(wantOps, newOp), "operations after appending")
+	})
+	t.Run("should ignore unknown fields", func(t *testing.T) {
+		contents := `{"format":"golang-auth-db","version":2,"created_by":"newer version"}` + "\n" +
+			`{"op":"create_user","user":{"id":1,"username":"John","stored_pass":"pass","auth_token":"token","email":"x"},"timestamp":123}` + "\n"
+		testFile, deleteFile := CreateTempFile(t, contents)
+		defer deleteFile()
+
+		operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, []models.Operation{
+			{Type: models.CreateUserOp, User: models.UserModel{Id: 1, Username: "John", StoredPass: "pass", AuthToken: entities.Token{Token: "token"}}},
+		}, "read operations")
+	})
+	t.Run("should refuse files with a newer format version", func(t *testing.T) {
+		testFile, deleteFile := CreateTempFile(t, `{"format":"golang-auth-db","version":4}`+"\n")
+		defer deleteFile()
+		_, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+		Assert(t, errors.Is(err, db_file_interactor_impl.ErrUnsupportedFormatVersion), true, "error is ErrUnsupportedFormatVersion")
+	})
+	t.Run("should fail on invalid rows", func(t *testing.T) {
+		header := `{"format":"golang-auth-db","version":2}` + "\n"
+		cases := []string{
+			// v1
+			"unknown_op,1\n", "delete_user,abc\n", "add_token,1\n", "1,John\n",
+			// v2
+			header + `{"op":"unknown_op"}` + "\n",
+			header + `{"op":"create_user"}` + "\n",
+			header + `{"op":"delete_user","user_id":"abc"}` + "\n",
+			header + "not json\n",
+			`{"format":"something else","version":2}` + "\n",
+		}
+		for _, contents := range cases {
+			testFile, deleteFile := CreateTempFile(t, contents)
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			AssertSomeError(t, err)
+			deleteFile()
+		}
+	})
+	t.Run("ReplaceOperations() should atomically replace the whole file", func(t *testing.T) {
+		dir := t.TempDir()
+		testFile := filepath.Join(dir, "db.csv")
+		interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+		size, err := interactor.Size()
+		AssertNoError(t, err)
+		Assert(t, size, int64(0), "size of a not existing file")
+
+		for _, op := range GenerateRandomOperations(10) {
+			AssertNoError(t, interactor.WriteOperation(op))
+		}
+		sizeBefore, err := interactor.Size()
+		AssertNoError(t, err)
+
+		snapshot := GenerateRandomOperations(2)[:2]
+		AssertNoError(t, interactor.ReplaceOperations(snapshot))
+		operations, err := interactor.ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, snapshot, "operations after replacing")
+		sizeAfter, err := interactor.Size()
+		AssertNoError(t, err)
+		if sizeAfter >= sizeBefore {
+			t.Errorf("file should have shrunk after replacing: size before %d, after %d", sizeBefore, sizeAfter)
+		}
+
+		// appending should still work after replacing
+		newOp := models.Operation{Type: models.DeleteUserOp, UserId: 1}
+		AssertNoError(t, interactor.WriteOperation(newOp))
+		operations, err = interactor.ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, append(snapshot, newOp), "operations after appending")
+
+		leftovers, _ := filepath.Glob(filepath.Join(dir, "*compact*"))
+		Assert(t, len(leftovers), 0, "number of leftover temp files")
+	})
+	t.Run("encryption", func(t *testing.T) {
+		keyV1 := record_encryption.Key{Version: 1, Secret: bytes.Repeat([]byte{1}, record_encryption.KeySize)}
+		keyV2 := record_encryption.Key{Version: 2, Secret: bytes.Repeat([]byte{2}, record_encryption.KeySize)}
+		newKeyRing := func(keys ...record_encryption.Key) *record_encryption.KeyRing {
+			ring, err := record_encryption.NewKeyRing(keys)
+			if err != nil {
+				t.Fatalf("error creating a key ring: %v", err)
+			}
+			return ring
+		}
+		// waitUntilReadable waits for the background re-encryption to finish
+		waitUntilReadable := func(t *testing.T, testFile string, keys record_encryption.KeyProvider) []models.Operation {
+			t.Helper()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				contents, err := os.ReadFile(testFile)
+				AssertNoError(t, err)
+				var decrypted bytes.Buffer
+				if err := db_file_interactor_impl.Decrypt(&decrypted, bytes.NewReader(contents), keys); err == nil && !bytes.Contains(contents, []byte(`"op"`)) {
+					operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReadOperations()
+					AssertNoError(t, err)
+					return operations
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("the file wasn't re-encrypted in time, contents: %s", contents)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		t.Run("should encrypt records and read them back", func(t *testing.T) {
+			testFile, deleteFile := CreateTempFile(t, "")
+			defer deleteFile()
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV1)))
+			generatedOps := GenerateRandomOperations(3)
+			for _, op := range generatedOps {
+				AssertNoError(t, interactor.WriteOperation(op))
+			}
+
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			for _, op := range generatedOps {
+				if op.Type == models.CreateUserOp && bytes.Contains(contents, []byte(op.User.AuthToken.Token)) {
+					t.Errorf("db file contains a token in the clear: %s", contents)
+				}
+			}
+
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV1))).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "decrypted operations")
+
+			_, err = db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrNoEncryptionKeys), true, "error is ErrNoEncryptionKeys")
+			_, err = db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV2))).ReadOperations()
+			AssertSomeError(t, err)
+		})
+		t.Run("should reject records in the clear, unless migrating", func(t *testing.T) {
+			testFile, deleteFile := CreateTempFile(t, "")
+			defer deleteFile()
+			generatedOps := GenerateRandomOperations(3)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(generatedOps))
+			plaintext := mustReadFile(t, testFile)
+
+			keys := newKeyRing(keyV1)
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReadOperations()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrUnencryptedRecord), true, "error is ErrUnencryptedRecord")
+
+			migrating := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys), db_file_interactor_impl.WithEncryptionMigration())
+			operations, err := migrating.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations read from the plaintext file")
+			// the file is encrypted before ReadOperations returns
+			Assert(t, bytes.Contains(mustReadFile(t, testFile), []byte(`"op"`)), false, "the file contains records in the clear")
+			operations, err = db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations after encrypting")
+
+			// the migration is one-shot
+			plaintextRecord, _, _ := bytes.Cut(bytes.SplitN(plaintext, []byte("\n"), 3)[1], []byte("\n"))
+			dbFile, err := os.OpenFile(testFile, os.O_WRONLY|os.O_APPEND, 0)
+			AssertNoError(t, err)
+			_, err = dbFile.Write(append(plaintextRecord, '\n'))
+			AssertNoError(t, err)
+			AssertNoError(t, dbFile.Close())
+			_, err = migrating.ReadOperations()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrUnencryptedRecord), true, "error is ErrUnencryptedRecord after migrating")
+		})
+		t.Run("should not keep a plaintext backup when migrating an older format", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, os.WriteFile(testFile, []byte("1,John,hashed_pass,some_token\n"), 0600))
+			keys := newKeyRing(keyV1)
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys), db_file_interactor_impl.WithEncryptionMigration()).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 1, "number of read operations")
+			_, err = os.Stat(testFile + ".v1.bak")
+			Assert(t, errors.Is(err, os.ErrNotExist), true, "the backup doesn't exist")
+			Assert(t, bytes.Contains(mustReadFile(t, testFile), []byte("John")), false, "the file contains a username in the clear")
+		})
+		t.Run("should bind encrypted records to their lines", func(t *testing.T) {
+			testFile, deleteFile := CreateTempFile(t, "")
+			defer deleteFile()
+			keys := newKeyRing(keyV1)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReplaceOperations(GenerateRandomOperations(1)))
+			lines := bytes.SplitAfter(mustReadFile(t, testFile), []byte("\n"))
+			lines[1], lines[2] = lines[2], lines[1]
+			AssertNoError(t, os.WriteFile(testFile, bytes.Join(lines, nil), 0600))
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReadOperations()
+			AssertSomeError(t, err)
+		})
+		t.Run("should re-encrypt with the new key after rotation", func(t *testing.T) {
+			testFile, deleteFile := CreateTempFile(t, "")
+			defer deleteFile()
+			generatedOps := GenerateRandomOperations(3)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV1))).ReplaceOperations(generatedOps))
+
+			rotated := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV1, keyV2)))
+			operations, err := rotated.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations read with both keys")
+			AssertNoError(t, rotated.Reencrypt())
+
+			// the old key is not needed anymore
+			Assert(t, waitUntilReadable(t, testFile, newKeyRing(keyV2)), generatedOps, "operations after rotation")
+		})
+		t.Run("Close() should wait for the background re-encryption and stop writing", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			generatedOps := GenerateRandomOperations(3)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeyRing(keyV1))).ReplaceOperations(generatedOps))
+
+			keys := newKeyRing(keyV1, keyV2)
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys))
+			AssertNoError(t, writer.Lock())
+			_, err := writer.ReadOperations()
+			AssertNoError(t, err)
+			AssertNoError(t, writer.Close())
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+
+			AssertError(t, writer.Reencrypt(), db_file_interactor_impl.ErrClosed)
+			AssertError(t, writer.WriteOperation(generatedOps[0]), db_file_interactor_impl.ErrClosed)
+			AssertError(t, writer.ReplaceOperations(generatedOps), db_file_interactor_impl.ErrClosed)
+			// another writer can take over the file
+			other := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys))
+			AssertNoError(t, other.Lock())
+			defer other.Close()
+			contentsAfter, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			Assert(t, string(contentsAfter), string(contents), "file contents after Close()")
+		})
+		t.Run("Decrypt() should write a plaintext copy", func(t *testing.T) {
+			keys := newKeyRing(keyV1)
+			testFile, deleteFile := CreateTempFile(t, "")
+			defer deleteFile()
+			generatedOps := GenerateRandomOperations(2)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReplaceOperations(generatedOps))
+			encrypted, err := os.Open(testFile)
+			AssertNoError(t, err)
+			defer encrypted.Close()
+
+			plaintextFile, deletePlaintext := CreateTempFile(t, "")
+			defer deletePlaintext()
+			var plaintext bytes.Buffer
+			AssertNoError(t, db_file_interactor_impl.Decrypt(&plaintext, encrypted, keys))
+			Assert(t, bytes.Contains(plaintext.Bytes(), []byte(generatedOps[0].User.Username)), true, "plaintext contains a username")
+			AssertNoError(t, os.WriteFile(plaintextFile, plaintext.Bytes(), 0644))
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(plaintextFile).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations in the plaintext copy")
+		})
+	})
+	t.Run("locking", func(t *testing.T) {
+		t.Run("should allow only one writer", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			AssertNoError(t, writer.Lock())
+
+			err := db_file_interactor_impl.NewDBFileInteractor(testFile).Lock()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrLocked), true, "error is ErrLocked")
+
+			// the lock should survive replacing the file
+			AssertNoError(t, writer.ReplaceOperations(GenerateRandomOperations(2)))
+			err = db_file_interactor_impl.NewDBFileInteractor(testFile).Lock()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrLocked), true, "error is ErrLocked after replacing the file")
+
+			AssertNoError(t, writer.Close())
+			other := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			AssertNoError(t, other.Lock())
+			AssertNoError(t, other.Close())
+		})
+		t.Run("should not lock anything if locking is disabled explicitly", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithoutLocking())
+			AssertNoError(t, writer.Lock())
+			defer writer.Close()
+			AssertNoError(t, writer.ReplaceOperations(GenerateRandomOperations(2)))
+
+			other := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			AssertNoError(t, other.Lock())
+			AssertNoError(t, other.Close())
+		})
+		t.Run("read-only mode should work alongside the writer and never modify the file", func(t *testing.T) {
+			legacyContents := "1,John,hashed_pass,some_token\n"
+			testFile, deleteFile := CreateTempFile(t, legacyContents)
+			defer deleteFile()
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			AssertNoError(t, writer.Lock())
+			defer writer.Close()
+
+			readOnly := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly())
+			AssertNoError(t, readOnly.Lock())
+			operations, err := readOnly.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 1, "number of read operations")
+			AssertError(t, readOnly.WriteOperation(operations[0]), db_file_interactor_impl.ErrReadOnly)
+			AssertError(t, readOnly.ReplaceOperations(operations), db_file_interactor_impl.ErrReadOnly)
+
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			Assert(t, string(contents), legacyContents, "file contents (it shouldn't be migrated)")
+
+			_, err = db_file_interactor_impl.NewDBFileInteractor(testFile+"-not-existing", db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			AssertSomeError(t, err)
+		})
+	})
+	t.Run("durability modes", func(t *testing.T) {
+		modes := map[string]db_file_interactor_impl.Durability{
+			"no sync":          db_file_interactor_impl.NoSync,
+			"sync every write": db_file_interactor_impl.SyncEveryWrite,
+			"group commit":     db_file_interactor_impl.GroupCommit,
+		}
+		for name, durability := range modes {
+			t.Run(name, func(t *testing.T) {
+				testFile := filepath.Join(t.TempDir(), "db")
+				interactor := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithDurability(durability))
+
+				const wantedCount = 200
+				var wg sync.WaitGroup
+				wg.Add(wantedCount)
+				for i := 0; i < wantedCount; i++ {
+					go func() {
+						defer wg.Done()
+						AssertNoError(t, interactor.WriteOperation(models.Operation{Type: models.CreateUserOp, User: GenerateRandomUserModel()}))
+					}()
+				}
+				wg.Wait()
+
+				operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+				AssertNoError(t, err)
+				Assert(t, len(operations), wantedCount, "number of written operations")
+			})
+		}
+	})
+	t.Run("torn record recovery", func(t *testing.T) {
+		writeOps := func(t *testing.T, testFile string, ops []models.Operation) []byte {
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			return contents
+		}
+		t.Run("should quarantine a truncated trailing record and continue", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			generatedOps := GenerateRandomOperations(2)
+			validContents := writeOps(t, testFile, generatedOps)
+			tornRecord := `{"op":"create_user","user":{"id":10,"usern`
+			AssertNoError(t, os.WriteFile(testFile, append(validContents, tornRecord...), 0644))
+
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations before the torn record")
+
+			quarantined, err := os.ReadFile(testFile + ".quarantine")
+			AssertNoError(t, err)
+			Assert(t, string(quarantined), tornRecord+"\n", "contents of the quarantine file")
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			Assert(t, string(contents), string(validContents), "db file contents after recovery")
+
+			newOp := models.Operation{Type: models.DeleteUserOp, UserId: 2}
+			AssertNoError(t, interactor.WriteOperation(newOp))
+			operations, err = interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, append(generatedOps, newOp), "operations after appending")
+		})
+		t.Run("should recover from a truncated header", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, os.WriteFile(testFile, []byte(`{"format":"golang-au`), 0644))
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 0, "number of operations")
+
+			newOp := models.Operation{Type: models.CreateUserOp, User: GenerateRandomUserModel()}
+			AssertNoError(t, interactor.WriteOperation(newOp))
+			operations, err = interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, []models.Operation{newOp}, "operations after appending")
+		})
+		t.Run("should keep a complete last record without a newline", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			generatedOps := GenerateRandomOperations(2)
+			validContents := writeOps(t, testFile, generatedOps)
+			AssertNoError(t, os.WriteFile(testFile, bytes.TrimSuffix(validContents, []byte("\n")), 0644))
+
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "read operations")
+			newOp := models.Operation{Type: models.DeleteUserOp, UserId: 2}
+			AssertNoError(t, interactor.WriteOperation(newOp))
+			operations, err = interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, append(generatedOps, newOp), "operations after appending")
+		})
+		t.Run("should still fail on malformed records in the middle of the file", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			validContents := writeOps(t, testFile, GenerateRandomOperations(2))
+			corrupted := append([]byte{}, validContents...)
+			corrupted = append(corrupted, "garbage\n"...)
+			corrupted = append(corrupted, `{"op":"delete_user","user_id":1}`...)
+			AssertNoError(t, os.WriteFile(testFile, corrupted, 0644))
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			AssertSomeError(t, err)
+		})
+		t.Run("read-only mode should not modify the file", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			generatedOps := GenerateRandomOperations(2)
+			tornContents := append(writeOps(t, testFile, generatedOps), `{"op":"del`...)
+			AssertNoError(t, os.WriteFile(testFile, tornContents, 0644))
+
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "read operations")
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			Assert(t, string(contents), string(tornContents), "file contents")
+			_, err = os.Stat(testFile + ".quarantine")
+			Assert(t, errors.Is(err, os.ErrNotExist), true, "quarantine file doesn't exist")
+		})
+	})
+	t.Run("checksums", func(t *testing.T) {
+		// corruptLine changes a letter in the record, keeping it valid JSON
+		corruptLine := func(t *testing.T, testFile string, lineNum int) {
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			lines := bytes.Split(contents, []byte("\n"))
+			line := lines[lineNum-1]
+			i := bytes.Index(line, []byte(`"op":"`)) + len(`"op":"`)
+			line[i] = byte(strings.ToUpper(string(line[i]))[0])
+			AssertNoError(t, os.WriteFile(testFile, bytes.Join(lines, []byte("\n")), 0644))
+		}
+		users := GenerateRandomUserModels(3)
+		for i := range users {
+			users[i].Id = i + 1
+		}
+		ops := []models.Operation{
+			{Type: models.CreateUserOp, User: users[0]},
+			{Type: models.CreateUserOp, User: users[1]},
+			{Type: models.CreateUserOp, User: users[2]},
+		}
+
+		t.Run("should fail on a corrupt record by default", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			Assert(t, bytes.Count(contents, []byte(`"crc32c":"`)), len(ops), "number of records with a checksum")
+
+			corruptLine(t, testFile, 3)
+			_, err = db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrChecksumMismatch), true, "error is ErrChecksumMismatch")
+		})
+		t.Run("should accept records appended without checksums by an older version after a rollback", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+			// an older version keeps the header and appends records without checksums
+			lines := bytes.Split(mustReadFile(t, testFile), []byte("\n"))
+			checksumStart := bytes.Index(lines[3], []byte(`,"crc32c":"`))
+			lines[3] = append(lines[3][:checksumStart:checksumStart], '}')
+			AssertNoError(t, os.WriteFile(testFile, bytes.Join(lines, []byte("\n")), 0644))
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, ops, "operations read by a read-only interactor")
+			report, err := db_file_interactor_impl.Verify(bytes.NewReader(mustReadFile(t, testFile)), nil)
+			AssertNoError(t, err)
+			Assert(t, report.OK(), true, "report is OK")
+			Assert(t, report.UncheckedRecords, 1, "number of records without a checksum")
+
+			// rolling forward again adds the missing checksum, and the records appended from now on have them too
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			operations, err = writer.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, ops, "operations after rolling forward")
+			deleteOp := models.Operation{Type: models.DeleteUserOp, UserId: 1}
+			AssertNoError(t, writer.WriteOperation(deleteOp))
+			contents := mustReadFile(t, testFile)
+			Assert(t, bytes.Count(contents, []byte(`"crc32c":"`)), len(ops)+1, "number of records with a checksum")
+			operations, err = db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, append(ops[:3:3], deleteOp), "operations after appending")
+
+			t.Run("records with a checksum should still be verified", func(t *testing.T) {
+				corruptLine(t, testFile, 3)
+				_, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+				Assert(t, errors.Is(err, db_file_interactor_impl.ErrChecksumMismatch), true, "error is ErrChecksumMismatch")
+			})
+		})
+		t.Run("should accept records without checksums in older files and add checksums to them", func(t *testing.T) {
+			testFile, deleteFile := CreateTempFile(t, `{"format":"golang-auth-db","version":2}`+"\n"+
+				`{"op":"create_user","user":{"id":1,"username":"John","stored_pass":"pass","auth_token":"token"}}`+"\n")
+			defer deleteFile()
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 1, "number of operations")
+			Assert(t, bytes.Contains(mustReadFile(t, testFile), []byte(`"crc32c"`)), false, "a read-only interactor added checksums")
+
+			rewritten, err := db_file_interactor_impl.NewDBFileInteractor(testFile).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, rewritten, operations, "operations after adding checksums")
+			contents := mustReadFile(t, testFile)
+			Assert(t, bytes.HasPrefix(contents, []byte(`{"format":"golang-auth-db","version":2,"checksums":true}`)), true, "the header records checksums")
+			Assert(t, bytes.Count(contents, []byte(`"crc32c":"`)), 1, "number of records with a checksum")
+		})
+		t.Run("should skip corrupt records with the SkipCorrupted policy", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+			corruptLine(t, testFile, 3)
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithVerifyPolicy(db_file_interactor_impl.SkipCorrupted))
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, []models.Operation{ops[0], ops[2]}, "operations without the corrupt one")
+
+			newOp := models.Operation{Type: models.DeleteUserOp, UserId: 1}
+			AssertNoError(t, interactor.WriteOperation(newOp))
+			operations, err = interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, []models.Operation{ops[0], ops[2], newOp}, "operations after appending")
+		})
+		t.Run("should skip the records of users, whose creation was skipped", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			token := entities.Token{Token: RandomString()}
+			withDependents := append(ops[:3:3],
+				models.Operation{Type: models.AddTokenOp, UserId: 2, Token: token},
+				models.Operation{Type: models.AddTokenOp, UserId: 3, Token: token},
+				models.Operation{Type: models.DeleteUserOp, UserId: 2},
+			)
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			AssertNoError(t, writer.ReplaceOperations(withDependents))
+			corruptLine(t, testFile, 3)
+
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithVerifyPolicy(db_file_interactor_impl.SkipCorrupted), db_file_interactor_impl.WithReadOnly())
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, []models.Operation{ops[0], ops[2], withDependents[4]}, "operations without the corrupt one and its dependents")
+
+			// the appended records may depend on the skipped ones too, so a follower reads the whole file again
+			removeToken := models.Operation{Type: models.RemoveTokenOp, UserId: 2, Token: token}
+			AssertNoError(t, writer.WriteOperation(removeToken))
+			operations, reloaded, err := interactor.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, reloaded, true, "reloaded")
+			Assert(t, operations, []models.Operation{ops[0], ops[2], withDependents[4]}, "operations after appending a dependent record")
+		})
+		t.Run("should detect corruption of encrypted records", func(t *testing.T) {
+			keys, err := record_encryption.NewKeyRing([]record_encryption.Key{{Version: 1, Secret: bytes.Repeat([]byte{1}, record_encryption.KeySize)}})
+			AssertNoError(t, err)
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(keys)).ReplaceOperations(ops))
+			contents, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			i := bytes.Index(contents, []byte(`"data":"`)) + len(`"data":"`)
+			contents[i] ^= 'A' ^ 'B'
+			AssertNoError(t, os.WriteFile(testFile, contents, 0644))
+
+			_, err = db_file_interactor_impl.Verify(bytes.NewReader(contents), nil)
+			AssertError(t, err, db_file_interactor_impl.ErrNoEncryptionKeys)
+			report, err := db_file_interactor_impl.Verify(bytes.NewReader(contents), keys)
+			AssertNoError(t, err)
+			Assert(t, len(report.CorruptRecords), 1, "number of corrupt records")
+		})
+	})
+	t.Run("Verify()", func(t *testing.T) {
+		user := func(id int, username, token string) models.UserModel {
+			return models.UserModel{Id: id, Username: username, StoredPass: RandomString(), AuthToken: entities.Token{Token: token}}
+		}
+		withPublicId := func(user models.UserModel) models.UserModel {
+			user.PublicId = "shared-public-id"
+			return user
+		}
+		ops := []models.Operation{
+			{Type: models.CreateUserOp, User: user(1, "john", "token1")},                 // line 2
+			{Type: models.CreateUserOp, User: user(2, "john", "token2")},                 // line 3
+			{Type: models.CreateUserOp, User: user(3, "jack", "shared")},                 // line 4
+			{Type: models.CreateUserOp, User: user(4, "jill", "other")},                  // line 5
+			{Type: models.AddTokenOp, UserId: 4, Token: entities.Token{Token: "shared"}}, // line 6
+			{Type: models.CreateUserOp, User: user(5, "jim", "token5")},                  // line 7
+			{Type: models.CreateUserOp, User: user(5, "jim2", "token6")},                 // line 8
+			{Type: models.DeleteUserOp, UserId: 99},                                      // line 9
+			{Type: models.CreateUserOp, User: user(6, "corrupt", "token7")},              // line 10
+			{Type: models.CreateUserOp, User: withPublicId(user(7, "jane", "token8"))},   // line 11
+			{Type: models.CreateUserOp, User: withPublicId(user(8, "joe", "token9"))},    // line 12
+		}
+		testFile := filepath.Join(t.TempDir(), "db")
+		AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+		contents, err := os.ReadFile(testFile)
+		AssertNoError(t, err)
+		contents = bytes.Replace(contents, []byte(`"corrupt"`), []byte(`"corrupT"`), 1)
+
+		report, err := db_file_interactor_impl.Verify(bytes.NewReader(contents), nil)
+		AssertNoError(t, err)
+		Assert(t, report.OK(), false, "report is OK")
+		Assert(t, report.FormatVersion, 2, "format version")
+		Assert(t, report.Records, len(ops), "number of records")
+		Assert(t, len(report.CorruptRecords), 1, "number of corrupt records")
+		Assert(t, report.CorruptRecords[0].Line, 10, "line of the corrupt record")
+		Assert(t, len(report.DanglingRecords), 1, "number of dangling records")
+		Assert(t, report.DanglingRecords[0].Line, 9, "line of the dangling record")
+		Assert(t, report.DuplicateIds, []db_file_interactor_impl.Duplicate{{Value: "5", Lines: []int{7, 8}}}, "duplicate ids")
+		Assert(t, report.DuplicateUsernames, []db_file_interactor_impl.Duplicate{{Value: "john", Lines: []int{2, 3}}}, "duplicate usernames")
+		Assert(t, report.DuplicateTokens, []db_file_interactor_impl.Duplicate{{Value: "shared", Lines: []int{4, 6}}}, "duplicate tokens")
+		Assert(t, report.DuplicatePublicIds, []db_file_interactor_impl.Duplicate{{Value: "shared-public-id", Lines: []int{11, 12}}}, "duplicate public ids")
+
+		t.Run("should report nothing for a valid file", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(GenerateRandomOperations(5)))
+			validFile, err := os.Open(testFile)
+			AssertNoError(t, err)
+			defer validFile.Close()
+			report, err := db_file_interactor_impl.Verify(validFile, nil)
+			AssertNoError(t, err)
+			Assert(t, report.OK(), true, "report is OK")
+		})
+	})
+	t.Run("following", func(t *testing.T) {
+		testFile := filepath.Join(t.TempDir(), "db")
+		writer := db_file_interactor_impl.NewDBFileInteractor(testFile)
+		writeAll := func(t testing.TB, operations []models.Operation) {
+			t.Helper()
+			for _, op := range operations {
+				AssertNoError(t, writer.WriteOperation(op))
+			}
+		}
+		initialOps := GenerateRandomOperations(3)
+		writeAll(t, initialOps)
+
+		follower := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly())
+		operations, err := follower.ReadOperations()
+		AssertNoError(t, err)
+		Assert(t, operations, initialOps, "read operations")
+		Assert(t, follower.ReplicationLag(), time.Duration(0), "lag when everything was read")
+
+		t.Run("should read only the appended operations", func(t *testing.T) {
+			appendedOps := GenerateRandomOperations(2)
+			writeAll(t, appendedOps)
+			Assert(t, follower.ReplicationLag() > 0, true, "lag is positive when there are unread operations")
+
+			operations, reloaded, err := follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, reloaded, false, "reloaded")
+			Assert(t, operations, appendedOps, "appended operations")
+			Assert(t, follower.ReplicationLag(), time.Duration(0), "lag after reading")
+
+			operations, _, err = follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 0, "number of operations when nothing was appended")
+		})
+		t.Run("should leave an incomplete record for the next read", func(t *testing.T) {
+			before, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			appendedOp := []models.Operation{{Type: models.CreateUserOp, User: GenerateRandomUserModel()}}
+			writeAll(t, appendedOp)
+			after, err := os.ReadFile(testFile)
+			AssertNoError(t, err)
+			record := after[len(before):]
+			AssertNoError(t, os.Truncate(testFile, int64(len(before)+len(record)/2)))
+
+			operations, _, err := follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 0, "number of operations while the record is incomplete")
+			Assert(t, follower.ReplicationLag() > 0, true, "lag is positive while the record is incomplete")
+
+			AssertNoError(t, os.WriteFile(testFile, after, 0644))
+			operations, _, err = follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, appendedOp, "operations after the record is completed")
+		})
+		t.Run("should reload the whole file when the writer replaces it", func(t *testing.T) {
+			snapshot := GenerateRandomOperations(2)
+			AssertNoError(t, writer.ReplaceOperations(snapshot))
+			operations, reloaded, err := follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, reloaded, true, "reloaded")
+			Assert(t, operations, snapshot, "operations of the new file")
+
+			appendedOps := GenerateRandomOperations(1)
+			writeAll(t, appendedOps)
+			operations, reloaded, err = follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, reloaded, false, "reloaded after appending to the new file")
+			Assert(t, operations, appendedOps, "operations appended to the new file")
+		})
+		t.Run("Watch() should report changes of the file", func(t *testing.T) {
+			waitForChange := func(t testing.TB, changes <-chan struct{}) {
+				t.Helper()
+				select {
+				case <-changes:
+				case <-time.After(5 * time.Second):
+					t.Fatal("no change was reported")
+				}
+			}
+			// polling is so rare here that only inotify can report the change
+			if runtime.GOOS == "linux" {
+				changes, stop := follower.Watch(time.Hour)
+				defer stop()
+				writeAll(t, GenerateRandomOperations(1))
+				waitForChange(t, changes)
+			}
+			changes, stop := follower.Watch(time.Millisecond)
+			defer stop()
+			waitForChange(t, changes)
+		})
+	})
+	t.Run("snapshots", func(t *testing.T) {
+		keys, err := record_encryption.NewKeyRing([]record_encryption.Key{{Version: 1, Secret: bytes.Repeat([]byte{1}, record_encryption.KeySize)}})
+		AssertNoError(t, err)
+		cases := map[string][]db_file_interactor_impl.Option{
+			"plaintext": nil,
+			"encrypted": {db_file_interactor_impl.WithEncryption(keys)},
+		}
+		for name, opts := range cases {
+			t.Run(name, func(t *testing.T) {
+				interactor := db_file_interactor_impl.NewDBFileInteractor(filepath.Join(t.TempDir(), "db"), opts...)
+				generatedOps := GenerateRandomOperations(3)
+				var snapshot bytes.Buffer
+				AssertNoError(t, interactor.WriteSnapshot(&snapshot, generatedOps))
+				contents := snapshot.Bytes()
+				Assert(t, bytes.Contains(contents, []byte(generatedOps[0].User.Username)), len(opts) == 0, "the snapshot contains usernames in the clear")
+
+				operations, err := interactor.ReadSnapshot(bytes.NewReader(contents))
+				AssertNoError(t, err)
+				Assert(t, operations, generatedOps, "operations read from the snapshot")
+
+				// a snapshot is a valid db file
+				snapshotFile := filepath.Join(t.TempDir(), "snapshot.db")
+				AssertNoError(t, os.WriteFile(snapshotFile, contents, 0644))
+				operations, err = db_file_interactor_impl.NewDBFileInteractor(snapshotFile, opts...).ReadOperations()
+				AssertNoError(t, err)
+				Assert(t, operations, generatedOps, "operations read from the snapshot as a db file")
+			})
+		}
+		t.Run("should reject empty, truncated and corrupt snapshots regardless of the verify policy", func(t *testing.T) {
+			interactor := db_file_interactor_impl.NewDBFileInteractor(filepath.Join(t.TempDir(), "db"), db_file_interactor_impl.WithVerifyPolicy(db_file_interactor_impl.SkipCorrupted))
+			var snapshot bytes.Buffer
+			AssertNoError(t, interactor.WriteSnapshot(&snapshot, GenerateRandomOperations(2)))
+			contents := snapshot.Bytes()
+
+			_, err := interactor.ReadSnapshot(bytes.NewReader(nil))
+			AssertError(t, err, db_file_interactor_impl.ErrEmptyBackup)
+			_, err = interactor.ReadSnapshot(bytes.NewReader(contents[:len(contents)-10]))
+			AssertSomeError(t, err)
+			corrupt := bytes.Replace(contents, []byte(`"op"`), []byte(`"oP"`), 1)
+			_, err = interactor.ReadSnapshot(bytes.NewReader(corrupt))
+			AssertSomeError(t, err)
+		})
+	})
+	t.Run("binary snapshots", func(t *testing.T) {
+		keyV1 := record_encryption.Key{Version: 1, Secret: bytes.Repeat([]byte{1}, record_encryption.KeySize)}
+		keyV2 := record_encryption.Key{Version: 2, Secret: bytes.Repeat([]byte{2}, record_encryption.KeySize)}
+		keys, err := record_encryption.NewKeyRing([]record_encryption.Key{keyV1})
+		AssertNoError(t, err)
+		generatedOps := GenerateRandomOperations(3)
+		generatedOps[0].User.PasswordHistory = []string{RandomString(), RandomString()}
+		generatedOps[3].User.PasswordHistory = []string{RandomString()}
+
+		cases := map[string][]db_file_interactor_impl.Option{
+			"plaintext": {db_file_interactor_impl.WithBinarySnapshots()},
+			"encrypted": {db_file_interactor_impl.WithBinarySnapshots(), db_file_interactor_impl.WithEncryption(keys)},
+		}
+		for name, opts := range cases {
+			t.Run(name, func(t *testing.T) {
+				testFile := filepath.Join(t.TempDir(), "db")
+				writer := db_file_interactor_impl.NewDBFileInteractor(testFile, opts...)
+				AssertNoError(t, writer.ReplaceOperations(generatedOps))
+				contents, err := os.ReadFile(testFile)
+				AssertNoError(t, err)
+				Assert(t, bytes.HasPrefix(contents, []byte(`{"format":"golang-auth-db","version":3,`)), true, "the file has a version 3 header")
+				Assert(t, bytes.Contains(contents, []byte(`"op"`)), false, "the file contains JSON records")
+				Assert(t, bytes.Contains(contents, []byte(generatedOps[0].User.Username)), len(opts) == 1, "the file contains usernames in the clear")
+
+				appendedOps := GenerateRandomOperations(1)
+				for _, op := range appendedOps {
+					AssertNoError(t, writer.WriteOperation(op))
+				}
+				wantOps := append(append([]models.Operation{}, generatedOps...), appendedOps...)
+				// the option only affects writing, so a file with a binary snapshot can be read without it
+				operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, opts[1:]...).ReadOperations()
+				AssertNoError(t, err)
+				Assert(t, operations, wantOps, "operations read from the file")
+
+				// records in the clear are reported as corrupt when keys are given
+				var verifyKeys record_encryption.KeyProvider
+				if len(opts) > 1 {
+					verifyKeys = keys
+				}
+				report, err := db_file_interactor_impl.Verify(bytes.NewReader(mustReadFile(t, testFile)), verifyKeys)
+				AssertNoError(t, err)
+				Assert(t, report.OK(), true, "report is OK")
+				Assert(t, report.FormatVersion, 3, "format version")
+				Assert(t, report.Records, len(wantOps), "number of records")
+
+				var decrypted bytes.Buffer
+				AssertNoError(t, db_file_interactor_impl.Decrypt(&decrypted, bytes.NewReader(mustReadFile(t, testFile)), keys))
+				Assert(t, bytes.HasPrefix(decrypted.Bytes(), []byte(`{"format":"golang-auth-db","version":2,"checksums":true}`)), true, "Decrypt() converts the file to version 2")
+			})
+		}
+		t.Run("should omit public ids if no user has one", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots())
+			AssertNoError(t, interactor.ReplaceOperations(generatedOps))
+			Assert(t, bytes.Contains(mustReadFile(t, testFile), []byte(`"public_ids":true`)), true, "the header marks public ids")
+
+			withoutPublicIds := GenerateUserOperations(3)
+			AssertNoError(t, interactor.ReplaceOperations(withoutPublicIds))
+			Assert(t, bytes.Contains(mustReadFile(t, testFile), []byte(`"public_ids"`)), false, "the header marks public ids")
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, withoutPublicIds, "operations read from the file")
+		})
+		t.Run("should be converted back to JSON records by rewriting the file without the option", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots()).ReplaceOperations(generatedOps))
+			interactor := db_file_interactor_impl.NewDBFileInteractor(testFile)
+			operations, err := interactor.ReadOperations()
+			AssertNoError(t, err)
+			AssertNoError(t, interactor.ReplaceOperations(operations))
+			Assert(t, bytes.HasPrefix(mustReadFile(t, testFile), []byte(`{"format":"golang-auth-db","version":2,"checksums":true}`)), true, "the file has a version 2 header")
+			operations, err = interactor.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations read from the converted file")
+		})
+		t.Run("should be re-encrypted after key rotation", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots(), db_file_interactor_impl.WithEncryption(keys)).ReplaceOperations(generatedOps))
+			rotatedKeys, err := record_encryption.NewKeyRing([]record_encryption.Key{keyV1, keyV2})
+			AssertNoError(t, err)
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots(), db_file_interactor_impl.WithEncryption(rotatedKeys)).Reencrypt())
+
+			newKeys, err := record_encryption.NewKeyRing([]record_encryption.Key{keyV2})
+			AssertNoError(t, err)
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithEncryption(newKeys)).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, generatedOps, "operations read with the new key")
+		})
+		t.Run("should fail on a corrupt snapshot regardless of the verify policy", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots()).ReplaceOperations(generatedOps))
+			contents := mustReadFile(t, testFile)
+			i := bytes.Index(contents, []byte(generatedOps[0].User.Username))
+			contents[i] ^= 1
+			AssertNoError(t, os.WriteFile(testFile, contents, 0644))
+
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithVerifyPolicy(db_file_interactor_impl.SkipCorrupted)).ReadOperations()
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrCorruptBinarySnapshot), true, "error is ErrCorruptBinarySnapshot")
+			_, err = db_file_interactor_impl.Verify(bytes.NewReader(contents), nil)
+			Assert(t, errors.Is(err, db_file_interactor_impl.ErrCorruptBinarySnapshot), true, "Verify() error is ErrCorruptBinarySnapshot")
+		})
+		t.Run("should count as a single line", func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "db")
+			writer := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithBinarySnapshots())
+			// newlines inside the snapshot mustn't shift the line numbers of the records after it
+			ops := []models.Operation{{Type: models.CreateUserOp, User: models.UserModel{Id: 1, Username: "new\nline\n", StoredPass: RandomString()}}}
+			AssertNoError(t, writer.ReplaceOperations(ops))
+			AssertNoError(t, writer.WriteOperation(models.Operation{Type: models.DeleteUserOp, UserId: 1}))
+			AssertNoError(t, writer.WriteOperation(models.Operation{Type: models.DeleteUserOp, UserId: 2}))
+
+			follower := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly())
+			operations, err := follower.ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, len(operations), 3, "number of operations")
+			AssertNoError(t, writer.WriteOperation(models.Operation{Type: models.IdCounterOp, UserId: 5}))
+			appended, reloaded, err := follower.ReadNewOperations()
+			AssertNoError(t, err)
+			Assert(t, reloaded, false, "reloaded")
+			Assert(t, appended, []models.Operation{{Type: models.IdCounterOp, UserId: 5}}, "appended operations")
+
+			report, err := db_file_interactor_impl.Verify(bytes.NewReader(mustReadFile(t, testFile)), nil)
+			AssertNoError(t, err)
+			Assert(t, len(report.DanglingRecords), 1, "number of dangling records")
+			Assert(t, report.DanglingRecords[0].Line, 4, "line of the dangling record")
+		})
+	})
+	t.Run("parallel decoding", func(t *testing.T) {
+		// enough operations for the file to be split into chunks
+		users := make([]models.UserModel, 20000)
+		ops := make([]models.Operation, len(users))
+		for i := range users {
+			users[i] = models.UserModel{Id: i + 1, Username: fmt.Sprintf("user%d", i), StoredPass: strings.Repeat("x", 60), AuthToken: entities.Token{Token: RandomString()}}
+			ops[i] = models.Operation{Type: models.CreateUserOp, User: users[i]}
+		}
+		testFile := filepath.Join(t.TempDir(), "db")
+		AssertNoError(t, db_file_interactor_impl.NewDBFileInteractor(testFile).ReplaceOperations(ops))
+		Assert(t, len(mustReadFile(t, testFile)) > 1<<20, true, "the file is bigger than the parallel decoding threshold")
+		prevProcs := runtime.GOMAXPROCS(4)
+		defer runtime.GOMAXPROCS(prevProcs)
+
+		t.Run("should keep the order of operations", func(t *testing.T) {
+			operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			AssertNoError(t, err)
+			Assert(t, operations, ops, "operations")
+		})
+		t.Run("should report the earliest corrupt line", func(t *testing.T) {
+			contents := mustReadFile(t, testFile)
+			lines := bytes.Split(contents, []byte("\n"))
+			for _, lineNum := range []int{15000, 12345} {
+				lines[lineNum-1] = []byte(`{"op":"corrupt"}`)
+			}
+			AssertNoError(t, os.WriteFile(testFile, bytes.Join(lines, []byte("\n")), 0644))
+
+			_, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+			Assert(t, err != nil && strings.Contains(err.Error(), "line 12345:"), true, "error is about line 12345")
+			report, err := db_file_interactor_impl.Verify(bytes.NewReader(bytes.Join(lines, []byte("\n"))), nil)
+			AssertNoError(t, err)
+			Assert(t, len(report.CorruptRecords), 2, "number of corrupt records")
+			Assert(t, report.CorruptRecords[0].Line, 12345, "line of the first corrupt record")
+			Assert(t, report.CorruptRecords[1].Line, 15000, "line of the second corrupt record")
+		})
+	})
+	t.Run("streaming", func(t *testing.T) {
+		// with 2 goroutines the file is decoded in several rounds of batches
+		prevProcs := runtime.GOMAXPROCS(2)
+		defer runtime.GOMAXPROCS(prevProcs)
+		ops := make([]models.Operation, 40000)
+		for i := range ops {
+			ops[i] = models.Operation{Type: models.CreateUserOp, User: models.UserModel{Id: i + 1, Username: fmt.Sprintf("user%d", i), StoredPass: strings.Repeat("x", 60), AuthToken: entities.Token{Token: RandomString()}}}
+		}
+		// a record longer than the buffer of the reader
+		ops[100].User.PasswordHistory = []string{strings.Repeat("h", 200<<10)}
+		cases := map[string][]db_file_interactor_impl.Option{
+			"records":         nil,
+			"binary snapshot": {db_file_interactor_impl.WithBinarySnapshots()},
+		}
+		for name, opts := range cases {
+			t.Run(name, func(t *testing.T) {
+				testFile := filepath.Join(t.TempDir(), "db")
+				writer := db_file_interactor_impl.NewDBFileInteractor(testFile, opts...)
+				AssertNoError(t, writer.ReplaceOperations(ops[:10]))
+				for _, op := range ops[10:] {
+					AssertNoError(t, writer.WriteOperation(op))
+				}
+				AssertNoError(t, writer.Close())
+				Assert(t, len(mustReadFile(t, testFile)) > 4<<20, true, "the file is bigger than 2 rounds of batches")
+
+				operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+				AssertNoError(t, err)
+				Assert(t, operations, ops, "operations")
+
+				t.Run("should report the right lines of corrupt records in later batches", func(t *testing.T) {
+					contents := mustReadFile(t, testFile)
+					lines := bytes.Split(contents, []byte("\n"))
+					lines[len(lines)-100] = []byte(`{"op":"corrupt"}`)
+					AssertNoError(t, os.WriteFile(testFile, bytes.Join(lines, []byte("\n")), 0644))
+					// Verify reads the file as a whole, and counts the binary snapshot as a single line
+					report, err := db_file_interactor_impl.Verify(bytes.NewReader(mustReadFile(t, testFile)), nil)
+					AssertNoError(t, err)
+					AssertFatal(t, len(report.CorruptRecords), 1, "number of corrupt records")
+
+					_, err = db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+					wantLine := fmt.Sprintf("line %d:", report.CorruptRecords[0].Line)
+					Assert(t, err != nil && strings.Contains(err.Error(), wantLine), true, "error is about "+wantLine)
+				})
+			})
+		}
 	})
 	t.Run("error cases", func(t *testing.T) {
 		// TODO: Try to test file reading/writing (maybe using afero)
 	})
 }
+
+func mustReadFile(t testing.TB, fileName string) []byte {
+	t.Helper()
+	contents, err := os.ReadFile(fileName)
+	AssertNoError(t, err)
+	return contents
+}
+
+// benchmarkUserCounts are the sizes of the startup benchmarks, the biggest one needs more than 5 GB of memory, so it is skipped with -short
+var benchmarkUserCounts = []int{1_000_000, 10_000_000}
+
+func BenchmarkReadOperations(b *testing.B) {
+	formats := []struct {
+		name string
+		opts []db_file_interactor_impl.Option
+	}{
+		{"json", nil},
+		{"binary", []db_file_interactor_impl.Option{db_file_interactor_impl.WithBinarySnapshots()}},
+	}
+	for _, usersCount := range benchmarkUserCounts {
+		for _, format := range formats {
+			b.Run(fmt.Sprintf("users=%d/%s", usersCount, format.name), func(b *testing.B) {
+				if testing.Short() && usersCount > 1_000_000 {
+					b.Skip("skipping the biggest size in short mode")
+				}
+				testFile := filepath.Join(b.TempDir(), "db")
+				AssertNoError(b, db_file_interactor_impl.NewDBFileInteractor(testFile, format.opts...).ReplaceOperations(GenerateUserOperations(usersCount)))
+				runtime.GC()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					operations, err := db_file_interactor_impl.NewDBFileInteractor(testFile, db_file_interactor_impl.WithReadOnly()).ReadOperations()
+					AssertNoError(b, err)
+					Assert(b, len(operations), usersCount, "number of operations")
+				}
+			})
+		}
+	}
+}
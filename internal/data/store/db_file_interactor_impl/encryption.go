@@ -0,0 +1,130 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// With encryption enabled every record is written as
+//
+//	{"encrypted":{"key":<key version>,"nonce":<base64>,"data":<base64>}}
+//
+// where data is the plaintext record encrypted with AES-256-GCM.
+// The envelope is bound to the line of the record (see recordAAD), so that records can't be swapped, duplicated or moved.
+// The header stays in the clear, so that the format of the file can be detected without the keys.
+//
+// When keys are set, records in the clear and envelopes written before they were bound to their lines are rejected,
+// except while migrating the file (see WithEncryptionMigration).
+type encryptedRecord struct {
+	Encrypted *record_encryption.Envelope `json:"encrypted"`
+}
+
+var ErrNoEncryptionKeys = errors.New("the db file contains encrypted records, but no encryption keys were provided")
+var ErrUnencryptedRecord = errors.New("the record is in the clear or not bound to its line, while encryption is enabled (see WithEncryptionMigration)")
+
+// codec encodes and decodes single records: it adds and verifies checksums, and encrypts the records if keys are set
+type codec struct {
+	keys         record_encryption.KeyProvider
+	verifyPolicy VerifyPolicy
+	// accept records in the clear (and unbound envelopes) although keys are set, see WithEncryptionMigration
+	acceptUnencrypted bool
+	// records without a checksum were appended by an older version of the library, set for files with checksums in the header (see checksum.go)
+	expectChecksums bool
+}
+
+// recordAAD is the additional data the envelope of the record on the line (numbered from 1) is bound to
+func recordAAD(line int) []byte {
+	return strconv.AppendInt([]byte(formatName+" line "), int64(line), 10)
+}
+
+// encode returns the record for the operation, which will be written on the line (numbered from 1)
+func (c codec) encode(op models.Operation, line int) ([]byte, error) {
+	encoded, err := encodeOperation(op)
+	if err != nil {
+		return nil, err
+	}
+	record := bytes.TrimSuffix(encoded, []byte("\n"))
+	if c.keys != nil {
+		envelope, err := record_encryption.Seal(c.keys, record, recordAAD(line))
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting operation: %w", err)
+		}
+		record, err = json.Marshal(encryptedRecord{Encrypted: &envelope})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding encrypted operation: %w", err)
+		}
+	}
+	return append(addChecksum(record), '\n'), nil
+}
+
+// decode decodes the record on the line lineNum (numbered from 1).
+// It also reports whether the record is stale, i.e. it should be re-encrypted,
+// because it is encrypted with an older key, or it is accepted unencrypted while migrating,
+// and whether it is unchecked, i.e. it is missing a checksum although the file expects them.
+func (c codec) decode(line []byte, lineNum int) (op models.Operation, stale, unchecked bool, err error) {
+	checked, err := verifyChecksum(line)
+	if err != nil {
+		return models.Operation{}, false, false, err
+	}
+	unchecked = c.expectChecksums && !checked
+	op, stale, err = c.decodeRecord(line, lineNum)
+	return op, stale, unchecked, err
+}
+
+func (c codec) decodeRecord(line []byte, lineNum int) (op models.Operation, stale bool, err error) {
+	// records in the clear start with the type of the operation (see encodeOperation), so they are parsed only once
+	if bytes.HasPrefix(line, []byte(`{"op":`)) {
+		return c.decodeUnencrypted(line)
+	}
+	var record encryptedRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return models.Operation{}, false, err
+	}
+	if record.Encrypted == nil {
+		return c.decodeUnencrypted(line)
+	}
+	plaintext, bound, err := c.open(*record.Encrypted, lineNum)
+	if err != nil {
+		return models.Operation{}, false, err
+	}
+	currentKey, err := c.keys.CurrentKey()
+	if err != nil {
+		return models.Operation{}, false, fmt.Errorf("error getting the current encryption key: %w", err)
+	}
+	op, err = decodeOperation(plaintext)
+	return op, !bound || record.Encrypted.KeyVersion != currentKey.Version, err
+}
+
+func (c codec) decodeUnencrypted(line []byte) (models.Operation, bool, error) {
+	if c.keys != nil && !c.acceptUnencrypted {
+		return models.Operation{}, false, ErrUnencryptedRecord
+	}
+	op, err := decodeOperation(line)
+	return op, c.keys != nil, err
+}
+
+// open decrypts the envelope of the record on the line, bound reports whether it was bound to the line.
+// Envelopes written before they were bound to their lines are accepted only while migrating.
+func (c codec) open(envelope record_encryption.Envelope, line int) (plaintext []byte, bound bool, err error) {
+	if c.keys == nil {
+		return nil, false, ErrNoEncryptionKeys
+	}
+	plaintext, err = record_encryption.Open(c.keys, envelope, recordAAD(line))
+	if err == nil {
+		return plaintext, true, nil
+	}
+	if !c.acceptUnencrypted {
+		return nil, false, err
+	}
+	plaintext, unboundErr := record_encryption.Open(c.keys, envelope, nil)
+	if unboundErr != nil {
+		return nil, false, err
+	}
+	return plaintext, false, nil
+}
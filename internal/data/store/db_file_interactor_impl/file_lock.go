@@ -0,0 +1,83 @@
+package db_file_interactor_impl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrLocked = errors.New("the db file is locked by another process, only one writer is allowed (tools running alongside it should open the file in read-only mode)")
+var ErrReadOnly = errors.New("the db file is opened in read-only mode")
+var ErrClosed = errors.New("the db file interactor is closed, its lock is released")
+var ErrLockingNotSupported = errors.New("locking the db file is not supported on this platform, single-writer enforcement can only be disabled explicitly")
+
+// WithoutLocking makes Lock do nothing, so that the file can be written on platforms without flock (see ErrLockingNotSupported).
+// Nothing then keeps a second process from writing to the file at the same time, which corrupts it, so the caller has to make sure there is only one writer.
+func WithoutLocking() Option {
+	return func(d *DBFileInteractorImpl) {
+		d.withoutLocking = true
+	}
+}
+
+// Lock acquires an exclusive advisory lock (flock) on the DB file, failing with ErrLocked if another writer holds it.
+// It should be called before ReadOperations and released with Close. It does nothing in read-only mode and with WithoutLocking.
+// On platforms without flock it fails with ErrLockingNotSupported.
+//
+// The lock is held on the file itself, so when the file is atomically replaced (see ReplaceOperations),
+// the lock is taken on the new file before it is renamed over the old one.
+func (d *DBFileInteractorImpl) Lock() error {
+	if d.readOnly {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lockFile != nil {
+		return nil
+	}
+	d.closed = false
+	if d.withoutLocking {
+		return nil
+	}
+	for {
+		file, err := os.OpenFile(d.dbFileName, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening the db file for locking: %w", err)
+		}
+		if err := tryLock(file); err != nil {
+			file.Close()
+			if errors.Is(err, ErrLocked) {
+				return fmt.Errorf("%w: %s", err, d.dbFileName)
+			}
+			return fmt.Errorf("error locking the db file: %w", err)
+		}
+		// the previous writer might have replaced the file between opening and locking,
+		// in which case the lock is on a file which is not at dbFileName anymore
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("error getting info of the locked db file: %w", err)
+		}
+		current, err := os.Stat(d.dbFileName)
+		if err == nil && os.SameFile(locked, current) {
+			d.lockFile = file
+			return nil
+		}
+		file.Close()
+	}
+}
+
+// Close releases the lock acquired by Lock and waits for the background re-encryption (see ReadOperations).
+// Afterwards the file is not written anymore, writing methods return ErrClosed until Lock is called again.
+func (d *DBFileInteractorImpl) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	var err error
+	if d.lockFile != nil {
+		err = d.lockFile.Close()
+		d.lockFile = nil
+	}
+	d.mu.Unlock()
+	// a re-encryption which hasn't started yet sees closed and returns
+	d.background.Wait()
+	return err
+}
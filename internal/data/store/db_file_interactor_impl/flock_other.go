@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package db_file_interactor_impl
+
+import "os"
+
+// flock is not available on this platform, so Lock fails unless locking is disabled with WithoutLocking
+func tryLock(file *os.File) error {
+	return ErrLockingNotSupported
+}
@@ -0,0 +1,172 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// A read-only interactor can follow the file while another process is writing to it (see store.WithFollowing):
+// Watch reports changes of the file, and ReadNewOperations reads only the records appended since the previous read.
+// When the writer replaces the file (compaction, migration, re-encryption), it is read again completely.
+
+// tailState is how far the file has been read
+type tailState struct {
+	// the file which was read, to notice it being replaced
+	file os.FileInfo
+	// the offset just after the last complete record which was read
+	offset int64
+	// the number of lines before offset, used for error messages
+	lines int
+	// files with an older format can't be continued, they are read again completely when they change
+	appendable bool
+	// the appended records must have checksums, see checksum.go
+	checksums bool
+	// records were skipped (see SkipCorrupted), so the file is read again completely,
+	// since the appended records may refer to the users of the skipped ones
+	skipped bool
+	// when unread records were noticed, zero if everything has been read
+	behindSince time.Time
+}
+
+// startTail records that the file was read up to its last complete record, it should be called with tailMu locked.
+// An incomplete record at the end is left for the next read, since the writer may still be appending it.
+func (d *DBFileInteractorImpl) startTail(info os.FileInfo, end filePosition, parsed parsedFile) {
+	d.tail = tailState{
+		file:       info,
+		offset:     end.offset,
+		lines:      end.lines,
+		appendable: isAppendableVersion(parsed.version),
+		checksums:  parsed.checksums,
+		skipped:    len(parsed.corruptRecords) != 0,
+	}
+	d.noticeUnread(info)
+}
+
+// ReadNewOperations returns the operations appended to the file since the previous call or ReadOperations.
+// If the file was replaced or can't be continued, all of its operations are returned with reloaded set to true.
+func (d *DBFileInteractorImpl) ReadNewOperations() (operations []models.Operation, reloaded bool, err error) {
+	d.tailMu.Lock()
+	defer d.tailMu.Unlock()
+	dbFile, err := os.Open(d.dbFileName)
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening file while reading new operations: %w", err)
+	}
+	defer dbFile.Close()
+	info, err := dbFile.Stat()
+	if err != nil {
+		return nil, false, fmt.Errorf("error getting info of the db file: %w", err)
+	}
+
+	switch {
+	case d.tail.file == nil || !os.SameFile(info, d.tail.file) || info.Size() < d.tail.offset:
+		// replaced or truncated
+		operations, err := d.readOperations()
+		return operations, true, err
+	case info.Size() == d.tail.offset:
+		d.noticeUnread(info)
+		return nil, false, nil
+	case !d.tail.appendable || d.tail.offset == 0 || d.tail.skipped:
+		// an empty file gets a header with the first record, so it is read completely too
+		operations, err := d.readOperations()
+		return operations, true, err
+	}
+
+	appended := make([]byte, info.Size()-d.tail.offset)
+	if _, err := dbFile.ReadAt(appended, d.tail.offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, false, fmt.Errorf("error reading new operations: %w", err)
+	}
+	complete := appended[:bytes.LastIndexByte(appended, '\n')+1]
+	c := d.codec
+	c.expectChecksums = d.tail.checksums
+	parsed, err := decodeOperations(complete, d.tail.lines+1, c)
+	if err != nil {
+		return nil, false, fmt.Errorf("got an error while parsing new operations: %w", err)
+	}
+	if len(parsed.corruptRecords) != 0 {
+		operations, err := d.readOperations()
+		return operations, true, err
+	}
+	d.tail.offset += int64(len(complete))
+	d.tail.lines += bytes.Count(complete, []byte("\n"))
+	d.tail.file = info
+	d.noticeUnread(info)
+	return parsed.operations, false, nil
+}
+
+// ReplicationLag returns for how long the file has had records, which weren't read yet, or zero if everything has been read.
+// It is measured from the modification time of the file when the unread records were noticed,
+// so it is precise when records are appended one at a time and a bit underestimated for bursts.
+func (d *DBFileInteractorImpl) ReplicationLag() time.Duration {
+	info, err := os.Stat(d.dbFileName)
+	d.tailMu.Lock()
+	defer d.tailMu.Unlock()
+	if err == nil && d.tail.file != nil {
+		d.noticeUnread(info)
+	}
+	if d.tail.behindSince.IsZero() {
+		return 0
+	}
+	return time.Since(d.tail.behindSince)
+}
+
+// noticeUnread updates tail.behindSince according to the current info of the file, it should be called with tailMu locked
+func (d *DBFileInteractorImpl) noticeUnread(info os.FileInfo) {
+	if os.SameFile(info, d.tail.file) && info.Size() == d.tail.offset {
+		d.tail.behindSince = time.Time{}
+		return
+	}
+	if d.tail.behindSince.IsZero() {
+		d.tail.behindSince = time.Now()
+		if info.ModTime().Before(d.tail.behindSince) {
+			d.tail.behindSince = info.ModTime()
+		}
+	}
+}
+
+// Watch sends a value to changes whenever the file might have changed, until stop is called.
+// Changes are reported by inotify where it is available, and the file is also polled every pollInterval,
+// since inotify may be unavailable or miss changes (e.g. on network file systems).
+// Changes, which happen while the previous one wasn't received yet, are merged into it.
+func (d *DBFileInteractorImpl) Watch(pollInterval time.Duration) (changes <-chan struct{}, stop func()) {
+	changesCh := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changesCh <- struct{}{}:
+		default:
+		}
+	}
+	stopNotifications, err := watchFile(d.dbFileName, notify)
+	if err != nil {
+		log.Printf("can't watch db file %s for changes (%v), falling back to polling it every %v", d.dbFileName, err, pollInterval)
+		stopNotifications = func() {}
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				notify()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return changesCh, func() {
+		once.Do(func() {
+			stopNotifications()
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
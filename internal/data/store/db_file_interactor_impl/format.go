@@ -0,0 +1,409 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+)
+
+// The DB file starts with a header line describing the format of the rest of the file:
+//
+//	{"format":"golang-auth-db","version":2}
+//
+// It is followed by one JSON object per operation (JSON Lines).
+// Unknown fields are ignored while reading, so new optional fields can be added without bumping the version,
+// and a file written by a newer version of the library can still be read by an older one (e.g. after a rollback).
+// The version is bumped only for incompatible changes, together with adding a migration to formatMigrations.
+//
+// Files without a header were written before it was introduced, they are version 1 (see format_v1_csv.go).
+// Version 3 is version 2 with a binary snapshot before the records (see format_binary_snapshot.go).
+const formatName = "golang-auth-db"
+const currentFormatVersion = 2
+
+var ErrUnsupportedFormatVersion = errors.New("the db file was written by a newer version of the library with an incompatible format")
+
+// formatMigrations[v] upgrades the body (everything after the header) of a version v file to version v+1.
+// Older files are upgraded by applying the whole chain up to currentFormatVersion.
+var formatMigrations = map[int]func(body []byte) ([]byte, error){
+	1: migrateV1ToV2,
+}
+
+func migrateV1ToV2(body []byte) ([]byte, error) {
+	operations, err := readV1(body)
+	if err != nil {
+		return nil, err
+	}
+	return encodeOperations(operations, 2, codec{})
+}
+
+type fileHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// every record written by this version has a checksum, see checksum.go
+	Checksums      bool                  `json:"checksums,omitempty"`
+	BinarySnapshot *binarySnapshotHeader `json:"binary_snapshot,omitempty"`
+}
+
+type operationRecord struct {
+	Op     models.OperationType `json:"op"`
+	User   *userRecord          `json:"user,omitempty"`
+	UserId int                  `json:"user_id,omitempty"`
+	Token  string               `json:"token,omitempty"`
+}
+
+type userRecord struct {
+	Id              int      `json:"id"`
+	Username        string   `json:"username"`
+	StoredPass      string   `json:"stored_pass"`
+	AuthToken       string   `json:"auth_token"`
+	PasswordHistory []string `json:"password_history,omitempty"`
+	PublicId        string   `json:"public_id,omitempty"`
+	LegacyId        int      `json:"legacy_id,omitempty"`
+}
+
+func encodeHeader() []byte {
+	header, _ := encodeHeaderWith(fileHeader{Format: formatName, Version: currentFormatVersion, Checksums: true})
+	return header
+}
+
+func encodeHeaderWith(header fileHeader) ([]byte, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the header: %w", err)
+	}
+	return append(encoded, '\n'), nil
+}
+
+// isAppendableVersion reports whether records in the current format can be appended to a file of the version
+func isAppendableVersion(version int) bool {
+	return version == currentFormatVersion || version == binarySnapshotFormatVersion
+}
+
+// fileLayout is how the parts of a db file are laid out
+type fileLayout struct {
+	version int
+	// the records are written with checksums
+	checksums bool
+	// only set for version 3
+	binarySnapshotHeader binarySnapshotHeader
+	binarySnapshot       []byte
+	// the records after the header (and the binary snapshot)
+	body []byte
+	// the line number of the first line of body
+	bodyLine int
+}
+
+// parseFile splits the file into its parts.
+// An empty file is treated as a file of the current version.
+func parseFile(contents []byte) (fileLayout, error) {
+	if len(contents) == 0 {
+		return fileLayout{version: currentFormatVersion, checksums: true, bodyLine: 1}, nil
+	}
+	if contents[0] != '{' {
+		return fileLayout{version: 1, body: contents, bodyLine: 1}, nil
+	}
+	headerLine, body, _ := bytes.Cut(contents, []byte("\n"))
+	var header fileHeader
+	if err := json.Unmarshal(headerLine, &header); err != nil || header.Format != formatName {
+		return fileLayout{}, fmt.Errorf("the db file doesn't start with a valid header: %q", headerLine)
+	}
+	layout := fileLayout{version: header.Version, checksums: header.Checksums, body: body, bodyLine: 2}
+	if header.Version == binarySnapshotFormatVersion {
+		if header.BinarySnapshot == nil {
+			return fileLayout{}, fmt.Errorf("%w: missing in the header", ErrCorruptBinarySnapshot)
+		}
+		section, body, err := splitBinarySnapshot(*header.BinarySnapshot, body)
+		if err != nil {
+			return fileLayout{}, err
+		}
+		layout.binarySnapshotHeader, layout.binarySnapshot, layout.body, layout.bodyLine = *header.BinarySnapshot, section, body, 3
+	}
+	return layout, nil
+}
+
+// parsedFile is the result of parsing a whole db file
+type parsedFile struct {
+	operations []models.Operation
+	// the line number of every operation in the file (in the current format, if it was migrated)
+	lines   []int
+	version int
+	// whether the records are written with checksums, files without it are rewritten when opened for writing
+	checksums bool
+	// records which should be re-encrypted (see codec.decode)
+	staleRecords int
+	// records without a checksum in a file expecting them, see checksum.go
+	uncheckedRecords int
+	// records skipped because of the SkipCorrupted policy
+	corruptRecords []CorruptRecord
+}
+
+// CorruptRecord is a record, which failed checksum verification or couldn't be decoded
+type CorruptRecord struct {
+	Line int
+	Err  error
+}
+
+// upgradeFile parses the file contents, migrating them to the current version if needed
+func upgradeFile(contents []byte, c codec) (parsedFile, error) {
+	layout, err := parseFile(contents)
+	if err != nil {
+		return parsedFile{}, err
+	}
+	version, body := layout.version, layout.body
+	// the records of migrated files are encoded again below, so they get checksums
+	c.expectChecksums = layout.checksums || version < currentFormatVersion
+	if version == binarySnapshotFormatVersion {
+		return decodeWithBinarySnapshot(layout, c)
+	}
+	if version > currentFormatVersion {
+		return parsedFile{}, fmt.Errorf("%w: version %d, supported up to %d", ErrUnsupportedFormatVersion, version, binarySnapshotFormatVersion)
+	}
+	for v := version; v < currentFormatVersion; v++ {
+		migrate, ok := formatMigrations[v]
+		if !ok {
+			return parsedFile{}, fmt.Errorf("no migration from format version %d", v)
+		}
+		body, err = migrate(body)
+		if err != nil {
+			return parsedFile{}, fmt.Errorf("error migrating from format version %d to %d: %w", v, v+1, err)
+		}
+	}
+	parsed, err := decodeOperations(body, 2, c) // the body starts after the header
+	parsed.version, parsed.checksums = version, c.expectChecksums
+	return parsed, err
+}
+
+// encodeOperations encodes the records of a body starting on the line firstLine (numbered from 1)
+func encodeOperations(operations []models.Operation, firstLine int, c codec) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, op := range operations {
+		line, err := c.encode(op, firstLine+i)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+	}
+	return buf.Bytes(), nil
+}
+
+// bodies smaller than this are decoded by a single goroutine, since starting workers would take longer than decoding them
+const parallelDecodingThreshold = 1 << 20
+
+// decodeOperations decodes the records of body, firstLine is the line number of its first record in the file (numbered from 1).
+// Big bodies are split at line boundaries into chunks, which are decoded in parallel.
+// There is room for an operation per line, so that every chunk can decode straight into its part of the result.
+func decodeOperations(body []byte, firstLine int, c codec) (parsedFile, error) {
+	return decodeOperationsAfter(parsedFile{}, body, firstLine, c)
+}
+
+// decodeOperationsAfter decodes the records of body and appends them to the operations already in parsed
+func decodeOperationsAfter(parsed parsedFile, body []byte, firstLine int, c codec) (parsedFile, error) {
+	workers := 1
+	if len(body) >= parallelDecodingThreshold {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return decodeChunksAfter(parsed, splitIntoChunks(body, firstLine, workers), c)
+}
+
+// decodeChunksAfter decodes the chunks in parallel and appends their operations to the ones already in parsed.
+// If there isn't enough room after them, the room is at least doubled, so that decoding a file chunk by chunk (see streaming.go) copies it only a few times.
+func decodeChunksAfter(parsed parsedFile, chunks []decodingChunk, c codec) (parsedFile, error) {
+	capacity := len(parsed.operations)
+	for i := range chunks {
+		chunks[i].start = capacity
+		capacity += chunks[i].lines + 1
+	}
+	operations, lines := parsed.operations[:cap(parsed.operations)], parsed.lines[:cap(parsed.lines)]
+	if len(operations) < capacity || len(lines) < capacity {
+		size := capacity
+		if grown := 2 * len(parsed.operations); size < grown {
+			size = grown
+		}
+		operations, lines = make([]models.Operation, size), make([]int, size)
+		copy(operations, parsed.operations)
+		copy(lines, parsed.lines)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	for i := range chunks {
+		go func(chunk *decodingChunk) {
+			defer wg.Done()
+			chunk.decode(operations, lines, c)
+		}(&chunks[i])
+	}
+	wg.Wait()
+
+	// the chunks are merged in order, so the first error is the one of the earliest line like with decoding sequentially
+	decoded := len(parsed.operations)
+	for _, chunk := range chunks {
+		if chunk.err != nil {
+			return parsedFile{}, chunk.err
+		}
+		copy(operations[decoded:], operations[chunk.start:chunk.start+chunk.decoded])
+		copy(lines[decoded:], lines[chunk.start:chunk.start+chunk.decoded])
+		decoded += chunk.decoded
+		parsed.staleRecords += chunk.staleRecords
+		parsed.uncheckedRecords += chunk.uncheckedRecords
+		parsed.corruptRecords = append(parsed.corruptRecords, chunk.corruptRecords...)
+	}
+	parsed.operations, parsed.lines = operations[:decoded], lines[:decoded]
+	return parsed, nil
+}
+
+// decodingChunk is a part of the body decoded by a single goroutine
+type decodingChunk struct {
+	data      []byte
+	firstLine int
+	// the number of newlines in data
+	lines int
+	// where the operations of the chunk are decoded to
+	start int
+
+	decoded          int
+	staleRecords     int
+	uncheckedRecords int
+	corruptRecords   []CorruptRecord
+	err              error
+}
+
+// splitIntoChunks splits body into about n chunks of whole lines
+func splitIntoChunks(body []byte, firstLine, n int) []decodingChunk {
+	chunks := make([]decodingChunk, 0, n)
+	chunkSize := len(body)/n + 1
+	for len(body) > 0 || len(chunks) == 0 {
+		end := len(body)
+		if chunkSize < end {
+			if newline := bytes.IndexByte(body[chunkSize:], '\n'); newline >= 0 {
+				end = chunkSize + newline + 1
+			}
+		}
+		chunk := decodingChunk{data: body[:end], firstLine: firstLine, lines: bytes.Count(body[:end], []byte("\n"))}
+		chunks = append(chunks, chunk)
+		firstLine += chunk.lines
+		body = body[end:]
+	}
+	return chunks
+}
+
+func (chunk *decodingChunk) decode(operations []models.Operation, lines []int, c codec) {
+	data, lineNum := chunk.data, chunk.firstLine-1
+	for len(data) > 0 {
+		line := data
+		if newline := bytes.IndexByte(data, '\n'); newline >= 0 {
+			line, data = data[:newline], data[newline+1:]
+		} else {
+			data = nil
+		}
+		lineNum++
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		op, stale, unchecked, err := c.decode(line, lineNum)
+		if err != nil {
+			if c.verifyPolicy == SkipCorrupted {
+				chunk.corruptRecords = append(chunk.corruptRecords, CorruptRecord{Line: lineNum, Err: err})
+				continue
+			}
+			chunk.err = fmt.Errorf("error decoding operation on line %d: %w", lineNum, err)
+			return
+		}
+		if stale {
+			chunk.staleRecords++
+		}
+		if unchecked {
+			chunk.uncheckedRecords++
+		}
+		operations[chunk.start+chunk.decoded] = op
+		lines[chunk.start+chunk.decoded] = lineNum
+		chunk.decoded++
+	}
+}
+
+// decodeWithBinarySnapshot decodes a version 3 file, the operations of the binary snapshot are all on line 2
+func decodeWithBinarySnapshot(layout fileLayout, c codec) (parsedFile, error) {
+	// the records after the snapshot are decoded right after its operations, see decodeOperationsAfter
+	room := bytes.Count(layout.body, []byte("\n")) + runtime.GOMAXPROCS(0)
+	snapshotOperations, stale, err := decodeBinarySnapshot(layout.binarySnapshotHeader, layout.binarySnapshot, room, c)
+	if err != nil {
+		// skipping the snapshot would lose all users, so it fails regardless of the verify policy
+		return parsedFile{}, fmt.Errorf("error decoding the binary snapshot on line %d: %w", binarySnapshotLine, err)
+	}
+	parsed := parsedFile{operations: snapshotOperations, lines: make([]int, len(snapshotOperations), len(snapshotOperations)+room)}
+	for i := range parsed.lines {
+		parsed.lines[i] = binarySnapshotLine
+	}
+	if stale {
+		parsed.staleRecords++
+	}
+	parsed, err = decodeOperationsAfter(parsed, layout.body, layout.bodyLine, c)
+	parsed.version, parsed.checksums = binarySnapshotFormatVersion, c.expectChecksums
+	return parsed, err
+}
+
+// encodeOperation returns a single line (including the newline) for the operation.
+// Only the fields used by the type of the operation are written.
+func encodeOperation(op models.Operation) ([]byte, error) {
+	record := operationRecord{Op: op.Type}
+	switch op.Type {
+	case models.CreateUserOp, models.UpdateUserOp:
+		record.User = &userRecord{
+			Id:              op.User.Id,
+			Username:        op.User.Username,
+			StoredPass:      op.User.StoredPass,
+			AuthToken:       op.User.AuthToken.Token,
+			PasswordHistory: op.User.PasswordHistory,
+			PublicId:        op.User.PublicId,
+			LegacyId:        op.User.LegacyId,
+		}
+	case models.DeleteUserOp, models.IdCounterOp:
+		record.UserId = op.UserId
+	case models.AddTokenOp, models.RemoveTokenOp:
+		record.UserId = op.UserId
+		record.Token = op.Token.Token
+	default:
+		return nil, fmt.Errorf("unknown operation type: %q", op.Type)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding operation: %w", err)
+	}
+	return append(line, '\n'), nil
+}
+
+func decodeOperation(line []byte) (models.Operation, error) {
+	var record operationRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return models.Operation{}, err
+	}
+	switch record.Op {
+	case models.CreateUserOp, models.UpdateUserOp:
+		if record.User == nil {
+			return models.Operation{}, fmt.Errorf("%s operation without a user", record.Op)
+		}
+		var history []string
+		if len(record.User.PasswordHistory) != 0 {
+			history = record.User.PasswordHistory
+		}
+		return models.Operation{Type: record.Op, User: models.UserModel{
+			Id:              record.User.Id,
+			Username:        record.User.Username,
+			StoredPass:      record.User.StoredPass,
+			AuthToken:       entities.Token{Token: record.User.AuthToken},
+			PasswordHistory: history,
+			PublicId:        record.User.PublicId,
+			LegacyId:        record.User.LegacyId,
+		}}, nil
+	case models.DeleteUserOp, models.IdCounterOp:
+		return models.Operation{Type: record.Op, UserId: record.UserId}, nil
+	case models.AddTokenOp, models.RemoveTokenOp:
+		return models.Operation{Type: record.Op, UserId: record.UserId, Token: entities.Token{Token: record.Token}}, nil
+	}
+	return models.Operation{}, fmt.Errorf("unknown operation type: %q", record.Op)
+}
@@ -0,0 +1,321 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+)
+
+// With WithBinarySnapshots the operations are written in a compact binary form whenever the whole file is rewritten
+// (compaction, migration, re-encryption). Such a file has format version 3:
+//
+//	{"format":"golang-auth-db","version":3,"binary_snapshot":{"size":<bytes>,"crc32c":"xxxxxxxx"}}
+//	<size bytes of binary operations>
+//	<records appended after the snapshot, one per line like in version 2>
+//
+// The binary section is followed by a newline, so that it counts as a single line of the file.
+// If encryption is enabled, the whole section is encrypted at once (bound to line 2, see recordAAD), and the header also holds "key" and "nonce".
+// The checksum covers the section as it is stored.
+//
+// The binary section starts with the number of operations and the total number of password history entries (uvarints),
+// followed by the operations: a type byte and the fields used by the type, like in encodeOperation.
+// Ids are varints, strings are a uvarint length followed by the bytes, password histories are a uvarint count followed by the strings.
+// If some user has a public id, the header has "public_ids":true and every user is followed by its public id (a string) and legacy id,
+// otherwise they are omitted, so that such files stay readable by versions of the library before public ids were added.
+//
+// All strings of the section are substrings of a single string, and all histories share a single slice,
+// so loading it takes a few allocations regardless of the number of users.
+// The trade-off is that the whole string stays in memory as long as any user loaded from it does, i.e. usually until the process exits,
+// including the strings of users deleted or changed since then. This is at most the size of the section (about the size of the users' data),
+// while copying every string would take several allocations per user and make loading big files much slower.
+//
+// Version 3 is only written when binary snapshots are enabled, so that files stay readable by older versions of the library otherwise.
+// A file with a binary snapshot can be converted back to version 2 by compacting it without the option or with the decrypt_db command.
+const binarySnapshotFormatVersion = 3
+
+// the binary section is the second line of the file, right after the header
+const binarySnapshotLine = 2
+
+var ErrCorruptBinarySnapshot = errors.New("the binary snapshot of the db file is corrupt")
+
+// WithBinarySnapshots makes the file be written with a binary snapshot whenever it is rewritten as a whole, which loads much faster.
+func WithBinarySnapshots() Option {
+	return func(d *DBFileInteractorImpl) {
+		d.binarySnapshots = true
+	}
+}
+
+type binarySnapshotHeader struct {
+	Size     int    `json:"size"`
+	Checksum string `json:"crc32c"`
+	// set if the section is encrypted
+	KeyVersion int    `json:"key,omitempty"`
+	Nonce      []byte `json:"nonce,omitempty"`
+	// set if the users are followed by their public and legacy ids
+	PublicIds bool `json:"public_ids,omitempty"`
+}
+
+var binaryOperationTypes = []models.OperationType{
+	models.CreateUserOp,
+	models.UpdateUserOp,
+	models.DeleteUserOp,
+	models.AddTokenOp,
+	models.RemoveTokenOp,
+	models.IdCounterOp,
+}
+
+func binaryOperationType(opType models.OperationType) (byte, error) {
+	for i, t := range binaryOperationTypes {
+		if t == opType {
+			return byte(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operation type: %q", opType)
+}
+
+// encodeBinarySnapshot returns the header line and the section (including its trailing newline),
+// they are returned separately to avoid copying the section
+func encodeBinarySnapshot(operations []models.Operation, keys record_encryption.KeyProvider) (header, section []byte, err error) {
+	historyEntries := 0
+	publicIds := false
+	// an upper bound of the size of the section, so that it is allocated once
+	size := 2*binary.MaxVarintLen64 + 1
+	for _, op := range operations {
+		historyEntries += len(op.User.PasswordHistory)
+		size += 1 + 7*binary.MaxVarintLen64 + len(op.User.Username) + len(op.User.StoredPass) + len(op.User.AuthToken.Token) + len(op.Token.Token) + len(op.User.PublicId)
+		publicIds = publicIds || op.User.PublicId != "" || op.User.LegacyId != 0
+		for _, hash := range op.User.PasswordHistory {
+			size += binary.MaxVarintLen64 + len(hash)
+		}
+	}
+	section = make([]byte, 0, size)
+	section = appendUvarint(section, uint64(len(operations)))
+	section = appendUvarint(section, uint64(historyEntries))
+	for _, op := range operations {
+		opType, err := binaryOperationType(op.Type)
+		if err != nil {
+			return nil, nil, err
+		}
+		section = append(section, opType)
+		switch op.Type {
+		case models.CreateUserOp, models.UpdateUserOp:
+			section = appendVarint(section, int64(op.User.Id))
+			section = appendString(section, op.User.Username)
+			section = appendString(section, op.User.StoredPass)
+			section = appendString(section, op.User.AuthToken.Token)
+			section = appendUvarint(section, uint64(len(op.User.PasswordHistory)))
+			for _, hash := range op.User.PasswordHistory {
+				section = appendString(section, hash)
+			}
+			if publicIds {
+				section = appendString(section, op.User.PublicId)
+				section = appendVarint(section, int64(op.User.LegacyId))
+			}
+		case models.DeleteUserOp, models.IdCounterOp:
+			section = appendVarint(section, int64(op.UserId))
+		case models.AddTokenOp, models.RemoveTokenOp:
+			section = appendVarint(section, int64(op.UserId))
+			section = appendString(section, op.Token.Token)
+		}
+	}
+
+	snapshotHeader := &binarySnapshotHeader{PublicIds: publicIds}
+	if keys != nil {
+		envelope, err := record_encryption.Seal(keys, section, recordAAD(binarySnapshotLine))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error encrypting the binary snapshot: %w", err)
+		}
+		section = envelope.Ciphertext
+		snapshotHeader.KeyVersion, snapshotHeader.Nonce = envelope.KeyVersion, envelope.Nonce
+	}
+	snapshotHeader.Size = len(section)
+	snapshotHeader.Checksum = fmt.Sprintf("%08x", crc32.Checksum(section, castagnoli))
+
+	header, err = encodeHeaderWith(fileHeader{Format: formatName, Version: binarySnapshotFormatVersion, Checksums: true, BinarySnapshot: snapshotHeader})
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, append(section, '\n'), nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUvarint(b, uint64(len(s))), s...)
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendVarint(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], x)]...)
+}
+
+// decodeBinarySnapshot also reports whether the section is stale, i.e. it should be re-encrypted (see codec.decode).
+// The returned slice has room for extraCapacity more operations.
+func decodeBinarySnapshot(snapshotHeader binarySnapshotHeader, section []byte, extraCapacity int, c codec) (operations []models.Operation, stale bool, err error) {
+	if fmt.Sprintf("%08x", crc32.Checksum(section, castagnoli)) != snapshotHeader.Checksum {
+		return nil, false, fmt.Errorf("%w: %v", ErrCorruptBinarySnapshot, ErrChecksumMismatch)
+	}
+	encrypted := snapshotHeader.Nonce != nil
+	switch {
+	case encrypted:
+		var bound bool
+		section, bound, err = c.open(record_encryption.Envelope{KeyVersion: snapshotHeader.KeyVersion, Nonce: snapshotHeader.Nonce, Ciphertext: section}, binarySnapshotLine)
+		if err != nil {
+			return nil, false, err
+		}
+		currentKey, err := c.keys.CurrentKey()
+		if err != nil {
+			return nil, false, fmt.Errorf("error getting the current encryption key: %w", err)
+		}
+		stale = !bound || snapshotHeader.KeyVersion != currentKey.Version
+	case c.keys != nil && !c.acceptUnencrypted:
+		return nil, false, fmt.Errorf("the binary snapshot: %w", ErrUnencryptedRecord)
+	default:
+		stale = c.keys != nil
+	}
+	operations, err = readBinaryOperations(section, snapshotHeader.PublicIds, extraCapacity)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrCorruptBinarySnapshot, err)
+	}
+	return operations, stale, nil
+}
+
+var errTruncatedBinarySnapshot = errors.New("unexpected end of the section")
+
+// binaryReader reads the fields of a section, the strings it returns are substrings of data
+type binaryReader struct {
+	data string
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	// binary.Uvarint takes a []byte, so the varint is decoded here to avoid converting data
+	var x uint64
+	for i, shift := 0, uint(0); i < len(r.data) && i < binary.MaxVarintLen64; i, shift = i+1, shift+7 {
+		b := r.data[i]
+		if b < 0x80 {
+			r.data = r.data[i+1:]
+			return x | uint64(b)<<shift
+		}
+		x |= uint64(b&0x7f) << shift
+	}
+	r.err = errTruncatedBinarySnapshot
+	return 0
+}
+
+func (r *binaryReader) varint() int64 {
+	ux := r.uvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = errTruncatedBinarySnapshot
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.data)) {
+		r.err = errTruncatedBinarySnapshot
+		return ""
+	}
+	s := r.data[:length]
+	r.data = r.data[length:]
+	return s
+}
+
+func readBinaryOperations(section []byte, publicIds bool, extraCapacity int) ([]models.Operation, error) {
+	// the only copy of the data, all strings are taken from it
+	r := &binaryReader{data: string(section)}
+	count, historyEntries := r.uvarint(), r.uvarint()
+	// every operation takes at least 2 bytes and every history entry at least 1, which bounds the allocations for corrupt counts
+	if r.err != nil || count > uint64(len(r.data))/2 || historyEntries > uint64(len(r.data)) {
+		return nil, errTruncatedBinarySnapshot
+	}
+	operations := make([]models.Operation, count, int(count)+extraCapacity)
+	histories := make([]string, historyEntries)
+	for i := range operations {
+		opTypeIndex := r.byte()
+		if r.err == nil && int(opTypeIndex) >= len(binaryOperationTypes) {
+			return nil, fmt.Errorf("unknown operation type %d of operation #%d", opTypeIndex, i+1)
+		}
+		op := &operations[i]
+		op.Type = binaryOperationTypes[opTypeIndex]
+		switch op.Type {
+		case models.CreateUserOp, models.UpdateUserOp:
+			op.User.Id = int(r.varint())
+			op.User.Username = r.string()
+			op.User.StoredPass = r.string()
+			op.User.AuthToken = entities.Token{Token: r.string()}
+			if historyLen := r.uvarint(); historyLen != 0 {
+				if historyLen > uint64(len(histories)) {
+					return nil, fmt.Errorf("too many password history entries in operation #%d", i+1)
+				}
+				op.User.PasswordHistory, histories = histories[:historyLen:historyLen], histories[historyLen:]
+				for j := range op.User.PasswordHistory {
+					op.User.PasswordHistory[j] = r.string()
+				}
+			}
+			if publicIds {
+				op.User.PublicId = r.string()
+				op.User.LegacyId = int(r.varint())
+			}
+		case models.DeleteUserOp, models.IdCounterOp:
+			op.UserId = int(r.varint())
+		case models.AddTokenOp, models.RemoveTokenOp:
+			op.UserId = int(r.varint())
+			op.Token = entities.Token{Token: r.string()}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("error reading operation #%d: %w", i+1, r.err)
+		}
+	}
+	if len(r.data) != 0 {
+		return nil, errors.New("unexpected data after the last operation")
+	}
+	return operations, nil
+}
+
+// splitBinarySnapshot cuts the section and its trailing newline off the rest of the file after the header
+func splitBinarySnapshot(snapshotHeader binarySnapshotHeader, rest []byte) (section, body []byte, err error) {
+	if snapshotHeader.Size < 0 || len(rest) < snapshotHeader.Size+1 || rest[snapshotHeader.Size] != '\n' {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorruptBinarySnapshot, errTruncatedBinarySnapshot)
+	}
+	return rest[:snapshotHeader.Size], rest[snapshotHeader.Size+1:], nil
+}
+
+// countLines returns the number of newlines in contents, counting the binary snapshot (if there is one) as a single line
+func countLines(contents []byte) int {
+	lines := bytes.Count(contents, []byte("\n"))
+	if layout, err := parseFile(contents); err == nil {
+		lines -= bytes.Count(layout.binarySnapshot, []byte("\n"))
+	}
+	return lines
+}
@@ -0,0 +1,110 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+)
+
+// Version 1 of the format is CSV without a header.
+// Such files are only read for migrating them, new files are always written in the current format.
+func readV1(contents []byte) ([]models.Operation, error) {
+	csvReader := csv.NewReader(bytes.NewReader(contents))
+	csvReader.FieldsPerRecord = -1 // different operations have different amounts of columns
+	// rows are converted one by one, so the whole file is never held as strings
+	csvReader.ReuseRecord = true
+
+	operations := make([]models.Operation, 0, bytes.Count(contents, []byte("\n"))+1)
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return operations, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("got an error while reading csv: %w", err)
+		}
+		op, err := sliceToOperation(record)
+		if err != nil {
+			return nil, fmt.Errorf("error converting csv row to operation: %w", err)
+		}
+		operations = append(operations, op)
+	}
+}
+
+// Every v1 row starts with the operation type, followed by:
+//   - create_user, update_user: id, username, stored password, token, password history (JSON)
+//   - delete_user, id_counter: id
+//   - add_token, remove_token: id, token
+//
+// Rows written before the operation log was introduced contain only a user (id, username, stored password, token and optionally history),
+// they are read as create_user operations.
+func sliceToOperation(slice []string) (models.Operation, error) {
+	if len(slice) == 0 {
+		return models.Operation{}, fmt.Errorf("empty csv row")
+	}
+	if _, err := strconv.Atoi(slice[0]); err == nil {
+		user, err := sliceToUserModel(slice)
+		return models.Operation{Type: models.CreateUserOp, User: user}, err
+	}
+
+	opType, args := models.OperationType(slice[0]), slice[1:]
+	switch opType {
+	case models.CreateUserOp, models.UpdateUserOp:
+		user, err := sliceToUserModel(args)
+		return models.Operation{Type: opType, User: user}, err
+	case models.DeleteUserOp, models.IdCounterOp:
+		if len(args) != 1 {
+			return models.Operation{}, fmt.Errorf("incorrect amount of columns in a %s row: %v", opType, slice)
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return models.Operation{}, fmt.Errorf("error converting id to int: %w", err)
+		}
+		return models.Operation{Type: opType, UserId: id}, nil
+	case models.AddTokenOp, models.RemoveTokenOp:
+		if len(args) != 2 {
+			return models.Operation{}, fmt.Errorf("incorrect amount of columns in a %s row: %v", opType, slice)
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return models.Operation{}, fmt.Errorf("error converting id to int: %w", err)
+		}
+		return models.Operation{Type: opType, UserId: id, Token: entities.Token{Token: args[1]}}, nil
+	}
+	return models.Operation{}, fmt.Errorf("unknown operation type: %q", opType)
+}
+
+const numberOfModelFields = 5
+
+// the password history column was added later, so rows without it are also accepted
+const numberOfLegacyModelFields = 4
+
+func sliceToUserModel(slice []string) (models.UserModel, error) {
+	if len(slice) != numberOfModelFields && len(slice) != numberOfLegacyModelFields {
+		return models.UserModel{}, fmt.Errorf("incorrect amount of columns in a csv row: %v", slice)
+	}
+	id, err := strconv.Atoi(slice[0])
+	if err != nil {
+		return models.UserModel{}, fmt.Errorf("error converting id to int: %w", err)
+	}
+	var history []string
+	if len(slice) == numberOfModelFields && slice[4] != "" {
+		if err := json.Unmarshal([]byte(slice[4]), &history); err != nil {
+			return models.UserModel{}, fmt.Errorf("error decoding password history: %w", err)
+		}
+	}
+	return models.UserModel{
+		Id:              id,
+		Username:        slice[1],
+		StoredPass:      slice[2],
+		AuthToken:       entities.Token{Token: slice[3]},
+		PasswordHistory: history,
+	}, nil
+}
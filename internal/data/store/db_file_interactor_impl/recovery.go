@@ -0,0 +1,87 @@
+package db_file_interactor_impl
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+)
+
+// A crash in the middle of appending an operation can leave a truncated record at the end of the file.
+// Such a record was never acknowledged to the writer, so it is safe to drop it:
+// it is moved to the "<dbFileName>.quarantine" file for inspection and cut off the db file.
+// Malformed records anywhere else in the file are still treated as errors.
+
+// parseWithRecovery parses the file contents with the codec, recovering from a truncated trailing record
+func (d *DBFileInteractorImpl) parseWithRecovery(contents []byte, c codec) (parsedFile, error) {
+	lastNewline := bytes.LastIndexByte(contents, '\n')
+	complete, tail := contents[:lastNewline+1], contents[lastNewline+1:]
+	parsed, err := upgradeFile(contents, c)
+	if len(tail) == 0 {
+		return parsed, err
+	}
+
+	// with the SkipCorrupted policy a truncated record is skipped instead of failing the parsing
+	tailIsCorrupt := err != nil
+	if err == nil && len(parsed.corruptRecords) != 0 {
+		tailIsCorrupt = parsed.corruptRecords[len(parsed.corruptRecords)-1].Line == lineCount(contents)
+	}
+	if !tailIsCorrupt {
+		// the last record is complete, only its newline is missing, so it should be added before appending anything
+		if !d.readOnly {
+			if err := appendToFile(d.dbFileName, []byte("\n")); err != nil {
+				return parsedFile{}, fmt.Errorf("error terminating the last record: %w", err)
+			}
+		}
+		return parsed, nil
+	}
+
+	parsedComplete, completeErr := upgradeFile(complete, c)
+	if completeErr != nil {
+		// the problem is not (only) in the last record
+		return parsedFile{}, err
+	}
+	log.Printf("the last record of db file %s is truncated (probably the process crashed while writing it), ignoring it", d.dbFileName)
+	if !d.readOnly {
+		if err := d.quarantine(tail, len(complete)); err != nil {
+			return parsedFile{}, err
+		}
+	}
+	return parsedComplete, nil
+}
+
+func lineCount(contents []byte) int {
+	return countLines(contents) + 1
+}
+
+func (d *DBFileInteractorImpl) quarantine(tornRecord []byte, validSize int) error {
+	quarantineFileName := d.dbFileName + ".quarantine"
+	if err := appendToFile(quarantineFileName, append(tornRecord, '\n')); err != nil {
+		return fmt.Errorf("error quarantining the truncated record: %w", err)
+	}
+	dbFile, err := os.OpenFile(d.dbFileName, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error opening the db file for truncating: %w", err)
+	}
+	defer dbFile.Close()
+	if err := dbFile.Truncate(int64(validSize)); err != nil {
+		return fmt.Errorf("error cutting off the truncated record: %w", err)
+	}
+	if err := dbFile.Sync(); err != nil {
+		return fmt.Errorf("error syncing the db file: %w", err)
+	}
+	log.Printf("the truncated record was moved to %s", quarantineFileName)
+	return nil
+}
+
+func appendToFile(fileName string, data []byte) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
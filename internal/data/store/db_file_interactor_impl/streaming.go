@@ -0,0 +1,207 @@
+package db_file_interactor_impl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// Files in the current format (version 2, or 3 with a binary snapshot) are loaded while streaming them:
+// the records are read in batches of whole lines, and every round of batches is decoded in parallel,
+// so loading takes about streamingBatchSize per CPU on top of the decoded operations, regardless of the size of the file.
+// The binary snapshot is read as a whole, since the loaded users keep referring to it anyway (see format_binary_snapshot.go).
+//
+// Files of older versions are read as a whole, since they are migrated and the original contents are backed up (see upgradeFile).
+// So are files with a header which can't be streamed (e.g. a truncated one), so that they fail or are recovered like before.
+
+// streamingBatchSize is about how much of the file a single goroutine decodes at once
+const streamingBatchSize = 1 << 20
+
+// streamingReadBufferSize is the size of the reads from the file, lines longer than it are read in several parts
+const streamingReadBufferSize = 64 << 10
+
+// filePosition is how far the file was read, see tailState
+type filePosition struct {
+	// the offset just after the last complete record
+	offset int64
+	// the number of lines before offset
+	lines int
+}
+
+// loadFile parses the file, streaming it if possible. The contents are returned only if the file was read as a whole.
+func (d *DBFileInteractorImpl) loadFile(file *os.File, c codec) (parsed parsedFile, end filePosition, contents []byte, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return parsedFile{}, filePosition{}, nil, err
+	}
+	reader := bufio.NewReaderSize(file, streamingReadBufferSize)
+	header, headerLine, streamable := readStreamableHeader(reader)
+	if !streamable {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return parsedFile{}, filePosition{}, nil, err
+		}
+		contents, err := readWholeFile(file)
+		if err != nil {
+			return parsedFile{}, filePosition{}, nil, err
+		}
+		parsed, err := d.parseWithRecovery(contents, c)
+		offset := bytes.LastIndexByte(contents, '\n') + 1
+		return parsed, filePosition{offset: int64(offset), lines: countLines(contents[:offset])}, contents, err
+	}
+
+	c.expectChecksums = header.Checksums
+	parsed = parsedFile{version: header.Version, checksums: header.Checksums}
+	end = filePosition{offset: int64(len(headerLine)), lines: 1}
+	if header.Version == binarySnapshotFormatVersion {
+		if parsed, err = readStreamedBinarySnapshot(reader, *header.BinarySnapshot, info.Size(), parsed, c); err != nil {
+			return parsedFile{}, filePosition{}, nil, err
+		}
+		end = filePosition{offset: end.offset + int64(header.BinarySnapshot.Size) + 1, lines: binarySnapshotLine}
+	}
+	parsed, end, err = d.streamRecords(reader, parsed, end, c)
+	return parsed, end, nil, err
+}
+
+// readStreamableHeader reads the header line, if it is a complete header of a version, which can be streamed
+func readStreamableHeader(reader *bufio.Reader) (header fileHeader, headerLine []byte, streamable bool) {
+	headerLine, err := reader.ReadSlice('\n')
+	if err != nil || headerLine[0] != '{' {
+		return fileHeader{}, nil, false
+	}
+	if err := json.Unmarshal(headerLine, &header); err != nil || header.Format != formatName {
+		return fileHeader{}, nil, false
+	}
+	switch {
+	case header.Version == currentFormatVersion:
+		return header, headerLine, true
+	case header.Version == binarySnapshotFormatVersion && header.BinarySnapshot != nil:
+		return header, headerLine, true
+	}
+	return fileHeader{}, nil, false
+}
+
+// readStreamedBinarySnapshot reads and decodes the binary section of a version 3 file, which follows its header
+func readStreamedBinarySnapshot(reader *bufio.Reader, snapshotHeader binarySnapshotHeader, fileSize int64, parsed parsedFile, c codec) (parsedFile, error) {
+	if snapshotHeader.Size < 0 || int64(snapshotHeader.Size) >= fileSize {
+		return parsedFile{}, fmt.Errorf("%w: %v", ErrCorruptBinarySnapshot, errTruncatedBinarySnapshot)
+	}
+	sectionLine := make([]byte, snapshotHeader.Size+1)
+	if _, err := io.ReadFull(reader, sectionLine); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return parsedFile{}, fmt.Errorf("error reading the binary snapshot: %w", err)
+	}
+	section, _, err := splitBinarySnapshot(snapshotHeader, sectionLine)
+	if err != nil {
+		return parsedFile{}, err
+	}
+	operations, stale, err := decodeBinarySnapshot(snapshotHeader, section, 0, c)
+	if err != nil {
+		// skipping the snapshot would lose all users, so it fails regardless of the verify policy
+		return parsedFile{}, fmt.Errorf("error decoding the binary snapshot on line %d: %w", binarySnapshotLine, err)
+	}
+	parsed.operations, parsed.lines = operations, make([]int, len(operations), cap(operations))
+	for i := range parsed.lines {
+		parsed.lines[i] = binarySnapshotLine
+	}
+	if stale {
+		parsed.staleRecords++
+	}
+	return parsed, nil
+}
+
+// streamRecords decodes the records from the reader until the end of the file and appends them to the operations in parsed.
+// A truncated record at the end of the file is recovered like in parseWithRecovery.
+func (d *DBFileInteractorImpl) streamRecords(reader *bufio.Reader, parsed parsedFile, end filePosition, c codec) (parsedFile, filePosition, error) {
+	workers := runtime.GOMAXPROCS(0)
+	var tail []byte
+	for eof := false; !eof; {
+		chunks := make([]decodingChunk, 0, workers)
+		for len(chunks) < workers && !eof {
+			batch, err := readBatch(reader, streamingBatchSize)
+			if errors.Is(err, io.EOF) {
+				eof = true
+			} else if err != nil {
+				return parsedFile{}, filePosition{}, fmt.Errorf("error reading the db file: %w", err)
+			}
+			if eof {
+				lastNewline := bytes.LastIndexByte(batch, '\n')
+				batch, tail = batch[:lastNewline+1], batch[lastNewline+1:]
+			}
+			chunk := decodingChunk{data: batch, firstLine: end.lines + 1, lines: bytes.Count(batch, []byte("\n"))}
+			chunks = append(chunks, chunk)
+			end.offset += int64(len(batch))
+			end.lines += chunk.lines
+		}
+		var err error
+		if parsed, err = decodeChunksAfter(parsed, chunks, c); err != nil {
+			return parsedFile{}, filePosition{}, err
+		}
+	}
+	parsed, err := d.recoverTail(parsed, tail, end, c)
+	if err != nil {
+		return parsedFile{}, filePosition{}, err
+	}
+	// the room left by growing the slices while decoding isn't needed anymore
+	if n := len(parsed.operations); cap(parsed.operations) > n+n/4 {
+		parsed.operations = append([]models.Operation(nil), parsed.operations...)
+		parsed.lines = append([]int(nil), parsed.lines...)
+	}
+	return parsed, end, nil
+}
+
+// readBatch reads whole lines until at least size bytes are read.
+// It returns io.EOF with the rest of the file, whose last line may be missing its newline.
+func readBatch(reader *bufio.Reader, size int) ([]byte, error) {
+	var batch []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		batch = append(batch, line...)
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			// the line is longer than the buffer of the reader, the rest of it follows
+		case err != nil:
+			return batch, err
+		case len(batch) >= size:
+			return batch, nil
+		}
+	}
+}
+
+// recoverTail handles a record without a trailing newline at the end of the file, which starts at end:
+// a complete record gets its newline, a truncated one is quarantined (see recovery.go).
+func (d *DBFileInteractorImpl) recoverTail(parsed parsedFile, tail []byte, end filePosition, c codec) (parsedFile, error) {
+	if len(tail) == 0 {
+		return parsed, nil
+	}
+	tailChunk := decodingChunk{data: tail, firstLine: end.lines + 1}
+	operations, lines := make([]models.Operation, 1), make([]int, 1)
+	tailChunk.decode(operations, lines, c)
+	if tailChunk.err == nil && len(tailChunk.corruptRecords) == 0 {
+		// the last record is complete, only its newline is missing, so it should be added before appending anything
+		if !d.readOnly {
+			if err := appendToFile(d.dbFileName, []byte("\n")); err != nil {
+				return parsedFile{}, fmt.Errorf("error terminating the last record: %w", err)
+			}
+		}
+		parsed.operations = append(parsed.operations, operations[:tailChunk.decoded]...)
+		parsed.lines = append(parsed.lines, lines[:tailChunk.decoded]...)
+		parsed.staleRecords += tailChunk.staleRecords
+		parsed.uncheckedRecords += tailChunk.uncheckedRecords
+		return parsed, nil
+	}
+
+	log.Printf("the last record of db file %s is truncated (probably the process crashed while writing it), ignoring it", d.dbFileName)
+	if !d.readOnly {
+		if err := d.quarantine(tail, int(end.offset)); err != nil {
+			return parsedFile{}, err
+		}
+	}
+	return parsed, nil
+}
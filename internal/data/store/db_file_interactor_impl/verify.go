@@ -0,0 +1,160 @@
+package db_file_interactor_impl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/record_encryption"
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// VerifyReport lists all problems found by Verify
+type VerifyReport struct {
+	FormatVersion int
+	Records       int
+	// records without a checksum, which were appended by an older version of the library (see checksum.go).
+	// They aren't a problem by themselves, the file gets checksums for them when it is opened for writing.
+	UncheckedRecords int
+	// records which failed checksum verification or couldn't be decoded
+	CorruptRecords []CorruptRecord
+	// records referring to a user id, which doesn't exist at that point of the log
+	DanglingRecords []CorruptRecord
+	// values shared by several users at the same time
+	DuplicateIds       []Duplicate
+	DuplicateUsernames []Duplicate
+	DuplicateTokens    []Duplicate
+	// public and legacy ids (see models.UserModel) shared by several users
+	DuplicatePublicIds []Duplicate
+}
+
+// Duplicate is a value shared by several users, together with the lines of the records, which introduced it
+type Duplicate struct {
+	Value string
+	Lines []int
+}
+
+func (r VerifyReport) OK() bool {
+	return len(r.CorruptRecords) == 0 && len(r.DanglingRecords) == 0 &&
+		len(r.DuplicateIds) == 0 && len(r.DuplicateUsernames) == 0 && len(r.DuplicateTokens) == 0 && len(r.DuplicatePublicIds) == 0
+}
+
+// Verify scans a whole db file and reports corrupt records and duplicates, without modifying anything.
+// keys may be nil if the file is not encrypted.
+// Line numbers of files with an older format refer to the file after migrating it to the current format.
+func Verify(src io.Reader, keys record_encryption.KeyProvider) (VerifyReport, error) {
+	contents, err := io.ReadAll(src)
+	if err != nil {
+		return VerifyReport{}, fmt.Errorf("error reading the db file: %w", err)
+	}
+	parsed, err := upgradeFile(contents, codec{keys: keys, verifyPolicy: SkipCorrupted})
+	if err != nil {
+		return VerifyReport{}, fmt.Errorf("error parsing the db file: %w", err)
+	}
+	for _, corrupt := range parsed.corruptRecords {
+		if errors.Is(corrupt.Err, ErrNoEncryptionKeys) {
+			return VerifyReport{}, ErrNoEncryptionKeys
+		}
+	}
+
+	report := VerifyReport{
+		FormatVersion:    parsed.version,
+		Records:          len(parsed.operations) + len(parsed.corruptRecords),
+		UncheckedRecords: parsed.uncheckedRecords,
+		CorruptRecords:   parsed.corruptRecords,
+	}
+	users, lastLines, duplicateIds := replayForVerification(parsed, &report)
+	report.DuplicateIds = duplicatesFrom(duplicateIds)
+
+	usernames := map[string][]int{}
+	tokens := map[string][]int{}
+	publicIds := map[string][]int{}
+	for id, user := range users {
+		usernames[user.Username] = append(usernames[user.Username], lastLines[id])
+		if user.AuthToken.Token != "" {
+			tokens[user.AuthToken.Token] = append(tokens[user.AuthToken.Token], lastLines[id])
+		}
+		if user.PublicId != "" {
+			publicIds[user.PublicId] = append(publicIds[user.PublicId], lastLines[id])
+		}
+		if user.LegacyId != 0 {
+			legacyId := user_ids.FormatLegacyId(user.LegacyId)
+			publicIds[legacyId] = append(publicIds[legacyId], lastLines[id])
+		}
+	}
+	report.DuplicateUsernames = duplicatesFrom(usernames)
+	report.DuplicateTokens = duplicatesFrom(tokens)
+	report.DuplicatePublicIds = duplicatesFrom(publicIds)
+	return report, nil
+}
+
+// replayForVerification replays the operations like the store does, but records problems instead of failing on them.
+// It returns the final users, the line of the last record of every user, and the lines of creations of every id created more than once.
+func replayForVerification(parsed parsedFile, report *VerifyReport) (users map[int]models.UserModel, lastLines map[int]int, duplicateIds map[string][]int) {
+	users = map[int]models.UserModel{}
+	lastLines = map[int]int{}
+	duplicateIds = map[string][]int{}
+	for i, op := range parsed.operations {
+		line := parsed.lines[i]
+		if op.Type == models.CreateUserOp {
+			if _, exists := users[op.User.Id]; exists {
+				id := strconv.Itoa(op.User.Id)
+				if len(duplicateIds[id]) == 0 {
+					duplicateIds[id] = []int{lastLines[op.User.Id]}
+				}
+				duplicateIds[id] = append(duplicateIds[id], line)
+			}
+			users[op.User.Id] = op.User
+			lastLines[op.User.Id] = line
+			continue
+		}
+		if op.Type == models.IdCounterOp {
+			continue
+		}
+
+		id := op.UserId
+		if op.Type == models.UpdateUserOp {
+			id = op.User.Id
+		}
+		user, exists := users[id]
+		if !exists {
+			report.DanglingRecords = append(report.DanglingRecords, CorruptRecord{Line: line, Err: fmt.Errorf("%s refers to a non existing user id %d", op.Type, id)})
+			continue
+		}
+		switch op.Type {
+		case models.UpdateUserOp:
+			user = op.User
+		case models.DeleteUserOp:
+			delete(users, id)
+			delete(lastLines, id)
+			continue
+		case models.AddTokenOp:
+			user.AuthToken = op.Token
+		case models.RemoveTokenOp:
+			if user.AuthToken == op.Token {
+				user.AuthToken.Token = ""
+			}
+		}
+		users[id] = user
+		lastLines[id] = line
+	}
+	return users, lastLines, duplicateIds
+}
+
+// duplicatesFrom returns the values with more than one line, sorted by the first line
+func duplicatesFrom(linesByValue map[string][]int) []Duplicate {
+	duplicates := []Duplicate{}
+	for value, lines := range linesByValue {
+		if len(lines) > 1 {
+			sort.Ints(lines)
+			duplicates = append(duplicates, Duplicate{Value: value, Lines: lines})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Lines[0] < duplicates[j].Lines[0]
+	})
+	return duplicates
+}
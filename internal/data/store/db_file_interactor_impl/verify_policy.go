@@ -0,0 +1,64 @@
+package db_file_interactor_impl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// VerifyPolicy sets what happens when a record fails checksum verification or can't be decoded while loading the file
+type VerifyPolicy int
+
+const (
+	// FailOnCorruption makes loading fail on the first corrupt record
+	FailOnCorruption VerifyPolicy = iota
+	// SkipCorrupted skips corrupt records, logging every one of them.
+	// Later records referring to a user, which doesn't exist because its records were skipped, are skipped and logged too.
+	// Skipped records are dropped from the file by the next compaction, the verify_db command can be used to inspect them before that.
+	SkipCorrupted
+)
+
+func WithVerifyPolicy(policy VerifyPolicy) Option {
+	return func(d *DBFileInteractorImpl) {
+		d.codec.verifyPolicy = policy
+	}
+}
+
+var ErrDependsOnCorruptRecord = errors.New("the record refers to a user, which doesn't exist because a corrupt record was skipped")
+
+// skipDependents skips the operations referring to a user id, which doesn't exist at that point of the log,
+// adding them to the corrupt records, since applying them would fail.
+// Such operations are expected only after skipping corrupt records, so files without them are returned as they are.
+func skipDependents(parsed parsedFile) parsedFile {
+	if len(parsed.corruptRecords) == 0 {
+		return parsed
+	}
+	exists := map[int]bool{}
+	kept := 0
+	for i, op := range parsed.operations {
+		id := op.UserId
+		switch op.Type {
+		case models.CreateUserOp:
+			exists[op.User.Id] = true
+		case models.UpdateUserOp:
+			id = op.User.Id
+		}
+		if op.Type != models.CreateUserOp && op.Type != models.IdCounterOp && !exists[id] {
+			err := fmt.Errorf("%w: %s of user id %d", ErrDependsOnCorruptRecord, op.Type, id)
+			parsed.corruptRecords = append(parsed.corruptRecords, CorruptRecord{Line: parsed.lines[i], Err: err})
+			continue
+		}
+		if op.Type == models.DeleteUserOp {
+			delete(exists, id)
+		}
+		parsed.operations[kept], parsed.lines[kept] = op, parsed.lines[i]
+		kept++
+	}
+	parsed.operations, parsed.lines = parsed.operations[:kept], parsed.lines[:kept]
+	sort.SliceStable(parsed.corruptRecords, func(i, j int) bool {
+		return parsed.corruptRecords[i].Line < parsed.corruptRecords[j].Line
+	})
+	return parsed
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package db_file_interactor_impl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchFile calls notify on inotify events for the file.
+// The directory is watched instead of the file itself, since the writer replaces the file by renaming a new one over it.
+func watchFile(fileName string, notify func()) (stop func(), err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	mask := uint32(syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(fileName), mask); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	// a non-blocking fd is handled by the runtime poller, so closing the file interrupts the Read below
+	events := os.NewFile(uintptr(fd), "inotify")
+	go readEvents(events, filepath.Base(fileName), notify)
+	return func() { events.Close() }, nil
+}
+
+func readEvents(events *os.File, name string, notify func()) {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := events.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			eventName := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			// on overflow some events were dropped, so the file might have changed
+			if eventName == name || event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				notify()
+			}
+			offset = nameStart + int(event.Len)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package db_file_interactor_impl
+
+import "errors"
+
+// inotify is not available on this platform, so the file is only polled
+func watchFile(fileName string, notify func()) (stop func(), err error) {
+	return nil, errors.New("watching files is not supported on this platform")
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+)
+
+// TailingDBFileInteractor is implemented by DB file interactors, which can follow a file written by another process
+type TailingDBFileInteractor interface {
+	DBFileInteractor
+	// ReadNewOperations returns the operations appended since the previous read.
+	// If the file was replaced (e.g. compacted by the writer), all of its operations are returned with reloaded set to true.
+	ReadNewOperations() (operations []models.Operation, reloaded bool, err error)
+	// Watch sends a value to changes whenever the file might have changed, at least every pollInterval, until stop is called
+	Watch(pollInterval time.Duration) (changes <-chan struct{}, stop func())
+	// ReplicationLag returns for how long the file has had operations, which weren't read yet
+	ReplicationLag() time.Duration
+}
+
+var ErrFollowingNotSupported = errors.New("the db file interactor doesn't support following the file")
+
+// WithFollowing makes the store follow the DB file while another process (the writer) is changing it,
+// e.g. on read-mostly replicas, which only need TokenAuthMiddleware.
+// Operations appended by the writer are applied as soon as the file changes (it is also checked every pollInterval),
+// and when the writer replaces the file (e.g. compacts it), the whole file is loaded again.
+// It implies WithReadOnly, the file interactor should implement TailingDBFileInteractor and be read-only too.
+func WithFollowing(pollInterval time.Duration) Option {
+	return func(p *PersistentInMemoryFileStore) {
+		p.readOnly = true
+		p.followInterval = pollInterval
+	}
+}
+
+// ReplicationLag returns for how long the DB file has had operations, which aren't visible in the store yet.
+// It is zero if the store is not following the file (see WithFollowing).
+func (p *PersistentInMemoryFileStore) ReplicationLag() time.Duration {
+	tailer, ok := p.fileInteractor.(TailingDBFileInteractor)
+	if p.followInterval == 0 || !ok {
+		return 0
+	}
+	return tailer.ReplicationLag()
+}
+
+func (p *PersistentInMemoryFileStore) startFollowing(tailer TailingDBFileInteractor) (stop func()) {
+	changes, stopWatching := tailer.Watch(p.followInterval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-changes:
+				if err := p.catchUp(tailer); err != nil {
+					log.Printf("error while following the db file: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopWatching()
+			close(done)
+			<-finished
+		})
+	}
+}
+
+// catchUp applies the operations appended to the DB file since the last read
+func (p *PersistentInMemoryFileStore) catchUp(tailer TailingDBFileInteractor) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	operations, reloaded, err := tailer.ReadNewOperations()
+	if err != nil {
+		return fmt.Errorf("got an error while reading new operations from file interactor: %w", err)
+	}
+	if !reloaded {
+		var touched []string
+		for _, op := range operations {
+			touched = append(touched, p.touchedTokens(op)...)
+		}
+		p.indexMu.Lock()
+		err := p.applyNew(operations)
+		p.indexMu.Unlock()
+		p.invalidate(touched)
+		if err == nil {
+			return nil
+		}
+		// the state in memory is now partially updated, but it is replaced below anyway
+		log.Printf("new operations of the db file don't match the loaded state (%v), loading the whole file", err)
+		operations, err = p.fileInteractor.ReadOperations()
+		if err != nil {
+			return fmt.Errorf("got an error while reading operations from file interactor: %w", err)
+		}
+	}
+	return p.reload(operations)
+}
+
+// applyNew should be called with both mu and indexMu locked
+func (p *PersistentInMemoryFileStore) applyNew(operations []models.Operation) error {
+	for _, op := range operations {
+		if err := p.apply(op); err != nil {
+			return err
+		}
+		p.operationsCount++
+		p.appendedOperations++
+	}
+	return nil
+}
+
+// reload replaces the whole state with the result of replaying the operations, it should be called with mu locked
+func (p *PersistentInMemoryFileStore) reload(operations []models.Operation) error {
+	fresh, err := replayed(operations)
+	if err != nil {
+		return err
+	}
+	p.swapState(fresh)
+	return nil
+}
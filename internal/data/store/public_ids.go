@@ -0,0 +1,97 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+)
+
+// WithIdStrategy makes new users get public ids generated by the strategy.
+// Existing users keep being exposed with their integer ids until they are given public ids with SetPublicId.
+func WithIdStrategy(strategy user_ids.Strategy) Option {
+	return func(p *PersistentInMemoryFileStore) {
+		p.idStrategy = strategy
+	}
+}
+
+// maxPublicIdAttempts bounds the retries after generating a taken public id, which only a broken strategy does repeatedly
+const maxPublicIdAttempts = 10
+
+var errPublicIdsExhausted = errors.New("the id strategy keeps generating taken public ids")
+
+// newPublicId returns a free public id for a new user, or an empty one if no id strategy is set, it should be called with mu locked
+func (p *PersistentInMemoryFileStore) newPublicId() (string, error) {
+	if p.idStrategy == nil {
+		return "", nil
+	}
+	for i := 0; i < maxPublicIdAttempts; i++ {
+		id, err := p.idStrategy()
+		if err != nil {
+			return "", err
+		}
+		if _, taken := p.resolveId(id); !taken {
+			return id, nil
+		}
+	}
+	return "", errPublicIdsExhausted
+}
+
+// FindUserById finds the user by its public id, by its legacy id,
+// or by its integer id if it has neither (see mappers.ExposedId)
+func (p *PersistentInMemoryFileStore) FindUserById(id string) (models.UserModel, error) {
+	p.indexMu.RLock()
+	defer p.indexMu.RUnlock()
+	user, ok := p.resolveId(id)
+	if !ok {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	return copyUser(user), nil
+}
+
+// resolveId should be called with mu or indexMu locked
+func (p *PersistentInMemoryFileStore) resolveId(id string) (*models.UserModel, bool) {
+	if user, ok := p.publicIdToUser[id]; ok {
+		return user, true
+	}
+	legacyId, ok := user_ids.ParseLegacyId(id)
+	if !ok {
+		return nil, false
+	}
+	if user, ok := p.legacyIdToUser[legacyId]; ok {
+		return user, true
+	}
+	user, ok := p.users[legacyId]
+	if !ok || user.PublicId != "" || user.LegacyId != 0 {
+		return nil, false
+	}
+	return user, true
+}
+
+// SetPublicId replaces the public and the legacy id of the user, e.g. for giving a public id to a user created without an id strategy.
+// It returns auth_store_contract.PublicIdTakenErr if another user is resolvable by one of the new ids.
+func (p *PersistentInMemoryFileStore) SetPublicId(username, publicId string, legacyId int) (err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+
+	user, ok := p.usernameToUser[username]
+	if !ok {
+		return auth_store_contract.UserNotFoundErr
+	}
+	newIds := []string{}
+	if publicId != "" {
+		newIds = append(newIds, publicId)
+	}
+	if legacyId != 0 {
+		newIds = append(newIds, user_ids.FormatLegacyId(legacyId))
+	}
+	for _, id := range newIds {
+		if owner, taken := p.resolveId(id); taken && owner != user {
+			return auth_store_contract.PublicIdTakenErr
+		}
+	}
+	updatedUser := copyUser(user)
+	updatedUser.PublicId, updatedUser.LegacyId = publicId, legacyId
+	return p.writeAndApply(models.Operation{Type: models.UpdateUserOp, User: updatedUser})
+}
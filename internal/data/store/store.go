@@ -1,9 +1,14 @@
 package store
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
 	"github.com/k0marov/golang-auth/internal/data/models"
 	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
 	"github.com/k0marov/golang-auth/internal/domain/entities"
@@ -11,96 +16,595 @@ import (
 )
 
 type DBFileInteractor interface {
-	ReadUsers() ([]models.UserModel, error)
-	WriteUser(models.UserModel) error
+	ReadOperations() ([]models.Operation, error)
+	WriteOperation(models.Operation) error
+	// ReplaceOperations atomically replaces the whole log, it is used for compaction
+	ReplaceOperations([]models.Operation) error
+	Size() (int64, error)
+	// Close releases the resources (e.g. the file lock) held by the interactor
+	Close() error
+}
+
+// AppendingDBFileInteractor is implemented by interactors, which share fsyncs between concurrent writes (see db_file_interactor_impl.GroupCommit).
+// The store appends operations with AppendOperation holding mu, and waits for them to reach the disk only after releasing it,
+// since writers waiting for an fsync with mu held are serialized, and so could never share one.
+type AppendingDBFileInteractor interface {
+	// AppendOperation appends the operation and returns a function, which returns once the operation is on disk
+	AppendOperation(models.Operation) (waitForSync func() error, err error)
+}
+
+// CompactionPolicy sets when the log is automatically compacted (checked after every write and on startup).
+// The thresholds count only what was appended since the last compaction, since the snapshot itself can't be compacted any further.
+// On startup it isn't known how big the last snapshot was, so a log with anything to compact is measured as a whole.
+// Zero values disable the corresponding threshold.
+type CompactionPolicy struct {
+	// compact when more than MaxOperations operations were appended
+	MaxOperations int
+	// compact when the log file grew by more than MaxFileSize bytes
+	MaxFileSize int64
+}
+
+type Option func(*PersistentInMemoryFileStore)
+
+var ErrReadOnly = errors.New("the store is opened in read-only mode")
+
+// WithReadOnly makes all mutations fail with ErrReadOnly and disables compaction,
+// so that the store can be opened by tools running alongside the process, which writes to it.
+func WithReadOnly() Option {
+	return func(p *PersistentInMemoryFileStore) {
+		p.readOnly = true
+	}
+}
+
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(p *PersistentInMemoryFileStore) {
+		p.compactionPolicy = policy
+	}
 }
 
 // An in-memory database is used here for 2 reasons:
 // 1. This database is accessed on nearly every request (see TokenAuthMiddleware), so speed is needed
 // 2. The schema is quite light on memory - 50 MB of RAM is enough to hold 100 000+ users
+//
+// Every mutation is first appended to the DB file as an operation, and then applied in memory.
+// On startup all operations from the file are replayed.
+// To keep the file from growing without bound, it is periodically compacted into a snapshot of the current state.
+//
+// Writers are serialized by mu, which is held during file IO (appending, compaction),
+// except for waiting for a shared fsync, which happens after releasing it (see AppendingDBFileInteractor).
+// The indexes are additionally guarded by indexMu, which writers lock only for applying an operation in memory,
+// so readers (e.g. TokenAuthMiddleware on every request) never wait for the disk.
+// Writers can read the indexes holding only mu, since nobody else changes them.
 type PersistentInMemoryFileStore struct {
-	fileInteractor DBFileInteractor
+	fileInteractor   DBFileInteractor
+	compactionPolicy CompactionPolicy
+	readOnly         bool
+	// the number of operations currently in the log
+	operationsCount int
+	// the number of operations appended since the last compaction and the size of the log right after it, see CompactionPolicy
+	appendedOperations int
+	compactedSize      int64
 
 	usernameToUser map[string]*models.UserModel
 	tokenToUser    map[string]*models.UserModel
-	users          []models.UserModel
+	users          map[int]*models.UserModel
+	// see public_ids.go
+	publicIdToUser map[string]*models.UserModel
+	legacyIdToUser map[int]*models.UserModel
+	indexMu        sync.RWMutex
 
 	biggestId int
+	// generates public ids of new users, if set
+	idStrategy user_ids.Strategy
+	// preallocated users, see newUser
+	userSlab []models.UserModel
 
 	mu sync.Mutex
+	// waits for the operation written while holding mu to reach the disk, see unlockAndSync, guarded by mu
+	pendingSync func() error
+
+	// see follow.go
+	followInterval time.Duration
+	stopFollowing  func()
+	// see token_invalidation.go
+	tokenInvalidator TokenInvalidator
 }
 
-func NewPersistentInMemoryFileStore(fileInteractor DBFileInteractor) (*PersistentInMemoryFileStore, error) {
-	users, err := fileInteractor.ReadUsers()
+func NewPersistentInMemoryFileStore(fileInteractor DBFileInteractor, opts ...Option) (*PersistentInMemoryFileStore, error) {
+	operations, err := fileInteractor.ReadOperations()
 	if err != nil {
-		return nil, fmt.Errorf("got an error while reading users from file interactor: %w", err)
+		return nil, fmt.Errorf("got an error while reading operations from file interactor: %w", err)
+	}
+
+	store := &PersistentInMemoryFileStore{fileInteractor: fileInteractor}
+	for _, opt := range opts {
+		opt(store)
+	}
+	if err := store.replay(operations); err != nil {
+		return nil, err
+	}
+	store.resetCompactionBaseline(store.operationsCount - store.snapshotLength())
+	store.maybeCompact()
+	if store.followInterval > 0 {
+		tailer, ok := fileInteractor.(TailingDBFileInteractor)
+		if !ok {
+			return nil, ErrFollowingNotSupported
+		}
+		store.stopFollowing = store.startFollowing(tailer)
+	}
+	return store, nil
+}
+
+// replay builds the indexes by applying the operations read from the file.
+// The indexes are sized for all created users beforehand, and the users are allocated at once, so that big files load quickly.
+func (p *PersistentInMemoryFileStore) replay(operations []models.Operation) error {
+	created := 0
+	for i := range operations {
+		if operations[i].Type == models.CreateUserOp {
+			created++
+		}
+	}
+	p.usernameToUser = make(map[string]*models.UserModel, created)
+	p.tokenToUser = make(map[string]*models.UserModel, created)
+	p.users = make(map[int]*models.UserModel, created)
+	p.publicIdToUser = map[string]*models.UserModel{}
+	p.legacyIdToUser = map[int]*models.UserModel{}
+	p.userSlab = make([]models.UserModel, created)
+	defer func() { p.userSlab = nil }()
+
+	for i := range operations {
+		if err := p.apply(operations[i]); err != nil {
+			return fmt.Errorf("got an error while replaying operation #%d: %w", i+1, err)
+		}
 	}
+	p.operationsCount = len(operations)
+	return nil
+}
+
+// replayed returns a new state built by replaying the operations, it can be swapped in with swapState
+func replayed(operations []models.Operation) (*PersistentInMemoryFileStore, error) {
+	fresh := &PersistentInMemoryFileStore{}
+	if err := fresh.replay(operations); err != nil {
+		return nil, err
+	}
+	return fresh, nil
+}
 
-	biggestId := 0
-	usernameToUser := make(map[string]*models.UserModel)
-	tokenToUser := make(map[string]*models.UserModel)
+// swapState replaces the whole state with the one of fresh, it should be called with mu locked.
+// The new indexes are built beforehand, so that readers are blocked only for swapping them.
+func (p *PersistentInMemoryFileStore) swapState(fresh *PersistentInMemoryFileStore) {
+	p.indexMu.Lock()
+	p.usernameToUser, p.tokenToUser, p.users = fresh.usernameToUser, fresh.tokenToUser, fresh.users
+	p.publicIdToUser, p.legacyIdToUser = fresh.publicIdToUser, fresh.legacyIdToUser
+	p.indexMu.Unlock()
+	p.biggestId = fresh.biggestId
+	p.operationsCount = fresh.operationsCount
+	p.resetCompactionBaseline(fresh.operationsCount - fresh.snapshotLength())
+	if p.tokenInvalidator != nil {
+		p.tokenInvalidator.InvalidateAll()
+	}
+}
+
+var errUnknownUserId = errors.New("operation refers to a user id which doesn't exist")
+
+// apply changes the in-memory state according to the operation, it should be called with both mu and indexMu locked.
+func (p *PersistentInMemoryFileStore) apply(op models.Operation) error {
+	switch op.Type {
+	case models.CreateUserOp, models.UpdateUserOp:
+		// a create for an existing id may appear in older files, where updates were written as new rows,
+		// in this case the later record overrides the earlier ones
+		if oldUser, exists := p.users[op.User.Id]; exists {
+			p.unindex(oldUser)
+		} else if op.Type == models.UpdateUserOp {
+			return errUnknownUserId
+		}
+		user := p.newUser(&op.User)
+		p.users[user.Id] = user
+		p.index(user)
+		if user.Id > p.biggestId {
+			p.biggestId = user.Id
+		}
+	case models.DeleteUserOp:
+		user, exists := p.users[op.UserId]
+		if !exists {
+			return errUnknownUserId
+		}
+		p.unindex(user)
+		delete(p.users, op.UserId)
+	case models.AddTokenOp:
+		user, exists := p.users[op.UserId]
+		if !exists {
+			return errUnknownUserId
+		}
+		p.unindex(user)
+		user.AuthToken = op.Token
+		p.index(user)
+	case models.RemoveTokenOp:
+		user, exists := p.users[op.UserId]
+		if !exists {
+			return errUnknownUserId
+		}
+		if user.AuthToken == op.Token {
+			p.unindex(user)
+			user.AuthToken = entities.Token{}
+			p.index(user)
+		}
+	case models.IdCounterOp:
+		if op.UserId > p.biggestId {
+			p.biggestId = op.UserId
+		}
+	default:
+		return fmt.Errorf("unknown operation type: %q", op.Type)
+	}
+	return nil
+}
+
+// newUser returns a copy of the user for storing it in the indexes.
+// While replaying, it is taken from the slab allocated by replay (a slot of a deleted user stays unused until the next restart).
+func (p *PersistentInMemoryFileStore) newUser(model *models.UserModel) *models.UserModel {
+	var user *models.UserModel
+	if len(p.userSlab) != 0 {
+		user, p.userSlab = &p.userSlab[0], p.userSlab[1:]
+	} else {
+		user = new(models.UserModel)
+	}
+	*user = copyUser(model)
+	return user
+}
+
+func (p *PersistentInMemoryFileStore) index(user *models.UserModel) {
+	p.usernameToUser[user.Username] = user
+	if user.AuthToken.Token != "" {
+		p.tokenToUser[user.AuthToken.Token] = user
+	}
+	if user.PublicId != "" {
+		p.publicIdToUser[user.PublicId] = user
+	}
+	if user.LegacyId != 0 {
+		p.legacyIdToUser[user.LegacyId] = user
+	}
+}
+
+func (p *PersistentInMemoryFileStore) unindex(user *models.UserModel) {
+	if p.usernameToUser[user.Username] == user {
+		delete(p.usernameToUser, user.Username)
+	}
+	if p.tokenToUser[user.AuthToken.Token] == user {
+		delete(p.tokenToUser, user.AuthToken.Token)
+	}
+	if p.publicIdToUser[user.PublicId] == user {
+		delete(p.publicIdToUser, user.PublicId)
+	}
+	if p.legacyIdToUser[user.LegacyId] == user {
+		delete(p.legacyIdToUser, user.LegacyId)
+	}
+}
+
+// writeAndApply persists the operation and only then applies it, so that nothing is changed if writing fails.
+// With an AppendingDBFileInteractor the operation is applied once it is appended, and the caller waits for the fsync in unlockAndSync.
+// If the fsync fails, the operation stays applied (it is in the file anyway), and the error only reports that it may not survive a machine crash.
+func (p *PersistentInMemoryFileStore) writeAndApply(op models.Operation) error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	var err error
+	if appender, ok := p.fileInteractor.(AppendingDBFileInteractor); ok {
+		p.pendingSync, err = appender.AppendOperation(op)
+	} else {
+		err = p.fileInteractor.WriteOperation(op)
+	}
+	if err != nil {
+		return fmt.Errorf("got an error while writing to a file interactor: %w", err)
+	}
+	p.operationsCount++
+	p.appendedOperations++
+	touched := p.touchedTokens(op)
+	p.indexMu.Lock()
+	err = p.apply(op)
+	p.indexMu.Unlock()
+	p.invalidate(touched)
+	if err != nil {
+		return err
+	}
+	p.maybeCompact()
+	return nil
+}
+
+// unlockAndSync unlocks mu, and then waits for the operation written while holding it to reach the disk,
+// replacing a nil *err with the error of the fsync. Writers defer it instead of unlocking mu directly.
+func (p *PersistentInMemoryFileStore) unlockAndSync(err *error) {
+	waitForSync := p.pendingSync
+	p.pendingSync = nil
+	p.mu.Unlock()
+	if waitForSync == nil {
+		return
+	}
+	if syncErr := waitForSync(); syncErr != nil && *err == nil {
+		*err = fmt.Errorf("got an error while syncing an operation to disk: %w", syncErr)
+	}
+}
+
+// Compact replaces the log with a snapshot of the current state.
+// Writers are blocked while it is running, readers are not.
+func (p *PersistentInMemoryFileStore) Compact() error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.compact()
+}
+
+// StartPeriodicCompaction compacts the log every interval, if it contains any operations which can be compacted.
+// Call the returned function to stop it.
+func (p *PersistentInMemoryFileStore) StartPeriodicCompaction(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				if p.operationsCount > p.snapshotLength() {
+					if err := p.compact(); err != nil {
+						log.Printf("periodic compaction of the store failed: %v", err)
+					}
+				}
+				p.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
 
-	for i := range users {
-		user := &users[i]
-		if user.Id > biggestId {
-			biggestId = user.Id
+// maybeCompact compacts the log if it exceeds the thresholds of the compaction policy, it should be called with mu locked.
+// Compaction failures are only logged, since the log is still valid without compaction.
+func (p *PersistentInMemoryFileStore) maybeCompact() {
+	if p.readOnly {
+		return
+	}
+	policy := p.compactionPolicy
+	exceeded := policy.MaxOperations > 0 && p.appendedOperations > policy.MaxOperations
+	if !exceeded && policy.MaxFileSize > 0 {
+		size, err := p.fileInteractor.Size()
+		if err != nil {
+			log.Printf("error getting size of the store's log: %v", err)
+			return
 		}
-		usernameToUser[user.Username] = user
-		tokenToUser[user.AuthToken.Token] = user
+		exceeded = size-p.compactedSize > policy.MaxFileSize
+	}
+	if !exceeded {
+		return
+	}
+	if err := p.compact(); err != nil {
+		log.Printf("compaction of the store failed: %v", err)
+	}
+}
+
+// compact should be called with mu locked
+func (p *PersistentInMemoryFileStore) compact() error {
+	snapshot := p.snapshot()
+	if err := p.fileInteractor.ReplaceOperations(snapshot); err != nil {
+		return fmt.Errorf("got an error while replacing operations in a file interactor: %w", err)
+	}
+	p.operationsCount = len(snapshot)
+	p.resetCompactionBaseline(0)
+	return nil
+}
+
+// resetCompactionBaseline makes the thresholds of the compaction policy count from now on, it should be called with mu locked.
+// appended is the number of operations already in the log, which compaction would drop.
+// The current size is used as the baseline only if there are none of them, otherwise the log is measured as a whole.
+func (p *PersistentInMemoryFileStore) resetCompactionBaseline(appended int) {
+	p.appendedOperations = appended
+	p.compactedSize = 0
+	if appended > 0 || p.compactionPolicy.MaxFileSize <= 0 {
+		return
+	}
+	size, err := p.fileInteractor.Size()
+	if err != nil {
+		log.Printf("error getting size of the store's log: %v", err)
+		return
+	}
+	p.compactedSize = size
+}
+
+func (p *PersistentInMemoryFileStore) snapshotLength() int {
+	if p.biggestId > 0 {
+		return len(p.users) + 1
+	}
+	return len(p.users)
+}
+
+// snapshot returns the minimal list of operations, which leads to the current state, it should be called with mu locked
+func (p *PersistentInMemoryFileStore) snapshot() []models.Operation {
+	operations := make([]models.Operation, 0, p.snapshotLength())
+	if p.biggestId > 0 {
+		operations = append(operations, models.Operation{Type: models.IdCounterOp, UserId: p.biggestId})
 	}
+	for _, user := range p.sortedUsers() {
+		operations = append(operations, models.Operation{Type: models.CreateUserOp, User: user})
+	}
+	return operations
+}
+
+// sortedUsers returns copies of all users in the order of ids, it should be called with mu locked
+func (p *PersistentInMemoryFileStore) sortedUsers() []models.UserModel {
+	ids := make([]int, 0, len(p.users))
+	for id := range p.users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	users := make([]models.UserModel, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, copyUser(p.users[id]))
+	}
+	return users
+}
 
-	return &PersistentInMemoryFileStore{
-		fileInteractor: fileInteractor,
-		usernameToUser: usernameToUser,
-		tokenToUser:    tokenToUser,
-		users:          users,
-		biggestId:      biggestId,
-	}, nil
+// ForEachUser calls fn for a point-in-time copy of every user in the order of ids, stopping at the first error returned by fn.
+// Writers are blocked only while the users are copied.
+func (p *PersistentInMemoryFileStore) ForEachUser(fn func(models.UserModel) error) error {
+	p.mu.Lock()
+	users := p.sortedUsers()
+	p.mu.Unlock()
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (p *PersistentInMemoryFileStore) CreateUser(username, storedPass string, token entities.Token) (models.UserModel, error) {
+// Close releases the DB file, so that it can be opened by another store. The store shouldn't be used after closing.
+func (p *PersistentInMemoryFileStore) Close() error {
+	// following takes mu, so it has to be stopped before locking it
+	if p.stopFollowing != nil {
+		p.stopFollowing()
+	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	return p.fileInteractor.Close()
+}
+
+func (p *PersistentInMemoryFileStore) CreateUser(username, storedPass string, token entities.Token) (_ models.UserModel, err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+	// writers are serialized by mu, so nobody can take the username between this check and the write
+	if _, taken := p.usernameToUser[username]; taken {
+		return models.UserModel{}, auth_store_contract.UsernameTakenErr
+	}
+	if _, taken := p.tokenToUser[token.Token]; taken && token.Token != "" {
+		return models.UserModel{}, auth_store_contract.TokenTakenErr
+	}
 
+	publicId, err := p.newPublicId()
+	if err != nil {
+		return models.UserModel{}, err
+	}
 	newUser := models.UserModel{
 		Id:         p.biggestId + 1,
 		Username:   username,
 		StoredPass: storedPass,
 		AuthToken:  token,
+		PublicId:   publicId,
 	}
 
-	err := p.fileInteractor.WriteUser(newUser)
+	err = p.writeAndApply(models.Operation{Type: models.CreateUserOp, User: newUser})
 	if err != nil {
-		return models.UserModel{}, fmt.Errorf("got an error while writing to a file interactor: %w", err)
+		return models.UserModel{}, err
 	}
 
-	p.users = append(p.users, newUser)
-	newUserPtr := &p.users[len(p.users)-1]
+	return newUser, nil // return a copy, so the caller is not able to change the user directly
+}
 
-	p.usernameToUser[username] = newUserPtr
-	p.tokenToUser[token.Token] = newUserPtr
+func (p *PersistentInMemoryFileStore) UpdatePassword(username, storedPass string, passwordHistory []string) (err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
 
-	p.biggestId++
+	user, ok := p.usernameToUser[username]
+	if !ok {
+		return auth_store_contract.UserNotFoundErr
+	}
+	updatedUser := copyUser(user)
+	updatedUser.StoredPass = storedPass
+	updatedUser.PasswordHistory = append([]string(nil), passwordHistory...)
 
-	return newUser, nil // return a copy, so the caller is not able to change the user directly
+	return p.writeAndApply(models.Operation{Type: models.UpdateUserOp, User: updatedUser})
+}
+
+// ReplaceHash sets newHash only if the stored hash of the user still equals oldHash
+func (p *PersistentInMemoryFileStore) ReplaceHash(username, oldHash, newHash string) (_ bool, err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+
+	user, ok := p.usernameToUser[username]
+	if !ok {
+		return false, auth_store_contract.UserNotFoundErr
+	}
+	if user.StoredPass != oldHash {
+		return false, nil
+	}
+	updatedUser := copyUser(user)
+	updatedUser.StoredPass = newHash
+	if err := p.writeAndApply(models.Operation{Type: models.UpdateUserOp, User: updatedUser}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *PersistentInMemoryFileStore) DeleteUser(username string) (err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+
+	user, ok := p.usernameToUser[username]
+	if !ok {
+		return auth_store_contract.UserNotFoundErr
+	}
+	return p.writeAndApply(models.Operation{Type: models.DeleteUserOp, UserId: user.Id})
+}
+
+// AddToken sets a new auth token for the user, the previous token stops working
+func (p *PersistentInMemoryFileStore) AddToken(username string, token entities.Token) (err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+
+	user, ok := p.usernameToUser[username]
+	if !ok {
+		return auth_store_contract.UserNotFoundErr
+	}
+	return p.writeAndApply(models.Operation{Type: models.AddTokenOp, UserId: user.Id, Token: token})
+}
+
+// RemoveToken revokes the token (e.g. on logout)
+func (p *PersistentInMemoryFileStore) RemoveToken(token string) (err error) {
+	p.mu.Lock()
+	defer p.unlockAndSync(&err)
+
+	user, ok := p.tokenToUser[token]
+	if !ok {
+		return token_store_contract.TokenNotFoundErr
+	}
+	return p.writeAndApply(models.Operation{Type: models.RemoveTokenOp, UserId: user.Id, Token: user.AuthToken})
 }
 
 func (p *PersistentInMemoryFileStore) FindUser(username string) (models.UserModel, error) {
+	p.indexMu.RLock()
+	defer p.indexMu.RUnlock()
 	user, ok := p.usernameToUser[username]
 	if !ok {
 		return models.UserModel{}, auth_store_contract.UserNotFoundErr
 	}
-	return *user, nil
+	return copyUser(user), nil
 }
 func (p *PersistentInMemoryFileStore) FindUserFromToken(token string) (models.UserModel, error) {
+	p.indexMu.RLock()
+	defer p.indexMu.RUnlock()
 	user, ok := p.tokenToUser[token]
 	if !ok {
 		return models.UserModel{}, token_store_contract.TokenNotFoundErr
 	}
-	return *user, nil
+	return copyUser(user), nil
 }
 
 func (p *PersistentInMemoryFileStore) UserExists(username string) bool {
+	p.indexMu.RLock()
+	defer p.indexMu.RUnlock()
 	_, exists := p.usernameToUser[username]
 	return exists
 }
+
+// copyUser returns a deep copy of the user, so the caller is not able to change the stored user directly
+func copyUser(user *models.UserModel) models.UserModel {
+	userCopy := *user
+	userCopy.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return userCopy
+}
@@ -1,9 +1,16 @@
 package store_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/k0marov/golang-auth/internal/data/models"
 	"github.com/k0marov/golang-auth/internal/data/store"
@@ -16,7 +23,8 @@ import (
 func TestPersistentInMemoryFileStore(t *testing.T) {
 	t.Run("CreateUser() id generation", func(t *testing.T) {
 		createRandomUser := func(t testing.TB, sutStore *store.PersistentInMemoryFileStore) int {
-			createdUser, err := sutStore.CreateUser(RandomString(), RandomString(), entities.Token{Token: RandomString()})
+			user := GenerateRandomUser()
+			createdUser, err := sutStore.CreateUser(user.Username, user.Password, user.Token)
 			AssertNoError(t, err)
 			return createdUser.Id
 		}
@@ -64,6 +72,51 @@ func TestPersistentInMemoryFileStore(t *testing.T) {
 			AssertUniqueCount(t, generatedIds, wantedCount)
 		})
 	})
+	t.Run("CreateUser() should reject a taken username", func(t *testing.T) {
+		sutStore, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{})
+		AssertNoError(t, err)
+		user := GenerateRandomUser()
+		createUsers(t, sutStore, []RandomUser{user})
+
+		_, err = sutStore.CreateUser(user.Username, RandomString(), entities.Token{Token: RandomString()})
+		AssertError(t, err, auth_store_contract.UsernameTakenErr)
+
+		t.Run("atomically, when the same username is created concurrently", func(t *testing.T) {
+			const goroutines = 100
+			username := GenerateRandomUser().Username
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+			errs := make([]error, goroutines)
+			for i := 0; i < goroutines; i++ {
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = sutStore.CreateUser(username, RandomString(), entities.Token{Token: RandomString()})
+				}(i)
+			}
+			wg.Wait()
+
+			created := 0
+			for _, err := range errs {
+				if err == nil {
+					created++
+				} else {
+					AssertError(t, err, auth_store_contract.UsernameTakenErr)
+				}
+			}
+			Assert(t, created, 1, "number of created users")
+		})
+	})
+	t.Run("CreateUser() should reject a taken token", func(t *testing.T) {
+		sutStore, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{})
+		AssertNoError(t, err)
+		user := GenerateRandomUser()
+		createUsers(t, sutStore, []RandomUser{user})
+
+		other := GenerateRandomUser()
+		_, err = sutStore.CreateUser(other.Username, other.Password, user.Token)
+		AssertError(t, err, auth_store_contract.TokenTakenErr)
+		Assert(t, sutStore.UserExists(other.Username), false, "the user with a taken token is not created")
+	})
 	t.Run("in memory works", func(t *testing.T) {
 		fileInteractor := &StubDBFileInteractor{}
 		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
@@ -91,6 +144,606 @@ func TestPersistentInMemoryFileStore(t *testing.T) {
 			assertUsersInStore(t, sutStore, anotherNewUsers, anotherNewIds)
 		})
 	})
+	t.Run("UpdatePassword()", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+
+		users := GenerateRandomUsers(3)
+		ids := createUsers(t, sutStore, users)
+
+		history := []string{users[1].Password, RandomString()}
+		users[1].Password = RandomString()
+		err = sutStore.UpdatePassword(users[1].Username, users[1].Password, history)
+		AssertNoError(t, err)
+		assertUsersInStore(t, sutStore, users, ids)
+		assertHistory := func(t testing.TB, sutStore *store.PersistentInMemoryFileStore) {
+			t.Helper()
+			user, err := sutStore.FindUser(users[1].Username)
+			AssertNoError(t, err)
+			Assert(t, user.PasswordHistory, history, "password history")
+		}
+		assertHistory(t, sutStore)
+
+		t.Run("should persist the update", func(t *testing.T) {
+			sutStore, err = store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			assertUsersInStore(t, sutStore, users, ids)
+			assertHistory(t, sutStore)
+		})
+		t.Run("should return copies of the history", func(t *testing.T) {
+			user, err := sutStore.FindUser(users[1].Username)
+			AssertNoError(t, err)
+			user.PasswordHistory[0] = RandomString()
+			assertHistory(t, sutStore)
+		})
+		t.Run("should return UserNotFoundErr for a non existing user", func(t *testing.T) {
+			err := sutStore.UpdatePassword(GenerateRandomUser().Username, RandomString(), nil)
+			AssertError(t, err, auth_store_contract.UserNotFoundErr)
+		})
+	})
+	t.Run("DeleteUser()", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(3)
+		ids := createUsers(t, sutStore, users)
+
+		AssertNoError(t, sutStore.DeleteUser(users[1].Username))
+		assertUserNotInStore(t, sutStore, users[1])
+		AssertError(t, sutStore.DeleteUser(users[1].Username), auth_store_contract.UserNotFoundErr)
+
+		t.Run("should persist the deletion and not reuse the id", func(t *testing.T) {
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			assertUserNotInStore(t, sutStore, users[1])
+			assertUserInStore(t, sutStore, users[0], ids[0])
+			assertUserInStore(t, sutStore, users[2], ids[2])
+
+			newIds := createUsers(t, sutStore, GenerateRandomUsers(1))
+			Assert(t, newIds[0], ids[2]+1, "id of a user created after deletion")
+		})
+	})
+	t.Run("ForEachUser()", func(t *testing.T) {
+		sutStore, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{})
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(5)
+		ids := createUsers(t, sutStore, users)
+		AssertNoError(t, sutStore.DeleteUser(users[2].Username))
+
+		var listed []models.UserModel
+		AssertNoError(t, sutStore.ForEachUser(func(user models.UserModel) error {
+			listed = append(listed, user)
+			// writing from the callback shouldn't deadlock
+			return sutStore.UpdatePassword(user.Username, RandomString(), nil)
+		}))
+		AssertFatal(t, len(listed), 4, "number of listed users")
+		for i, want := range []int{0, 1, 3, 4} {
+			Assert(t, listed[i].Id, ids[want], "listed id in the order of ids")
+			Assert(t, listed[i].Username, users[want].Username, "listed username")
+			Assert(t, listed[i].AuthToken, users[want].Token, "listed token")
+		}
+
+		stopErr := errors.New(RandomString())
+		calls := 0
+		err = sutStore.ForEachUser(func(models.UserModel) error {
+			calls++
+			return stopErr
+		})
+		AssertError(t, err, stopErr)
+		Assert(t, calls, 1, "number of calls after an error")
+	})
+	t.Run("AddToken() and RemoveToken()", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		user := GenerateRandomUser()
+		ids := createUsers(t, sutStore, []RandomUser{user})
+
+		oldToken := user.Token
+		user.Token = entities.Token{Token: RandomString() + "new"}
+		AssertNoError(t, sutStore.AddToken(user.Username, user.Token))
+		assertUserInStore(t, sutStore, user, ids[0])
+		_, err = sutStore.FindUserFromToken(oldToken.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		AssertError(t, sutStore.AddToken(RandomString()+"unknown", user.Token), auth_store_contract.UserNotFoundErr)
+
+		AssertNoError(t, sutStore.RemoveToken(user.Token.Token))
+		_, err = sutStore.FindUserFromToken(user.Token.Token)
+		AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		AssertError(t, sutStore.RemoveToken(user.Token.Token), token_store_contract.TokenNotFoundErr)
+		Assert(t, sutStore.UserExists(user.Username), true, "user should still exist after removing his token")
+
+		t.Run("should persist the token operations", func(t *testing.T) {
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			_, err = sutStore.FindUserFromToken(user.Token.Token)
+			AssertError(t, err, token_store_contract.TokenNotFoundErr)
+			found, err := sutStore.FindUser(user.Username)
+			AssertNoError(t, err)
+			Assert(t, found.AuthToken, entities.Token{}, "token after removal")
+		})
+	})
+	t.Run("public ids", func(t *testing.T) {
+		publicIds := []string{}
+		strategy := func() (string, error) {
+			id := RandomString() + strconv.Itoa(len(publicIds))
+			publicIds = append(publicIds, id)
+			return id, nil
+		}
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		legacyUser, err := sutStore.CreateUser(RandomString(), RandomString(), GenerateRandomUser().Token)
+		AssertNoError(t, err)
+		Assert(t, legacyUser.PublicId, "", "public id of a user created without a strategy")
+
+		sutStore, err = store.NewPersistentInMemoryFileStore(fileInteractor, store.WithIdStrategy(strategy))
+		AssertNoError(t, err)
+		newUser, err := sutStore.CreateUser(RandomString(), RandomString(), GenerateRandomUser().Token)
+		AssertNoError(t, err)
+		Assert(t, newUser.PublicId, publicIds[0], "public id of a user created with a strategy")
+
+		assertFoundById := func(t testing.TB, sutStore *store.PersistentInMemoryFileStore, id string, want models.UserModel) {
+			t.Helper()
+			found, err := sutStore.FindUserById(id)
+			AssertNoError(t, err)
+			Assert(t, found, want, "user found by id "+id)
+		}
+		t.Run("FindUserById() should resolve public ids and integer ids of users without them", func(t *testing.T) {
+			assertFoundById(t, sutStore, newUser.PublicId, newUser)
+			assertFoundById(t, sutStore, strconv.Itoa(legacyUser.Id), legacyUser)
+			for _, id := range []string{strconv.Itoa(newUser.Id), RandomString(), "0" + strconv.Itoa(legacyUser.Id)} {
+				_, err := sutStore.FindUserById(id)
+				AssertError(t, err, auth_store_contract.UserNotFoundErr)
+			}
+		})
+		t.Run("SetPublicId() should keep the legacy id resolvable and persist", func(t *testing.T) {
+			migrated := legacyUser
+			migrated.PublicId, migrated.LegacyId = RandomString(), legacyUser.Id
+			AssertNoError(t, sutStore.SetPublicId(migrated.Username, migrated.PublicId, migrated.LegacyId))
+			assertFoundById(t, sutStore, migrated.PublicId, migrated)
+			assertFoundById(t, sutStore, strconv.Itoa(legacyUser.Id), migrated)
+
+			restarted, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			assertFoundById(t, restarted, migrated.PublicId, migrated)
+			assertFoundById(t, restarted, strconv.Itoa(legacyUser.Id), migrated)
+			assertFoundById(t, restarted, newUser.PublicId, newUser)
+		})
+		t.Run("SetPublicId() should reject ids of other users", func(t *testing.T) {
+			other, err := sutStore.CreateUser(RandomString(), RandomString(), GenerateRandomUser().Token)
+			AssertNoError(t, err)
+			AssertError(t, sutStore.SetPublicId(other.Username, newUser.PublicId, 0), auth_store_contract.PublicIdTakenErr)
+			AssertError(t, sutStore.SetPublicId(other.Username, RandomString(), legacyUser.Id), auth_store_contract.PublicIdTakenErr)
+			AssertError(t, sutStore.SetPublicId(RandomString(), RandomString(), 0), auth_store_contract.UserNotFoundErr)
+			assertFoundById(t, sutStore, other.PublicId, other)
+		})
+		t.Run("CreateUser() should regenerate taken public ids", func(t *testing.T) {
+			calls := 0
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithIdStrategy(func() (string, error) {
+				calls++
+				if calls == 1 {
+					return newUser.PublicId, nil
+				}
+				return strategy()
+			}))
+			AssertNoError(t, err)
+			created, err := sutStore.CreateUser(RandomString(), RandomString(), GenerateRandomUser().Token)
+			AssertNoError(t, err)
+			Assert(t, created.PublicId, publicIds[len(publicIds)-1], "public id")
+		})
+		t.Run("CreateUser() should forward errors of the strategy", func(t *testing.T) {
+			strategyErr := errors.New(RandomString())
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithIdStrategy(func() (string, error) {
+				return "", strategyErr
+			}))
+			AssertNoError(t, err)
+			user := GenerateRandomUser()
+			_, err = sutStore.CreateUser(user.Username, user.Password, user.Token)
+			AssertError(t, err, strategyErr)
+			Assert(t, sutStore.UserExists(user.Username), false, "the user is created")
+		})
+	})
+	t.Run("token invalidation", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(3)
+		createUsers(t, sutStore, users)
+		invalidator := &stubTokenInvalidator{}
+		sutStore.SetTokenInvalidator(invalidator)
+
+		newToken := entities.Token{Token: RandomString()}
+		AssertNoError(t, sutStore.AddToken(users[0].Username, newToken))
+		AssertNoError(t, sutStore.RemoveToken(users[1].Token.Token))
+		AssertNoError(t, sutStore.DeleteUser(users[2].Username))
+		created := GenerateRandomUser()
+		createUsers(t, sutStore, []RandomUser{created})
+		wantInvalidated := []string{newToken.Token, users[0].Token.Token, users[1].Token.Token, users[2].Token.Token, created.Token.Token}
+		for _, token := range wantInvalidated {
+			Assert(t, CheckInSlice(token, invalidator.tokens), true, "the changed token is invalidated")
+		}
+
+		t.Run("should invalidate all tokens when the whole state is replaced", func(t *testing.T) {
+			backup := bytes.NewBuffer(nil)
+			AssertNoError(t, sutStore.Snapshot(backup))
+			AssertNoError(t, sutStore.Restore(backup))
+			Assert(t, invalidator.all, 1, "number of InvalidateAll() calls")
+		})
+	})
+	t.Run("replaying", func(t *testing.T) {
+		t.Run("later creates of the same id should override earlier ones (older files)", func(t *testing.T) {
+			user := GenerateRandomUserModel()
+			updated := user
+			updated.StoredPass = RandomString() + "new"
+			updated.AuthToken = entities.Token{Token: RandomString() + "new"}
+			fileInteractor := &StubDBFileInteractor{operations: []models.Operation{
+				{Type: models.CreateUserOp, User: user},
+				{Type: models.CreateUserOp, User: updated},
+			}}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			found, err := sutStore.FindUser(user.Username)
+			AssertNoError(t, err)
+			Assert(t, found, updated, "replayed user")
+			_, err = sutStore.FindUserFromToken(user.AuthToken.Token)
+			AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		})
+		t.Run("should fail on operations with unknown ids", func(t *testing.T) {
+			for _, op := range []models.Operation{
+				{Type: models.UpdateUserOp, User: GenerateRandomUserModel()},
+				{Type: models.DeleteUserOp, UserId: 42},
+				{Type: models.AddTokenOp, UserId: 42},
+				{Type: models.RemoveTokenOp, UserId: 42},
+				{Type: "unknown"},
+			} {
+				_, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{operations: []models.Operation{op}})
+				AssertSomeError(t, err)
+			}
+		})
+	})
+	t.Run("compaction", func(t *testing.T) {
+		// creates 4 users, then updates, deletes and changes tokens, so that there is something to compact
+		populate := func(t testing.TB, sutStore *store.PersistentInMemoryFileStore) (alive []RandomUser, aliveIds []int) {
+			t.Helper()
+			users := GenerateRandomUsers(4)
+			ids := createUsers(t, sutStore, users)
+			users[0].Password = RandomString()
+			AssertNoError(t, sutStore.UpdatePassword(users[0].Username, users[0].Password, nil))
+			users[1].Token = entities.Token{Token: RandomString() + "new"}
+			AssertNoError(t, sutStore.AddToken(users[1].Username, users[1].Token))
+			AssertNoError(t, sutStore.DeleteUser(users[3].Username))
+			return users[:3], ids[:3]
+		}
+		assertCompacted := func(t testing.TB, fileInteractor *StubDBFileInteractor, users []RandomUser, ids []int) {
+			t.Helper()
+			// id counter + one create per alive user
+			Assert(t, len(fileInteractor.operations), len(users)+1, "number of operations after compaction")
+			restarted, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			assertUsersInStore(t, restarted, users, ids)
+			newIds := createUsers(t, restarted, GenerateRandomUsers(1))
+			Assert(t, newIds[0], ids[len(ids)-1]+2, "id of a user created after compaction (deleted ids shouldn't be reused)")
+		}
+
+		t.Run("on demand", func(t *testing.T) {
+			fileInteractor := &StubDBFileInteractor{}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			users, ids := populate(t, sutStore)
+
+			AssertNoError(t, sutStore.Compact())
+			assertUsersInStore(t, sutStore, users, ids)
+			assertCompacted(t, fileInteractor, users, ids)
+		})
+		t.Run("operation count threshold", func(t *testing.T) {
+			fileInteractor := &StubDBFileInteractor{}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithCompactionPolicy(store.CompactionPolicy{MaxOperations: 6}))
+			AssertNoError(t, err)
+			users, ids := populate(t, sutStore) // 7 operations
+			assertUsersInStore(t, sutStore, users, ids)
+			Assert(t, len(fileInteractor.operations), 4, "number of operations after compaction")
+		})
+		t.Run("file size threshold", func(t *testing.T) {
+			fileInteractor := &StubDBFileInteractor{}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			users, ids := populate(t, sutStore)
+			Assert(t, len(fileInteractor.operations), 7, "number of operations without compaction")
+
+			// the threshold is also checked on startup
+			sutStore, err = store.NewPersistentInMemoryFileStore(fileInteractor, store.WithCompactionPolicy(store.CompactionPolicy{MaxFileSize: 5}))
+			AssertNoError(t, err)
+			assertUsersInStore(t, sutStore, users, ids)
+			assertCompacted(t, fileInteractor, users, ids)
+		})
+		t.Run("thresholds should count only what was appended since the last compaction", func(t *testing.T) {
+			for _, policy := range []store.CompactionPolicy{{MaxOperations: 5}, {MaxFileSize: 5}} {
+				fileInteractor := &StubDBFileInteractor{}
+				sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithCompactionPolicy(policy))
+				AssertNoError(t, err)
+				// the snapshot soon exceeds the thresholds by itself, but only every 6th write should trigger compaction
+				users := GenerateRandomUsers(20)
+				ids := createUsers(t, sutStore, users)
+				Assert(t, fileInteractor.replaced, 3, "number of compactions")
+				Assert(t, len(fileInteractor.operations), 1+18+2, "number of operations in the log")
+				assertUsersInStore(t, sutStore, users, ids)
+
+				// the log holds nothing to compact, so the snapshot alone shouldn't trigger compaction on startup either
+				AssertNoError(t, sutStore.Compact())
+				_, err = store.NewPersistentInMemoryFileStore(fileInteractor, store.WithCompactionPolicy(policy))
+				AssertNoError(t, err)
+				Assert(t, fileInteractor.replaced, 4, "number of compactions after a restart")
+			}
+		})
+		t.Run("periodic", func(t *testing.T) {
+			fileInteractor := &StubDBFileInteractor{}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			users, ids := populate(t, sutStore)
+
+			stop := sutStore.StartPeriodicCompaction(time.Millisecond)
+			defer stop()
+			for i := 0; i < 1000; i++ {
+				fileInteractor.mu.Lock()
+				count := len(fileInteractor.operations)
+				fileInteractor.mu.Unlock()
+				if count == len(users)+1 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			stop()
+			assertCompacted(t, fileInteractor, users, ids)
+		})
+		t.Run("should return an error if replacing fails", func(t *testing.T) {
+			sutStore, err := store.NewPersistentInMemoryFileStore(&ErrorDBFileInteractor{ThrowOnWrite: true})
+			AssertNoError(t, err)
+			AssertSomeError(t, sutStore.Compact())
+		})
+	})
+	t.Run("should be race-free under concurrent reads, writes and compaction", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithCompactionPolicy(store.CompactionPolicy{MaxOperations: 50}))
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(20)
+		createUsers(t, sutStore, users)
+
+		const writers, readers, iterations = 4, 8, 300
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					user := users[(w+i)%len(users)]
+					switch i % 4 {
+					case 0:
+						AssertNoError(t, sutStore.UpdatePassword(user.Username, RandomString(), []string{RandomString()}))
+					case 1:
+						AssertNoError(t, sutStore.AddToken(user.Username, entities.Token{Token: fmt.Sprintf("token_%d_%d", w, i)}))
+					case 2:
+						// unique names, so that they don't clash with the existing users
+						newUser, err := sutStore.CreateUser(fmt.Sprintf("tmp_%d_%d", w, i), RandomString(), entities.Token{Token: fmt.Sprintf("tmp_token_%d_%d", w, i)})
+						AssertNoError(t, err)
+						AssertNoError(t, sutStore.DeleteUser(newUser.Username))
+					case 3:
+						AssertNoError(t, sutStore.Compact())
+					}
+				}
+			}(w)
+		}
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for i := 0; i < iterations*4; i++ {
+					user := users[(r+i)%len(users)]
+					Assert(t, sutStore.UserExists(user.Username), true, "UserExists() of an existing user")
+					found, err := sutStore.FindUser(user.Username)
+					AssertNoError(t, err)
+					Assert(t, found.Username, user.Username, "username of the found user")
+					if fromToken, err := sutStore.FindUserFromToken(found.AuthToken.Token); err == nil && fromToken.Id != found.Id {
+						// the token might have been replaced in the meantime, but it can never point to another user
+						t.Errorf("token of user %d points to user %d", found.Id, fromToken.Id)
+					}
+				}
+			}(r)
+		}
+		wg.Wait()
+
+		// the state after all of this should survive a restart
+		restarted, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		for _, user := range users {
+			want, err := sutStore.FindUser(user.Username)
+			AssertNoError(t, err)
+			got, err := restarted.FindUser(user.Username)
+			AssertNoError(t, err)
+			Assert(t, got, want, "user after restart")
+		}
+	})
+	t.Run("concurrent writers should share fsyncs of an appending file interactor", func(t *testing.T) {
+		fileInteractor := &GroupCommitDBFileInteractor{syncDuration: time.Millisecond}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+
+		const writers = 100
+		users := GenerateRandomUsers(writers)
+		var wg sync.WaitGroup
+		wg.Add(writers)
+		for _, user := range users {
+			go func(user RandomUser) {
+				defer wg.Done()
+				_, err := sutStore.CreateUser(user.Username, user.Password, user.Token)
+				AssertNoError(t, err)
+			}(user)
+		}
+		wg.Wait()
+
+		for _, user := range users {
+			Assert(t, sutStore.UserExists(user.Username), true, "UserExists() after the write returned")
+		}
+		Assert(t, fileInteractor.synced, uint64(writers), "number of operations on disk after all writes returned")
+		if fileInteractor.syncs == 0 || fileInteractor.syncs >= writers {
+			t.Errorf("expected fewer fsyncs than the %d writes, got %d", writers, fileInteractor.syncs)
+		}
+
+		t.Run("should report errors of the fsync", func(t *testing.T) {
+			fileInteractor.syncErr = errors.New(RandomString())
+			err := sutStore.UpdatePassword(users[0].Username, RandomString(), nil)
+			Assert(t, errors.Is(err, fileInteractor.syncErr), true, "error is the fsync error")
+		})
+	})
+	t.Run("read-only mode", func(t *testing.T) {
+		users := GenerateRandomUsers(3)
+		fileInteractor := &StubDBFileInteractor{}
+		writer, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		ids := createUsers(t, writer, users)
+		operationsBefore := len(fileInteractor.operations)
+
+		readOnly, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithReadOnly(), store.WithCompactionPolicy(store.CompactionPolicy{MaxOperations: 1}))
+		AssertNoError(t, err)
+		assertUsersInStore(t, readOnly, users, ids)
+
+		_, err = readOnly.CreateUser(RandomString(), RandomString(), entities.Token{Token: RandomString()})
+		AssertError(t, err, store.ErrReadOnly)
+		AssertError(t, readOnly.UpdatePassword(users[0].Username, RandomString(), nil), store.ErrReadOnly)
+		AssertError(t, readOnly.DeleteUser(users[0].Username), store.ErrReadOnly)
+		AssertError(t, readOnly.AddToken(users[0].Username, entities.Token{Token: RandomString()}), store.ErrReadOnly)
+		AssertError(t, readOnly.RemoveToken(users[0].Token.Token), store.ErrReadOnly)
+		AssertError(t, readOnly.Compact(), store.ErrReadOnly)
+		Assert(t, len(fileInteractor.operations), operationsBefore, "number of operations in the log")
+		assertUsersInStore(t, readOnly, users, ids)
+	})
+	t.Run("following", func(t *testing.T) {
+		writerInteractor := &StubDBFileInteractor{}
+		writer, err := store.NewPersistentInMemoryFileStore(writerInteractor)
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(3)
+		ids := createUsers(t, writer, users)
+
+		tailer := &StubTailingDBFileInteractor{StubDBFileInteractor: writerInteractor, changes: make(chan struct{}), lag: time.Second}
+		follower, err := store.NewPersistentInMemoryFileStore(tailer, store.WithFollowing(time.Hour))
+		AssertNoError(t, err)
+		defer follower.Close()
+		assertUsersInStore(t, follower, users, ids)
+		Assert(t, follower.ReplicationLag(), tailer.lag, "replication lag")
+		// changes are handled one at a time, so the second one is received only after the first was handled
+		notifyAndWait := func() {
+			tailer.changes <- struct{}{}
+			tailer.changes <- struct{}{}
+		}
+
+		t.Run("should apply appended operations", func(t *testing.T) {
+			newUsers := GenerateRandomUsers(2)
+			newIds := createUsers(t, writer, newUsers)
+			AssertNoError(t, writer.DeleteUser(users[0].Username))
+			notifyAndWait()
+			assertUsersInStore(t, follower, newUsers, newIds)
+			assertUserNotInStore(t, follower, users[0])
+			assertUsersInStore(t, follower, users[1:], ids[1:])
+		})
+		t.Run("should load the whole log again when it is replaced", func(t *testing.T) {
+			AssertNoError(t, writer.Compact())
+			notifyAndWait()
+			newUsers := GenerateRandomUsers(1)
+			newIds := createUsers(t, writer, newUsers)
+			notifyAndWait()
+			assertUsersInStore(t, follower, newUsers, newIds)
+			assertUsersInStore(t, follower, users[1:], ids[1:])
+		})
+		t.Run("should be read-only", func(t *testing.T) {
+			_, err := follower.CreateUser(RandomString(), RandomString(), entities.Token{Token: RandomString()})
+			AssertError(t, err, store.ErrReadOnly)
+		})
+		t.Run("should fail if the file interactor can't follow the file", func(t *testing.T) {
+			_, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{}, store.WithFollowing(time.Hour))
+			AssertError(t, err, store.ErrFollowingNotSupported)
+		})
+	})
+	t.Run("backup", func(t *testing.T) {
+		fileInteractor := &StubDBFileInteractor{}
+		sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+		AssertNoError(t, err)
+		users := GenerateRandomUsers(3)
+		ids := createUsers(t, sutStore, users)
+
+		var backup bytes.Buffer
+		AssertNoError(t, sutStore.Snapshot(&backup))
+		backupContents := backup.Bytes()
+		laterUsers := GenerateRandomUsers(2)
+		createUsers(t, sutStore, laterUsers)
+
+		t.Run("should restore the state at the moment of the snapshot", func(t *testing.T) {
+			AssertNoError(t, sutStore.Restore(bytes.NewReader(backupContents)))
+			assertUsersInStore(t, sutStore, users, ids)
+			for _, user := range laterUsers {
+				assertUserNotInStore(t, sutStore, user)
+			}
+			t.Run("should persist the restored state", func(t *testing.T) {
+				restarted, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+				AssertNoError(t, err)
+				assertUsersInStore(t, restarted, users, ids)
+				newIds := createUsers(t, restarted, GenerateRandomUsers(1))
+				Assert(t, newIds[0] > ids[len(ids)-1], true, "ids are not reused after restoring")
+			})
+		})
+		t.Run("should be consistent while writes continue", func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				createUsers(t, sutStore, GenerateRandomUsers(100))
+			}()
+			for i := 0; i < 20; i++ {
+				var backup bytes.Buffer
+				AssertNoError(t, sutStore.Snapshot(&backup))
+				operations, err := fileInteractor.ReadSnapshot(&backup)
+				AssertNoError(t, err)
+				restored, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{operations: operations})
+				AssertNoError(t, err)
+				assertUsersInStore(t, restored, users, ids)
+			}
+			wg.Wait()
+		})
+		t.Run("should reject invalid backups and leave the store intact", func(t *testing.T) {
+			duplicateUsername := GenerateRandomUserModel()
+			sameNameUser := GenerateRandomUserModel()
+			sameNameUser.Id = duplicateUsername.Id + 1
+			sameNameUser.Username = duplicateUsername.Username
+			samePublicIdUsers := GenerateRandomUserModels(2)
+			samePublicIdUsers[0].PublicId, samePublicIdUsers[1].PublicId = "x", "x"
+			samePublicIdUsers[1].Id = samePublicIdUsers[0].Id + 1
+			invalidBackups := map[string]string{
+				"not decodable": "abracadabra",
+				"inconsistent":  jsonString([]models.Operation{{Type: models.DeleteUserOp, UserId: 42}}),
+				"duplicate username": jsonString([]models.Operation{
+					{Type: models.CreateUserOp, User: duplicateUsername},
+					{Type: models.CreateUserOp, User: sameNameUser},
+				}),
+				"duplicate public id": jsonString([]models.Operation{
+					{Type: models.CreateUserOp, User: samePublicIdUsers[0]},
+					{Type: models.CreateUserOp, User: samePublicIdUsers[1]},
+				}),
+			}
+			for name, invalidBackup := range invalidBackups {
+				t.Run(name, func(t *testing.T) {
+					err := sutStore.Restore(strings.NewReader(invalidBackup))
+					Assert(t, errors.Is(err, store.ErrInvalidBackup), true, "error is ErrInvalidBackup")
+					assertUsersInStore(t, sutStore, users, ids)
+				})
+			}
+		})
+		t.Run("read-only stores can be backed up, but not restored", func(t *testing.T) {
+			readOnly, err := store.NewPersistentInMemoryFileStore(fileInteractor, store.WithReadOnly())
+			AssertNoError(t, err)
+			AssertNoError(t, readOnly.Snapshot(io.Discard))
+			AssertError(t, readOnly.Restore(bytes.NewReader(backupContents)), store.ErrReadOnly)
+		})
+	})
 	t.Run("test error handling", func(t *testing.T) {
 		t.Run("constructor should return error if read failed", func(t *testing.T) {
 			errorFileInteractor := &ErrorDBFileInteractor{ThrowOnRead: true, ThrowOnWrite: false}
@@ -109,6 +762,19 @@ func TestPersistentInMemoryFileStore(t *testing.T) {
 
 			assertUserNotInStore(t, store, randomUser)
 		})
+		t.Run("UpdatePassword() should return error if write failed (and do not update the user)", func(t *testing.T) {
+			fileInteractor := &StubDBFileInteractor{}
+			sutStore, err := store.NewPersistentInMemoryFileStore(fileInteractor)
+			AssertNoError(t, err)
+			user := GenerateRandomUser()
+			ids := createUsers(t, sutStore, []RandomUser{user})
+
+			sutStore, err = store.NewPersistentInMemoryFileStore(&errorOnWriteDBFileInteractor{fileInteractor})
+			AssertNoError(t, err)
+			err = sutStore.UpdatePassword(user.Username, RandomString(), nil)
+			AssertSomeError(t, err)
+			assertUserInStore(t, sutStore, user, ids[0])
+		})
 	})
 }
 
@@ -160,37 +826,243 @@ func assertUserEqual(t testing.TB, userInStore models.UserModel, want RandomUser
 }
 
 type StubDBFileInteractor struct {
-	users []models.UserModel
-	mu    sync.Mutex
+	operations []models.Operation
+	// the number of calls to ReplaceOperations
+	replaced int
+	mu       sync.Mutex
 }
 
-func (s *StubDBFileInteractor) ReadUsers() ([]models.UserModel, error) {
-	return s.users, nil
+func (s *StubDBFileInteractor) ReadOperations() ([]models.Operation, error) {
+	return s.operations, nil
+}
+func (s *StubDBFileInteractor) WriteOperation(op models.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operations = append(s.operations, op)
+	return nil
 }
-func (s *StubDBFileInteractor) WriteUser(user models.UserModel) error {
+func (s *StubDBFileInteractor) ReplaceOperations(operations []models.Operation) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.users = append(s.users, user)
+	s.operations = append([]models.Operation{}, operations...)
+	s.replaced++
 	return nil
 }
 
+// Size returns the number of operations, so that size thresholds are easy to test
+func (s *StubDBFileInteractor) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.operations)), nil
+}
+func (s *StubDBFileInteractor) Close() error {
+	return nil
+}
+func (s *StubDBFileInteractor) WriteSnapshot(w io.Writer, operations []models.Operation) error {
+	return json.NewEncoder(w).Encode(operations)
+}
+func (s *StubDBFileInteractor) ReadSnapshot(r io.Reader) (operations []models.Operation, err error) {
+	err = json.NewDecoder(r).Decode(&operations)
+	return
+}
+
+// StubTailingDBFileInteractor follows the operations written to the embedded stub by another store.
+// The log is considered replaced when it becomes shorter than what was already read (e.g. after compaction).
+type StubTailingDBFileInteractor struct {
+	*StubDBFileInteractor
+	read    int
+	changes chan struct{}
+	lag     time.Duration
+}
+
+func (s *StubTailingDBFileInteractor) ReadOperations() ([]models.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.read = len(s.operations)
+	return append([]models.Operation{}, s.operations...), nil
+}
+func (s *StubTailingDBFileInteractor) ReadNewOperations() ([]models.Operation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reloaded := len(s.operations) < s.read
+	if reloaded {
+		s.read = 0
+	}
+	newOperations := append([]models.Operation{}, s.operations[s.read:]...)
+	s.read = len(s.operations)
+	return newOperations, reloaded, nil
+}
+func (s *StubTailingDBFileInteractor) Watch(time.Duration) (<-chan struct{}, func()) {
+	return s.changes, func() {}
+}
+func (s *StubTailingDBFileInteractor) ReplicationLag() time.Duration {
+	return s.lag
+}
+
 type ErrorDBFileInteractor struct {
 	ThrowOnRead  bool
 	ThrowOnWrite bool
 }
 
-func (e *ErrorDBFileInteractor) ReadUsers() ([]models.UserModel, error) {
+func (e *ErrorDBFileInteractor) ReadOperations() ([]models.Operation, error) {
 	var err error
 	if e.ThrowOnRead {
 		err = errors.New(RandomString())
 	} else {
 		err = nil
 	}
-	return []models.UserModel{}, err
+	return []models.Operation{}, err
 }
-func (e *ErrorDBFileInteractor) WriteUser(user models.UserModel) error {
+func (e *ErrorDBFileInteractor) ReplaceOperations([]models.Operation) error {
 	if e.ThrowOnWrite {
 		return errors.New(RandomString())
 	}
 	return nil
 }
+func (e *ErrorDBFileInteractor) Size() (int64, error) {
+	return 0, nil
+}
+func (e *ErrorDBFileInteractor) WriteOperation(models.Operation) error {
+	if e.ThrowOnWrite {
+		return errors.New(RandomString())
+	}
+	return nil
+}
+func (e *ErrorDBFileInteractor) Close() error {
+	return nil
+}
+
+type errorOnWriteDBFileInteractor struct {
+	*StubDBFileInteractor
+}
+
+func (e *errorOnWriteDBFileInteractor) WriteOperation(models.Operation) error {
+	return errors.New(RandomString())
+}
+
+// benchmarkStore returns a store with usersCount users and their tokens
+func benchmarkStore(b *testing.B, usersCount int) (*store.PersistentInMemoryFileStore, []string) {
+	sutStore, err := store.NewPersistentInMemoryFileStore(&StubDBFileInteractor{})
+	AssertNoError(b, err)
+	tokens := make([]string, usersCount)
+	for i := range tokens {
+		user := GenerateRandomUser()
+		tokens[i] = user.Token.Token
+		_, err := sutStore.CreateUser(user.Username, user.Password, user.Token)
+		AssertNoError(b, err)
+	}
+	return sutStore, tokens
+}
+
+func BenchmarkFindUserFromToken(b *testing.B) {
+	sutStore, tokens := benchmarkStore(b, 10000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := sutStore.FindUserFromToken(tokens[i%len(tokens)]); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// lookups shouldn't slow down much while there is a steady stream of writes
+func BenchmarkFindUserFromToken_WithConcurrentWrites(b *testing.B) {
+	sutStore, tokens := benchmarkStore(b, 10000)
+	done := make(chan struct{})
+	var writerDone sync.WaitGroup
+	writerDone.Add(1)
+	go func() {
+		defer writerDone.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				user := GenerateRandomUser()
+				sutStore.CreateUser(user.Username, user.Password, user.Token)
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := sutStore.FindUserFromToken(tokens[i%len(tokens)]); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	writerDone.Wait()
+}
+
+// BenchmarkReplay measures building the indexes on startup, reading the file is measured by BenchmarkReadOperations of db_file_interactor_impl
+func BenchmarkReplay(b *testing.B) {
+	for _, usersCount := range []int{1_000_000, 10_000_000} {
+		b.Run(fmt.Sprintf("users=%d", usersCount), func(b *testing.B) {
+			if testing.Short() && usersCount > 1_000_000 {
+				b.Skip("skipping the biggest size in short mode")
+			}
+			interactor := &StubDBFileInteractor{operations: GenerateUserOperations(usersCount)}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := store.NewPersistentInMemoryFileStore(interactor)
+				AssertNoError(b, err)
+			}
+		})
+	}
+}
+
+func jsonString(v any) string {
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
+
+type stubTokenInvalidator struct {
+	tokens []string
+	all    int
+}
+
+func (s *stubTokenInvalidator) Invalidate(token string) {
+	s.tokens = append(s.tokens, token)
+}
+func (s *stubTokenInvalidator) InvalidateAll() {
+	s.all++
+}
+
+// GroupCommitDBFileInteractor simulates the fsyncs of db_file_interactor_impl.GroupCommit:
+// an fsync takes syncDuration and covers every operation appended before it started
+type GroupCommitDBFileInteractor struct {
+	StubDBFileInteractor
+	syncDuration time.Duration
+	syncErr      error
+	// guarded by syncMu
+	syncs, synced uint64
+	syncMu        sync.Mutex
+}
+
+func (s *GroupCommitDBFileInteractor) AppendOperation(op models.Operation) (func() error, error) {
+	s.mu.Lock()
+	s.operations = append(s.operations, op)
+	written := uint64(len(s.operations))
+	s.mu.Unlock()
+	return func() error {
+		s.syncMu.Lock()
+		defer s.syncMu.Unlock()
+		if s.syncErr != nil {
+			return s.syncErr
+		}
+		if s.synced >= written {
+			return nil
+		}
+		s.mu.Lock()
+		target := uint64(len(s.operations))
+		s.mu.Unlock()
+		time.Sleep(s.syncDuration)
+		s.syncs++
+		s.synced = target
+		return nil
+	}, nil
+}
@@ -0,0 +1,51 @@
+package store
+
+import "github.com/k0marov/golang-auth/internal/data/models"
+
+// TokenInvalidator is notified about tokens, which are revoked or whose users change,
+// so that caches in front of the store (see token_cache) can drop them immediately
+type TokenInvalidator interface {
+	Invalidate(token string)
+	InvalidateAll()
+}
+
+// SetTokenInvalidator makes the store notify the invalidator about every changed token,
+// including the changes made by another process while following the file (see WithFollowing).
+// When the whole state is replaced (e.g. by Restore), InvalidateAll is called.
+func (p *PersistentInMemoryFileStore) SetTokenInvalidator(invalidator TokenInvalidator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tokenInvalidator = invalidator
+}
+
+// touchedTokens returns the tokens, whose users are changed by the operation, it should be called before applying it with mu locked
+func (p *PersistentInMemoryFileStore) touchedTokens(op models.Operation) []string {
+	if p.tokenInvalidator == nil {
+		return nil
+	}
+	var tokens []string
+	userId := op.UserId
+	switch op.Type {
+	case models.CreateUserOp, models.UpdateUserOp:
+		userId = op.User.Id
+		tokens = append(tokens, op.User.AuthToken.Token)
+	case models.AddTokenOp:
+		tokens = append(tokens, op.Token.Token)
+	case models.DeleteUserOp, models.RemoveTokenOp:
+	default:
+		return nil
+	}
+	if user, exists := p.users[userId]; exists {
+		tokens = append(tokens, user.AuthToken.Token)
+	}
+	return tokens
+}
+
+// invalidate should be called with mu locked, after the indexes are updated and indexMu is unlocked
+func (p *PersistentInMemoryFileStore) invalidate(tokens []string) {
+	for _, token := range tokens {
+		if token != "" {
+			p.tokenInvalidator.Invalidate(token)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package token_cache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+)
+
+const (
+	DefaultCapacity    = 10000
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 5 * time.Second
+)
+
+type Option func(*CachingTokenStore)
+
+// WithCapacity sets how many tokens are cached, the least recently used ones are evicted first
+func WithCapacity(capacity int) Option {
+	return func(c *CachingTokenStore) {
+		c.capacity = capacity
+	}
+}
+
+// WithTTL sets for how long a found user is cached.
+// It bounds for how long a token revoked without calling Invalidate (e.g. by another instance) keeps working.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *CachingTokenStore) {
+		c.ttl = ttl
+	}
+}
+
+// WithNegativeTTL sets for how long unknown tokens are cached, so that repeated requests with invalid tokens don't reach the store.
+// Zero disables negative caching.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(c *CachingTokenStore) {
+		c.negativeTTL = ttl
+	}
+}
+
+// CachingTokenStore is a read-through cache in front of a slow token store (e.g. an SQL database),
+// which is otherwise hit by TokenAuthMiddleware on every request.
+// Concurrent lookups of the same uncached token share a single request to the store.
+// Errors other than TokenNotFoundErr are never cached.
+//
+// Invalidate should be called whenever a token is revoked or changes its owner, so that the change is visible immediately.
+// A lookup, which is in flight while any token is invalidated, doesn't fill the cache, since it might have read the old state.
+type CachingTokenStore struct {
+	store       token_store_contract.TokenStore
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// the most recently used entries are at the front
+	lru     *list.List
+	flights map[string]*flight
+	// incremented on every invalidation
+	generation uint64
+}
+
+type entry struct {
+	token   string
+	user    models.UserModel
+	found   bool
+	expires time.Time
+}
+
+// flight is a lookup in the store, which concurrent callers for the same token wait for
+type flight struct {
+	done chan struct{}
+	user models.UserModel
+	err  error
+}
+
+var errStorePanicked = errors.New("the token store panicked while looking up the token")
+
+func NewCachingTokenStore(store token_store_contract.TokenStore, opts ...Option) *CachingTokenStore {
+	c := &CachingTokenStore{
+		store:       store,
+		capacity:    DefaultCapacity,
+		ttl:         DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		flights:     map[string]*flight{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *CachingTokenStore) FindUserFromToken(token string) (models.UserModel, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[token]; ok {
+		cached := elem.Value.(*entry)
+		if time.Now().Before(cached.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			if !cached.found {
+				return models.UserModel{}, token_store_contract.TokenNotFoundErr
+			}
+			return copyUser(cached.user), nil
+		}
+		c.remove(elem)
+	}
+	f, inFlight := c.flights[token]
+	if inFlight {
+		c.mu.Unlock()
+		<-f.done
+	} else {
+		f = &flight{done: make(chan struct{})}
+		c.flights[token] = f
+		generation := c.generation
+		c.mu.Unlock()
+		c.load(token, f, generation)
+	}
+	if f.err != nil {
+		return models.UserModel{}, f.err
+	}
+	return copyUser(f.user), nil
+}
+
+func (c *CachingTokenStore) load(token string, f *flight, generation uint64) {
+	defer close(f.done)
+	defer c.finish(token, f, generation)
+	f.err = errStorePanicked
+	f.user, f.err = c.store.FindUserFromToken(token)
+}
+
+// finish caches the result of the flight, unless something was invalidated while it was in flight
+func (c *CachingTokenStore) finish(token string, f *flight, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flights[token] == f {
+		delete(c.flights, token)
+	}
+	if c.generation != generation {
+		return
+	}
+	switch {
+	case f.err == nil:
+		c.add(&entry{token: token, user: copyUser(f.user), found: true, expires: time.Now().Add(c.ttl)})
+	case errors.Is(f.err, token_store_contract.TokenNotFoundErr) && c.negativeTTL > 0:
+		c.add(&entry{token: token, expires: time.Now().Add(c.negativeTTL)})
+	}
+}
+
+// add should be called with mu locked
+func (c *CachingTokenStore) add(e *entry) {
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, ok := c.entries[e.token]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[e.token] = c.lru.PushFront(e)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove should be called with mu locked
+func (c *CachingTokenStore) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).token)
+}
+
+// Invalidate drops the token from the cache, it should be called on logout, revocation or when the token's user changes
+func (c *CachingTokenStore) Invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if elem, ok := c.entries[token]; ok {
+		c.remove(elem)
+	}
+	// later lookups shouldn't wait for a flight, which might return the old state
+	delete(c.flights, token)
+}
+
+// InvalidateAll drops all tokens from the cache, e.g. after the store was restored from a backup
+func (c *CachingTokenStore) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.flights = map[string]*flight{}
+}
+
+// Len returns the number of cached tokens, including the expired ones, which weren't evicted yet
+func (c *CachingTokenStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func copyUser(user models.UserModel) models.UserModel {
+	user.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return user
+}
@@ -0,0 +1,198 @@
+package token_cache_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/data/token_cache"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestCachingTokenStore(t *testing.T) {
+	user := GenerateRandomUserModel()
+	user.PasswordHistory = []string{RandomString()}
+	token := user.AuthToken.Token
+
+	t.Run("should cache found users and return copies", func(t *testing.T) {
+		store := newStubTokenStore(user)
+		cache := token_cache.NewCachingTokenStore(store)
+		for i := 0; i < 3; i++ {
+			found, err := cache.FindUserFromToken(token)
+			AssertNoError(t, err)
+			Assert(t, found, user, "found user")
+			found.PasswordHistory[0] = RandomString()
+		}
+		Assert(t, store.callsCount(), 1, "number of lookups in the store")
+	})
+	t.Run("should look the token up again after the TTL", func(t *testing.T) {
+		store := newStubTokenStore(user)
+		cache := token_cache.NewCachingTokenStore(store, token_cache.WithTTL(10*time.Millisecond))
+		cache.FindUserFromToken(token)
+		time.Sleep(30 * time.Millisecond)
+		cache.FindUserFromToken(token)
+		Assert(t, store.callsCount(), 2, "number of lookups in the store")
+	})
+	t.Run("negative caching", func(t *testing.T) {
+		unknown := RandomString()
+		t.Run("should cache unknown tokens", func(t *testing.T) {
+			store := newStubTokenStore()
+			cache := token_cache.NewCachingTokenStore(store)
+			for i := 0; i < 3; i++ {
+				_, err := cache.FindUserFromToken(unknown)
+				AssertError(t, err, token_store_contract.TokenNotFoundErr)
+			}
+			Assert(t, store.callsCount(), 1, "number of lookups in the store")
+		})
+		t.Run("should be disabled by a zero negative TTL", func(t *testing.T) {
+			store := newStubTokenStore()
+			cache := token_cache.NewCachingTokenStore(store, token_cache.WithNegativeTTL(0))
+			cache.FindUserFromToken(unknown)
+			cache.FindUserFromToken(unknown)
+			Assert(t, store.callsCount(), 2, "number of lookups in the store")
+		})
+	})
+	t.Run("should not cache other errors", func(t *testing.T) {
+		store := newStubTokenStore(user)
+		store.err = errors.New(RandomString())
+		cache := token_cache.NewCachingTokenStore(store)
+		_, err := cache.FindUserFromToken(token)
+		AssertError(t, err, store.err)
+		_, err = cache.FindUserFromToken(token)
+		AssertError(t, err, store.err)
+		Assert(t, store.callsCount(), 2, "number of lookups in the store")
+	})
+	t.Run("should evict the least recently used tokens", func(t *testing.T) {
+		users := GenerateRandomUserModels(3)
+		store := newStubTokenStore(users...)
+		cache := token_cache.NewCachingTokenStore(store, token_cache.WithCapacity(2))
+		cache.FindUserFromToken(users[0].AuthToken.Token)
+		cache.FindUserFromToken(users[1].AuthToken.Token)
+		cache.FindUserFromToken(users[0].AuthToken.Token)
+		cache.FindUserFromToken(users[2].AuthToken.Token)
+		Assert(t, cache.Len(), 2, "number of cached tokens")
+		Assert(t, store.callsCount(), 3, "number of lookups in the store")
+
+		cache.FindUserFromToken(users[0].AuthToken.Token)
+		Assert(t, store.callsCount(), 3, "number of lookups in the store after using a recently used token")
+		cache.FindUserFromToken(users[1].AuthToken.Token)
+		Assert(t, store.callsCount(), 4, "number of lookups in the store after using an evicted token")
+	})
+	t.Run("concurrent lookups of the same token should share a single lookup", func(t *testing.T) {
+		store := newStubTokenStore(user)
+		store.release = make(chan struct{})
+		cache := token_cache.NewCachingTokenStore(store)
+
+		const goroutines = 20
+		var wg sync.WaitGroup
+		wg.Add(goroutines)
+		for i := 0; i < goroutines; i++ {
+			go func() {
+				defer wg.Done()
+				found, err := cache.FindUserFromToken(token)
+				AssertNoError(t, err)
+				Assert(t, found.Username, user.Username, "username")
+			}()
+		}
+		store.waitForCall()
+		// give the others some time to join the lookup
+		time.Sleep(20 * time.Millisecond)
+		close(store.release)
+		wg.Wait()
+		Assert(t, store.callsCount(), 1, "number of lookups in the store")
+	})
+	t.Run("invalidation", func(t *testing.T) {
+		t.Run("Invalidate() should drop the token", func(t *testing.T) {
+			store := newStubTokenStore(user)
+			cache := token_cache.NewCachingTokenStore(store)
+			cache.FindUserFromToken(token)
+			store.remove(token)
+			cache.Invalidate(token)
+			_, err := cache.FindUserFromToken(token)
+			AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		})
+		t.Run("InvalidateAll() should drop all tokens", func(t *testing.T) {
+			users := GenerateRandomUserModels(2)
+			store := newStubTokenStore(users...)
+			cache := token_cache.NewCachingTokenStore(store)
+			cache.FindUserFromToken(users[0].AuthToken.Token)
+			cache.FindUserFromToken(users[1].AuthToken.Token)
+			cache.InvalidateAll()
+			Assert(t, cache.Len(), 0, "number of cached tokens")
+			cache.FindUserFromToken(users[0].AuthToken.Token)
+			Assert(t, store.callsCount(), 3, "number of lookups in the store")
+		})
+		t.Run("a lookup in flight during invalidation should not fill the cache", func(t *testing.T) {
+			store := newStubTokenStore(user)
+			store.release = make(chan struct{})
+			cache := token_cache.NewCachingTokenStore(store)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				cache.FindUserFromToken(token)
+			}()
+			store.waitForCall()
+			store.remove(token)
+			cache.Invalidate(token)
+			close(store.release)
+			<-done
+
+			_, err := cache.FindUserFromToken(token)
+			AssertError(t, err, token_store_contract.TokenNotFoundErr)
+		})
+	})
+}
+
+type stubTokenStore struct {
+	mu      sync.Mutex
+	users   map[string]models.UserModel
+	err     error
+	calls   int32
+	called  chan struct{}
+	release chan struct{}
+}
+
+func newStubTokenStore(users ...models.UserModel) *stubTokenStore {
+	store := &stubTokenStore{users: map[string]models.UserModel{}, called: make(chan struct{}, 100)}
+	for _, user := range users {
+		store.users[user.AuthToken.Token] = user
+	}
+	return store
+}
+
+func (s *stubTokenStore) FindUserFromToken(token string) (models.UserModel, error) {
+	atomic.AddInt32(&s.calls, 1)
+	s.called <- struct{}{}
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return models.UserModel{}, s.err
+	}
+	user, ok := s.users[token]
+	if !ok {
+		return models.UserModel{}, token_store_contract.TokenNotFoundErr
+	}
+	user.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	return user, nil
+}
+
+func (s *stubTokenStore) remove(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, token)
+}
+
+func (s *stubTokenStore) callsCount() int {
+	return int(atomic.LoadInt32(&s.calls))
+}
+
+func (s *stubTokenStore) waitForCall() {
+	<-s.called
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/k0marov/golang-auth/internal/core/client_errors"
+)
+
+// NewBackupHandler returns an admin handler, which streams a backup on GET and restores the backup from the request body on POST.
+// Requests should have an "Authorization: Token {adminToken}" header.
+// If restore returns a client_errors.ClientError (e.g. the backup is invalid), it is sent to the client.
+// Request bodies bigger than maxBackupSize bytes are cut off and rejected with 413.
+func NewBackupHandler(snapshot func(io.Writer) error, restore func(io.Reader) error, adminToken string, maxBackupSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(w, r, adminToken) {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="auth-backup.db"`)
+			if err := snapshot(w); err != nil {
+				log.Printf("error while streaming a backup: %v", err)
+				// the status is probably already sent, so the connection is broken to keep the client from taking a partial backup as a complete one
+				panic(http.ErrAbortHandler)
+			}
+		case http.MethodPost:
+			body := &limitedBody{r: http.MaxBytesReader(w, r.Body, maxBackupSize), limit: maxBackupSize}
+			if err := restore(body); err != nil {
+				log.Printf("error while restoring a backup: %v", err)
+				if body.tooLarge {
+					throwWithStatus(w, client_errors.BackupTooLargeError, http.StatusRequestEntityTooLarge)
+					return
+				}
+				handleServiceError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// limitedBody reports whether http.MaxBytesReader cut the body off, since its error can't be matched before Go 1.19 (see http.MaxBytesError)
+type limitedBody struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	// MaxBytesReader fails only once the limit is reached, with any error other than EOF
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, adminToken string) bool {
+	const prefix = "Token "
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		throwUnauthorized(w, client_errors.AuthTokenRequiredError)
+		return false
+	}
+	if !strings.HasPrefix(header, prefix) {
+		// e.g. the bare token or another scheme
+		throwUnauthorized(w, client_errors.AdminTokenInvalidError)
+		return false
+	}
+	token := header[len(prefix):]
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		throwUnauthorized(w, client_errors.AdminTokenInvalidError)
+		return false
+	}
+	return true
+}
+
+func throwUnauthorized(w http.ResponseWriter, httpErr client_errors.ClientError) {
+	throwWithStatus(w, httpErr, http.StatusUnauthorized)
+}
+
+func throwWithStatus(w http.ResponseWriter, httpErr client_errors.ClientError, status int) {
+	errorBuf := bytes.NewBuffer(nil)
+	json.NewEncoder(errorBuf).Encode(httpErr)
+	http.Error(w, errorBuf.String(), status)
+}
@@ -20,10 +20,16 @@ func NewRegisterHandler(register AuthServiceMethod) http.HandlerFunc {
 	return newBaseHandler(register)
 }
 
-func newBaseHandler(callProperService AuthServiceMethod) http.HandlerFunc {
+type ChangePasswordServiceMethod = func(values.ChangePasswordData) (entities.Token, error)
+
+func NewChangePasswordHandler(changePassword ChangePasswordServiceMethod) http.HandlerFunc {
+	return newBaseHandler(changePassword)
+}
+
+func newBaseHandler[PostData any](callProperService func(PostData) (entities.Token, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("contentType", "application/json")
-		var postData values.AuthData
+		var postData PostData
 		err := json.NewDecoder(r.Body).Decode(&postData)
 		if err != nil {
 			throwHTTPError(w, client_errors.InvalidJsonError)
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/k0marov/golang-auth/internal/core/client_errors"
@@ -28,6 +30,25 @@ func TestLoginHandler(t *testing.T) {
 	baseTestHandler(t, handlers.NewLoginHandler)
 }
 
+func TestChangePasswordHandler(t *testing.T) {
+	postData := values.ChangePasswordData{Username: RandomString(), Password: RandomString(), NewPassword: RandomString()}
+	randomToken := entities.Token{Token: RandomString()}
+	sut := handlers.NewChangePasswordHandler(func(data values.ChangePasswordData) (entities.Token, error) {
+		if data == postData {
+			return randomToken, nil
+		}
+		return entities.Token{}, client_errors.InvalidCredentialsError
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/url-should-not-be-used", bytes.NewReader([]byte(jsonString(postData))))
+	response := httptest.NewRecorder()
+	sut.ServeHTTP(response, request)
+
+	AssertJSON(t, response)
+	Assert(t, response.Code, 200, "status code")
+	Assert(t, response.Body.String(), jsonString(randomToken), "response body")
+}
+
 func baseTestHandler(t *testing.T, makeHandler func(handlers.AuthServiceMethod) http.HandlerFunc) {
 	t.Helper()
 
@@ -90,6 +111,77 @@ func baseTestHandler(t *testing.T, makeHandler func(handlers.AuthServiceMethod)
 	})
 }
 
+func TestBackupHandler(t *testing.T) {
+	adminToken := RandomString()
+	backup := RandomString()
+	var restored []string
+	restoreErr := error(nil)
+	const maxBackupSize = 1000
+	sut := handlers.NewBackupHandler(
+		func(w io.Writer) error {
+			_, err := io.WriteString(w, backup)
+			return err
+		},
+		func(r io.Reader) error {
+			body, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			restored = append(restored, string(body))
+			return restoreErr
+		},
+		adminToken,
+		maxBackupSize,
+	)
+	request := func(method, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/url-should-not-be-used", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Token "+token)
+		}
+		response := httptest.NewRecorder()
+		sut.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("should require the admin token", func(t *testing.T) {
+		AssertHTTPError(t, request(http.MethodGet, "", ""), client_errors.AuthTokenRequiredError, http.StatusUnauthorized)
+		AssertHTTPError(t, request(http.MethodPost, RandomString()+"wrong", backup), client_errors.AdminTokenInvalidError, http.StatusUnauthorized)
+		for _, header := range []string{adminToken, "Bearer " + adminToken, "token " + adminToken} {
+			withoutPrefix := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(backup))
+			withoutPrefix.Header.Set("Authorization", header)
+			response := httptest.NewRecorder()
+			sut.ServeHTTP(response, withoutPrefix)
+			AssertHTTPError(t, response, client_errors.AdminTokenInvalidError, http.StatusUnauthorized)
+		}
+		Assert(t, len(restored), 0, "number of restores")
+	})
+	t.Run("GET should stream the snapshot", func(t *testing.T) {
+		response := request(http.MethodGet, adminToken, "")
+		Assert(t, response.Code, http.StatusOK, "status code")
+		Assert(t, response.Body.String(), backup, "response body")
+	})
+	t.Run("POST should restore the request body", func(t *testing.T) {
+		response := request(http.MethodPost, adminToken, backup)
+		Assert(t, response.Code, http.StatusNoContent, "status code")
+		Assert(t, restored, []string{backup}, "restored backups")
+	})
+	t.Run("should reject backups bigger than the limit", func(t *testing.T) {
+		AssertHTTPError(t, request(http.MethodPost, adminToken, strings.Repeat("a", maxBackupSize+1)), client_errors.BackupTooLargeError, http.StatusRequestEntityTooLarge)
+		Assert(t, len(restored), 1, "number of restores")
+
+		response := request(http.MethodPost, adminToken, strings.Repeat("a", maxBackupSize))
+		Assert(t, response.Code, http.StatusNoContent, "status code of a backup of exactly the limit")
+	})
+	t.Run("should return client errors of restoring", func(t *testing.T) {
+		restoreErr = client_errors.BackupInvalidError
+		defer func() { restoreErr = nil }()
+		AssertHTTPError(t, request(http.MethodPost, adminToken, backup), client_errors.BackupInvalidError, http.StatusBadRequest)
+	})
+	t.Run("should reject other methods", func(t *testing.T) {
+		Assert(t, request(http.MethodDelete, adminToken, "").Code, http.StatusMethodNotAllowed, "status code")
+	})
+}
+
 func encodeAuthData(data values.AuthData) string {
 	post := bytes.NewBuffer(nil)
 	json.NewEncoder(post).Encode(data)
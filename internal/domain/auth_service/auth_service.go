@@ -1,16 +1,19 @@
 package auth_service
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/k0marov/golang-auth/internal/core/client_errors"
+	"github.com/k0marov/golang-auth/internal/data/models"
 	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
 	"github.com/k0marov/golang-auth/internal/domain/entities"
 	"github.com/k0marov/golang-auth/internal/domain/mappers"
 	"github.com/k0marov/golang-auth/internal/values"
-
-	"github.com/google/uuid"
 )
 
 type AuthStore = auth_store_contract.AuthStore
@@ -18,47 +21,105 @@ type AuthStore = auth_store_contract.AuthStore
 type Hasher interface {
 	Hash(password string) (string, error)
 	Compare(pass, hashedPass string) bool
+	// NeedsRehash is checked on every successful login,
+	// so that stored hashes can be upgraded (e.g. when the pepper is rotated)
+	NeedsRehash(hashedPass string) bool
 }
 
+// PasswordCheck is called for every new password before hashing it.
+// It should return a client_errors.ClientError if the password is not acceptable,
+// any other error is treated as an internal one.
+type PasswordCheck = func(password string) error
+
 type AuthServiceImpl struct {
 	store         AuthStore
 	hasher        Hasher
 	onNewRegister func(entities.User)
+	options
+}
+
+type Option func(*options)
+
+type options struct {
+	passwordChecks      []PasswordCheck
+	passwordHistorySize int
+	tokenIssuer         TokenIssuer
+}
+
+// TokenIssuer issues a new token on every registration, login and password change,
+// e.g. for sessions kept in a separate token store
+type TokenIssuer interface {
+	IssueToken(user models.UserModel) (entities.Token, error)
+}
+
+func WithPasswordChecks(checks ...PasswordCheck) Option {
+	return func(o *options) {
+		o.passwordChecks = append(o.passwordChecks, checks...)
+	}
+}
+
+// WithPasswordHistory forbids changing the password to any of the last historySize passwords of the user (including the current one).
+// The hashes of historySize-1 previous passwords are kept in the store for this.
+func WithPasswordHistory(historySize int) Option {
+	return func(o *options) {
+		o.passwordHistorySize = historySize
+	}
+}
+
+// WithTokenIssuer makes the service return tokens issued by the issuer instead of the token kept with the user in the store
+func WithTokenIssuer(issuer TokenIssuer) Option {
+	return func(o *options) {
+		o.tokenIssuer = issuer
+	}
 }
 
 // The onNewRegister function is called every time a new user is registered.
 // This function can be used, for example, for creating a User Profile in some other database.
 // It is called synchronously, which can be slow if it does something expensive.
 // So, if you don't need synchronous behavior for this handler, wrap the expensive operation in a goroutine
-func NewAuthServiceImpl(store AuthStore, hasher Hasher, onNewRegister func(entities.User)) *AuthServiceImpl {
-	return &AuthServiceImpl{
+func NewAuthServiceImpl(store AuthStore, hasher Hasher, onNewRegister func(entities.User), opts ...Option) *AuthServiceImpl {
+	service := &AuthServiceImpl{
 		store:         store,
 		hasher:        hasher,
 		onNewRegister: onNewRegister,
 	}
+	for _, opt := range opts {
+		opt(&service.options)
+	}
+	return service
 }
 
 func (s *AuthServiceImpl) Register(authData values.AuthData) (entities.Token, error) {
-	if !checkUsernameValidity(authData.Username) {
+	if !CheckUsernameValidity(authData.Username) {
 		return entities.Token{}, client_errors.UsernameInvalidError
 	}
 	if s.store.UserExists(authData.Username) {
 		return entities.Token{}, client_errors.UsernameAlreadyTakenError
 	}
+	if err := s.checkPassword(authData.Password); err != nil {
+		return entities.Token{}, err
+	}
 
 	hashedPassword, err := s.hasher.Hash(authData.Password)
 	if err != nil {
 		return entities.Token{}, fmt.Errorf("error while hashing password: %w", err)
 	}
-	token := generateToken()
+	token, err := GenerateToken()
+	if err != nil {
+		return entities.Token{}, err
+	}
 	newUser, err := s.store.CreateUser(authData.Username, string(hashedPassword), token)
 	if err != nil {
+		// the username could have been taken by a concurrent registration after the check above
+		if errors.Is(err, auth_store_contract.UsernameTakenErr) {
+			return entities.Token{}, client_errors.UsernameAlreadyTakenError
+		}
 		return entities.Token{}, fmt.Errorf("error while creating a new user: %w", err)
 	}
 
 	s.onNewRegister(mappers.ModelToUser(newUser))
 
-	return token, nil
+	return s.tokenFor(newUser)
 }
 
 func (s *AuthServiceImpl) Login(authData values.AuthData) (entities.Token, error) {
@@ -73,14 +134,151 @@ func (s *AuthServiceImpl) Login(authData values.AuthData) (entities.Token, error
 	if !s.hasher.Compare(authData.Password, existingUser.StoredPass) {
 		return entities.Token{}, client_errors.InvalidCredentialsError
 	}
+	if replacer, ok := s.store.(auth_store_contract.HashReplacer); ok && s.hasher.NeedsRehash(existingUser.StoredPass) {
+		s.rehash(replacer, existingUser, authData.Password)
+	}
+
+	return s.tokenFor(existingUser)
+}
+
+var errNoToken = errors.New("the user has no token (e.g. after logging out) and the store can't add a new one")
+
+// tokenFor returns the token of the user in the store, or a new one if it was revoked (e.g. on logout),
+// or a token from the token issuer if it is set
+func (s *AuthServiceImpl) tokenFor(user models.UserModel) (entities.Token, error) {
+	if s.tokenIssuer == nil {
+		if user.AuthToken.Token != "" {
+			return user.AuthToken, nil
+		}
+		adder, ok := s.store.(auth_store_contract.TokenAdder)
+		if !ok {
+			return entities.Token{}, errNoToken
+		}
+		token, err := GenerateToken()
+		if err != nil {
+			return entities.Token{}, err
+		}
+		if err := adder.AddToken(user.Username, token); err != nil {
+			return entities.Token{}, fmt.Errorf("error while adding a new token: %w", err)
+		}
+		return token, nil
+	}
+	token, err := s.tokenIssuer.IssueToken(user)
+	if err != nil {
+		return entities.Token{}, fmt.Errorf("error while issuing a token: %w", err)
+	}
+	return token, nil
+}
 
-	return existingUser.AuthToken, nil
+// rehash is best effort: if it fails, the old hash is still valid, so the login shouldn't fail.
+// The hash is replaced only if it is still the one which was checked, since the password could have been changed while hashing it.
+// The password itself stays the same, so the history is left untouched.
+func (s *AuthServiceImpl) rehash(replacer auth_store_contract.HashReplacer, user models.UserModel, password string) {
+	newHash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.Printf("error while rehashing password of user %s: %v", user.Username, err)
+		return
+	}
+	if _, err := replacer.ReplaceHash(user.Username, user.StoredPass, newHash); err != nil {
+		log.Printf("error while storing rehashed password of user %s: %v", user.Username, err)
+	}
+}
+
+// ChangePassword checks the current credentials of the user and then sets the new password.
+// The auth token of the user is not changed (unless a token issuer is used, see WithTokenIssuer).
+func (s *AuthServiceImpl) ChangePassword(data values.ChangePasswordData) (entities.Token, error) {
+	existingUser, err := s.store.FindUser(data.Username)
+	if err != nil {
+		if err == auth_store_contract.UserNotFoundErr {
+			return entities.Token{}, client_errors.InvalidCredentialsError
+		} else {
+			return entities.Token{}, err
+		}
+	}
+	if !s.hasher.Compare(data.Password, existingUser.StoredPass) {
+		return entities.Token{}, client_errors.InvalidCredentialsError
+	}
+	if err := s.setNewPassword(existingUser, data.NewPassword); err != nil {
+		return entities.Token{}, err
+	}
+	return s.tokenFor(existingUser)
+}
+
+// ResetPassword sets the new password without checking the current one.
+// It is meant to be called by the application after it has verified the user in some other way (e.g. via email).
+func (s *AuthServiceImpl) ResetPassword(username, newPassword string) error {
+	existingUser, err := s.store.FindUser(username)
+	if err != nil {
+		return err
+	}
+	return s.setNewPassword(existingUser, newPassword)
+}
+
+func (s *AuthServiceImpl) setNewPassword(user models.UserModel, newPassword string) error {
+	if err := s.checkPassword(newPassword); err != nil {
+		return err
+	}
+	if s.passwordHistorySize > 0 && s.isReused(user, newPassword) {
+		return client_errors.PasswordReusedError
+	}
+	hashedPassword, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return fmt.Errorf("error while hashing password: %w", err)
+	}
+	err = s.store.UpdatePassword(user.Username, hashedPassword, s.updatedHistory(user))
+	if err != nil {
+		return fmt.Errorf("error while updating password: %w", err)
+	}
+	return nil
+}
+
+func (s *AuthServiceImpl) isReused(user models.UserModel, newPassword string) bool {
+	previousHashes := append([]string{user.StoredPass}, user.PasswordHistory...)
+	if len(previousHashes) > s.passwordHistorySize {
+		previousHashes = previousHashes[:s.passwordHistorySize]
+	}
+	for _, hash := range previousHashes {
+		if s.hasher.Compare(newPassword, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// updatedHistory returns the history after changing the password: the current hash becomes the most recent entry
+func (s *AuthServiceImpl) updatedHistory(user models.UserModel) []string {
+	keep := s.passwordHistorySize - 1
+	if keep <= 0 {
+		return nil
+	}
+	history := append([]string{user.StoredPass}, user.PasswordHistory...)
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	return history
+}
+
+func (s *AuthServiceImpl) checkPassword(password string) error {
+	if len(password) > MaxPasswordLength {
+		return client_errors.PasswordTooLongError
+	}
+	for _, check := range s.passwordChecks {
+		if err := check(password); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 const ValidUsernameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_0123456789"
 const MaxUsernameLength = 20
 
-func checkUsernameValidity(username string) bool {
+// MaxPasswordLength limits the amount of work done for hashing a single password.
+// Keep it in sync with client_errors.PasswordTooLongError.
+const MaxPasswordLength = 1024
+
+// CheckUsernameValidity is exported, so that imported users are validated the same way as registered ones
+func CheckUsernameValidity(username string) bool {
 	if len(username) > MaxUsernameLength || username == "" {
 		return false
 	}
@@ -95,8 +293,14 @@ func checkUsernameValidity(username string) bool {
 	return true
 }
 
-func generateToken() entities.Token {
-	// this actually never returns an error
-	token, _ := uuid.NewUUID()
-	return entities.Token{Token: token.String()}
+// tokenBytes is the number of random bytes of a token, so that tokens can't be guessed or predicted from each other
+const tokenBytes = 32
+
+// GenerateToken returns a new token of random bytes from crypto/rand, encoded with unpadded URL-safe base64
+func GenerateToken() (entities.Token, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return entities.Token{}, fmt.Errorf("error generating a token: %w", err)
+	}
+	return entities.Token{Token: base64.RawURLEncoding.EncodeToString(b)}, nil
 }
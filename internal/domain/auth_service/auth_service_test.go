@@ -1,7 +1,10 @@
 package auth_service_test
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/k0marov/golang-auth/internal/core/client_errors"
@@ -19,6 +22,19 @@ var dummyHasher = &StubHasher{}
 var panickingRegisterHandler = func(entities.User) { panic("The register handler shouldn't have been called here") }
 var silentRegisterHandler = func(entities.User) {}
 
+func TestGenerateToken(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		token, err := auth_service.GenerateToken()
+		AssertNoError(t, err)
+		decoded, err := base64.RawURLEncoding.DecodeString(token.Token)
+		AssertNoError(t, err)
+		Assert(t, len(decoded), 32, "number of random bytes")
+		Assert(t, seen[token.Token], false, "token was generated before")
+		seen[token.Token] = true
+	}
+}
+
 func TestAuthService_Register(t *testing.T) {
 	t.Run("should check if user with provided username already exists in the store", func(t *testing.T) {
 		// arrange
@@ -47,6 +63,19 @@ func TestAuthService_Register(t *testing.T) {
 			})
 			AssertError(t, err, client_errors.UsernameAlreadyTakenError)
 		})
+		t.Run("error case (username taken by a concurrent registration)", func(t *testing.T) {
+			store := &StubAuthStore{
+				createUser: func(string, string, entities.Token) (models.UserModel, error) {
+					return models.UserModel{}, fmt.Errorf("wrapped: %w", auth_store_contract.UsernameTakenErr)
+				},
+			}
+			service := auth_service.NewAuthServiceImpl(store, dummyHasher, panickingRegisterHandler)
+			_, err := service.Register(values.AuthData{
+				Username: newUsername,
+				Password: RandomString(),
+			})
+			AssertError(t, err, client_errors.UsernameAlreadyTakenError)
+		})
 
 	})
 	t.Run("should check if username is valid (contains proper characters)", func(t *testing.T) {
@@ -87,6 +116,45 @@ func TestAuthService_Register(t *testing.T) {
 			})
 		}
 	})
+	t.Run("should reject too long passwords", func(t *testing.T) {
+		service := auth_service.NewAuthServiceImpl(dummyStore, dummyHasher, silentRegisterHandler)
+		_, err := service.Register(values.AuthData{Username: RandomString(), Password: strings.Repeat("a", auth_service.MaxPasswordLength)})
+		AssertNoError(t, err)
+		_, err = service.Register(values.AuthData{Username: RandomString(), Password: strings.Repeat("a", auth_service.MaxPasswordLength+1)})
+		AssertError(t, err, client_errors.PasswordTooLongError)
+	})
+	t.Run("should run the password checks", func(t *testing.T) {
+		rejectedPass := RandomString()
+		checkCalls := []string{}
+		check := func(pass string) error {
+			checkCalls = append(checkCalls, pass)
+			if pass == rejectedPass {
+				return client_errors.PasswordBreachedError
+			}
+			return nil
+		}
+		t.Run("happy case", func(t *testing.T) {
+			checkCalls = []string{}
+			service := auth_service.NewAuthServiceImpl(dummyStore, dummyHasher, silentRegisterHandler, auth_service.WithPasswordChecks(check, check))
+			pass := RandomString() + "ok"
+			_, err := service.Register(values.AuthData{Username: RandomString(), Password: pass})
+			AssertNoError(t, err)
+			Assert(t, checkCalls, []string{pass, pass}, "calls to password checks")
+		})
+		t.Run("error case (password rejected)", func(t *testing.T) {
+			createCalls := 0
+			store := &StubAuthStore{
+				createUser: func(string, string, entities.Token) (models.UserModel, error) {
+					createCalls++
+					return models.UserModel{}, nil
+				},
+			}
+			service := auth_service.NewAuthServiceImpl(store, dummyHasher, panickingRegisterHandler, auth_service.WithPasswordChecks(check))
+			_, err := service.Register(values.AuthData{Username: RandomString(), Password: rejectedPass})
+			AssertError(t, err, client_errors.PasswordBreachedError)
+			Assert(t, createCalls, 0, "no users should be created")
+		})
+	})
 	t.Run("should create a new user in the store (with password hashed second time), trigger the onNewRegister() and return the right token if all checks have passed", func(t *testing.T) {
 		type createArgs struct {
 			username string
@@ -95,11 +163,11 @@ func TestAuthService_Register(t *testing.T) {
 		}
 		t.Run("happy case", func(t *testing.T) {
 			createdUserModel := GenerateRandomUserModel()
-			createdUser := mappers.ModelToUser(createdUserModel)
 			createCalledWith := []createArgs{}
 			store := &StubAuthStore{
 				createUser: func(username string, password string, token entities.Token) (models.UserModel, error) {
 					createCalledWith = append(createCalledWith, createArgs{username, password, token})
+					createdUserModel.Username, createdUserModel.StoredPass, createdUserModel.AuthToken = username, password, token
 					return createdUserModel, nil
 				},
 			}
@@ -122,7 +190,8 @@ func TestAuthService_Register(t *testing.T) {
 			AssertFatal(t, len(createCalledWith), 1, "number of times CreateUser was called")
 			Assert(t, createCalledWith[0], createArgs{rightUsername, rightHashedPass, token}, "CreateUser args")
 
-			Assert(t, onNewRegisterCalls, []entities.User{createdUser}, "calls to register handler")
+			Assert(t, token, createdUserModel.AuthToken, "the returned token is the one of the created user")
+			Assert(t, onNewRegisterCalls, []entities.User{mappers.ModelToUser(createdUserModel)}, "calls to register handler")
 		})
 		t.Run("hasher returns an error (do not create new user)", func(t *testing.T) {
 			createCalls := 0
@@ -250,12 +319,238 @@ func TestAuthService_Login(t *testing.T) {
 		AssertNoError(t, err)
 		Assert(t, token, hisToken, "the returned token")
 	})
+	t.Run("should add a new token if the stored one was revoked (e.g. after logout)", func(t *testing.T) {
+		loggedOut := models.UserModel{Username: existingUsername, StoredPass: hisPassHashed}
+		store := &StubTokenAddingStore{StubAuthStore: StubAuthStore{
+			findUser: func(string) (models.UserModel, error) { return loggedOut, nil },
+		}}
+		service := auth_service.NewAuthServiceImpl(store, dummyHasher, panickingRegisterHandler)
+
+		token, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+		AssertNoError(t, err)
+		Assert(t, token.Token != "", true, "the returned token is not empty")
+		Assert(t, store.added, []entities.Token{token}, "tokens added to the store")
+
+		t.Run("should return store errors", func(t *testing.T) {
+			store.err = errors.New(RandomString())
+			_, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+			Assert(t, errors.Is(err, store.err), true, "error is the store error")
+		})
+		t.Run("should fail if the store can't add tokens", func(t *testing.T) {
+			service := auth_service.NewAuthServiceImpl(&store.StubAuthStore, dummyHasher, panickingRegisterHandler)
+			_, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+			AssertSomeError(t, err)
+		})
+	})
+	t.Run("should return a token from the token issuer if it is provided", func(t *testing.T) {
+		issued := entities.Token{Token: RandomString()}
+		issuer := &StubTokenIssuer{token: issued}
+		service := auth_service.NewAuthServiceImpl(store, dummyHasher, panickingRegisterHandler, auth_service.WithTokenIssuer(issuer))
+
+		token, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+		AssertNoError(t, err)
+		Assert(t, token, issued, "the returned token")
+		Assert(t, issuer.issuedFor, []string{existingUsername}, "users the tokens were issued for")
+
+		t.Run("should return issuer errors", func(t *testing.T) {
+			issuer.err = errors.New(RandomString())
+			_, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+			Assert(t, errors.Is(err, issuer.err), true, "error is the issuer error")
+		})
+	})
+	t.Run("should rehash the password if hasher says the stored hash is outdated", func(t *testing.T) {
+		newHash := RandomString()
+		makeStore := func(replaceCalls *[][3]string, replaceErr error) *StubHashReplacingStore {
+			return &StubHashReplacingStore{
+				StubAuthStore: StubAuthStore{findUser: store.findUser},
+				replaceHash: func(username, oldHash, newHash string) (bool, error) {
+					*replaceCalls = append(*replaceCalls, [3]string{username, oldHash, newHash})
+					return replaceErr == nil, replaceErr
+				},
+			}
+		}
+		makeHasher := func(needsRehash bool) StubHasher {
+			return StubHasher{
+				hash: func(pass string) (string, error) {
+					if pass == hisPass {
+						return newHash, nil
+					}
+					panic("called with unexpected arguments")
+				},
+				needsRehash: func(hashedPass string) bool {
+					Assert(t, hashedPass, hisPassHashed, "hash checked for rehashing")
+					return needsRehash
+				},
+			}
+		}
+		login := func(store auth_store_contract.AuthStore, hasher StubHasher) (entities.Token, error) {
+			service := auth_service.NewAuthServiceImpl(store, hasher, panickingRegisterHandler)
+			return service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+		}
+		t.Run("hash is outdated", func(t *testing.T) {
+			replaceCalls := [][3]string{}
+			token, err := login(makeStore(&replaceCalls, nil), makeHasher(true))
+			AssertNoError(t, err)
+			Assert(t, token, hisToken, "the returned token")
+			Assert(t, replaceCalls, [][3]string{{existingUsername, hisPassHashed, newHash}}, "calls to ReplaceHash")
+		})
+		t.Run("hash is up to date", func(t *testing.T) {
+			replaceCalls := [][3]string{}
+			_, err := login(makeStore(&replaceCalls, nil), makeHasher(false))
+			AssertNoError(t, err)
+			Assert(t, len(replaceCalls), 0, "number of calls to ReplaceHash")
+		})
+		t.Run("store returns an error while replacing (login should still succeed)", func(t *testing.T) {
+			replaceCalls := [][3]string{}
+			token, err := login(makeStore(&replaceCalls, errors.New(RandomString())), makeHasher(true))
+			AssertNoError(t, err)
+			Assert(t, token, hisToken, "the returned token")
+		})
+		t.Run("store can't replace hashes conditionally (the hash is left as is)", func(t *testing.T) {
+			store := &StubAuthStore{
+				findUser: store.findUser,
+				updatePassword: func(string, string, []string) error {
+					panic("the hash shouldn't be overwritten unconditionally")
+				},
+			}
+			token, err := login(store, makeHasher(true))
+			AssertNoError(t, err)
+			Assert(t, token, hisToken, "the returned token")
+		})
+		t.Run("should not revert a password change made while rehashing", func(t *testing.T) {
+			newPass := RandomString() + "new"
+			users := &MapHashReplacingStore{users: map[string]models.UserModel{
+				existingUsername: {Username: existingUsername, StoredPass: "v1:" + hisPass, AuthToken: hisToken},
+			}}
+			var service *auth_service.AuthServiceImpl
+			changed := false
+			hasher := StubHasher{
+				hash: func(pass string) (string, error) {
+					// the password is changed by another request while the login is computing the new hash
+					if pass == hisPass && !changed {
+						changed = true
+						_, err := service.ChangePassword(values.ChangePasswordData{Username: existingUsername, Password: hisPass, NewPassword: newPass})
+						AssertNoError(t, err)
+					}
+					return "v2:" + pass, nil
+				},
+				compare:     func(pass, hashedPass string) bool { return hashedPass == "v1:"+pass || hashedPass == "v2:"+pass },
+				needsRehash: func(hashedPass string) bool { return strings.HasPrefix(hashedPass, "v1:") },
+			}
+			service = auth_service.NewAuthServiceImpl(users, hasher, panickingRegisterHandler)
+
+			_, err := service.Login(values.AuthData{Username: existingUsername, Password: hisPass})
+			AssertNoError(t, err)
+			Assert(t, changed, true, "the password was changed during the login")
+			Assert(t, users.users[existingUsername].StoredPass, "v2:"+newPass, "stored hash after the login")
+		})
+	})
+}
+
+func TestAuthService_ChangePassword(t *testing.T) {
+	username := RandomString()
+	currentPass := RandomString()
+	token := entities.Token{Token: RandomString()}
+	// the stub hasher "hashes" by prepending "hashed:"
+	hasher := StubHasher{
+		hash:    func(pass string) (string, error) { return "hashed:" + pass, nil },
+		compare: func(pass, hashedPass string) bool { return "hashed:"+pass == hashedPass },
+	}
+	oldPasses := []string{RandomString() + "1", RandomString() + "2", RandomString() + "3"}
+	storedUser := models.UserModel{
+		Username:        username,
+		StoredPass:      "hashed:" + currentPass,
+		AuthToken:       token,
+		PasswordHistory: []string{"hashed:" + oldPasses[0], "hashed:" + oldPasses[1], "hashed:" + oldPasses[2]},
+	}
+	type updateArgs struct {
+		username, storedPass string
+		history              []string
+	}
+	newStore := func(updateCalls *[]updateArgs) *StubAuthStore {
+		return &StubAuthStore{
+			findUser: func(name string) (models.UserModel, error) {
+				if name == username {
+					return storedUser, nil
+				}
+				return models.UserModel{}, auth_store_contract.UserNotFoundErr
+			},
+			updatePassword: func(username, storedPass string, history []string) error {
+				*updateCalls = append(*updateCalls, updateArgs{username, storedPass, history})
+				return nil
+			},
+		}
+	}
+	changePassword := func(service *auth_service.AuthServiceImpl, password, newPassword string) (entities.Token, error) {
+		return service.ChangePassword(values.ChangePasswordData{Username: username, Password: password, NewPassword: newPassword})
+	}
+
+	t.Run("happy case", func(t *testing.T) {
+		updateCalls := []updateArgs{}
+		service := auth_service.NewAuthServiceImpl(newStore(&updateCalls), hasher, panickingRegisterHandler, auth_service.WithPasswordHistory(3))
+		newPass := RandomString() + "new"
+		gotToken, err := changePassword(service, currentPass, newPass)
+		AssertNoError(t, err)
+		Assert(t, gotToken, token, "returned token")
+		wantHistory := []string{"hashed:" + currentPass, "hashed:" + oldPasses[0]}
+		Assert(t, updateCalls, []updateArgs{{username, "hashed:" + newPass, wantHistory}}, "calls to UpdatePassword")
+	})
+	t.Run("should check the current credentials", func(t *testing.T) {
+		service := auth_service.NewAuthServiceImpl(newStore(&[]updateArgs{}), hasher, panickingRegisterHandler)
+		_, err := changePassword(service, "wrong", RandomString())
+		AssertError(t, err, client_errors.InvalidCredentialsError)
+		_, err = service.ChangePassword(values.ChangePasswordData{Username: RandomString(), Password: currentPass, NewPassword: RandomString()})
+		AssertError(t, err, client_errors.InvalidCredentialsError)
+	})
+	t.Run("should reject the last historySize passwords", func(t *testing.T) {
+		cases := []struct {
+			historySize int
+			newPass     string
+			reused      bool
+		}{
+			{3, currentPass, true},
+			{3, oldPasses[0], true},
+			{3, oldPasses[1], true},
+			{3, oldPasses[2], false},
+			{1, currentPass, true},
+			{1, oldPasses[0], false},
+			{0, currentPass, false},
+		}
+		for _, c := range cases {
+			updateCalls := []updateArgs{}
+			service := auth_service.NewAuthServiceImpl(newStore(&updateCalls), hasher, panickingRegisterHandler, auth_service.WithPasswordHistory(c.historySize))
+			_, err := changePassword(service, currentPass, c.newPass)
+			if c.reused {
+				AssertError(t, err, client_errors.PasswordReusedError)
+				Assert(t, len(updateCalls), 0, "number of calls to UpdatePassword")
+			} else {
+				AssertNoError(t, err)
+				Assert(t, len(updateCalls), 1, "number of calls to UpdatePassword")
+			}
+		}
+	})
+	t.Run("should run the password checks", func(t *testing.T) {
+		check := func(string) error { return client_errors.PasswordBreachedError }
+		service := auth_service.NewAuthServiceImpl(newStore(&[]updateArgs{}), hasher, panickingRegisterHandler, auth_service.WithPasswordChecks(check))
+		_, err := changePassword(service, currentPass, RandomString())
+		AssertError(t, err, client_errors.PasswordBreachedError)
+	})
+	t.Run("ResetPassword() should not require the current password", func(t *testing.T) {
+		updateCalls := []updateArgs{}
+		service := auth_service.NewAuthServiceImpl(newStore(&updateCalls), hasher, panickingRegisterHandler, auth_service.WithPasswordHistory(2))
+		AssertError(t, service.ResetPassword(username, oldPasses[0]), client_errors.PasswordReusedError)
+		newPass := RandomString() + "new"
+		AssertNoError(t, service.ResetPassword(username, newPass))
+		Assert(t, updateCalls, []updateArgs{{username, "hashed:" + newPass, []string{"hashed:" + currentPass}}}, "calls to UpdatePassword")
+		AssertError(t, service.ResetPassword(RandomString(), newPass), auth_store_contract.UserNotFoundErr)
+	})
 }
 
 type StubAuthStore struct {
-	userExists func(string) bool
-	createUser func(string, string, entities.Token) (models.UserModel, error)
-	findUser   func(string) (models.UserModel, error)
+	userExists     func(string) bool
+	createUser     func(string, string, entities.Token) (models.UserModel, error)
+	findUser       func(string) (models.UserModel, error)
+	updatePassword func(string, string, []string) error
 }
 
 func (s *StubAuthStore) UserExists(username string) bool {
@@ -269,7 +564,7 @@ func (s *StubAuthStore) CreateUser(username string, hashedPassword string, token
 	if s.createUser != nil {
 		return s.createUser(username, hashedPassword, token)
 	}
-	return models.UserModel{}, nil
+	return models.UserModel{Username: username, StoredPass: hashedPassword, AuthToken: token}, nil
 }
 
 func (s *StubAuthStore) FindUser(username string) (models.UserModel, error) {
@@ -279,10 +574,88 @@ func (s *StubAuthStore) FindUser(username string) (models.UserModel, error) {
 	return models.UserModel{}, auth_store_contract.UserNotFoundErr
 }
 
+func (s *StubAuthStore) UpdatePassword(username, storedPassword string, passwordHistory []string) error {
+	if s.updatePassword != nil {
+		return s.updatePassword(username, storedPassword, passwordHistory)
+	}
+	return nil
+}
+
+type StubHashReplacingStore struct {
+	StubAuthStore
+	replaceHash func(string, string, string) (bool, error)
+}
+
+func (s *StubHashReplacingStore) ReplaceHash(username, oldHash, newHash string) (bool, error) {
+	return s.replaceHash(username, oldHash, newHash)
+}
+
+// MapHashReplacingStore keeps users in a map, so that the interleaving of writes can be observed
+type MapHashReplacingStore struct {
+	users map[string]models.UserModel
+}
+
+func (s *MapHashReplacingStore) UserExists(username string) bool {
+	_, ok := s.users[username]
+	return ok
+}
+
+func (s *MapHashReplacingStore) CreateUser(username string, hashedPassword string, token entities.Token) (models.UserModel, error) {
+	user := models.UserModel{Username: username, StoredPass: hashedPassword, AuthToken: token}
+	s.users[username] = user
+	return user, nil
+}
+
+func (s *MapHashReplacingStore) FindUser(username string) (models.UserModel, error) {
+	user, ok := s.users[username]
+	if !ok {
+		return models.UserModel{}, auth_store_contract.UserNotFoundErr
+	}
+	return user, nil
+}
+
+func (s *MapHashReplacingStore) UpdatePassword(username, storedPassword string, passwordHistory []string) error {
+	user, ok := s.users[username]
+	if !ok {
+		return auth_store_contract.UserNotFoundErr
+	}
+	user.StoredPass, user.PasswordHistory = storedPassword, passwordHistory
+	s.users[username] = user
+	return nil
+}
+
+func (s *MapHashReplacingStore) ReplaceHash(username, oldHash, newHash string) (bool, error) {
+	user, ok := s.users[username]
+	if !ok {
+		return false, auth_store_contract.UserNotFoundErr
+	}
+	if user.StoredPass != oldHash {
+		return false, nil
+	}
+	user.StoredPass = newHash
+	s.users[username] = user
+	return true, nil
+}
+
+type StubTokenAddingStore struct {
+	StubAuthStore
+	added []entities.Token
+	err   error
+}
+
+func (s *StubTokenAddingStore) AddToken(username string, token entities.Token) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.added = append(s.added, token)
+	return nil
+}
+
 type StubHasher struct {
-	isHashed func(string) bool
-	hash     func(string) (string, error)
-	compare  func(string, string) bool
+	isHashed    func(string) bool
+	hash        func(string) (string, error)
+	compare     func(string, string) bool
+	needsRehash func(string) bool
 }
 
 func (s StubHasher) IsHashed(pass string) bool {
@@ -303,3 +676,23 @@ func (s StubHasher) Compare(pass, hashedPass string) bool {
 	}
 	return s.compare(pass, hashedPass)
 }
+func (s StubHasher) NeedsRehash(hashedPass string) bool {
+	if s.needsRehash == nil {
+		return false
+	}
+	return s.needsRehash(hashedPass)
+}
+
+type StubTokenIssuer struct {
+	token     entities.Token
+	err       error
+	issuedFor []string
+}
+
+func (s *StubTokenIssuer) IssueToken(user models.UserModel) (entities.Token, error) {
+	s.issuedFor = append(s.issuedFor, user.Username)
+	if s.err != nil {
+		return entities.Token{}, s.err
+	}
+	return s.token, nil
+}
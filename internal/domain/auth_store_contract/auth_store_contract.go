@@ -11,6 +11,53 @@ type AuthStore interface {
 	UserExists(username string) bool
 	CreateUser(username string, storedPassword string, token entities.Token) (models.UserModel, error)
 	FindUser(username string) (models.UserModel, error)
+	// passwordHistory holds hashes of the previous passwords, the most recent first
+	UpdatePassword(username string, storedPassword string, passwordHistory []string) error
+}
+
+// UserLister is implemented by stores, which can enumerate their users (e.g. for exporting them)
+type UserLister interface {
+	// ForEachUser calls fn for every user in the order of ids, stopping at the first error returned by fn
+	ForEachUser(fn func(models.UserModel) error) error
+}
+
+// UserByIdFinder is implemented by stores, which can find users by the ids exposed to clients (see mappers.ExposedId)
+type UserByIdFinder interface {
+	// FindUserById resolves both public ids and legacy integer ids, it returns UserNotFoundErr for unknown ids
+	FindUserById(id string) (models.UserModel, error)
+}
+
+// TokenAdder is implemented by stores, whose tokens can be revoked (e.g. on logout),
+// so that a user without a token gets a new one on the next login
+type TokenAdder interface {
+	// AddToken sets a new auth token for the user
+	AddToken(username string, token entities.Token) error
+}
+
+// HashReplacer is implemented by stores, which can replace the stored hash of a password only if it hasn't changed since it was read,
+// so that rehashing it on login (see auth_service.Login) can't revert a password change made in the meantime
+type HashReplacer interface {
+	// ReplaceHash sets newHash if the stored hash of the user still equals oldHash, keeping the password history.
+	// It reports whether the hash was replaced, and returns UserNotFoundErr for unknown usernames.
+	ReplaceHash(username, oldHash, newHash string) (bool, error)
+}
+
+// PublicIdSetter is implemented by stores, which keep public ids (see the user_ids package),
+// it is used for giving public ids to existing users and for keeping them when users are moved between stores
+type PublicIdSetter interface {
+	// SetPublicId replaces the public and the legacy id of the user (empty and zero mean none),
+	// it returns PublicIdTakenErr if another user is already resolvable by one of them
+	SetPublicId(username string, publicId string, legacyId int) error
 }
 
 var UserNotFoundErr = errors.New("User not found")
+
+// UsernameTakenErr is returned by CreateUser if a user with this username already exists.
+// Stores check it atomically with creating the user, so concurrent registrations of the same name can't both succeed.
+var UsernameTakenErr = errors.New("username is already taken")
+
+// TokenTakenErr is returned by CreateUser if another user already has this token
+var TokenTakenErr = errors.New("token is already taken")
+
+// PublicIdTakenErr is returned by SetPublicId if another user already has the public id or the legacy id
+var PublicIdTakenErr = errors.New("public id is already taken")
@@ -0,0 +1,72 @@
+// Package id_migration gives public ids (see the user_ids package) to users, which were created before public ids were enabled.
+// The integer ids, with which they were exposed so far, stay resolvable as their legacy ids,
+// so that references kept by other services don't break.
+package id_migration
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+)
+
+type Store interface {
+	auth_store_contract.UserLister
+	auth_store_contract.PublicIdSetter
+}
+
+// maxAttempts bounds the retries after generating a taken public id
+const maxAttempts = 3
+
+// AssignPublicIds gives a public id generated by the strategy to every user without one, and returns how many users got it.
+// It can be run while the store is in use, and running it again after an interruption resumes it.
+// onProgress (if not nil) is called with the number of users processed so far after each user.
+func AssignPublicIds(store Store, strategy user_ids.Strategy, onProgress func(processed int)) (int, error) {
+	// the users are collected first, since some stores can't be written to while listing them
+	var pending []models.UserModel
+	err := store.ForEachUser(func(user models.UserModel) error {
+		if user.PublicId == "" {
+			pending = append(pending, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error listing users: %w", err)
+	}
+
+	assigned := 0
+	for i, user := range pending {
+		err := assign(store, strategy, user)
+		switch {
+		case errors.Is(err, auth_store_contract.UserNotFoundErr):
+			// deleted after listing
+		case err != nil:
+			return assigned, fmt.Errorf("error assigning a public id to user %s: %w", user.Username, err)
+		default:
+			assigned++
+		}
+		if onProgress != nil {
+			onProgress(i + 1)
+		}
+	}
+	return assigned, nil
+}
+
+func assign(store Store, strategy user_ids.Strategy, user models.UserModel) error {
+	legacyId := user.LegacyId
+	if legacyId == 0 {
+		legacyId = user.Id
+	}
+	for attempt := 1; ; attempt++ {
+		publicId, err := strategy()
+		if err != nil {
+			return err
+		}
+		err = store.SetPublicId(user.Username, publicId, legacyId)
+		if !errors.Is(err, auth_store_contract.PublicIdTakenErr) || attempt == maxAttempts {
+			return err
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package id_migration_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/id_migration"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestAssignPublicIds(t *testing.T) {
+	newStore := func() *stubStore {
+		users := GenerateRandomUserModels(4)
+		for i := range users {
+			users[i].Id = i + 1
+		}
+		// already migrated
+		users[1].PublicId, users[1].LegacyId = RandomString(), users[1].Id
+		// imported from another store, where it had another id
+		users[2].LegacyId = 42
+		return &stubStore{users: users}
+	}
+	strategy := func() (string, error) {
+		return RandomString() + RandomString(), nil
+	}
+
+	t.Run("should give public ids to users without them, keeping their exposed ids as legacy ids", func(t *testing.T) {
+		store := newStore()
+		migrated := store.users[1]
+		var progress []int
+		assigned, err := id_migration.AssignPublicIds(store, strategy, func(n int) { progress = append(progress, n) })
+		AssertNoError(t, err)
+		Assert(t, assigned, 3, "number of assigned ids")
+		Assert(t, progress, []int{1, 2, 3}, "progress")
+		Assert(t, store.users[1], migrated, "already migrated user")
+		for i, wantLegacyId := range []int{1, 2, 42, 4} {
+			Assert(t, store.users[i].PublicId != "", true, "the user has a public id")
+			Assert(t, store.users[i].LegacyId, wantLegacyId, "legacy id")
+		}
+
+		assigned, err = id_migration.AssignPublicIds(store, strategy, nil)
+		AssertNoError(t, err)
+		Assert(t, assigned, 0, "number of ids assigned by the second run")
+	})
+	t.Run("should retry with a new id if the generated one is taken", func(t *testing.T) {
+		store := newStore()
+		taken := store.users[1].PublicId
+		calls := 0
+		_, err := id_migration.AssignPublicIds(store, func() (string, error) {
+			calls++
+			if calls == 1 {
+				return taken, nil
+			}
+			return strategy()
+		}, nil)
+		AssertNoError(t, err)
+		Assert(t, store.users[0].PublicId != taken && store.users[0].PublicId != "", true, "the user got a free public id")
+	})
+	t.Run("should skip users deleted while running", func(t *testing.T) {
+		store := newStore()
+		store.deleteOnSet = store.users[0].Username
+		assigned, err := id_migration.AssignPublicIds(store, strategy, nil)
+		AssertNoError(t, err)
+		Assert(t, assigned, 2, "number of assigned ids")
+	})
+	t.Run("should forward errors", func(t *testing.T) {
+		store := newStore()
+		strategyErr := errors.New(RandomString())
+		_, err := id_migration.AssignPublicIds(store, func() (string, error) { return "", strategyErr }, nil)
+		Assert(t, errors.Is(err, strategyErr), true, "error is the strategy error")
+
+		store.listErr = errors.New(RandomString())
+		_, err = id_migration.AssignPublicIds(store, strategy, nil)
+		Assert(t, errors.Is(err, store.listErr), true, "error is the listing error")
+	})
+}
+
+type stubStore struct {
+	users       []models.UserModel
+	listErr     error
+	deleteOnSet string
+}
+
+func (s *stubStore) ForEachUser(fn func(models.UserModel) error) error {
+	if s.listErr != nil {
+		return s.listErr
+	}
+	for _, user := range s.users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stubStore) SetPublicId(username, publicId string, legacyId int) error {
+	if username == s.deleteOnSet {
+		return auth_store_contract.UserNotFoundErr
+	}
+	for _, user := range s.users {
+		if user.Username != username && user.PublicId == publicId {
+			return auth_store_contract.PublicIdTakenErr
+		}
+	}
+	for i := range s.users {
+		if s.users[i].Username == username {
+			s.users[i].PublicId, s.users[i].LegacyId = publicId, legacyId
+			return nil
+		}
+	}
+	return auth_store_contract.UserNotFoundErr
+}
@@ -1,15 +1,27 @@
 package mappers
 
 import (
-	"strconv"
-
+	"github.com/k0marov/golang-auth/internal/core/user_ids"
 	"github.com/k0marov/golang-auth/internal/data/models"
 	"github.com/k0marov/golang-auth/internal/domain/entities"
 )
 
 func ModelToUser(model models.UserModel) entities.User {
 	return entities.User{
-		Id:       strconv.Itoa(model.Id),
+		Id:       ExposedId(model),
 		Username: model.Username,
 	}
 }
+
+// ExposedId returns the id of the user, which is shown to clients: its public id,
+// or the legacy integer id for users, which were created before public ids were enabled and haven't got one yet
+func ExposedId(model models.UserModel) string {
+	switch {
+	case model.PublicId != "":
+		return model.PublicId
+	case model.LegacyId != 0:
+		return user_ids.FormatLegacyId(model.LegacyId)
+	default:
+		return user_ids.FormatLegacyId(model.Id)
+	}
+}
@@ -33,6 +33,23 @@ func TestModelToUser(t *testing.T) {
 			Id:       "33",
 			Username: "Jack",
 		}},
+		{models.UserModel{
+			Id:       34,
+			Username: "Jane",
+			PublicId: "01J9ZQ4M8X3V6T2B7K5N0R1W9Y",
+			LegacyId: 34,
+		}, entities.User{
+			Id:       "01J9ZQ4M8X3V6T2B7K5N0R1W9Y",
+			Username: "Jane",
+		}},
+		{models.UserModel{
+			Id:       7,
+			Username: "Jim",
+			LegacyId: 35,
+		}, entities.User{
+			Id:       "35",
+			Username: "Jim",
+		}},
 	}
 
 	for _, c := range cases {
@@ -4,10 +4,19 @@ import (
 	"errors"
 
 	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
 )
 
 type TokenStore interface {
 	FindUserFromToken(token string) (models.UserModel, error)
 }
 
+// TokenLister is implemented by stores keeping tokens apart from the users (e.g. the Redis token store),
+// so that their tokens can be exported together with the users
+type TokenLister interface {
+	// ForEachToken calls fn for every live token with the username of its owner, in no particular order,
+	// stopping at the first error returned by fn. Tokens of deleted users are skipped.
+	ForEachToken(fn func(username string, token entities.Token) error) error
+}
+
 var TokenNotFoundErr = errors.New("token not found")
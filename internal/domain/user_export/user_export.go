@@ -0,0 +1,526 @@
+// Package user_export moves users between stores of any kind through a portable JSON document:
+//
+//	{"format": "golang-auth-export", "version": 1, "exported_at": "2006-01-02T15:04:05Z", "users": [
+//	{"id": 1, "username": "john", "password_hash": "...", "token": "...", "password_history": ["..."], "public_id": "...", "legacy_id": 1},
+//	...
+//	], "count": 1, "tokens": [
+//	{"username": "john", "token": "..."},
+//	...
+//	], "token_count": 1}
+//
+// The tokens section is written only for a separate token store (see WithTokenStore), in which a user can have several tokens;
+// readers of older versions skip it like any unknown field.
+// Users and tokens are written and read one by one, so exports of any size can be streamed.
+// The importing store assigns its own integer ids, but if it keeps public ids (see auth_store_contract.PublicIdSetter),
+// the ids exposed to clients (see mappers.ExposedId) are kept: users without a public id keep their old integer id as the legacy id.
+// Exports contain password hashes and live tokens, so they should be handled as carefully as the stores themselves.
+package user_export
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_service"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+)
+
+const (
+	Format  = "golang-auth-export"
+	Version = 1
+)
+
+// ErrInvalidExport is returned by Import and Verify if the document is malformed, truncated or has an unsupported version
+var ErrInvalidExport = errors.New("invalid export")
+
+type ExportedUser struct {
+	Id           int    `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// empty if the user is logged out
+	Token string `json:"token,omitempty"`
+	// hashes of the previous passwords, the most recent first
+	PasswordHistory []string `json:"password_history,omitempty"`
+	// see models.UserModel
+	PublicId string `json:"public_id,omitempty"`
+	LegacyId int    `json:"legacy_id,omitempty"`
+}
+
+// ExportedToken is a token of a separate token store
+type ExportedToken struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// TokenStore keeps tokens apart from the users (e.g. the Redis token store), its tokens are exported and imported if it is given with WithTokenStore
+type TokenStore interface {
+	token_store_contract.TokenStore
+	token_store_contract.TokenLister
+	auth_store_contract.TokenAdder
+}
+
+type options struct {
+	tokens TokenStore
+}
+
+type Option func(*options)
+
+// WithTokenStore makes Export write the tokens of the token store, Import add them to it and Verify check them in it.
+// The tokens kept in the users (see ExportedUser.Token) are moved regardless.
+func WithTokenStore(tokens TokenStore) Option {
+	return func(o *options) {
+		o.tokens = tokens
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type Store interface {
+	auth_store_contract.AuthStore
+	token_store_contract.TokenStore
+}
+
+// Export writes all users of the store (and the tokens of the token store, see WithTokenStore) to w and returns how many users were written.
+// onProgress (if not nil) is called with the number of users written so far after each user.
+func Export(w io.Writer, store auth_store_contract.UserLister, onProgress func(exported int), opts ...Option) (int, error) {
+	o := newOptions(opts)
+	buffered := bufio.NewWriter(w)
+	header, err := json.Marshal(time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	fmt.Fprintf(buffered, `{"format":%q,"version":%d,"exported_at":%s,"users":[`, Format, Version, header)
+
+	exported := 0
+	err = store.ForEachUser(func(user models.UserModel) error {
+		line, err := json.Marshal(ExportedUser{
+			Id:              user.Id,
+			Username:        user.Username,
+			PasswordHash:    user.StoredPass,
+			Token:           user.AuthToken.Token,
+			PasswordHistory: user.PasswordHistory,
+			PublicId:        user.PublicId,
+			LegacyId:        user.LegacyId,
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding user %s: %w", user.Username, err)
+		}
+		if exported > 0 {
+			buffered.WriteByte(',')
+		}
+		buffered.WriteByte('\n')
+		if _, err := buffered.Write(line); err != nil {
+			return fmt.Errorf("error writing the export: %w", err)
+		}
+		exported++
+		if onProgress != nil {
+			onProgress(exported)
+		}
+		return nil
+	})
+	if err != nil {
+		return exported, err
+	}
+
+	fmt.Fprintf(buffered, "\n],\"count\":%d", exported)
+	if o.tokens != nil {
+		if err := exportTokens(buffered, o.tokens); err != nil {
+			return exported, err
+		}
+	}
+	buffered.WriteString("}\n")
+	if err := buffered.Flush(); err != nil {
+		return exported, fmt.Errorf("error writing the export: %w", err)
+	}
+	return exported, nil
+}
+
+func exportTokens(w *bufio.Writer, tokens token_store_contract.TokenLister) error {
+	w.WriteString(`,"tokens":[`)
+	exported := 0
+	err := tokens.ForEachToken(func(username string, token entities.Token) error {
+		line, err := json.Marshal(ExportedToken{Username: username, Token: token.Token})
+		if err != nil {
+			return fmt.Errorf("error encoding a token of user %s: %w", username, err)
+		}
+		if exported > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteByte('\n')
+		if _, err := w.Write(line); err != nil {
+			return fmt.Errorf("error writing the export: %w", err)
+		}
+		exported++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting the tokens: %w", err)
+	}
+	fmt.Fprintf(w, "\n],\"token_count\":%d", exported)
+	return nil
+}
+
+type ImportReport struct {
+	Total    int
+	Imported int
+	// users, which are already in the store with the same password hash (e.g. imported by an interrupted run),
+	// their password histories and ids are completed like for imported users
+	AlreadyImported int
+	// usernames which are already taken in the store by users with another password hash, these users are left untouched
+	AlreadyExisting []string
+	// usernames of imported users, whose public or legacy id is taken by another user of the store, so they are exposed with a new id
+	IdConflicts []string
+
+	// the number of tokens in the tokens section of the export
+	Tokens int
+	// tokens added to the token store, or already there for the same user (e.g. added by an interrupted run)
+	ImportedTokens int
+	// tokens, which weren't imported: of users left untouched or taken by another user of the token store,
+	// or all of them if no token store was given
+	SkippedTokens int
+}
+
+// Import creates the users of an export in the store, keeping their hashes, tokens and password histories.
+// Users without a token (logged out ones) get a new token, which nobody knows, so they stay logged out.
+// The tokens of a separate token store are added to the one given with WithTokenStore, getting its full TTL.
+// Import is not atomic: if it fails midway, the users imported so far stay in the store.
+// Every step is idempotent for users already in the store with the same hash, so running it again resumes the import,
+// even if it was interrupted between creating a user and setting its password history or ids.
+// onProgress (if not nil) is called with the number of users processed so far after each user.
+func Import(r io.Reader, store auth_store_contract.AuthStore, onProgress func(processed int), opts ...Option) (ImportReport, error) {
+	o := newOptions(opts)
+	report := ImportReport{}
+	untouched := map[string]bool{}
+	onUser := func(user ExportedUser) error {
+		report.Total++
+		leftUntouched, err := importUser(store, user, &report)
+		if err != nil {
+			return err
+		}
+		if leftUntouched {
+			untouched[user.Username] = true
+		}
+		if onProgress != nil {
+			onProgress(report.Total)
+		}
+		return nil
+	}
+	onToken := func(token ExportedToken) error {
+		report.Tokens++
+		if o.tokens == nil || untouched[token.Username] {
+			report.SkippedTokens++
+			return nil
+		}
+		imported, err := importToken(o.tokens, token)
+		if err != nil {
+			return err
+		}
+		if imported {
+			report.ImportedTokens++
+		} else {
+			report.SkippedTokens++
+		}
+		return nil
+	}
+	err := readExport(r, onUser, onToken)
+	return report, err
+}
+
+// importToken adds the token to the token store, it reports false if the token is taken by another user or its user doesn't exist
+func importToken(tokens TokenStore, token ExportedToken) (bool, error) {
+	err := tokens.AddToken(token.Username, entities.Token{Token: token.Token})
+	switch {
+	case errors.Is(err, auth_store_contract.UserNotFoundErr):
+		return false, nil
+	case errors.Is(err, auth_store_contract.TokenTakenErr):
+		owner, err := tokens.FindUserFromToken(token.Token)
+		if errors.Is(err, token_store_contract.TokenNotFoundErr) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error while finding the owner of a token of user %s: %w", token.Username, err)
+		}
+		return owner.Username == token.Username, nil
+	case err != nil:
+		return false, fmt.Errorf("error while adding a token of user %s: %w", token.Username, err)
+	}
+	return true, nil
+}
+
+// importUser creates the user or completes an already imported one, it reports whether the username is taken by another user
+func importUser(store auth_store_contract.AuthStore, user ExportedUser, report *ImportReport) (leftUntouched bool, err error) {
+	token := entities.Token{Token: user.Token}
+	if token.Token == "" {
+		if token, err = auth_service.GenerateToken(); err != nil {
+			return false, err
+		}
+	}
+	stored, err := store.CreateUser(user.Username, user.PasswordHash, token)
+	switch {
+	case errors.Is(err, auth_store_contract.UsernameTakenErr):
+		stored, err = store.FindUser(user.Username)
+		if err != nil {
+			return false, fmt.Errorf("error while finding existing user %s: %w", user.Username, err)
+		}
+		if stored.StoredPass != user.PasswordHash {
+			report.AlreadyExisting = append(report.AlreadyExisting, user.Username)
+			return true, nil
+		}
+		report.AlreadyImported++
+	case err != nil:
+		return false, fmt.Errorf("error while creating user %s: %w", user.Username, err)
+	default:
+		report.Imported++
+	}
+	return false, completeUser(store, user, stored, report)
+}
+
+// completeUser sets the password history and ids of the export on the stored user, skipping the ones it already has
+func completeUser(store auth_store_contract.AuthStore, user ExportedUser, stored models.UserModel, report *ImportReport) error {
+	if !equalHistories(stored.PasswordHistory, user.PasswordHistory) {
+		if err := store.UpdatePassword(user.Username, user.PasswordHash, user.PasswordHistory); err != nil {
+			return fmt.Errorf("error while setting password history of user %s: %w", user.Username, err)
+		}
+	}
+	setter, ok := store.(auth_store_contract.PublicIdSetter)
+	if !ok || (stored.PublicId == user.PublicId && stored.LegacyId == exposedLegacyId(user)) {
+		return nil
+	}
+	err := setter.SetPublicId(user.Username, user.PublicId, exposedLegacyId(user))
+	if errors.Is(err, auth_store_contract.PublicIdTakenErr) {
+		report.IdConflicts = append(report.IdConflicts, user.Username)
+	} else if err != nil {
+		return fmt.Errorf("error while setting public id of user %s: %w", user.Username, err)
+	}
+	return nil
+}
+
+// exposedLegacyId returns the legacy id, with which the user should stay resolvable in the importing store.
+// The integer id of a user without a public id is the one exposed to clients (which is also the case for exports made before public ids were added).
+func exposedLegacyId(user ExportedUser) int {
+	if user.PublicId == "" && user.LegacyId == 0 {
+		return user.Id
+	}
+	return user.LegacyId
+}
+
+type VerifyReport struct {
+	Checked int
+	// usernames of the export, which are absent in the store
+	Missing []string
+	// usernames, whose hash, token, password history or (for stores keeping public ids) exposed id in the store differ from the export
+	Mismatched []string
+
+	// the number of tokens of a separate token store checked in the one given with WithTokenStore
+	CheckedTokens int
+	// usernames (repeated for each token), whose tokens are absent in the token store or belong to another user there
+	MissingTokens []string
+}
+
+func (r VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.MissingTokens) == 0
+}
+
+// Verify checks that every user of an export is present in the store with the same hash, token and password history,
+// and with the same public and legacy id if the store keeps them (see Import).
+// Tokens of users, which were exported logged out, aren't compared.
+// The tokens of a separate token store are checked only if a token store is given with WithTokenStore.
+func Verify(r io.Reader, store Store, opts ...Option) (VerifyReport, error) {
+	o := newOptions(opts)
+	report := VerifyReport{}
+	onToken := func(token ExportedToken) error {
+		if o.tokens == nil {
+			return nil
+		}
+		report.CheckedTokens++
+		owner, err := o.tokens.FindUserFromToken(token.Token)
+		if errors.Is(err, token_store_contract.TokenNotFoundErr) || (err == nil && owner.Username != token.Username) {
+			report.MissingTokens = append(report.MissingTokens, token.Username)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while finding the owner of a token of user %s: %w", token.Username, err)
+		}
+		return nil
+	}
+	err := readExport(r, func(user ExportedUser) error {
+		report.Checked++
+		stored, err := store.FindUser(user.Username)
+		if errors.Is(err, auth_store_contract.UserNotFoundErr) {
+			report.Missing = append(report.Missing, user.Username)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error while finding user %s: %w", user.Username, err)
+		}
+		matches, err := matchesStored(store, user, stored)
+		if err != nil {
+			return err
+		}
+		if !matches {
+			report.Mismatched = append(report.Mismatched, user.Username)
+		}
+		return nil
+	}, onToken)
+	return report, err
+}
+
+func matchesStored(store Store, user ExportedUser, stored models.UserModel) (bool, error) {
+	if stored.StoredPass != user.PasswordHash || !equalHistories(stored.PasswordHistory, user.PasswordHistory) {
+		return false, nil
+	}
+	if _, keepsIds := store.(auth_store_contract.PublicIdSetter); keepsIds {
+		if stored.PublicId != user.PublicId || stored.LegacyId != exposedLegacyId(user) {
+			return false, nil
+		}
+	}
+	if user.Token == "" {
+		return true, nil
+	}
+	if stored.AuthToken.Token != user.Token {
+		return false, nil
+	}
+	tokenOwner, err := store.FindUserFromToken(user.Token)
+	if errors.Is(err, token_store_contract.TokenNotFoundErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error while finding the owner of the token of user %s: %w", user.Username, err)
+	}
+	return tokenOwner.Username == user.Username, nil
+}
+
+func equalHistories(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readExport decodes an export token by token, calling onUser for each user and onToken for each token as soon as it is read
+func readExport(r io.Reader, onUser func(ExportedUser) error, onToken func(ExportedToken) error) error {
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	var format string
+	version, read, count := 0, 0, -1
+	readTokens, tokenCount := 0, -1
+	sawUsers, sawTokens := false, false
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+		}
+		switch key {
+		case "format":
+			err = decoder.Decode(&format)
+		case "version":
+			err = decoder.Decode(&version)
+		case "count":
+			err = decoder.Decode(&count)
+		case "token_count":
+			err = decoder.Decode(&tokenCount)
+		case "users":
+			if format != Format || version != Version {
+				return fmt.Errorf("%w: expected format %q of version %d before the users, got %q of version %d", ErrInvalidExport, Format, Version, format, version)
+			}
+			sawUsers = true
+			// errors of onUser are returned as they are, the others already wrap ErrInvalidExport
+			err := readArray(decoder, func(i int) error {
+				var user ExportedUser
+				if err := decoder.Decode(&user); err != nil {
+					return fmt.Errorf("%w: user #%d: %v", ErrInvalidExport, i+1, err)
+				}
+				if user.Username == "" || user.PasswordHash == "" {
+					return fmt.Errorf("%w: user #%d has no username or password hash", ErrInvalidExport, i+1)
+				}
+				read++
+				return onUser(user)
+			})
+			if err != nil {
+				return err
+			}
+		case "tokens":
+			// the users of the tokens should be imported before them
+			if !sawUsers {
+				return fmt.Errorf("%w: tokens before the users", ErrInvalidExport)
+			}
+			sawTokens = true
+			err := readArray(decoder, func(i int) error {
+				var token ExportedToken
+				if err := decoder.Decode(&token); err != nil {
+					return fmt.Errorf("%w: token #%d: %v", ErrInvalidExport, i+1, err)
+				}
+				if token.Username == "" || token.Token == "" {
+					return fmt.Errorf("%w: token #%d has no username or token", ErrInvalidExport, i+1)
+				}
+				readTokens++
+				return onToken(token)
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			// unknown metadata, e.g. from newer minor versions
+			err = decoder.Decode(&json.RawMessage{})
+		}
+		if err != nil {
+			return fmt.Errorf("%w: field %v: %v", ErrInvalidExport, key, err)
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return err
+	}
+	if !sawUsers {
+		return fmt.Errorf("%w: no users field", ErrInvalidExport)
+	}
+	if count != read {
+		return fmt.Errorf("%w: the export declares %d users, but has %d", ErrInvalidExport, count, read)
+	}
+	if sawTokens && tokenCount != readTokens {
+		return fmt.Errorf("%w: the export declares %d tokens, but has %d", ErrInvalidExport, tokenCount, readTokens)
+	}
+	return nil
+}
+
+// readArray calls readElement with the index of every element of a JSON array, which should decode the element
+func readArray(decoder *json.Decoder, readElement func(i int) error) error {
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for i := 0; decoder.More(); i++ {
+		if err := readElement(i); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+func expectDelim(decoder *json.Decoder, want json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	if token != want {
+		return fmt.Errorf("%w: expected %v, got %v", ErrInvalidExport, want, token)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package user_export_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/token_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/user_export"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+func TestExportImport(t *testing.T) {
+	source := newStubStore()
+	for _, user := range GenerateRandomUsers(3) {
+		source.CreateUser(user.Username, user.Password, user.Token)
+	}
+	history := []string{RandomString(), RandomString()}
+	AssertNoError(t, source.UpdatePassword(source.users[1].Username, RandomString(), history))
+	// a logged out user
+	source.users[2].AuthToken = entities.Token{}
+	// a user with a public id, and one imported from another store without it
+	source.users[0].PublicId, source.users[0].LegacyId = RandomString(), source.users[0].Id
+	source.users[2].LegacyId = 42
+
+	export := bytes.NewBuffer(nil)
+	var progress []int
+	exported, err := user_export.Export(export, source, func(n int) { progress = append(progress, n) })
+	AssertNoError(t, err)
+	Assert(t, exported, 3, "number of exported users")
+	Assert(t, progress, []int{1, 2, 3}, "progress")
+
+	t.Run("should import all users with their hashes, tokens and histories", func(t *testing.T) {
+		destination := newStubStore()
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		Assert(t, report.Total, 3, "total")
+		Assert(t, report.Imported, 3, "number of imported users")
+		AssertFatal(t, len(destination.users), 3, "number of created users")
+		for i, user := range destination.users {
+			Assert(t, user.Username, source.users[i].Username, "username")
+			Assert(t, user.StoredPass, source.users[i].StoredPass, "hash")
+			Assert(t, user.PasswordHistory, source.users[i].PasswordHistory, "history")
+		}
+		Assert(t, destination.users[0].AuthToken, source.users[0].AuthToken, "token")
+		if destination.users[2].AuthToken.Token == "" {
+			t.Error("a logged out user should get a new token")
+		}
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination)
+		AssertNoError(t, err)
+		Assert(t, verifyReport.Checked, 3, "number of verified users")
+		Assert(t, verifyReport.OK(), true, "verification result")
+
+		t.Run("importing again should skip already imported users", func(t *testing.T) {
+			report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+			AssertNoError(t, err)
+			Assert(t, report.Imported, 0, "number of imported users")
+			Assert(t, report.AlreadyImported, 3, "number of already imported users")
+			Assert(t, len(report.AlreadyExisting), 0, "number of already existing users")
+			Assert(t, len(destination.users), 3, "number of users in the store")
+		})
+	})
+	t.Run("should keep the exposed ids in stores, which keep public ids", func(t *testing.T) {
+		destination := &idKeepingStore{newStubStore()}
+		// takes the legacy id of the second user
+		destination.CreateUser(RandomString(), RandomString(), entities.Token{Token: RandomString()})
+		destination.users[0].LegacyId = 2
+
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		Assert(t, report.Imported, 3, "number of imported users")
+		Assert(t, report.IdConflicts, []string{source.users[1].Username}, "users with conflicting ids")
+		Assert(t, destination.users[1].PublicId, source.users[0].PublicId, "public id")
+		Assert(t, destination.users[1].LegacyId, source.users[0].LegacyId, "legacy id")
+		Assert(t, destination.users[3].LegacyId, 42, "legacy id of a user without a public id")
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination)
+		AssertNoError(t, err)
+		Assert(t, verifyReport.Mismatched, []string{source.users[1].Username}, "mismatched users")
+	})
+	t.Run("should resume an import interrupted after creating a user", func(t *testing.T) {
+		destination := &idKeepingStore{newStubStore()}
+		// created by the interrupted run without their histories and ids
+		for _, user := range source.users[:2] {
+			destination.CreateUser(user.Username, user.StoredPass, user.AuthToken)
+		}
+
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		Assert(t, report.Imported, 1, "number of imported users")
+		Assert(t, report.AlreadyImported, 2, "number of already imported users")
+		Assert(t, len(report.IdConflicts), 0, "number of users with conflicting ids")
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination)
+		AssertNoError(t, err)
+		Assert(t, verifyReport.OK(), true, "verification result")
+	})
+	t.Run("should leave existing users with another hash untouched", func(t *testing.T) {
+		destination := newStubStore()
+		existing, _ := destination.CreateUser(source.users[1].Username, RandomString(), entities.Token{Token: RandomString()})
+
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		Assert(t, report.Imported, 2, "number of imported users")
+		Assert(t, report.AlreadyExisting, []string{existing.Username}, "already existing users")
+		Assert(t, destination.users[0], existing, "the existing user")
+	})
+	t.Run("Verify() should report missing and mismatched users", func(t *testing.T) {
+		destination := newStubStore()
+		_, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		destination.users[0].StoredPass = RandomString()
+		destination.users = destination.users[:2]
+
+		report, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination)
+		AssertNoError(t, err)
+		Assert(t, report.Missing, []string{source.users[2].Username}, "missing users")
+		Assert(t, report.Mismatched, []string{source.users[0].Username}, "mismatched users")
+		Assert(t, report.OK(), false, "verification result")
+	})
+	t.Run("should return store errors", func(t *testing.T) {
+		destination := newStubStore()
+		destination.createErr = errors.New(RandomString())
+		_, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		Assert(t, errors.Is(err, destination.createErr), true, "error is the store error")
+	})
+	t.Run("should skip unknown fields", func(t *testing.T) {
+		withExtra := strings.Replace(export.String(), `"users":`, `"source":{"kind":"file"},"users":`, 1)
+		report, err := user_export.Import(strings.NewReader(withExtra), newStubStore(), nil)
+		AssertNoError(t, err)
+		Assert(t, report.Imported, 3, "number of imported users")
+	})
+	t.Run("should not write tokens without a token store", func(t *testing.T) {
+		Assert(t, strings.Contains(export.String(), `"tokens"`), false, "export has a tokens section")
+	})
+	t.Run("should reject invalid exports", func(t *testing.T) {
+		valid := export.String()
+		cases := map[string]string{
+			"not json":            "abracadabra",
+			"other format":        strings.Replace(valid, user_export.Format, "other", 1),
+			"unsupported version": strings.Replace(valid, `"version":1`, `"version":2`, 1),
+			"truncated":           valid[:len(valid)/2],
+			"wrong count":         strings.Replace(valid, `"count":3`, `"count":4`, 1),
+			"no users":            `{"format":"golang-auth-export","version":1,"count":0}`,
+			"users before format": `{"users":[],"format":"golang-auth-export","version":1,"count":0}`,
+			"user without hash":   `{"format":"golang-auth-export","version":1,"users":[{"username":"john"}],"count":1}`,
+			"tokens before users": `{"format":"golang-auth-export","version":1,"tokens":[],"token_count":0,"users":[],"count":0}`,
+			"wrong token count":   `{"format":"golang-auth-export","version":1,"users":[],"count":0,"tokens":[],"token_count":1}`,
+			"token without user":  `{"format":"golang-auth-export","version":1,"users":[],"count":0,"tokens":[{"token":"t"}],"token_count":1}`,
+		}
+		for name, invalid := range cases {
+			t.Run(name, func(t *testing.T) {
+				_, err := user_export.Import(strings.NewReader(invalid), newStubStore(), nil)
+				Assert(t, errors.Is(err, user_export.ErrInvalidExport), true, "error is ErrInvalidExport")
+			})
+		}
+	})
+}
+
+func TestExportImportTokens(t *testing.T) {
+	source := newStubStore()
+	for _, user := range GenerateRandomUsers(3) {
+		source.CreateUser(user.Username, user.Password, user.Token)
+	}
+	sourceTokens := newStubTokenStore(source)
+	// several tokens of one user, and one of another
+	for _, user := range []models.UserModel{source.users[0], source.users[0], source.users[1]} {
+		AssertNoError(t, sourceTokens.AddToken(user.Username, entities.Token{Token: RandomString()}))
+	}
+	export := bytes.NewBuffer(nil)
+	_, err := user_export.Export(export, source, nil, user_export.WithTokenStore(sourceTokens))
+	AssertNoError(t, err)
+
+	t.Run("should import and verify the tokens of the token store", func(t *testing.T) {
+		destination := newStubStore()
+		destinationTokens := newStubTokenStore(destination)
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil, user_export.WithTokenStore(destinationTokens))
+		AssertNoError(t, err)
+		Assert(t, report.Tokens, 3, "number of tokens")
+		Assert(t, report.ImportedTokens, 3, "number of imported tokens")
+		Assert(t, destinationTokens.owners, sourceTokens.owners, "tokens in the token store")
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination, user_export.WithTokenStore(destinationTokens))
+		AssertNoError(t, err)
+		Assert(t, verifyReport.CheckedTokens, 3, "number of checked tokens")
+		Assert(t, verifyReport.OK(), true, "verification result")
+
+		t.Run("importing again should count the tokens as imported", func(t *testing.T) {
+			report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil, user_export.WithTokenStore(destinationTokens))
+			AssertNoError(t, err)
+			Assert(t, report.ImportedTokens, 3, "number of imported tokens")
+			Assert(t, report.SkippedTokens, 0, "number of skipped tokens")
+		})
+	})
+	t.Run("should skip tokens of users left untouched and tokens taken by other users", func(t *testing.T) {
+		destination := newStubStore()
+		destinationTokens := newStubTokenStore(destination)
+		destination.CreateUser(source.users[1].Username, RandomString(), entities.Token{Token: RandomString()})
+		other, _ := destination.CreateUser(RandomString(), RandomString(), entities.Token{Token: RandomString()})
+		var takenToken string
+		for token, username := range sourceTokens.owners {
+			if username == source.users[0].Username {
+				takenToken = token
+				break
+			}
+		}
+		AssertNoError(t, destinationTokens.AddToken(other.Username, entities.Token{Token: takenToken}))
+
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil, user_export.WithTokenStore(destinationTokens))
+		AssertNoError(t, err)
+		Assert(t, report.ImportedTokens, 1, "number of imported tokens")
+		Assert(t, report.SkippedTokens, 2, "number of skipped tokens")
+		Assert(t, destinationTokens.owners[takenToken], other.Username, "owner of the taken token")
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination, user_export.WithTokenStore(destinationTokens))
+		AssertNoError(t, err)
+		Assert(t, len(verifyReport.MissingTokens), 2, "number of missing tokens")
+		Assert(t, verifyReport.OK(), false, "verification result")
+	})
+	t.Run("should skip the tokens without a token store", func(t *testing.T) {
+		destination := newStubStore()
+		report, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil)
+		AssertNoError(t, err)
+		Assert(t, report.Imported, 3, "number of imported users")
+		Assert(t, report.SkippedTokens, 3, "number of skipped tokens")
+
+		verifyReport, err := user_export.Verify(bytes.NewReader(export.Bytes()), destination)
+		AssertNoError(t, err)
+		Assert(t, verifyReport.CheckedTokens, 0, "number of checked tokens")
+		Assert(t, verifyReport.OK(), true, "verification result")
+	})
+	t.Run("should return errors of the token store", func(t *testing.T) {
+		destination := newStubStore()
+		destinationTokens := newStubTokenStore(destination)
+		destinationTokens.err = errors.New(RandomString())
+		_, err := user_export.Import(bytes.NewReader(export.Bytes()), destination, nil, user_export.WithTokenStore(destinationTokens))
+		Assert(t, errors.Is(err, destinationTokens.err), true, "import error is the token store error")
+		_, err = user_export.Export(bytes.NewBuffer(nil), source, nil, user_export.WithTokenStore(destinationTokens))
+		Assert(t, errors.Is(err, destinationTokens.err), true, "export error is the token store error")
+	})
+}
+
+// stubTokenStore keeps several tokens per user apart from the users
+type stubTokenStore struct {
+	users  *stubStore
+	owners map[string]string
+	err    error
+}
+
+func newStubTokenStore(users *stubStore) *stubTokenStore {
+	return &stubTokenStore{users: users, owners: map[string]string{}}
+}
+
+func (s *stubTokenStore) FindUserFromToken(token string) (models.UserModel, error) {
+	username, ok := s.owners[token]
+	if !ok {
+		return models.UserModel{}, token_store_contract.TokenNotFoundErr
+	}
+	user, err := s.users.FindUser(username)
+	user.AuthToken = entities.Token{Token: token}
+	return user, err
+}
+func (s *stubTokenStore) ForEachToken(fn func(username string, token entities.Token) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	for token, username := range s.owners {
+		if err := fn(username, entities.Token{Token: token}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (s *stubTokenStore) AddToken(username string, token entities.Token) error {
+	if s.err != nil {
+		return s.err
+	}
+	if !s.users.UserExists(username) {
+		return auth_store_contract.UserNotFoundErr
+	}
+	if _, taken := s.owners[token.Token]; taken {
+		return auth_store_contract.TokenTakenErr
+	}
+	s.owners[token.Token] = username
+	return nil
+}
+
+type stubStore struct {
+	users     []models.UserModel
+	createErr error
+}
+
+func newStubStore() *stubStore {
+	return &stubStore{}
+}
+
+func (s *stubStore) find(username string) int {
+	for i, user := range s.users {
+		if user.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *stubStore) UserExists(username string) bool {
+	return s.find(username) != -1
+}
+func (s *stubStore) CreateUser(username, storedPass string, token entities.Token) (models.UserModel, error) {
+	if s.createErr != nil {
+		return models.UserModel{}, s.createErr
+	}
+	if s.UserExists(username) {
+		return models.UserModel{}, auth_store_contract.UsernameTakenErr
+	}
+	user := models.UserModel{Id: len(s.users) + 1, Username: username, StoredPass: storedPass, AuthToken: token}
+	s.users = append(s.users, user)
+	return user, nil
+}
+func (s *stubStore) FindUser(username string) (models.UserModel, error) {
+	if i := s.find(username); i != -1 {
+		return s.users[i], nil
+	}
+	return models.UserModel{}, auth_store_contract.UserNotFoundErr
+}
+func (s *stubStore) UpdatePassword(username, storedPass string, history []string) error {
+	i := s.find(username)
+	if i == -1 {
+		return auth_store_contract.UserNotFoundErr
+	}
+	s.users[i].StoredPass = storedPass
+	s.users[i].PasswordHistory = history
+	return nil
+}
+func (s *stubStore) FindUserFromToken(token string) (models.UserModel, error) {
+	for _, user := range s.users {
+		if user.AuthToken.Token == token {
+			return user, nil
+		}
+	}
+	return models.UserModel{}, token_store_contract.TokenNotFoundErr
+}
+func (s *stubStore) ForEachUser(fn func(models.UserModel) error) error {
+	for _, user := range s.users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type idKeepingStore struct {
+	*stubStore
+}
+
+func (s *idKeepingStore) SetPublicId(username, publicId string, legacyId int) error {
+	for _, user := range s.users {
+		if user.Username != username && legacyId != 0 && user.LegacyId == legacyId {
+			return auth_store_contract.PublicIdTakenErr
+		}
+	}
+	i := s.find(username)
+	if i == -1 {
+		return auth_store_contract.UserNotFoundErr
+	}
+	s.users[i].PublicId, s.users[i].LegacyId = publicId, legacyId
+	return nil
+}
@@ -0,0 +1,54 @@
+package user_importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/k0marov/golang-auth/internal/values"
+)
+
+// ParseJSON parses a JSON array of {"username": ..., "password_hash": ...} objects
+func ParseJSON(r io.Reader) ([]values.ImportedUser, error) {
+	users := []values.ImportedUser{}
+	if err := json.NewDecoder(r).Decode(&users); err != nil {
+		return nil, fmt.Errorf("error decoding users JSON: %w", err)
+	}
+	return users, nil
+}
+
+// ParseCSV parses a CSV file with a header, which should contain the "username" and "password_hash" columns.
+// Other columns are ignored.
+func ParseCSV(r io.Reader) ([]values.ImportedUser, error) {
+	csvReader := csv.NewReader(r)
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV header: %w", err)
+	}
+	usernameCol, hashCol := -1, -1
+	for i, column := range header {
+		switch column {
+		case "username":
+			usernameCol = i
+		case "password_hash":
+			hashCol = i
+		}
+	}
+	if usernameCol == -1 || hashCol == -1 {
+		return nil, fmt.Errorf("CSV header should contain username and password_hash columns, got %v", header)
+	}
+
+	users := []values.ImportedUser{}
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV row: %w", err)
+		}
+		users = append(users, values.ImportedUser{Username: record[usernameCol], PasswordHash: record[hashCol]})
+	}
+	return users, nil
+}
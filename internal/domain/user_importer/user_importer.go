@@ -0,0 +1,75 @@
+package user_importer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/k0marov/golang-auth/internal/core/crypto/foreign_hashes"
+	"github.com/k0marov/golang-auth/internal/domain/auth_service"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/values"
+)
+
+type Report struct {
+	Total    int
+	Imported int
+	// usernames which don't pass the same validation as in registration
+	InvalidUsernames []string
+	// usernames which appear more than once in the import, none of their occurrences are imported
+	Duplicates []string
+	// usernames which are already taken in the store
+	AlreadyExisting []string
+	// usernames with password hashes in unsupported formats
+	UnsupportedHashes []string
+}
+
+func (r Report) Skipped() int {
+	return r.Total - r.Imported
+}
+
+// Import validates all users and creates the valid ones in the store, each with a new token.
+// The imported hashes are upgraded to the current hasher on the first successful login of each user.
+// If dryRun is true, nothing is written and the report only shows what would have happened.
+func Import(store auth_store_contract.AuthStore, users []values.ImportedUser, dryRun bool) (Report, error) {
+	report := Report{Total: len(users)}
+
+	occurrences := map[string]int{}
+	for _, user := range users {
+		occurrences[user.Username]++
+	}
+
+	reportedDuplicates := map[string]bool{}
+	for _, user := range users {
+		switch {
+		case !auth_service.CheckUsernameValidity(user.Username):
+			report.InvalidUsernames = append(report.InvalidUsernames, user.Username)
+		case occurrences[user.Username] > 1:
+			if !reportedDuplicates[user.Username] {
+				reportedDuplicates[user.Username] = true
+				report.Duplicates = append(report.Duplicates, user.Username)
+			}
+		case store.UserExists(user.Username):
+			report.AlreadyExisting = append(report.AlreadyExisting, user.Username)
+		case !foreign_hashes.IsSupported(user.PasswordHash):
+			report.UnsupportedHashes = append(report.UnsupportedHashes, user.Username)
+		default:
+			if !dryRun {
+				token, err := auth_service.GenerateToken()
+				if err != nil {
+					return report, err
+				}
+				_, err = store.CreateUser(user.Username, user.PasswordHash, token)
+				if errors.Is(err, auth_store_contract.UsernameTakenErr) {
+					// registered while the import was running
+					report.AlreadyExisting = append(report.AlreadyExisting, user.Username)
+					continue
+				}
+				if err != nil {
+					return report, fmt.Errorf("error while creating user %s: %w", user.Username, err)
+				}
+			}
+			report.Imported++
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,110 @@
+package user_importer_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/k0marov/golang-auth/internal/data/models"
+	"github.com/k0marov/golang-auth/internal/domain/auth_store_contract"
+	"github.com/k0marov/golang-auth/internal/domain/entities"
+	"github.com/k0marov/golang-auth/internal/domain/user_importer"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+	"github.com/k0marov/golang-auth/internal/values"
+)
+
+const validHash = "pbkdf2_sha256$1000$somesalt$vqJqygf2tor+2oXl6lWino6yb6bhsvOKyvQv/Gi94uE="
+
+func TestImport(t *testing.T) {
+	users := []values.ImportedUser{
+		{Username: "john", PasswordHash: validHash},
+		{Username: "jack@example.com", PasswordHash: validHash},
+		{Username: "twice", PasswordHash: validHash},
+		{Username: "existing", PasswordHash: validHash},
+		{Username: "twice", PasswordHash: validHash},
+		{Username: "plaintext", PasswordHash: "hunter2"},
+		{Username: "jane", PasswordHash: "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/"},
+	}
+	wantReport := user_importer.Report{
+		Total:             7,
+		Imported:          2,
+		InvalidUsernames:  []string{"jack@example.com"},
+		Duplicates:        []string{"twice"},
+		AlreadyExisting:   []string{"existing"},
+		UnsupportedHashes: []string{"plaintext"},
+	}
+
+	t.Run("should import valid users and report the others", func(t *testing.T) {
+		store := newStubStore("existing")
+		report, err := user_importer.Import(store, users, false)
+		AssertNoError(t, err)
+		Assert(t, report, wantReport, "report")
+		Assert(t, report.Skipped(), 5, "number of skipped users")
+		AssertFatal(t, len(store.created), 2, "number of created users")
+		Assert(t, store.created[0].Username, "john", "username of the created user")
+		Assert(t, store.created[0].StoredPass, validHash, "stored hash of the created user")
+		AssertUniqueCount(t, []entities.Token{store.created[0].AuthToken, store.created[1].AuthToken}, 2)
+	})
+	t.Run("should not write anything in dry run", func(t *testing.T) {
+		store := newStubStore("existing")
+		report, err := user_importer.Import(store, users, true)
+		AssertNoError(t, err)
+		Assert(t, report, wantReport, "report")
+		Assert(t, len(store.created), 0, "number of created users")
+	})
+	t.Run("should return store errors", func(t *testing.T) {
+		store := newStubStore()
+		store.createErr = errors.New(RandomString())
+		_, err := user_importer.Import(store, users, false)
+		AssertSomeError(t, err)
+	})
+}
+
+func TestParsers(t *testing.T) {
+	want := []values.ImportedUser{{Username: "john", PasswordHash: validHash}, {Username: "jane", PasswordHash: "$1$ab$cd"}}
+
+	users, err := user_importer.ParseJSON(strings.NewReader(`[{"username": "john", "password_hash": "` + validHash + `"}, {"username": "jane", "password_hash": "$1$ab$cd"}]`))
+	AssertNoError(t, err)
+	Assert(t, users, want, "users parsed from JSON")
+
+	users, err = user_importer.ParseCSV(strings.NewReader("id,password_hash,username\n1," + validHash + ",john\n2,$1$ab$cd,jane\n"))
+	AssertNoError(t, err)
+	Assert(t, users, want, "users parsed from CSV")
+
+	_, err = user_importer.ParseJSON(strings.NewReader("abracadabra"))
+	AssertSomeError(t, err)
+	_, err = user_importer.ParseCSV(strings.NewReader("id,name\n1,john\n"))
+	AssertSomeError(t, err)
+}
+
+type stubStore struct {
+	existing  map[string]bool
+	created   []models.UserModel
+	createErr error
+}
+
+func newStubStore(existing ...string) *stubStore {
+	store := &stubStore{existing: map[string]bool{}}
+	for _, username := range existing {
+		store.existing[username] = true
+	}
+	return store
+}
+
+func (s *stubStore) UserExists(username string) bool {
+	return s.existing[username]
+}
+func (s *stubStore) CreateUser(username, storedPass string, token entities.Token) (models.UserModel, error) {
+	if s.createErr != nil {
+		return models.UserModel{}, s.createErr
+	}
+	user := models.UserModel{Id: len(s.created) + 1, Username: username, StoredPass: storedPass, AuthToken: token}
+	s.created = append(s.created, user)
+	return user, nil
+}
+func (s *stubStore) FindUser(string) (models.UserModel, error) {
+	return models.UserModel{}, auth_store_contract.UserNotFoundErr
+}
+func (s *stubStore) UpdatePassword(string, string, []string) error {
+	return nil
+}
@@ -0,0 +1,341 @@
+package test_helpers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k0marov/golang-auth/internal/data/redis_token_store/resp_client"
+)
+
+// FakeRESPServer is an in-process stand-in for a Redis server, which supports just the commands used by this module:
+// PING, AUTH, SELECT, GET, SET (with EX, PX, NX and XX), DEL, EXISTS, PTTL and SCAN (with MATCH patterns ending with a single *
+// and COUNT). Keys expire lazily, like in Redis.
+type FakeRESPServer struct {
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	// if not empty, commands other than AUTH are rejected until the connection authenticates with it
+	password string
+	// keys per logical database
+	dbs   map[int]map[string]fakeValue
+	conns map[net.Conn]bool
+	// the number of accepted connections
+	accepted int
+	// the number of executed commands
+	commands int
+	// how long replies are held back after executing commands, see SetReplyDelay
+	replyDelay time.Duration
+}
+
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+// NewFakeRESPServer starts a server on a random local port, it is stopped when the test finishes
+func NewFakeRESPServer(t testing.TB) *FakeRESPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error starting a fake RESP server: %v", err)
+	}
+	s := &FakeRESPServer{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		dbs:      map[int]map[string]fakeValue{},
+		conns:    map[net.Conn]bool{},
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close stops the server, like a server going down
+func (s *FakeRESPServer) Close() {
+	s.listener.Close()
+	s.CloseConnections()
+}
+
+// CloseConnections closes all client connections, like a server does after a restart or an idle timeout
+func (s *FakeRESPServer) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// SetPassword makes new connections authenticate with AUTH password before any other command
+func (s *FakeRESPServer) SetPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// SetReplyDelay makes the server hold back replies after executing commands, like a server which is slow to respond
+func (s *FakeRESPServer) SetReplyDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replyDelay = delay
+}
+
+// Commands returns the number of commands executed so far
+func (s *FakeRESPServer) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+// Accepted returns the number of connections accepted so far
+func (s *FakeRESPServer) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Get returns the value of a key in the database 0 and whether it exists
+func (s *FakeRESPServer) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.lookup(0, key)
+	return v.value, ok
+}
+
+func (s *FakeRESPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.accepted++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *FakeRESPServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	s.mu.Lock()
+	session := &fakeSession{password: s.password, authenticated: s.password == ""}
+	s.mu.Unlock()
+	for {
+		request, err := resp_client.ReadReply(reader)
+		if err != nil {
+			return
+		}
+		elements, ok := request.([]any)
+		if !ok || len(elements) == 0 {
+			return
+		}
+		args := make([]string, len(elements))
+		for i, element := range elements {
+			args[i], _ = element.(string)
+		}
+		reply := s.execute(session, args)
+		s.mu.Lock()
+		s.commands++
+		delay := s.replyDelay
+		s.mu.Unlock()
+		time.Sleep(delay)
+		writer.WriteString(reply)
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+type fakeSession struct {
+	password      string
+	authenticated bool
+	db            int
+}
+
+func (s *FakeRESPServer) execute(session *fakeSession, args []string) string {
+	command := strings.ToUpper(args[0])
+	if command == "AUTH" {
+		if len(args) != 2 || args[1] != session.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		session.authenticated = true
+		return "+OK\r\n"
+	}
+	if !session.authenticated {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "SELECT" && len(args) == 2:
+		db, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "-ERR invalid DB index\r\n"
+		}
+		session.db = db
+		return "+OK\r\n"
+	case command == "GET" && len(args) == 2:
+		v, ok := s.lookup(session.db, args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v.value), v.value)
+	case command == "SET" && len(args) >= 3:
+		return s.set(session.db, args[1], args[2], args[3:])
+	case (command == "DEL" || command == "EXISTS") && len(args) >= 2:
+		count := 0
+		for _, key := range args[1:] {
+			if _, ok := s.lookup(session.db, key); ok {
+				count++
+				if command == "DEL" {
+					delete(s.dbs[session.db], key)
+				}
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+	case command == "PTTL" && len(args) == 2:
+		v, ok := s.lookup(session.db, args[1])
+		switch {
+		case !ok:
+			return ":-2\r\n"
+		case v.expires.IsZero():
+			return ":-1\r\n"
+		default:
+			return fmt.Sprintf(":%d\r\n", time.Until(v.expires).Milliseconds())
+		}
+	case command == "SCAN" && len(args) >= 2:
+		return s.scan(session.db, args[1], args[2:])
+	default:
+		return fmt.Sprintf("-ERR unknown command or wrong number of arguments for '%s'\r\n", args[0])
+	}
+}
+
+// set should be called with mu locked
+func (s *FakeRESPServer) set(db int, key, value string, options []string) string {
+	v := fakeValue{value: value}
+	nx, xx := false, false
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(options) {
+				return "-ERR syntax error\r\n"
+			}
+			n, err := strconv.ParseInt(options[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return "-ERR invalid expire time in 'set' command\r\n"
+			}
+			unit := time.Millisecond
+			if strings.ToUpper(options[i]) == "EX" {
+				unit = time.Second
+			}
+			v.expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+	_, exists := s.lookup(db, key)
+	if (nx && exists) || (xx && !exists) {
+		return "$-1\r\n"
+	}
+	if s.dbs[db] == nil {
+		s.dbs[db] = map[string]fakeValue{}
+	}
+	s.dbs[db][key] = v
+	return "+OK\r\n"
+}
+
+// scan should be called with mu locked, its cursor is the number of matching keys returned so far (in the order of the keys)
+func (s *FakeRESPServer) scan(db int, cursor string, options []string) string {
+	returned, err := strconv.Atoi(cursor)
+	if err != nil || returned < 0 {
+		return "-ERR invalid cursor\r\n"
+	}
+	prefix, count := "", 10
+	for i := 0; i+1 < len(options); i += 2 {
+		switch strings.ToUpper(options[i]) {
+		case "MATCH":
+			var ok bool
+			if prefix, ok = globPrefix(options[i+1]); !ok {
+				return "-ERR the fake server supports only MATCH patterns ending with a single *\r\n"
+			}
+		case "COUNT":
+			if count, err = strconv.Atoi(options[i+1]); err != nil || count <= 0 {
+				return "-ERR syntax error\r\n"
+			}
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+	var keys []string
+	for key := range s.dbs[db] {
+		if _, ok := s.lookup(db, key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if returned > len(keys) {
+		returned = len(keys)
+	}
+	page := keys[returned:]
+	next := "0"
+	if len(page) > count {
+		page, next = page[:count], strconv.Itoa(returned+count)
+	}
+	reply := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(page))
+	for _, key := range page {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+	}
+	return reply
+}
+
+// globPrefix returns the unescaped prefix of a pattern like "prefix*"
+func globPrefix(pattern string) (string, bool) {
+	var prefix strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			prefix.WriteByte(pattern[i])
+		case c == '*' && i == len(pattern)-1:
+			return prefix.String(), true
+		case strings.IndexByte(`*?[]\`, c) != -1:
+			return "", false
+		default:
+			prefix.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+// lookup should be called with mu locked, it drops the key if it has expired
+func (s *FakeRESPServer) lookup(db int, key string) (fakeValue, bool) {
+	v, ok := s.dbs[db][key]
+	if ok && !v.expires.IsZero() && !time.Now().Before(v.expires) {
+		delete(s.dbs[db], key)
+		return fakeValue{}, false
+	}
+	return v, ok
+}
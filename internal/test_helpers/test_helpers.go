@@ -2,11 +2,14 @@ package test_helpers
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http/httptest"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/k0marov/golang-auth/internal/core/client_errors"
@@ -103,11 +106,15 @@ func GenerateRandomUsers(count int) []RandomUser {
 	return result
 }
 
+// uniqueCounter makes generated usernames and tokens unique, since stores reject taken ones
+var uniqueCounter uint64
+
 func GenerateRandomUser() RandomUser {
+	n := atomic.AddUint64(&uniqueCounter, 1)
 	return RandomUser{
-		Username: RandomString(),
+		Username: fmt.Sprintf("%s%d", RandomString(), n),
 		Password: RandomString(),
-		Token:    entities.Token{Token: RandomString()},
+		Token:    entities.Token{Token: fmt.Sprintf("%s%d", RandomString(), n)},
 	}
 }
 
@@ -118,16 +125,66 @@ func GenerateRandomUserModel() models.UserModel {
 func GenerateRandomUserModels(count int) (storedUsers []models.UserModel) {
 	randomUsers := GenerateRandomUsers(count)
 	for _, user := range randomUsers {
+		var history []string
+		for i := rand.Intn(3); i > 0; i-- {
+			history = append(history, RandomString())
+		}
 		storedUsers = append(storedUsers, models.UserModel{
-			Id:         RandomInt(),
-			Username:   user.Username,
-			StoredPass: user.Password,
-			AuthToken:  user.Token,
+			Id:              RandomInt(),
+			Username:        user.Username,
+			StoredPass:      user.Password,
+			AuthToken:       user.Token,
+			PasswordHistory: history,
 		})
 	}
 	return
 }
 
+// GenerateRandomOperations returns usersCount create operations, followed by operations of all other types on the created users.
+// Every second user has a public id, and some of them also have a legacy id.
+func GenerateRandomOperations(usersCount int) []models.Operation {
+	users := GenerateRandomUserModels(usersCount)
+	operations := []models.Operation{}
+	for i := range users {
+		users[i].Id = i + 1
+		if i%2 == 1 {
+			users[i].PublicId = fmt.Sprintf("%s%d", RandomString(), atomic.AddUint64(&uniqueCounter, 1))
+		}
+		if i%4 == 1 {
+			users[i].LegacyId = users[i].Id
+		}
+		operations = append(operations, models.Operation{Type: models.CreateUserOp, User: users[i]})
+	}
+	for _, user := range users {
+		updated := user
+		updated.StoredPass = RandomString()
+		newToken := entities.Token{Token: RandomString()}
+		operations = append(operations,
+			models.Operation{Type: models.UpdateUserOp, User: updated},
+			models.Operation{Type: models.AddTokenOp, UserId: user.Id, Token: newToken},
+			models.Operation{Type: models.RemoveTokenOp, UserId: user.Id, Token: newToken},
+		)
+	}
+	operations = append(operations, models.Operation{Type: models.DeleteUserOp, UserId: users[0].Id})
+	return operations
+}
+
+// GenerateUserOperations returns create operations for usersCount users with realistic field lengths (a bcrypt hash and a 32 character token).
+// It is much faster than GenerateRandomOperations and the users share the password hash, so that it is usable for millions of users in benchmarks.
+func GenerateUserOperations(usersCount int) []models.Operation {
+	storedPass := "$2a$10$" + strings.Repeat("N9qo8uLOickgx2ZMRZoMye", 3)[:53]
+	operations := make([]models.Operation, usersCount)
+	for i := range operations {
+		operations[i] = models.Operation{Type: models.CreateUserOp, User: models.UserModel{
+			Id:         i + 1,
+			Username:   fmt.Sprintf("user%d@example.com", i+1),
+			StoredPass: storedPass,
+			AuthToken:  entities.Token{Token: fmt.Sprintf("%032x", uint64(i+1)*0x9e3779b97f4a7c15)},
+		}}
+	}
+	return operations
+}
+
 func AssertUniqueCount[T comparable](t testing.TB, slice []T, want int) {
 	t.Helper()
 	unique := []T{}
@@ -4,3 +4,15 @@ type AuthData struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
+
+type ChangePasswordData struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ImportedUser is a user from some other system, whose password was hashed in one of the formats supported by foreign_hashes
+type ImportedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
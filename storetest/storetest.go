@@ -0,0 +1,379 @@
+// Package storetest checks that a store behaves the way the rest of the package expects (see auth.UserStore and auth.TokenStore),
+// so that custom backends can be tested the same way as the built-in ones:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.RunConformance(t, func(t *testing.T) storetest.Opener {
+//			dsn := createTestDatabase(t)
+//			return func() (auth.Store, error) {
+//				return mystore.Open(dsn)
+//			}
+//		})
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	auth "github.com/k0marov/golang-auth"
+	. "github.com/k0marov/golang-auth/internal/test_helpers"
+)
+
+// Opener opens a store over the backend created by a Factory.
+// Every call should return a new instance over the same data, so that persistence can be checked.
+// The previous instance is closed before that, if it has a Close() error method.
+// Stores, which don't persist anything, can return the same instance every time.
+type Opener func() (auth.Store, error)
+
+// Factory creates a new empty backend for a single test, it should clean it up with t.Cleanup
+type Factory func(t *testing.T) Opener
+
+// RunConformance runs the conformance suite against the stores opened by factory.
+// It checks the not found errors, uniqueness of (case-sensitive) usernames and tokens, id assignment, returning copies rather than aliases,
+// concurrent usage and persistence across reopening. If the store implements auth.UserLister, ForEachUser is checked too,
+// and so are FindUserById and SetPublicId for stores implementing auth.UserByIdFinder and auth.PublicIdSetter.
+// Errors are compared with errors.Is, so they can be wrapped.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Run("not found errors", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		notStored := GenerateRandomUser()
+		Assert(t, store.UserExists(notStored.Username), false, "UserExists()")
+		_, err := store.FindUser(notStored.Username)
+		assertErrorIs(t, err, auth.ErrUserNotFound)
+		_, err = store.FindUserFromToken(notStored.Token.Token)
+		assertErrorIs(t, err, auth.ErrTokenNotFound)
+		err = store.UpdatePassword(notStored.Username, RandomString(), nil)
+		assertErrorIs(t, err, auth.ErrUserNotFound)
+		Assert(t, store.UserExists(notStored.Username), false, "UserExists() after a failed update")
+	})
+	t.Run("CreateUser() and lookups", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		user := GenerateRandomUser()
+		created, err := store.CreateUser(user.Username, user.Password, user.Token)
+		AssertNoError(t, err)
+		Assert(t, created.Username, user.Username, "username of the created user")
+		Assert(t, created.StoredPass, user.Password, "stored password of the created user")
+		Assert(t, created.AuthToken, user.Token, "token of the created user")
+		Assert(t, created.Id != 0, true, "the created user has an id")
+
+		Assert(t, store.UserExists(user.Username), true, "UserExists()")
+		assertStored(t, store, created)
+	})
+	t.Run("id assignment", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		users := createUsers(t, store, 10)
+		ids := []int{}
+		for _, user := range users {
+			Assert(t, user.Id != 0, true, "the created user has an id")
+			ids = append(ids, user.Id)
+			assertStored(t, store, user)
+		}
+		AssertUniqueCount(t, ids, len(users))
+	})
+	t.Run("uniqueness", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		existing := createUsers(t, store, 1)[0]
+
+		t.Run("CreateUser() should reject a taken username and leave the user intact", func(t *testing.T) {
+			_, err := store.CreateUser(existing.Username, RandomString(), GenerateRandomUser().Token)
+			assertErrorIs(t, err, auth.ErrUsernameTaken)
+			assertStored(t, store, existing)
+		})
+		t.Run("CreateUser() should reject a taken token and not create the user", func(t *testing.T) {
+			other := GenerateRandomUser()
+			_, err := store.CreateUser(other.Username, other.Password, existing.AuthToken)
+			assertErrorIs(t, err, auth.ErrTokenTaken)
+			Assert(t, store.UserExists(other.Username), false, "UserExists() of the rejected user")
+			assertStored(t, store, existing)
+		})
+		t.Run("usernames and tokens differing only in case should be distinct", func(t *testing.T) {
+			base := GenerateRandomUser()
+			lower, upper := strings.ToLower(base.Username)+"case", strings.ToUpper(base.Username)+"CASE"
+			lowerToken, upperToken := strings.ToLower(base.Token.Token)+"case", strings.ToUpper(base.Token.Token)+"CASE"
+			lowerUser, err := store.CreateUser(lower, RandomString(), auth.Token{Token: lowerToken})
+			AssertNoError(t, err)
+			upperUser, err := store.CreateUser(upper, RandomString(), auth.Token{Token: upperToken})
+			AssertNoError(t, err)
+			assertStored(t, store, lowerUser)
+			assertStored(t, store, upperUser)
+		})
+	})
+	t.Run("UpdatePassword()", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		users := createUsers(t, store, 2)
+		updated := users[0]
+		updated.PasswordHistory = []string{updated.StoredPass, RandomString()}
+		updated.StoredPass = RandomString()
+		AssertNoError(t, store.UpdatePassword(updated.Username, updated.StoredPass, updated.PasswordHistory))
+		assertStored(t, store, updated)
+		assertStored(t, store, users[1])
+
+		updated.PasswordHistory = nil
+		AssertNoError(t, store.UpdatePassword(updated.Username, updated.StoredPass, nil))
+		assertStored(t, store, updated)
+	})
+	t.Run("ReplaceHash()", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		replacer, ok := store.(auth.HashReplacer)
+		if !ok {
+			t.Skip("the store doesn't implement auth.HashReplacer")
+		}
+		users := createUsers(t, store, 2)
+		updated := users[0]
+		updated.PasswordHistory = []string{RandomString()}
+		AssertNoError(t, store.UpdatePassword(updated.Username, updated.StoredPass, updated.PasswordHistory))
+
+		oldHash := updated.StoredPass
+		updated.StoredPass = RandomString()
+		replaced, err := replacer.ReplaceHash(updated.Username, oldHash, updated.StoredPass)
+		AssertNoError(t, err)
+		Assert(t, replaced, true, "replaced with the current hash")
+		assertStored(t, store, updated)
+		assertStored(t, store, users[1])
+
+		replaced, err = replacer.ReplaceHash(updated.Username, oldHash, RandomString())
+		AssertNoError(t, err)
+		Assert(t, replaced, false, "replaced with an outdated hash")
+		assertStored(t, store, updated)
+
+		_, err = replacer.ReplaceHash(RandomString()+"unique", oldHash, RandomString())
+		assertErrorIs(t, err, auth.ErrUserNotFound)
+	})
+	t.Run("should return copies rather than aliases", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		user := createUsers(t, store, 1)[0]
+		history := []string{RandomString(), RandomString()}
+		AssertNoError(t, store.UpdatePassword(user.Username, user.StoredPass, history))
+		user.PasswordHistory = append([]string(nil), history...)
+
+		history[0] = RandomString()
+		assertStored(t, store, user)
+
+		found, err := store.FindUser(user.Username)
+		AssertNoError(t, err)
+		found.PasswordHistory[0] = RandomString()
+		found.StoredPass = RandomString()
+		found, err = store.FindUserFromToken(user.AuthToken.Token)
+		AssertNoError(t, err)
+		found.PasswordHistory[1] = RandomString()
+		assertStored(t, store, user)
+	})
+	t.Run("ForEachUser()", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		lister, ok := store.(auth.UserLister)
+		if !ok {
+			t.Skip("the store doesn't implement auth.UserLister")
+		}
+		users := createUsers(t, store, 5)
+		listed := map[string]auth.UserModel{}
+		AssertNoError(t, lister.ForEachUser(func(user auth.UserModel) error {
+			if _, seen := listed[user.Username]; seen {
+				t.Errorf("user %s is listed twice", user.Username)
+			}
+			listed[user.Username] = user
+			return nil
+		}))
+		Assert(t, len(listed), len(users), "number of listed users")
+		for _, user := range users {
+			assertSameUser(t, listed[user.Username], user, "listed")
+		}
+
+		stopErr := errors.New(RandomString())
+		calls := 0
+		err := lister.ForEachUser(func(auth.UserModel) error {
+			calls++
+			return stopErr
+		})
+		assertErrorIs(t, err, stopErr)
+		Assert(t, calls, 1, "number of calls after an error")
+	})
+	t.Run("FindUserById()", func(t *testing.T) {
+		harness := newHarness(t, factory)
+		if _, ok := harness.store.(auth.UserByIdFinder); !ok {
+			t.Skip("the store doesn't implement auth.UserByIdFinder")
+		}
+		users := createUsers(t, harness.store, 3)
+		for _, user := range users {
+			assertFoundById(t, harness.store, auth.ExposedId(user), user)
+		}
+		_, err := harness.store.(auth.UserByIdFinder).FindUserById(RandomString())
+		assertErrorIs(t, err, auth.ErrUserNotFound)
+
+		setter, ok := harness.store.(auth.PublicIdSetter)
+		if !ok {
+			return
+		}
+		t.Run("SetPublicId()", func(t *testing.T) {
+			migrated := users[0]
+			migrated.PublicId, migrated.LegacyId = RandomString()+RandomString(), 1000000+migrated.Id
+			AssertNoError(t, setter.SetPublicId(migrated.Username, migrated.PublicId, migrated.LegacyId))
+			assertStored(t, harness.store, migrated)
+			assertFoundById(t, harness.store, migrated.PublicId, migrated)
+			assertFoundById(t, harness.store, strconv.Itoa(migrated.LegacyId), migrated)
+			Assert(t, auth.ExposedId(migrated), migrated.PublicId, "exposed id")
+
+			assertErrorIs(t, setter.SetPublicId(users[1].Username, migrated.PublicId, 0), auth.ErrPublicIdTaken)
+			assertErrorIs(t, setter.SetPublicId(users[1].Username, "", migrated.LegacyId), auth.ErrPublicIdTaken)
+			assertErrorIs(t, setter.SetPublicId(GenerateRandomUser().Username, RandomString(), 0), auth.ErrUserNotFound)
+			assertStored(t, harness.store, users[1])
+
+			harness.reopen(t)
+			assertFoundById(t, harness.store, migrated.PublicId, migrated)
+			assertFoundById(t, harness.store, strconv.Itoa(migrated.LegacyId), migrated)
+			assertFoundById(t, harness.store, auth.ExposedId(users[2]), users[2])
+		})
+	})
+	t.Run("concurrent usage", func(t *testing.T) {
+		store := newHarness(t, factory).store
+		existing := createUsers(t, store, 5)
+
+		t.Run("concurrently created users should get unique ids, while readers see consistent users", func(t *testing.T) {
+			const goroutines = 50
+			var wg sync.WaitGroup
+			wg.Add(2 * goroutines)
+			ids := make([]int, goroutines)
+			for i := 0; i < goroutines; i++ {
+				go func(i int) {
+					defer wg.Done()
+					user := GenerateRandomUser()
+					created, err := store.CreateUser(user.Username, user.Password, user.Token)
+					AssertNoError(t, err)
+					ids[i] = created.Id
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					user := existing[i%len(existing)]
+					found, err := store.FindUserFromToken(user.AuthToken.Token)
+					AssertNoError(t, err)
+					Assert(t, found.Username, user.Username, "username of the token owner")
+				}(i)
+			}
+			wg.Wait()
+			AssertUniqueCount(t, ids, goroutines)
+		})
+		t.Run("only one of concurrent creations of the same username should succeed", func(t *testing.T) {
+			const goroutines = 20
+			username := GenerateRandomUser().Username
+			var wg sync.WaitGroup
+			wg.Add(goroutines)
+			errs := make([]error, goroutines)
+			for i := 0; i < goroutines; i++ {
+				go func(i int) {
+					defer wg.Done()
+					_, errs[i] = store.CreateUser(username, RandomString(), GenerateRandomUser().Token)
+				}(i)
+			}
+			wg.Wait()
+			created := 0
+			for _, err := range errs {
+				if err == nil {
+					created++
+				} else {
+					assertErrorIs(t, err, auth.ErrUsernameTaken)
+				}
+			}
+			Assert(t, created, 1, "number of created users")
+		})
+	})
+	t.Run("persistence across reopening", func(t *testing.T) {
+		harness := newHarness(t, factory)
+		users := createUsers(t, harness.store, 5)
+		users[1].PasswordHistory = []string{users[1].StoredPass}
+		users[1].StoredPass = RandomString()
+		AssertNoError(t, harness.store.UpdatePassword(users[1].Username, users[1].StoredPass, users[1].PasswordHistory))
+
+		harness.reopen(t)
+		ids := []int{}
+		for _, user := range users {
+			assertStored(t, harness.store, user)
+			ids = append(ids, user.Id)
+		}
+		added := createUsers(t, harness.store, 1)[0]
+		AssertUniqueCount(t, append(ids, added.Id), len(users)+1)
+
+		harness.reopen(t)
+		for _, user := range append(users, added) {
+			assertStored(t, harness.store, user)
+		}
+	})
+}
+
+type harness struct {
+	open  Opener
+	store auth.Store
+}
+
+func newHarness(t *testing.T, factory Factory) *harness {
+	t.Helper()
+	h := &harness{open: factory(t)}
+	h.reopen(t)
+	t.Cleanup(func() { closeStore(h.store) })
+	return h
+}
+
+func (h *harness) reopen(t *testing.T) {
+	t.Helper()
+	closeStore(h.store)
+	store, err := h.open()
+	if err != nil {
+		t.Fatalf("error opening a store: %v", err)
+	}
+	h.store = store
+}
+
+func closeStore(store auth.Store) {
+	if closer, ok := store.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
+
+func createUsers(t testing.TB, store auth.Store, count int) []auth.UserModel {
+	t.Helper()
+	created := []auth.UserModel{}
+	for _, user := range GenerateRandomUsers(count) {
+		model, err := store.CreateUser(user.Username, user.Password, user.Token)
+		if err != nil {
+			t.Fatalf("error creating a user: %v", err)
+		}
+		created = append(created, model)
+	}
+	return created
+}
+
+// assertStored checks that the user is found both by its username and by its token
+func assertStored(t testing.TB, store auth.Store, want auth.UserModel) {
+	t.Helper()
+	found, err := store.FindUser(want.Username)
+	AssertNoError(t, err)
+	assertSameUser(t, found, want, "found by username")
+	found, err = store.FindUserFromToken(want.AuthToken.Token)
+	AssertNoError(t, err)
+	assertSameUser(t, found, want, "found by token")
+}
+
+// assertSameUser treats nil and empty password histories as equal, since stores aren't required to distinguish them
+func assertSameUser(t testing.TB, got, want auth.UserModel, description string) {
+	t.Helper()
+	if len(got.PasswordHistory) == 0 && len(want.PasswordHistory) == 0 {
+		got.PasswordHistory, want.PasswordHistory = nil, nil
+	}
+	Assert(t, got, want, fmt.Sprintf("user %s", description))
+}
+
+func assertFoundById(t testing.TB, store auth.Store, id string, want auth.UserModel) {
+	t.Helper()
+	found, err := store.(auth.UserByIdFinder).FindUserById(id)
+	AssertNoError(t, err)
+	assertSameUser(t, found, want, "found by id "+id)
+}
+
+func assertErrorIs(t testing.TB, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Errorf("expected error %v, but got %v", want, got)
+	}
+}